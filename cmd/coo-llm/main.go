@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"github.com/user/coo-llm/internal/api"
 	"github.com/user/coo-llm/internal/balancer"
 	"github.com/user/coo-llm/internal/config"
@@ -20,6 +26,15 @@ import (
 var version = "1.2.28"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "store-server":
+			os.Exit(runStoreServer(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "dummy", "path to config file (optional, uses env vars if not set)")
 	versionFlag := flag.Bool("version", false, "show version")
 	flag.Parse()
@@ -29,48 +44,14 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Load config from CONFIG_PATH env var, flag, or default config.local.yaml or config.yaml
 	cfgPath := ""
 	if *configPath != "dummy" {
 		cfgPath = *configPath
 	}
-	if envPath := os.Getenv("CONFIG_PATH"); envPath != "" {
-		cfgPath = envPath
-	}
-	if cfgPath == "" {
-		// Try configs/config.local.yaml first, then configs/config.yaml, then config.local.yaml, config.yaml
-		if _, err := os.Stat("configs/config.local.yaml"); err == nil {
-			cfgPath = "configs/config.local.yaml"
-		} else if _, err := os.Stat("configs/config.yaml"); err == nil {
-			cfgPath = "configs/config.yaml"
-		} else if _, err := os.Stat("config.local.yaml"); err == nil {
-			cfgPath = "config.local.yaml"
-		} else if _, err := os.Stat("config.yaml"); err == nil {
-			cfgPath = "config.yaml"
-		}
-	}
-
-	cfg, err := config.LoadConfig(cfgPath)
+	cfgPath = resolveConfigPath(cfgPath)
+	cfg, err := loadConfig(cfgPath)
 	if err != nil {
-		fmt.Printf("Failed to load config: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Override port with PORT env var if set (for Railway, etc.)
-	if port := os.Getenv("PORT"); port != "" {
-		cfg.Server.Listen = ":" + port
-	}
-
-	// Override admin credentials with env vars
-	if adminID := os.Getenv("ADMIN_ID"); adminID != "" {
-		cfg.Server.WebUI.AdminID = adminID
-	}
-	if adminPassword := os.Getenv("ADMIN_PASSWORD"); adminPassword != "" {
-		cfg.Server.WebUI.AdminPassword = adminPassword
-	}
-
-	if err := config.ValidateConfig(cfg); err != nil {
-		fmt.Printf("Invalid config: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 
@@ -85,44 +66,28 @@ func main() {
 	}
 
 	// Init store
-	var runtimeStore store.RuntimeStore
+	runtimeStore, err := newRuntimeStore(cfg, logger.GetLogger())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	switch cfg.Storage.Runtime.Type {
-	case "redis":
-		runtimeStore = store.NewRedisStore(cfg.Storage.Runtime.Addr, cfg.Storage.Runtime.Password, logger.GetLogger())
-	case "http":
-		runtimeStore = store.NewHTTPStore(cfg.Storage.Runtime.Addr, cfg.Storage.Runtime.APIKey, logger.GetLogger())
-	case "sql":
-		sqlStore, err := store.NewSQLStore(cfg.Storage.Runtime.Addr, logger.GetLogger())
-		if err != nil {
-			fmt.Printf("Failed to connect to SQL database: %v\n", err)
-			os.Exit(1)
-		}
-		runtimeStore = sqlStore
-	case "mongodb":
-		mongoStore, err := store.NewMongoDBStore(cfg.Storage.Runtime.Addr, cfg.Storage.Runtime.Database, logger.GetLogger())
-		if err != nil {
-			fmt.Printf("Failed to connect to MongoDB: %v\n", err)
-			os.Exit(1)
-		}
-		runtimeStore = mongoStore
-	case "dynamodb":
-		dynamoStore, err := store.NewDynamoDBStore(cfg.Storage.Runtime.Addr, cfg.Storage.Runtime.TableUsage, cfg.Storage.Runtime.TableCache, cfg.Storage.Runtime.TableHistory, logger.GetLogger())
-		if err != nil {
-			fmt.Printf("Failed to connect to DynamoDB: %v\n", err)
-			os.Exit(1)
-		}
-		runtimeStore = dynamoStore
-	case "influxdb":
-		runtimeStore = store.NewInfluxDBStore(cfg.Storage.Runtime.Addr, cfg.Storage.Runtime.Password, cfg.Storage.Runtime.APIKey, cfg.Storage.Runtime.Database, logger.GetLogger())
-	default:
-		// Default to SQL database (PostgreSQL or SQLite based on connection string)
-		sqlStore, err := store.NewSQLStore(cfg.Storage.Runtime.Addr, logger.GetLogger())
-		if err != nil {
-			fmt.Printf("Failed to connect to SQL database: %v\n", err)
-			os.Exit(1)
-		}
-		runtimeStore = sqlStore
+	// Background work runs until shutdown begins
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Roll up and expire old runtime data in the background
+	if cfg.Storage.Retention.Enabled {
+		policy := store.NewRetentionPolicy(cfg.Storage.Retention)
+		store.StartCompactor(background, runtimeStore, policy, cfg.Storage.Retention.CompactionInterval, logger.GetLogger())
+	}
+
+	// Coalesce usage and metric writes in memory and flush them in batches
+	if cfg.Storage.Buffer.Enabled {
+		runtimeStore = store.NewBufferedStore(runtimeStore, store.BufferedStoreOptions{
+			FlushInterval: cfg.Storage.Buffer.FlushInterval,
+			MaxPending:    cfg.Storage.Buffer.MaxPending,
+		}, logger.GetLogger())
 	}
 
 	// Create store provider wrapper
@@ -138,15 +103,44 @@ func main() {
 	// Init selector
 	selector := balancer.NewSelector(cfg, storeProvider, logger)
 
+	// Apply policy, alias, client and provider changes saved by other instances
+	configSync := store.NewConfigSync(configStore, cfg.Storage.Config.SyncInterval, selector.ApplySharedConfig, logger.GetLogger())
+	configSync.Start(background)
+
+	// Probe provider keys in the background while policy.health_check is enabled
+	prober := balancer.NewProber(selector, logger.GetLogger())
+	prober.Start(background)
+
+	// Reload the config file when it changes or on SIGHUP
+	reloader := &configReloader{path: cfgPath, reg: reg, selector: selector, configs: configStore, logger: logger.GetLogger()}
+	if cfgPath != "" {
+		if err := config.Watch(background, cfgPath, reloader.reloadOrKeep); err != nil {
+			fmt.Printf("Warning: %v, reload with SIGHUP instead\n", err)
+		}
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			reloader.reloadOrKeep()
+		}
+	}()
+
 	// Setup router
 	r := chi.NewRouter()
+	// Accept or generate a request ID for every request
+	r.Use(api.RequestIDMiddleware)
+
+	// Liveness and readiness probes; readiness turns unready while the server drains on shutdown
+	health := api.NewHealthHandler(selector, runtimeStore, reg, api.HealthOptions{BuildVersion: version, ConfigVersion: configSync.Version, Prober: prober})
+	api.SetupHealthRoutes(r, health)
 
 	// API routes
 	apiRouter := chi.NewRouter()
 	// CORS middleware for API routes
-	apiRouter.Use(api.CORSMiddleware(cfg))
-	api.SetupRoutes(apiRouter, selector, logger, reg, cfg, runtimeStore)
-	api.SetupAdminRoutes(apiRouter, cfg, storeProvider, selector, logger)
+	apiRouter.Use(api.CORSMiddlewareFunc(selector.Config))
+	api.SetupRoutes(apiRouter, selector, logger, reg, runtimeStore)
+	api.SetupAdminRoutes(apiRouter, storeProvider, selector, logger, health)
 	r.Mount("/api", apiRouter)
 
 	// Web UI (serve after API routes so it acts as fallback)
@@ -205,10 +199,92 @@ func main() {
 		r.Handle(cfg.Logging.Prometheus.Endpoint, promhttp.Handler())
 	}
 
-	// Admin routes
+	ln, err := net.Listen("tcp", cfg.Server.Listen)
+	if err != nil {
+		fmt.Printf("Server failed: %v\n", err)
+		os.Exit(1)
+	}
 	fmt.Printf("Starting server on %s\n", cfg.Server.Listen)
-	if err := http.ListenAndServe(cfg.Server.Listen, r); err != nil {
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	srv := newHTTPServer(cfg.Server, r)
+	err = serve(srv, ln, cfg.Server, health, stop, stopBackground, func(ctx context.Context) {
+		// Wait for log shippers, then flush buffered writes and snapshots
+		if err := logger.Flush(ctx); err != nil {
+			fmt.Printf("Failed to flush logs: %v\n", err)
+		}
+		if closer, ok := runtimeStore.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				fmt.Printf("Failed to close runtime store: %v\n", err)
+			}
+		}
+	}, logger.GetLogger())
+	if err != nil {
 		fmt.Printf("Server failed: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// resolveConfigPath returns the config file to load: CONFIG_PATH, the -config flag,
+// or the first of the default locations that exists
+func resolveConfigPath(flagPath string) string {
+	cfgPath := flagPath
+	if envPath := os.Getenv("CONFIG_PATH"); envPath != "" {
+		cfgPath = envPath
+	}
+	if cfgPath == "" {
+		// Try configs/config.local.yaml first, then configs/config.yaml, then config.local.yaml, config.yaml
+		if _, err := os.Stat("configs/config.local.yaml"); err == nil {
+			cfgPath = "configs/config.local.yaml"
+		} else if _, err := os.Stat("configs/config.yaml"); err == nil {
+			cfgPath = "configs/config.yaml"
+		} else if _, err := os.Stat("config.local.yaml"); err == nil {
+			cfgPath = "config.local.yaml"
+		} else if _, err := os.Stat("config.yaml"); err == nil {
+			cfgPath = "config.yaml"
+		}
+	}
+	return cfgPath
+}
+
+// newRuntimeStore builds the runtime store selected by storage.runtime.type
+func newRuntimeStore(cfg *config.Config, logger zerolog.Logger) (store.RuntimeStore, error) {
+	rt := cfg.Storage.Runtime
+	switch rt.Type {
+	case "redis":
+		return store.NewRedisStore(rt.Addr, rt.Password, logger), nil
+	case "http":
+		return store.NewHTTPStoreWithOptions(rt.Addr, rt.APIKey, store.HTTPStoreOptions{Timeout: rt.Timeout, MaxRetries: rt.MaxRetries}, logger), nil
+	case "mongodb":
+		mongoStore, err := store.NewMongoDBStore(rt.Addr, rt.Database, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+		}
+		return mongoStore, nil
+	case "dynamodb":
+		dynamoStore, err := store.NewDynamoDBStoreWithOptions(rt.Addr, store.DynamoDBOptions{
+			TableUsage:   rt.TableUsage,
+			TableCache:   rt.TableCache,
+			TableHistory: rt.TableHistory,
+			TableMetrics: rt.TableMetrics,
+			Endpoint:     rt.Endpoint,
+		}, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to DynamoDB: %w", err)
+		}
+		return dynamoStore, nil
+	case "influxdb":
+		return store.NewInfluxDBStore(rt.Addr, rt.Password, rt.APIKey, rt.Database, logger), nil
+	case "memory":
+		// addr is an optional snapshot file written on shutdown and loaded on start
+		return store.NewMemoryStore(store.MemoryStoreOptions{SnapshotPath: rt.Addr}, logger)
+	default:
+		// "sql" and the default: PostgreSQL or SQLite based on connection string
+		sqlStore, err := store.NewSQLStore(rt.Addr, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to SQL database: %w", err)
+		}
+		return sqlStore, nil
+	}
+}
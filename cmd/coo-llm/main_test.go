@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
+
+	"github.com/user/coo-llm/internal/store"
 )
 
 func TestMainVersionFlag(t *testing.T) {
@@ -51,3 +54,27 @@ func TestEnvOverrides(t *testing.T) {
 		t.Errorf("Expected PORT=9090, got %s", port)
 	}
 }
+
+func TestRunMigrate(t *testing.T) {
+	dsn := t.TempDir() + "/migrate.db"
+
+	if code := runMigrate([]string{"-dsn", dsn, "-status"}); code != 0 {
+		t.Fatalf("status exited with %d", code)
+	}
+	if code := runMigrate([]string{"-dsn", dsn}); code != 0 {
+		t.Fatalf("migrate exited with %d", code)
+	}
+
+	migrator, err := store.NewSQLMigrator(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+	version, err := migrator.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != store.LatestSchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d", store.LatestSchemaVersion(), version)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// runMigrate implements `coo-llm migrate`, which applies SQL schema migrations
+// without starting the server
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to config file")
+	dsn := fs.String("dsn", "", "SQL connection string (default: storage.runtime.addr from config)")
+	target := fs.Int("to", 0, "migrate up to this schema version (default: latest)")
+	status := fs.Bool("status", false, "show the schema version and pending migrations without applying them")
+	fs.Parse(args)
+
+	connStr := *dsn
+	if connStr == "" {
+		cfg, err := config.LoadConfig(resolveConfigPath(*configPath))
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return 1
+		}
+		if t := cfg.Storage.Runtime.Type; t != "" && t != "sql" {
+			fmt.Printf("Runtime storage type %q has no schema migrations\n", t)
+			return 1
+		}
+		connStr = cfg.Storage.Runtime.Addr
+	}
+
+	migrator, err := store.NewSQLMigrator(connStr)
+	if err != nil {
+		fmt.Printf("Failed to connect to SQL database: %v\n", err)
+		return 1
+	}
+	defer migrator.Close()
+
+	ctx := context.Background()
+	current, err := migrator.Version(ctx)
+	if err != nil {
+		fmt.Printf("Failed to read schema version: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Schema version: %d (latest: %d)\n", current, store.LatestSchemaVersion())
+
+	if *status {
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		for _, m := range pending {
+			fmt.Printf("  pending %d: %s\n", m.Version, m.Description)
+		}
+		return 0
+	}
+
+	applied, err := migrator.Migrate(ctx, *target)
+	for _, m := range applied {
+		fmt.Printf("  applied %d: %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		fmt.Printf("Migration failed: %v\n", err)
+		return 1
+	}
+	if len(applied) == 0 {
+		fmt.Println("Schema is up to date")
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// loadConfig reads the config file, applies environment overrides and validates it
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Override port with PORT env var if set (for Railway, etc.)
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Server.Listen = ":" + port
+	}
+
+	// Override admin credentials with env vars
+	if adminID := os.Getenv("ADMIN_ID"); adminID != "" {
+		cfg.Server.WebUI.AdminID = adminID
+	}
+	if adminPassword := os.Getenv("ADMIN_PASSWORD"); adminPassword != "" {
+		cfg.Server.WebUI.AdminPassword = adminPassword
+	}
+
+	if err := config.ValidateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// configReloader re-reads the config file and applies it to the running server.
+// Providers, keys, aliases, client keys and policy change in place; in-flight
+// requests finish with the providers and config they started with.
+type configReloader struct {
+	path     string
+	reg      *provider.Registry
+	selector *balancer.Selector
+	configs  store.ConfigStore
+	logger   zerolog.Logger
+	mu       sync.Mutex
+}
+
+// Reload applies the config file, or returns an error and keeps the current config
+// if it can't be read, is invalid, or a provider can't be created from it
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	reg := provider.NewRegistry()
+	if err := reg.LoadFromConfig(cfg); err != nil {
+		return fmt.Errorf("failed to load providers: %w", err)
+	}
+
+	current := r.selector.Config()
+	for section, changed := range map[string]bool{
+		"server":  !reflect.DeepEqual(startupServer(current.Server), startupServer(cfg.Server)),
+		"storage": !reflect.DeepEqual(current.Storage, cfg.Storage),
+		"logging": !reflect.DeepEqual(current.Logging, cfg.Logging),
+	} {
+		if changed {
+			r.logger.Warn().Str("section", section).Msg("config section changed on reload, restart to apply it")
+		}
+	}
+
+	r.reg.Replace(reg)
+	r.selector.SetConfig(cfg)
+
+	// Share the new settings with other instances
+	if err := r.configs.SaveConfig(config.MaskSensitiveConfig(cfg)); err != nil {
+		r.logger.Warn().Err(err).Msg("failed to save reloaded config to store")
+	}
+	r.logger.Info().Str("path", r.path).Int("providers", len(reg.List())).Msg("config reloaded")
+	return nil
+}
+
+// startupServer returns the server settings that are only read at startup. CORS, the
+// admin API key and the WebUI login are read on every request, so a reload applies them.
+func startupServer(s config.Server) config.Server {
+	s.CORS = config.CORS{}
+	s.AdminAPIKey = ""
+	s.WebUI.AdminID = ""
+	s.WebUI.AdminPassword = ""
+	return s
+}
+
+// reloadOrKeep reloads and logs a rejected config instead of returning the error
+func (r *configReloader) reloadOrKeep() {
+	if err := r.Reload(); err != nil {
+		r.logger.Error().Err(err).Str("path", r.path).Msg("config reload rejected, keeping the current config")
+	}
+}
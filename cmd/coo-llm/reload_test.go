@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+const reloadConfigYAML = `
+version: "1.0"
+server:
+  listen: ":2906"
+llm_providers:
+  - id: "primary"
+    type: "openai"
+    api_keys: ["sk-old"]
+    model: "gpt-4o"
+model_aliases:
+  gpt-4o: primary:gpt-4o
+`
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(reloadConfigYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := provider.NewRegistry()
+	if err := reg.LoadFromConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	memory, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := balancer.NewSelector(cfg, nil, nil)
+	reloader := &configReloader{path: path, reg: reg, selector: selector, configs: store.NewSimpleConfigStore(memory), logger: zerolog.Nop()}
+
+	// A new provider and alias are applied in place
+	updated := `
+version: "1.0"
+server:
+  listen: ":2906"
+llm_providers:
+  - id: "primary"
+    type: "openai"
+    api_keys: ["sk-new"]
+    model: "gpt-4o"
+  - id: "backup"
+    type: "openai"
+    api_keys: ["sk-backup"]
+    model: "gpt-4o-mini"
+model_aliases:
+  gpt-4o: primary:gpt-4o
+  mini: backup:gpt-4o-mini
+`
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if _, err := reg.Get("backup"); err != nil {
+		t.Errorf("Expected provider backup after reload: %v", err)
+	}
+	if got := selector.Config().ModelAliases["mini"]; got != "backup:gpt-4o-mini" {
+		t.Errorf("Expected alias mini to be applied, got %q", got)
+	}
+
+	// Invalid YAML, an invalid config and an unknown provider type are rejected
+	for name, content := range map[string]string{
+		"yaml":     "version: [",
+		"invalid":  "version: \"1.0\"\n",
+		"provider": "version: \"1.0\"\nserver:\n  listen: \":2906\"\nllm_providers:\n  - id: \"x\"\n    type: \"nope\"\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloader.Reload(); err == nil {
+			t.Errorf("%s: expected reload to be rejected", name)
+		}
+	}
+	if got := selector.Config().ModelAliases["mini"]; got != "backup:gpt-4o-mini" {
+		t.Errorf("Expected the previous config to be kept, got alias %q", got)
+	}
+	if _, err := reg.Get("backup"); err != nil {
+		t.Errorf("Expected the previous providers to be kept: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/api"
+	"github.com/user/coo-llm/internal/config"
+)
+
+// Server timeouts used when the config leaves them at zero
+const (
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = 5 * time.Minute
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// timeoutOrDefault returns def for a zero timeout and no timeout for a negative one
+func timeoutOrDefault(d, def time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// newHTTPServer builds the server with the configured timeouts
+func newHTTPServer(cfg config.Server, handler http.Handler) *http.Server {
+	readTimeout := timeoutOrDefault(cfg.ReadTimeout, defaultReadTimeout)
+	return &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      timeoutOrDefault(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       timeoutOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
+	}
+}
+
+// serve runs srv on ln until a signal arrives on stop. It then cancels ctx, which
+// stops background work started from it, marks the instance unready, keeps serving
+// for the shutdown delay, stops accepting connections and waits up to the shutdown
+// timeout for in-flight requests and streams. Connections still open after that are
+// closed. onShutdown runs last, with a fresh shutdown timeout, to flush logs and
+// buffered writes.
+func serve(srv *http.Server, ln net.Listener, cfg config.Server, health *api.HealthHandler, stop <-chan os.Signal, cancel context.CancelFunc, onShutdown func(ctx context.Context), logger zerolog.Logger) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		logger.Info().Str("signal", sig.String()).Msg("shutting down")
+	}
+
+	if cancel != nil {
+		cancel()
+	}
+	health.SetDraining()
+	if cfg.ShutdownDelay > 0 {
+		time.Sleep(cfg.ShutdownDelay)
+	}
+
+	shutdownTimeout := timeoutOrDefault(cfg.ShutdownTimeout, defaultShutdownTimeout)
+	ctx, cancelShutdown := withOptionalTimeout(shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn().Err(err).Msg("shutdown deadline reached, closing remaining connections")
+		srv.Close()
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if onShutdown != nil {
+		flushCtx, cancelFlush := withOptionalTimeout(shutdownTimeout)
+		defer cancelFlush()
+		onShutdown(flushCtx)
+	}
+	logger.Info().Msg("server stopped")
+	return nil
+}
+
+// withOptionalTimeout is context.WithTimeout where zero means no deadline
+func withOptionalTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/api"
+	"github.com/user/coo-llm/internal/config"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Server{ShutdownTimeout: 5 * time.Second}
+	health := api.NewHealthHandler(nil, nil, nil, api.HealthOptions{})
+	stop := make(chan os.Signal, 1)
+	flushed := make(chan struct{})
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(newHTTPServer(cfg, mux), ln, cfg, health, stop, stopBackground, func(ctx context.Context) { close(flushed) }, zerolog.Nop())
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	stop <- syscall.SIGTERM
+	deadline := time.Now().Add(2 * time.Second)
+	for !health.Draining() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !health.Draining() {
+		t.Fatal("Expected the instance to be marked unready")
+	}
+	if background.Err() == nil {
+		t.Error("Expected background work to be stopped when shutdown begins")
+	}
+
+	// New connections are refused while the request is still in flight
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err != nil {
+			break
+		} else {
+			conn.Close()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-flushed:
+		t.Fatal("Expected flushing to wait for the in-flight request")
+	default:
+	}
+
+	close(release)
+	if got := <-body; got != "done" {
+		t.Errorf("Expected the in-flight request to complete, got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	select {
+	case <-flushed:
+	default:
+		t.Error("Expected onShutdown to run")
+	}
+}
+
+func TestServeClosesConnectionsAfterDeadline(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Server{ShutdownTimeout: 100 * time.Millisecond}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(newHTTPServer(cfg, mux), ln, cfg, api.NewHealthHandler(nil, nil, nil, api.HealthOptions{}), stop, nil, nil, zerolog.Nop())
+	}()
+
+	go http.Get("http://" + ln.Addr().String() + "/stream")
+	<-started
+	stop <- syscall.SIGTERM
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected shutdown to succeed after the deadline, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected shutdown to give up on the stream at the deadline")
+	}
+}
+
+func TestTimeoutOrDefault(t *testing.T) {
+	if got := timeoutOrDefault(0, time.Minute); got != time.Minute {
+		t.Errorf("Expected the default for zero, got %v", got)
+	}
+	if got := timeoutOrDefault(-1, time.Minute); got != 0 {
+		t.Errorf("Expected no timeout for a negative value, got %v", got)
+	}
+	if got := timeoutOrDefault(time.Second, time.Minute); got != time.Second {
+		t.Errorf("Expected the configured timeout, got %v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/log"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// storeServerAPIKeyEnv supplies the store server API key when -api-key is not set
+const storeServerAPIKeyEnv = "COO_LLM_STORE_API_KEY"
+
+// runStoreServer implements `coo-llm store-server`, which serves the HTTP store
+// contract on top of the runtime store configured in storage.runtime
+func runStoreServer(args []string) int {
+	fs := flag.NewFlagSet("store-server", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to config file")
+	listen := fs.String("listen", ":2907", "address to listen on")
+	apiKey := fs.String("api-key", os.Getenv(storeServerAPIKeyEnv), "bearer token clients must send (default: $"+storeServerAPIKeyEnv+")")
+	fs.Parse(args)
+
+	if *apiKey == "" {
+		fmt.Printf("An API key is required: set -api-key or %s\n", storeServerAPIKeyEnv)
+		return 1
+	}
+
+	cfg, err := config.LoadConfig(resolveConfigPath(*configPath))
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		return 1
+	}
+	if cfg.Storage.Runtime.Type == "http" {
+		fmt.Println("The store server needs a local backend; storage.runtime.type must not be http")
+		return 1
+	}
+
+	logger := log.NewLogger(&cfg.Logging)
+	backend, err := newRuntimeStore(cfg, logger.GetLogger())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	server := store.NewHTTPStoreServer(backend, store.NewSimpleConfigStore(backend), *apiKey, logger.GetLogger())
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	fmt.Printf("Store server listening on %s (backend: %s)\n", *listen, cfg.Storage.Runtime.Type)
+	if err := srv.ListenAndServe(); err != nil {
+		fmt.Printf("Store server failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
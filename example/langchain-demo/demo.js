@@ -45,10 +45,7 @@ async function main() {
         total_tokens: response2.usage_metadata.total_tokens,
       });
     }
-    // Check for cost in response metadata (COO-LLM specific)
-    if (response2.response_metadata && response2.response_metadata.usage && response2.response_metadata.usage.cost) {
-      console.log('Cost:', response2.response_metadata.usage.cost);
-    }
+    // COO-LLM reports the cost in the x-coo-cost response header, keeping the body OpenAI's
 
     // Test 4: Streaming response
     console.log('\nTesting streaming response:');
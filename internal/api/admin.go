@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -17,15 +18,16 @@ import (
 	"github.com/user/coo-llm/internal/store"
 )
 
+// AdminHandler serves the Admin API. Settings are read from the selector's config on
+// every request, so a reload applies to them.
 type AdminHandler struct {
-	cfg      *config.Config
 	store    store.StoreProvider
 	selector *balancer.Selector
 	logger   *log.Logger
 }
 
-func NewAdminHandler(cfg *config.Config, store store.StoreProvider, selector *balancer.Selector, logger *log.Logger) *AdminHandler {
-	return &AdminHandler{cfg: cfg, store: store, selector: selector, logger: logger}
+func NewAdminHandler(store store.StoreProvider, selector *balancer.Selector, logger *log.Logger) *AdminHandler {
+	return &AdminHandler{store: store, selector: selector, logger: logger}
 }
 
 func (h *AdminHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
@@ -33,7 +35,7 @@ func (h *AdminHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
 	cfg, err := h.store.LoadConfig()
 	if err != nil {
 		// Fallback to in-memory config if store fails
-		cfg = h.maskSensitiveConfig(h.cfg)
+		cfg = h.maskSensitiveConfig(h.selector.Config())
 	} else {
 		// Store already has masked config, but ensure it's fully masked
 		cfg = h.maskSensitiveConfig(cfg)
@@ -75,6 +77,8 @@ func (h *AdminHandler) UpdateConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
+	// Apply here right away; other instances pick it up on their next sync
+	h.selector.ApplySharedConfig(&updatedCfg)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Config updated successfully"})
@@ -213,13 +217,8 @@ func (h *AdminHandler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update in-memory config (h.cfg is a pointer, so we can update it directly)
-	h.cfg.Policy.Algorithm = policyUpdate.Algorithm
-	h.cfg.Policy.Priority = policyUpdate.Priority
-	if policyUpdate.Cache != nil {
-		h.cfg.Policy.Cache.Enabled = policyUpdate.Cache.Enabled
-		h.cfg.Policy.Cache.TTLSeconds = policyUpdate.Cache.TTLSeconds
-	}
+	// Apply here right away; other instances pick it up on their next sync
+	h.selector.ApplySharedConfig(currentCfg)
 
 	logger := h.logger.GetLogger()
 	logger.Info().
@@ -309,7 +308,7 @@ func (h *AdminHandler) GetClientStats(w http.ResponseWriter, r *http.Request) {
 	// Get all client keys from config
 	clientStats := make(map[string]interface{})
 
-	for _, apiKey := range h.cfg.APIKeys {
+	for _, apiKey := range h.selector.Config().APIKeys {
 		key := apiKey.Key
 		clientData := map[string]interface{}{
 			"total": map[string]float64{
@@ -348,7 +347,7 @@ func (h *AdminHandler) GetClientStats(w http.ResponseWriter, r *http.Request) {
 					"cost":    0,
 				}
 			}
-			clientData["by_provider"].(map[string]map[string]float64)[provider]["queries"]++
+			clientData["by_provider"].(map[string]map[string]float64)[provider]["queries"] += float64(p.Samples())
 			clientData["by_provider"].(map[string]map[string]float64)[provider]["tokens"] += tokenMap[p.Timestamp]
 			clientData["by_provider"].(map[string]map[string]float64)[provider]["cost"] += costMap[p.Timestamp]
 		}
@@ -473,7 +472,7 @@ func (h *AdminHandler) contains(slice []string, item string) bool {
 
 // Helper function to get client ID from key
 func (h *AdminHandler) getClientIDFromKey(clientKey string) string {
-	for _, apiKey := range h.cfg.APIKeys {
+	for _, apiKey := range h.selector.Config().APIKeys {
 		if apiKey.Key == clientKey {
 			return apiKey.ID
 		}
@@ -516,7 +515,7 @@ func (h *AdminHandler) aggregateByGroups(allPoints map[string][]store.MetricPoin
 				// Count queries from latency points
 				for _, p := range allPoints["latency"] {
 					if h.matchesGroup(p, groupBy, keyParts) {
-						stats["queries"]++
+						stats["queries"] += float64(p.Samples())
 					}
 				}
 				// Sum tokens and cost
@@ -553,7 +552,8 @@ func (h *AdminHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.AdminID == h.cfg.Server.WebUI.AdminID && req.Password == h.cfg.Server.WebUI.AdminPassword {
+	webUI := h.selector.Config().Server.WebUI
+	if req.AdminID == webUI.AdminID && req.Password == webUI.AdminPassword {
 		// Generate JWT token
 		token, err := h.generateJWTToken(req.AdminID)
 		if err != nil {
@@ -576,7 +576,7 @@ func (h *AdminHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 func (h *AdminHandler) generateJWTToken(adminID string) (string, error) {
 	// Use admin API key as JWT secret, or a configured secret
-	secret := h.cfg.Server.AdminAPIKey
+	secret := h.selector.Config().Server.AdminAPIKey
 	if secret == "" {
 		secret = "default-jwt-secret-change-in-production"
 	}
@@ -632,8 +632,9 @@ func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 
 func (h *AdminHandler) ListClients(w http.ResponseWriter, r *http.Request) {
 	// Return clients from config (admin endpoint, keys are needed for management)
-	clients := make([]map[string]interface{}, len(h.cfg.APIKeys))
-	for i, apiKey := range h.cfg.APIKeys {
+	apiKeys := h.selector.Config().APIKeys
+	clients := make([]map[string]interface{}, len(apiKeys))
+	for i, apiKey := range apiKeys {
 		clients[i] = map[string]interface{}{
 			"id":                apiKey.ID,
 			"api_key":           apiKey.Key, // Full key for admin management
@@ -803,15 +804,176 @@ func (h *AdminHandler) GetGlobalMetrics(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(metrics)
 }
 
-func SetupAdminRoutes(r chi.Router, cfg *config.Config, store store.StoreProvider, selector *balancer.Selector, logger *log.Logger) {
-	handler := NewAdminHandler(cfg, store, selector, logger)
+// maxTimeSeriesBuckets bounds the buckets of a time-series request, so one request
+// can't make the store aggregate an unbounded number of them
+const maxTimeSeriesBuckets = 10000
+
+// parseTimeRange reads start/end query params, defaulting to the last window. It fails
+// when either isn't a Unix timestamp or the range ends before it starts.
+func parseTimeRange(r *http.Request, window time.Duration) (int64, int64, error) {
+	end := time.Now().Unix()
+	if endStr := r.URL.Query().Get("end"); endStr != "" {
+		var err error
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid end: %q is not a Unix timestamp", endStr)
+		}
+	}
+	start := time.Unix(end, 0).Add(-window).Unix()
+	if startStr := r.URL.Query().Get("start"); startStr != "" {
+		var err error
+		if start, err = strconv.ParseInt(startStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid start: %q is not a Unix timestamp", startStr)
+		}
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end must not be before start")
+	}
+	return start, end, nil
+}
+
+// parseTimeSeriesRange reads the time range and bucket interval of a time-series
+// request, defaulting to the last 24 hours in 1h buckets
+func parseTimeSeriesRange(r *http.Request) (int64, int64, string, error) {
+	start, end, err := parseTimeRange(r, 24*time.Hour)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "1h"
+	}
+	seconds, err := store.ParseInterval(interval)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if buckets := (end-start)/seconds + 1; buckets > maxTimeSeriesBuckets {
+		return 0, 0, "", fmt.Errorf("the range spans %d buckets of %s, more than the limit of %d; use a wider interval or a shorter range", buckets, interval, maxTimeSeriesBuckets)
+	}
+	return start, end, interval, nil
+}
+
+// writeTimeSeries encodes a time-series response, grouping points by series name
+func (h *AdminHandler) writeTimeSeries(w http.ResponseWriter, points []store.TimeSeriesPoint, err error, start, end int64, interval string) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series := make(map[string][]store.TimeSeriesPoint)
+	for _, p := range points {
+		series[p.Metric] = append(series[p.Metric], p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"start":    start,
+		"end":      end,
+		"interval": interval,
+		"series":   series,
+	})
+}
+
+func (h *AdminHandler) GetClientTimeSeries(w http.ResponseWriter, r *http.Request) {
+	clientID := chi.URLParam(r, "client_id")
+	start, end, interval, err := parseTimeSeriesRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Metrics are tagged with the client's API key, accept either the ID or the key
+	clientKey := clientID
+	for _, apiKey := range h.selector.Config().APIKeys {
+		if apiKey.ID == clientID {
+			clientKey = apiKey.Key
+			break
+		}
+	}
+
+	points, err := h.store.GetClientTimeSeries(clientKey, start, end, interval)
+	h.writeTimeSeries(w, points, err, start, end, interval)
+}
+
+func (h *AdminHandler) GetProviderTimeSeries(w http.ResponseWriter, r *http.Request) {
+	providerID := chi.URLParam(r, "provider_id")
+	start, end, interval, err := parseTimeSeriesRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.store.GetProviderTimeSeries(providerID, start, end, interval)
+	h.writeTimeSeries(w, points, err, start, end, interval)
+}
+
+func (h *AdminHandler) GetKeyTimeSeries(w http.ResponseWriter, r *http.Request) {
+	providerID := chi.URLParam(r, "provider_id")
+	keyID := chi.URLParam(r, "key_id")
+	start, end, interval, err := parseTimeSeriesRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.store.GetKeyTimeSeries(providerID, keyID, start, end, interval)
+	h.writeTimeSeries(w, points, err, start, end, interval)
+}
+
+// GetStorageStats reports the size of the runtime store
+func (h *AdminHandler) GetStorageStats(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.store.(store.StorageStatsProvider)
+	if !ok {
+		http.Error(w, `{"error": "storage stats not supported"}`, http.StatusNotImplemented)
+		return
+	}
+	stats, err := provider.StorageStats(r.Context())
+	if errors.Is(err, store.ErrNotSupported) {
+		http.Error(w, `{"error": "storage stats not supported"}`, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error": "failed to get storage stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// CompactStorage runs one compaction pass with the configured retention policy
+func (h *AdminHandler) CompactStorage(w http.ResponseWriter, r *http.Request) {
+	compactor, ok := h.store.(store.Compactor)
+	if !ok {
+		http.Error(w, `{"error": "compaction not supported"}`, http.StatusNotImplemented)
+		return
+	}
+	policy := store.NewRetentionPolicy(h.selector.Config().Storage.Retention)
+	result, err := compactor.Compact(r.Context(), policy, time.Now())
+	if errors.Is(err, store.ErrNotSupported) {
+		http.Error(w, `{"error": "compaction not supported"}`, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logger := h.logger.GetLogger()
+		logger.Error().Err(err).Msg("storage compaction failed")
+		http.Error(w, `{"error": "compaction failed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// SetupAdminRoutes serves the Admin API. The status endpoint is served when health is not nil.
+func SetupAdminRoutes(r chi.Router, store store.StoreProvider, selector *balancer.Selector, logger *log.Logger, health *HealthHandler) {
+	handler := NewAdminHandler(store, selector, logger)
 
 	// Login endpoint (no auth required)
 	r.Post("/login", handler.Login)
 
 	// Admin routes with auth
 	adminRouter := chi.NewRouter()
-	adminRouter.Use(AdminAuthMiddleware(cfg.Server.AdminAPIKey, cfg))
+	adminRouter.Use(AdminAuthMiddlewareFunc(selector.Config))
 	adminRouter.Use(RateLimitMiddleware())
 	adminRouter.Use(AuditLogMiddleware(logger))
 
@@ -835,6 +997,21 @@ func SetupAdminRoutes(r chi.Router, cfg *config.Config, store store.StoreProvide
 	adminRouter.Get("/v1/metrics/providers/{provider_id}", handler.GetProviderMetrics)
 	adminRouter.Get("/v1/metrics/global", handler.GetGlobalMetrics)
 
+	// Time-series metrics
+	adminRouter.Get("/v1/metrics/clients/{client_id}/timeseries", handler.GetClientTimeSeries)
+	adminRouter.Get("/v1/metrics/providers/{provider_id}/timeseries", handler.GetProviderTimeSeries)
+	adminRouter.Get("/v1/metrics/providers/{provider_id}/keys/{key_id}/timeseries", handler.GetKeyTimeSeries)
+
+	// Storage maintenance
+	adminRouter.Get("/v1/storage", handler.GetStorageStats)
+	adminRouter.Post("/v1/storage/compact", handler.CompactStorage)
+
+	// Dependency status
+	if health != nil {
+		adminRouter.Get("/v1/status", health.Status)
+		adminRouter.Post("/v1/health/probe", health.Probe)
+	}
+
 	// Mount admin router
 	r.Mount("/admin", adminRouter)
 }
@@ -920,6 +1097,14 @@ func AuditLogMiddleware(logger *log.Logger) func(http.Handler) http.Handler {
 }
 
 func AdminAuthMiddleware(adminKey string, cfg *config.Config) func(http.Handler) http.Handler {
+	static := *cfg
+	static.Server.AdminAPIKey = adminKey
+	return AdminAuthMiddlewareFunc(func() *config.Config { return &static })
+}
+
+// AdminAuthMiddlewareFunc is AdminAuthMiddleware with the admin key, WebUI login and
+// CORS settings looked up on every request, so a config reload applies to them
+func AdminAuthMiddlewareFunc(current func() *config.Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Allow OPTIONS requests for CORS preflight
@@ -927,6 +1112,8 @@ func AdminAuthMiddleware(adminKey string, cfg *config.Config) func(http.Handler)
 				next.ServeHTTP(w, r)
 				return
 			}
+			cfg := current()
+			adminKey := cfg.Server.AdminAPIKey
 
 			auth := r.Header.Get("Authorization")
 			if auth == "" {
@@ -1011,8 +1198,15 @@ func validateWebUIToken(token string, cfg *config.Config) bool {
 }
 
 func CORSMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	return CORSMiddlewareFunc(func() *config.Config { return cfg })
+}
+
+// CORSMiddlewareFunc is CORSMiddleware with the CORS settings looked up on every
+// request, so a config reload applies to them
+func CORSMiddlewareFunc(current func() *config.Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := current()
 			if !cfg.Server.CORS.Enabled {
 				next.ServeHTTP(w, r)
 				return
@@ -1051,6 +1245,9 @@ func CORSMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
 				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.Server.CORS.MaxAge))
 			}
 
+			// Let browser clients read the request ID and routing decision headers
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+
 			// Handle preflight requests
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -31,7 +31,7 @@ func TestAdminMetricsAPI(t *testing.T) {
 	// Mock store
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(func(next http.Handler) http.Handler {
@@ -74,7 +74,7 @@ func TestAdminClientStatsAPI(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(func(next http.Handler) http.Handler {
@@ -111,7 +111,7 @@ func TestAdminStatsAPI(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(func(next http.Handler) http.Handler {
@@ -146,7 +146,7 @@ func TestAdminClientManagement(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(func(next http.Handler) http.Handler {
@@ -284,7 +284,7 @@ func TestAdminEnhancedMetrics(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(func(next http.Handler) http.Handler {
@@ -357,7 +357,7 @@ func TestRateLimiting(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(RateLimitMiddleware())
@@ -408,7 +408,7 @@ func TestAuditLogging(t *testing.T) {
 
 	mockStore := &mockStoreWithMetrics{}
 	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
-	handler := NewAdminHandler(cfg, mockStore, selector, nil)
+	handler := NewAdminHandler(mockStore, selector, nil)
 
 	r := chi.NewRouter()
 	r.Use(AuditLogMiddleware(nil)) // Using nil logger for test
@@ -510,6 +510,50 @@ func (m *mockStoreWithMetrics) GetGlobalMetrics(start, end int64) (*store.Global
 }
 
 // Test SetupAdminRoutes with proper route mounting
+func TestAdminRoutesFollowConfigReload(t *testing.T) {
+	cfg := &config.Config{Server: config.Server{
+		AdminAPIKey: "old-admin-key",
+		WebUI:       config.WebUI{AdminID: "admin", AdminPassword: "old-password"},
+		CORS:        config.CORS{Enabled: true, AllowedOrigins: []string{"https://old.example"}},
+	}}
+	mockStore := &mockStoreWithMetrics{}
+	selector := balancer.NewSelector(cfg, mockStore, newTestLogger())
+	r := chi.NewRouter()
+	r.Use(CORSMiddlewareFunc(selector.Config))
+	SetupAdminRoutes(r, mockStore, selector, nil, nil)
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Origin", "https://new.example")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	reloaded := *cfg
+	reloaded.Server.AdminAPIKey = "new-admin-key"
+	reloaded.Server.WebUI.AdminPassword = "new-password"
+	reloaded.Server.CORS.AllowedOrigins = []string{"https://new.example"}
+	selector.SetConfig(&reloaded)
+
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/admin/v1/config", "old-admin-key", "").Code)
+	w := send("GET", "/admin/v1/config", "new-admin-key", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://new.example", w.Header().Get("Access-Control-Allow-Origin"))
+
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/login", "", `{"admin_id": "admin", "password": "old-password"}`).Code)
+	w = send("POST", "/login", "", `{"admin_id": "admin", "password": "new-password"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var login struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	assert.Equal(t, http.StatusOK, send("GET", "/admin/v1/config", login.Token, "").Code)
+}
+
 func TestSetupAdminRoutes(t *testing.T) {
 	cfg := &config.Config{
 		Server: config.Server{
@@ -523,7 +567,7 @@ func TestSetupAdminRoutes(t *testing.T) {
 	r := chi.NewRouter()
 
 	// Setup admin routes (this should mount at /admin)
-	SetupAdminRoutes(r, cfg, mockStore, selector, nil)
+	SetupAdminRoutes(r, mockStore, selector, nil, nil)
 
 	// Test authentication middleware
 	t.Run("AdminRoutes_RequireAuth", func(t *testing.T) {
@@ -630,6 +674,24 @@ func TestSetupAdminRoutes(t *testing.T) {
 		assert.Contains(t, response, "clients")
 		assert.IsType(t, []any{}, response["clients"])
 	})
+	t.Run("AdminRoutes_WithAuth_TimeSeriesRange", func(t *testing.T) {
+		get := func(query string) int {
+			req := httptest.NewRequest("GET", "/admin/v1/metrics/providers/openai-prod/timeseries?"+query, nil)
+			req.Header.Set("Authorization", "Bearer test-admin-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, get(""))
+		assert.Equal(t, http.StatusOK, get("start=0&end=86400&interval=1m"))
+		assert.Equal(t, http.StatusBadRequest, get("start=yesterday"))
+		assert.Equal(t, http.StatusBadRequest, get("end=1.5"))
+		assert.Equal(t, http.StatusBadRequest, get("start=2000&end=1000"))
+		assert.Equal(t, http.StatusBadRequest, get("interval=1w"))
+		// A year of 1s buckets
+		assert.Equal(t, http.StatusBadRequest, get("start=0&end=31536000&interval=1s"))
+	})
 }
 func (m *mockStoreWithMetrics) GetClientTimeSeries(clientID string, start, end int64, interval string) ([]store.TimeSeriesPoint, error) {
 	return []store.TimeSeriesPoint{}, nil
@@ -7,7 +7,11 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
@@ -46,6 +50,80 @@ func TestModelsEndpoint(t *testing.T) {
 	assert.Len(t, data, 1)
 }
 
+func TestModelsEndpoint_Discovery(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}, Model: "gpt-4"},
+			{ID: "claude-prod", Type: "claude", APIKeys: []string{"sk-ant"}, Model: "claude-3-opus"},
+		},
+		ModelAliases: map[string]string{
+			"fast":  "openai:gpt-4o",
+			"smart": "claude-prod:claude-3-opus",
+		},
+		APIKeys: []config.APIKeyConfig{
+			{ID: "all", Key: "all-key", AllowedProviders: []string{"*"}},
+			{ID: "openai-only", Key: "openai-key", AllowedProviders: []string{"openai-prod"}},
+		},
+	}
+	reg := provider.NewRegistry()
+	reg.Register(&mockProvider{})
+	selector := balancer.NewSelector(cfg, &mockStore{}, nil)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, log.NewLogger(&config.Logging{}), reg, &mockStore{})
+
+	list := func(key string) []string {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Data []Model `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		var ids []string
+		for _, m := range resp.Data {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	// claude-prod isn't registered, so only its configured model is listed
+	assert.Equal(t, []string{"openai-prod:gpt-4", "openai-prod:gpt-4o", "claude-prod:claude-3-opus", "fast", "smart"}, list("all-key"))
+	assert.Equal(t, []string{"openai-prod:gpt-4", "openai-prod:gpt-4o", "fast"}, list("openai-key"))
+
+	get := func(key, id string) (int, Model) {
+		req := httptest.NewRequest("GET", "/v1/models/"+id, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var m Model
+		json.Unmarshal(w.Body.Bytes(), &m)
+		return w.Code, m
+	}
+
+	code, m := get("all-key", "openai-prod:gpt-4o")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Model{
+		ID: "openai-prod:gpt-4o", Object: "model", Created: modelCreated, OwnedBy: "openai-prod",
+		Provider: "openai-prod", Type: "openai", Model: "gpt-4o",
+		ContextWindow: 128000, MaxOutputTokens: 16384,
+		Pricing:      &ModelPricing{Input: 2.5, Output: 10, CachedInput: 1.25},
+		Capabilities: &ModelCapabilities{Tools: true, Vision: true, JSONMode: true, Streaming: true},
+	}, m)
+
+	code, m = get("all-key", "fast")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "openai:gpt-4o", m.AliasFor)
+	assert.Equal(t, "openai-prod", m.Provider)
+	assert.Equal(t, "gpt-4o", m.Model)
+
+	code, _ = get("openai-key", "smart")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("all-key", "openai-prod:gpt-5")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
 func TestChatCompletionsEndpoint(t *testing.T) {
 	// Mock config and components
 	cfg := &config.Config{
@@ -77,7 +155,7 @@ func TestChatCompletionsEndpoint(t *testing.T) {
 	runtimeStore := &mockStore{}
 	selector := balancer.NewSelector(cfg, runtimeStore, logger)
 	r := chi.NewRouter()
-	SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	reqBody := map[string]any{
 		"model": "gpt-4o",
@@ -102,6 +180,161 @@ func TestChatCompletionsEndpoint(t *testing.T) {
 	assert.Contains(t, resp, "choices")
 }
 
+func TestChatCompletionsEndpoint_StreamWrittenBeforeReturn(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+		APIKeys: []config.APIKeyConfig{
+			{ID: "test-client", Key: "test-key", AllowedProviders: []string{"*"}},
+		},
+		ModelAliases: map[string]string{"gpt-4o": "openai-prod:gpt-4o"},
+		Policy:       config.Policy{Strategy: "round_robin"},
+	}
+
+	reg := provider.NewRegistry()
+	reg.Register(&mockProvider{})
+	logger := log.NewLogger(&config.Logging{})
+	runtimeStore := &mockStore{}
+	r := chi.NewRouter()
+	SetupRoutes(r, balancer.NewSelector(cfg, runtimeStore, logger), logger, reg, runtimeStore)
+
+	body := `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// The whole stream is written by the time the handler returns, so shutdown can drain it
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "data: [DONE]")
+	// Text sent with the last chunk by providers without native streaming is kept
+	assert.Contains(t, w.Body.String(), `"content":"Hello back"`)
+}
+
+// mockProviderStreamingUsage reports usage with the last chunk, like OpenAI's streams
+type mockProviderStreamingUsage struct {
+	mockProvider
+}
+
+func (m *mockProviderStreamingUsage) GenerateStream(ctx context.Context, req *provider.LLMRequest) (<-chan *provider.LLMStreamResponse, error) {
+	streamChan := make(chan *provider.LLMStreamResponse, 2)
+	go func() {
+		defer close(streamChan)
+		streamChan <- &provider.LLMStreamResponse{Text: "Hello back", FinishReason: "stop"}
+		streamChan <- &provider.LLMStreamResponse{Done: true, Usage: &provider.Usage{InputTokens: 9, CachedInputTokens: 4, OutputTokens: 3, TotalTokens: 12}}
+	}()
+	return streamChan, nil
+}
+
+func TestChatCompletionsEndpoint_StreamAccounting(t *testing.T) {
+	stream := func(p provider.LLMProvider, body string) (*httptest.ResponseRecorder, *recordingStore) {
+		cfg := &config.Config{
+			LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}}},
+			APIKeys:      []config.APIKeyConfig{{ID: "test-client", Key: "test-key", AllowedProviders: []string{"*"}}},
+			ModelAliases: map[string]string{"gpt-4o": "openai-prod:gpt-4o"},
+			Policy:       config.Policy{Strategy: "round_robin"},
+		}
+		reg := provider.NewRegistry()
+		reg.Register(p)
+		logger := log.NewLogger(&config.Logging{})
+		runtimeStore := &recordingStore{}
+		r := chi.NewRouter()
+		SetupRoutes(r, balancer.NewSelector(cfg, runtimeStore, logger), logger, reg, runtimeStore)
+
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w, runtimeStore
+	}
+
+	// Usage the provider reports is billed and sent to clients that ask for it
+	w, runtimeStore := stream(&mockProviderStreamingUsage{}, `{"model": "gpt-4o", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "Hello"}]}`)
+	events := readEvents(t, w.Body.Bytes())
+	require.GreaterOrEqual(t, len(events), 2)
+	var last struct {
+		Choices []any           `json:"choices"`
+		Usage   CompletionUsage `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(events[len(events)-2]), &last))
+	assert.NotNil(t, last.Choices)
+	assert.Empty(t, last.Choices)
+	assert.Equal(t, CompletionUsage{PromptTokens: 9, CompletionTokens: 3, TotalTokens: 12, PromptTokensDetails: PromptTokensDetails{CachedTokens: 4}}, last.Usage)
+	for _, event := range events[:len(events)-2] {
+		assert.Contains(t, event, `"usage":null`)
+	}
+
+	tokens := runtimeStore.points("tokens")
+	require.Len(t, tokens, 1)
+	assert.Equal(t, float64(12), tokens[0].Value)
+	assert.Equal(t, "openai-prod", tokens[0].Tags["provider"])
+	assert.Len(t, runtimeStore.points("latency"), 1)
+	cost := runtimeStore.points("cost")
+	require.Len(t, cost, 1)
+	assert.Greater(t, cost[0].Value, float64(0))
+
+	// Without include_usage, chunks have no usage field
+	w, _ = stream(&mockProviderStreamingUsage{}, `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	assert.NotContains(t, w.Body.String(), `"usage"`)
+
+	// Providers that don't report usage are billed on an estimate
+	_, runtimeStore = stream(&mockProvider{}, `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	tokens = runtimeStore.points("tokens")
+	require.Len(t, tokens, 1)
+	assert.Greater(t, tokens[0].Value, float64(0))
+	cost = runtimeStore.points("cost")
+	require.Len(t, cost, 1)
+	assert.Greater(t, cost[0].Value, float64(0))
+}
+
+// mockProviderFailingCall answers like mockProviderReplying but fails its second call
+type mockProviderFailingCall struct {
+	mockProviderReplying
+}
+
+func (m *mockProviderFailingCall) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
+	resp, _ := m.mockProviderReplying.Generate(ctx, req)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.requests) == 2 {
+		return nil, errors.New("API error: 500 - overloaded")
+	}
+	return resp, nil
+}
+
+func TestChatCompletionsEndpoint_EmulatedChoicesUsage(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "claude", APIKeys: []string{"sk-test"}}},
+		Policy:       config.Policy{Retry: config.RetryConfig{MaxAttempts: 1, Timeout: time.Second}},
+	}
+	reg := provider.NewRegistry()
+	reg.Register(&mockProviderFailingCall{mockProviderReplying{replies: []string{"ok"}}})
+	logger := log.NewLogger(&config.Logging{})
+	runtimeStore := &recordingStore{}
+	r := chi.NewRouter()
+	SetupRoutes(r, balancer.NewSelector(cfg, runtimeStore, logger), logger, reg, runtimeStore)
+
+	body := `{"model": "openai-prod:claude-3-5-sonnet", "n": 3, "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadGateway, w.Code, w.Body.String())
+
+	// Each emulated choice is a request against the key, and the choices that were
+	// generated before one failed are billed
+	assert.Equal(t, float64(3), runtimeStore.usageOf("req"))
+	assert.Equal(t, float64(1), runtimeStore.usageOf("errors"))
+	tokens := runtimeStore.points("tokens")
+	require.Len(t, tokens, 1)
+	assert.Equal(t, float64(20), tokens[0].Value)
+	cost := runtimeStore.points("cost")
+	require.Len(t, cost, 1)
+	assert.Greater(t, cost[0].Value, float64(0))
+}
+
 func TestChatCompletionsEndpoint_InvalidModel(t *testing.T) {
 	cfg := &config.Config{
 		LLMProviders: []config.LLMProvider{
@@ -128,7 +361,7 @@ func TestChatCompletionsEndpoint_InvalidModel(t *testing.T) {
 	runtimeStore := &mockStore{}
 	selector := balancer.NewSelector(cfg, runtimeStore, logger)
 	r := chi.NewRouter()
-	SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	reqBody := map[string]any{
 		"messages": []map[string]string{
@@ -208,7 +441,7 @@ func TestChatCompletionsEndpoint_RetryOnFailure(t *testing.T) {
 	selector := balancer.NewSelector(cfg, runtimeStore, logger)
 
 	r := chi.NewRouter()
-	SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	reqBody := map[string]any{
 		"model": "gpt-4o",
@@ -271,7 +504,7 @@ func TestChatCompletionsEndpoint_Caching(t *testing.T) {
 	runtimeStore := &mockStoreWithCache{cache: make(map[string]string)}
 	selector := balancer.NewSelector(cfg, runtimeStore, logger)
 	r := chi.NewRouter()
-	SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	reqBody := map[string]any{
 		"model": "gpt-4o",
@@ -311,11 +544,42 @@ func TestChatCompletionsEndpoint_Caching(t *testing.T) {
 	assert.True(t, exists)
 	assert.NotEmpty(t, cached)
 
-	// Verify second response has cache_hit flag
+	// The cache hit is reported in a header, keeping the body OpenAI's
+	assert.Equal(t, "hit", w2.Header().Get(HeaderCache))
 	var resp2 map[string]any
 	err := json.Unmarshal(w2.Body.Bytes(), &resp2)
 	require.NoError(t, err)
-	assert.Equal(t, true, resp2["cache_hit"])
+	assert.NotContains(t, resp2, "cache_hit")
+	assert.Equal(t, w2.Header().Get(log.RequestIDHeader), resp2["id"])
+
+	send := func(extra map[string]any) *httptest.ResponseRecorder {
+		body := map[string]any{"model": "gpt-4o", "messages": []any{map[string]any{"role": "user", "content": "Test caching"}}}
+		for k, v := range extra {
+			body[k] = v
+		}
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+
+	// A plain answer isn't served to requests that ask for something else
+	w := send(map[string]any{"response_format": map[string]any{"type": "json_object"}})
+	assert.Equal(t, "miss", w.Header().Get(HeaderCache))
+	assert.Equal(t, 2, mockProv.callCount)
+	w = send(map[string]any{"stream": true})
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	// Sampling parameters are part of the key
+	w = send(map[string]any{"temperature": 0.2})
+	assert.Equal(t, "miss", w.Header().Get(HeaderCache))
+	assert.Equal(t, 3, mockProv.callCount)
+	w = send(map[string]any{"temperature": 0.2, "user": "someone"})
+	assert.Equal(t, "hit", w.Header().Get(HeaderCache))
+	assert.Equal(t, 3, mockProv.callCount)
 }
 
 func TestChatCompletionsEndpoint_ConversationHistory(t *testing.T) {
@@ -350,7 +614,7 @@ func TestChatCompletionsEndpoint_ConversationHistory(t *testing.T) {
 	selector := balancer.NewSelector(cfg, runtimeStore, logger)
 
 	r := chi.NewRouter()
-	SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	reqBody := map[string]any{
 		"model": "gpt-4o",
@@ -386,13 +650,776 @@ func TestChatCompletionsEndpoint_ConversationHistory(t *testing.T) {
 	assert.Equal(t, "Oh, my god", mockProv.messages[2]["content"])
 }
 
+func TestChatCompletionsEndpoint_UnsupportedCapability(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+		Models: []config.ModelSpec{
+			{Provider: "openai-prod", Model: "text-only", Capabilities: &config.ModelCapabilities{Streaming: true}},
+		},
+	}
+	reg := provider.NewRegistry()
+	mockProv := &mockProvider{}
+	reg.Register(mockProv)
+	logger := log.NewLogger(&config.Logging{})
+	selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+	send := func(body map[string]any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// gpt-4 takes no images
+	w := send(map[string]any{
+		"model": "openai-prod:gpt-4",
+		"messages": []any{map[string]any{"role": "user", "content": []any{
+			map[string]any{"type": "text", "text": "What is this?"},
+			map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/cat.png"}},
+		}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "does not support image input")
+
+	w = send(map[string]any{
+		"model":    "openai-prod:text-only",
+		"messages": []any{map[string]any{"role": "user", "content": "Hi"}},
+		"tools":    []any{map[string]any{"type": "function", "function": map[string]any{"name": "lookup"}}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "does not support tools")
+	assert.Equal(t, 0, mockProv.callCount)
+
+	w = send(map[string]any{
+		"model":    "openai-prod:text-only",
+		"messages": []any{map[string]any{"role": "user", "content": "Hi"}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestTokenizeEndpoint(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}, Model: "gpt-4o"},
+			{ID: "claude-prod", Type: "claude", APIKeys: []string{"sk-ant"}, Model: "claude-3-opus"},
+			{ID: "gemini-prod", Type: "gemini", APIKeys: []string{"g-key"}, Model: "gemini-1.5-pro"},
+		},
+		ModelAliases: map[string]string{"smart": "openai-prod:gpt-4o"},
+		APIKeys: []config.APIKeyConfig{
+			{ID: "all", Key: "all-key", AllowedProviders: []string{"*"}},
+			{ID: "claude-only", Key: "claude-key", AllowedProviders: []string{"claude-prod"}},
+		},
+	}
+	reg := provider.NewRegistry()
+	reg.Register(&mockProvider{})
+	counter := &mockTokenCounter{tokens: 42}
+	reg.Register(counter)
+	selector := balancer.NewSelector(cfg, &mockStore{}, nil)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, log.NewLogger(&config.Logging{}), reg, &mockStore{})
+
+	send := func(path, key string, body map[string]any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	messages := []any{map[string]any{"role": "user", "content": "hello world"}}
+
+	// Aliases resolve like chat requests, and OpenAI models are counted with tiktoken
+	w := send("/v1/tokenize", "all-key", map[string]any{"model": "smart", "messages": messages})
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp TokenizeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, TokenizeResponse{Object: "tokenize", Model: "gpt-4o", Provider: "openai-prod", InputTokens: 9, Method: "tiktoken", Encoding: "o200k_base", ContextWindow: 128000}, resp)
+
+	// Vendors with a count endpoint count their own models
+	w = send("/v1/tokenize", "all-key", map[string]any{"model": "claude-prod:claude-3-opus", "messages": messages})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 42, resp.InputTokens)
+	assert.Equal(t, "vendor", resp.Method)
+	assert.Equal(t, "claude-3-opus", counter.lastModel)
+
+	// Without one, or when it fails, the count is estimated
+	counter.err = errors.New("API error: 500 - overloaded")
+	w = send("/v1/tokenize", "all-key", map[string]any{"model": "claude-prod:claude-3-opus", "messages": messages})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "heuristic", resp.Method)
+	w = send("/v1/tokenize", "all-key", map[string]any{"model": "gemini-prod:gemini-1.5-pro", "messages": messages})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "heuristic", resp.Method)
+	assert.Greater(t, resp.InputTokens, 0)
+
+	w = send("/v1/tokenize", "claude-key", map[string]any{"model": "smart", "messages": messages})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = send("/v1/tokenize", "all-key", map[string]any{"messages": messages})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The Anthropic endpoint takes a Messages body with a top-level system prompt
+	counter.err = nil
+	tools := []any{map[string]any{"name": "get_weather", "input_schema": map[string]any{"type": "object"}}}
+	data, _ := json.Marshal(map[string]any{"model": "claude-prod:claude-3-opus", "system": "Be brief.", "messages": messages, "tools": tools})
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", bytes.NewReader(data))
+	req.Header.Set("x-api-key", "claude-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"input_tokens": 42}`, w.Body.String())
+	require.Len(t, counter.lastMessages, 2)
+	assert.Equal(t, "system", counter.lastMessages[0]["role"])
+	assert.Equal(t, tools, counter.lastTools)
+
+	w = send("/v1/messages/count_tokens", "claude-key", map[string]any{"model": "openai-prod:gpt-4o", "messages": messages})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type": "error", "error": {"type": "permission_error", "message": "Provider not allowed for this API key"}}`, w.Body.String())
+}
+
+func TestChatCompletionsEndpoint_ContextWindow(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+	}
+	reg := provider.NewRegistry()
+	mockProv := &mockProvider{}
+	reg.Register(mockProv)
+	logger := log.NewLogger(&config.Logging{})
+	selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+	// About 10,000 tokens, more than gpt-4's 8,192
+	long := strings.Repeat("hello ", 10000)
+	send := func() *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]any{
+			"model":    "openai-prod:gpt-4",
+			"messages": []any{map[string]any{"role": "user", "content": long}},
+		})
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send()
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	var errResp struct {
+		Error map[string]string `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, "context_length_exceeded", errResp.Error["code"])
+	assert.Equal(t, "messages", errResp.Error["param"])
+	assert.Contains(t, errResp.Error["message"], "maximum context length is 8192 tokens")
+	assert.Equal(t, 0, mockProv.callCount, "oversize requests are not sent upstream")
+
+	// A routing group lets the request move to a model with a larger window
+	next := *cfg
+	next.RoutingGroups = []config.RoutingGroup{{Name: "gpt", Models: []string{"openai-prod:gpt-4", "openai-prod:gpt-4o"}}}
+	selector.SetConfig(&next)
+	w = send()
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gpt-4o", mockProv.lastModel)
+	assert.Equal(t, "gpt-4o", w.Header().Get(HeaderModel))
+	promptTokens, err := strconv.Atoi(w.Header().Get(HeaderPromptTokens))
+	require.NoError(t, err)
+	assert.Greater(t, promptTokens, 8192)
+}
+
+func TestChatCompletionsEndpoint_InvalidRequestNotRetried(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+		Policy: config.Policy{
+			Retry:    config.RetryConfig{MaxAttempts: 3, Timeout: time.Second},
+			Fallback: config.FallbackConfig{Enabled: true, Providers: []string{"openai-prod"}, MaxProviders: 1},
+		},
+	}
+	reg := provider.NewRegistry()
+	mockProv := &mockProviderRejecting{}
+	reg.Register(mockProv)
+	logger := log.NewLogger(&config.Logging{})
+	selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+	data, _ := json.Marshal(map[string]any{
+		"model":    "openai-prod:gpt-4o",
+		"messages": []any{map[string]any{"role": "user", "content": "Hello"}},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 1, mockProv.callCount)
+}
+
+func TestChatCompletionsEndpoint_ClientGoneNotRetried(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+		Policy: config.Policy{
+			Retry:    config.RetryConfig{MaxAttempts: 3, Timeout: time.Second, Interval: time.Minute},
+			Fallback: config.FallbackConfig{Enabled: true, Providers: []string{"openai-prod"}, MaxProviders: 1},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg := provider.NewRegistry()
+	mockProv := &mockProviderDisconnecting{disconnect: cancel}
+	reg.Register(mockProv)
+	logger := log.NewLogger(&config.Logging{})
+	selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+	r := chi.NewRouter()
+	SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+	data, _ := json.Marshal(map[string]any{
+		"model":    "openai-prod:gpt-4o",
+		"messages": []any{map[string]any{"role": "user", "content": "Hello"}},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data)).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(w, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler waited out the retry interval after the client left")
+	}
+	assert.Equal(t, 1, mockProv.callCount, "no retry or fallback once the client is gone")
+}
+
+func TestChatCompletionsEndpoint_StructuredOutput(t *testing.T) {
+	schemaFormat := map[string]any{
+		"type": "json_schema",
+		"json_schema": map[string]any{
+			"name": "person",
+			"schema": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"name": map[string]any{"type": "string"}, "age": map[string]any{"type": "integer"}},
+				"required":   []any{"name", "age"},
+			},
+		},
+	}
+	tests := []struct {
+		name           string
+		format         any
+		repair         bool
+		replies        []string
+		wantCode       int
+		wantStatus     string
+		wantContent    string
+		wantCalls      int
+		wantTokens     float64
+		wantInvalidErr bool
+	}{
+		{name: "valid json object in a code fence", format: map[string]any{"type": "json_object"}, replies: []string{"```json\n{\"ok\": true}\n```"},
+			wantCode: http.StatusOK, wantStatus: "valid", wantContent: `{"ok": true}`, wantCalls: 1, wantTokens: 10},
+		{name: "schema mismatch without repair", format: schemaFormat, replies: []string{`{"name": "Ada"}`},
+			wantCode: http.StatusOK, wantStatus: "invalid", wantContent: `{"name": "Ada"}`, wantCalls: 1, wantTokens: 10, wantInvalidErr: true},
+		{name: "schema mismatch repaired", format: schemaFormat, repair: true, replies: []string{`{"name": "Ada"}`, `{"name": "Ada", "age": 36}`},
+			wantCode: http.StatusOK, wantStatus: "repaired", wantContent: `{"name": "Ada", "age": 36}`, wantCalls: 2, wantTokens: 20},
+		{name: "repair still invalid", format: map[string]any{"type": "json_object"}, repair: true, replies: []string{"not json"},
+			wantCode: http.StatusOK, wantStatus: "invalid", wantContent: "not json", wantCalls: 2, wantTokens: 20, wantInvalidErr: true},
+		{name: "unknown format type", format: map[string]any{"type": "yaml"}, wantCode: http.StatusBadRequest},
+		{name: "invalid schema", format: map[string]any{"type": "json_schema", "json_schema": map[string]any{"name": "bad", "schema": map[string]any{"type": 5}}},
+			wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}}},
+				Policy: config.Policy{
+					Retry:            config.RetryConfig{MaxAttempts: 1, Timeout: time.Second},
+					StructuredOutput: config.StructuredOutput{Repair: tt.repair},
+				},
+			}
+			reg := provider.NewRegistry()
+			mockProv := &mockProviderReplying{replies: tt.replies}
+			reg.Register(mockProv)
+			logger := log.NewLogger(&config.Logging{})
+			selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+			r := chi.NewRouter()
+			SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+			data, _ := json.Marshal(map[string]any{
+				"model":           "openai-prod:gpt-4o",
+				"messages":        []any{map[string]any{"role": "user", "content": "Who wrote the first program?"}},
+				"response_format": tt.format,
+			})
+			req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, 0, mockProv.callCount)
+				return
+			}
+
+			assert.Equal(t, tt.wantStatus, w.Header().Get(HeaderStructuredOutput))
+			assert.Equal(t, tt.wantCalls, mockProv.callCount)
+			require.NotNil(t, mockProv.requests[0].ResponseFormat)
+			if tt.wantCalls > 1 {
+				repairMsgs := mockProv.requests[1].Messages
+				require.Len(t, repairMsgs, 3)
+				assert.Equal(t, tt.replies[0], repairMsgs[1]["content"])
+				assert.Contains(t, repairMsgs[2]["content"], "rejected")
+			}
+
+			var resp map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			choice := resp["choices"].([]any)[0].(map[string]any)
+			assert.Equal(t, tt.wantContent, choice["message"].(map[string]any)["content"])
+			assert.Equal(t, tt.wantTokens, resp["usage"].(map[string]any)["total_tokens"])
+			if tt.wantInvalidErr {
+				so := resp["structured_output"].(map[string]any)
+				assert.Equal(t, false, so["valid"])
+				assert.NotEmpty(t, so["error"])
+			} else {
+				assert.NotContains(t, resp, "structured_output")
+			}
+		})
+	}
+}
+
+func TestChatCompletionsEndpoint_StructuredOutputRepairFails(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}}},
+		Policy: config.Policy{
+			Retry:            config.RetryConfig{MaxAttempts: 1, Timeout: time.Second},
+			StructuredOutput: config.StructuredOutput{Repair: true},
+		},
+	}
+	reg := provider.NewRegistry()
+	reg.Register(&mockProviderFailingCall{mockProviderReplying{replies: []string{"not json"}}})
+	logger := log.NewLogger(&config.Logging{})
+	runtimeStore := &recordingStore{}
+	r := chi.NewRouter()
+	SetupRoutes(r, balancer.NewSelector(cfg, runtimeStore, logger), logger, reg, runtimeStore)
+
+	body := `{"model": "openai-prod:gpt-4o", "response_format": {"type": "json_object"}, "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "invalid", w.Header().Get(HeaderStructuredOutput))
+
+	// The failed repair is a non-final attempt; the request's outcome is the answer sent
+	outcomes := runtimeStore.points(store.MetricRequest)
+	require.Len(t, outcomes, 2)
+	assert.Equal(t, "2", outcomes[0].Tags[store.TagAttempt])
+	assert.Equal(t, store.OutcomeError, outcomes[0].Tags[store.TagOutcome])
+	assert.Equal(t, "false", outcomes[0].Tags[store.TagFinal])
+	assert.Equal(t, "1", outcomes[1].Tags[store.TagAttempt])
+	assert.Equal(t, store.OutcomeSuccess, outcomes[1].Tags[store.TagOutcome])
+	assert.Equal(t, "200", outcomes[1].Tags[store.TagStatus])
+	assert.Equal(t, "true", outcomes[1].Tags[store.TagFinal])
+}
+
+func TestChatCompletionsEndpoint_StructuredOutputStreamed(t *testing.T) {
+	stream := func(reply string) StructuredOutputResult {
+		cfg := &config.Config{
+			LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}}},
+			Policy:       config.Policy{Retry: config.RetryConfig{MaxAttempts: 1, Timeout: time.Second}},
+		}
+		reg := provider.NewRegistry()
+		reg.Register(&mockProviderReplying{replies: []string{reply}})
+		logger := log.NewLogger(&config.Logging{})
+		r := chi.NewRouter()
+		SetupRoutes(r, balancer.NewSelector(cfg, &mockStore{}, logger), logger, reg, &mockStore{})
+
+		body := `{"model": "openai-prod:gpt-4o", "stream": true, "response_format": {"type": "json_object"}, "messages": [{"role": "user", "content": "Hello"}]}`
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer test-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// The result is reported on the finish chunk only
+		events := readEvents(t, w.Body.Bytes())
+		var finish struct {
+			Choices          []ChunkChoice           `json:"choices"`
+			StructuredOutput *StructuredOutputResult `json:"structured_output"`
+		}
+		for _, event := range events[:len(events)-2] {
+			assert.NotContains(t, event, "structured_output")
+		}
+		require.NoError(t, json.Unmarshal([]byte(events[len(events)-2]), &finish))
+		require.Len(t, finish.Choices, 1)
+		require.NotNil(t, finish.Choices[0].FinishReason)
+		require.NotNil(t, finish.StructuredOutput)
+		return *finish.StructuredOutput
+	}
+
+	assert.Equal(t, StructuredOutputResult{Valid: true}, stream("```json\n{\"ok\": true}\n```"))
+	result := stream("not json")
+	assert.False(t, result.Valid)
+	assert.Contains(t, result.Error, "not valid JSON")
+}
+
+func TestChatCompletionsEndpoint_StructuredOutputEmulated(t *testing.T) {
+	tests := []struct {
+		name         string
+		providerType string
+		model        string
+		wantCode     int
+	}{
+		// Claude has no JSON mode; its provider forces a tool call instead
+		{name: "claude", providerType: "claude", model: "claude-3-5-sonnet", wantCode: http.StatusOK},
+		{name: "claude without vision", providerType: "claude", model: "claude-3-5-haiku", wantCode: http.StatusOK},
+		{name: "model without json mode", providerType: "openai", model: "gpt-4", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: tt.providerType, APIKeys: []string{"sk-test"}}},
+				Policy:       config.Policy{Retry: config.RetryConfig{MaxAttempts: 1, Timeout: time.Second}},
+			}
+			reg := provider.NewRegistry()
+			mockProv := &mockProviderReplying{replies: []string{`{"name": "Ada"}`}}
+			reg.Register(mockProv)
+			logger := log.NewLogger(&config.Logging{})
+			r := chi.NewRouter()
+			SetupRoutes(r, balancer.NewSelector(cfg, &mockStore{}, logger), logger, reg, &mockStore{})
+
+			data, _ := json.Marshal(map[string]any{
+				"model":    "openai-prod:" + tt.model,
+				"messages": []any{map[string]any{"role": "user", "content": "Who wrote the first program?"}},
+				"response_format": map[string]any{"type": "json_schema", "json_schema": map[string]any{
+					"name":   "person",
+					"schema": map[string]any{"type": "object", "properties": map[string]any{"name": map[string]any{"type": "string"}}, "required": []any{"name"}},
+				}},
+			})
+			req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, 0, mockProv.callCount)
+				return
+			}
+			assert.Equal(t, "valid", w.Header().Get(HeaderStructuredOutput))
+			require.Len(t, mockProv.requests, 1)
+			require.NotNil(t, mockProv.requests[0].ResponseFormat)
+			assert.Equal(t, provider.ResponseFormatJSONSchema, mockProv.requests[0].ResponseFormat.Type)
+		})
+	}
+}
+
+func TestChatCompletionsEndpoint_SamplingParams(t *testing.T) {
+	tests := []struct {
+		name         string
+		providerType string
+		params       map[string]any
+		wantCode     int
+		wantParam    string
+		wantErrCode  string
+		wantChoices  int
+		wantIgnored  string
+	}{
+		{name: "n emulated with one call per choice", providerType: "claude", params: map[string]any{"n": 2, "seed": 1, "top_k": 5},
+			wantCode: http.StatusOK, wantChoices: 2, wantIgnored: "seed"},
+		{name: "all parameters sent", providerType: "openai", params: map[string]any{"seed": 1, "stop": "END"},
+			wantCode: http.StatusOK, wantChoices: 1},
+		{name: "unsupported logprobs", providerType: "claude", params: map[string]any{"logprobs": true},
+			wantCode: http.StatusBadRequest, wantParam: "logprobs", wantErrCode: "unsupported_parameter"},
+		{name: "invalid value", providerType: "openai", params: map[string]any{"temperature": 3},
+			wantCode: http.StatusBadRequest, wantParam: "temperature", wantErrCode: "invalid_value"},
+		{name: "several choices streamed", providerType: "openai", params: map[string]any{"n": 2, "stream": true},
+			wantCode: http.StatusBadRequest, wantParam: "n", wantErrCode: "unsupported_parameter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: tt.providerType, APIKeys: []string{"sk-test"}}},
+				Policy:       config.Policy{Retry: config.RetryConfig{MaxAttempts: 1, Timeout: time.Second}},
+			}
+			reg := provider.NewRegistry()
+			mockProv := &mockProviderReplying{replies: []string{"first", "second"}}
+			reg.Register(mockProv)
+			logger := log.NewLogger(&config.Logging{})
+			selector := balancer.NewSelector(cfg, &mockStore{}, logger)
+			r := chi.NewRouter()
+			SetupRoutes(r, selector, logger, reg, &mockStore{})
+
+			body := map[string]any{
+				"model":    "openai-prod:some-model",
+				"messages": []any{map[string]any{"role": "user", "content": "Hello"}},
+			}
+			for k, v := range tt.params {
+				body[k] = v
+			}
+			data, _ := json.Marshal(body)
+			req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			var resp map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if tt.wantCode != http.StatusOK {
+				apiErr := resp["error"].(map[string]any)
+				assert.Equal(t, tt.wantParam, apiErr["param"])
+				assert.Equal(t, tt.wantErrCode, apiErr["code"])
+				assert.Equal(t, 0, mockProv.callCount)
+				return
+			}
+
+			choices := resp["choices"].([]any)
+			require.Len(t, choices, tt.wantChoices)
+			assert.Equal(t, tt.wantChoices, mockProv.callCount)
+			for i, c := range choices {
+				assert.Equal(t, float64(i), c.(map[string]any)["index"])
+			}
+			assert.Equal(t, float64(10*tt.wantChoices), resp["usage"].(map[string]any)["total_tokens"])
+			assert.Equal(t, tt.wantIgnored, w.Header().Get(HeaderIgnoredParams))
+			require.NotNil(t, mockProv.requests[0].Sampling)
+		})
+	}
+}
+
+func TestChatCompletionsEndpoint_RequestIDAndRoutingHeaders(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{
+				ID:      "openai-prod",
+				Type:    "openai",
+				APIKeys: []string{"sk-test"},
+				Pricing: config.Pricing{InputTokenCost: 1, OutputTokenCost: 2},
+			},
+		},
+		APIKeys: []config.APIKeyConfig{
+			{ID: "test-client", Key: "test-key", AllowedProviders: []string{"*"}},
+		},
+		ModelAliases: map[string]string{"gpt-4o": "openai-prod:gpt-4o"},
+	}
+
+	reg := provider.NewRegistry()
+	reg.Register(&mockProvider{})
+	logger := log.NewLogger(&config.Logging{})
+	runtimeStore := &mockStore{}
+	selector := balancer.NewSelector(cfg, runtimeStore, logger)
+
+	r := chi.NewRouter()
+	r.Use(RequestIDMiddleware)
+	SetupRoutes(r, selector, logger, reg, runtimeStore)
+
+	body, _ := json.Marshal(map[string]any{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+	})
+
+	// Client-supplied request ID is echoed and used as the response id
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	req.Header.Set("X-Request-ID", "client-req-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "client-req-1", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, "openai-prod", w.Header().Get("x-coo-provider"))
+	assert.Equal(t, "gpt-4o", w.Header().Get("x-coo-model"))
+	assert.NotEmpty(t, w.Header().Get("x-coo-key-id"))
+	assert.Equal(t, "1", w.Header().Get("x-coo-attempts"))
+	assert.Equal(t, "miss", w.Header().Get("x-coo-cache"))
+	// gpt-4o is priced from the model catalog, not the provider-wide pricing
+	assert.Equal(t, "0.0000625", w.Header().Get("x-coo-cost"))
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "client-req-1", resp["id"])
+
+	// Invalid request IDs are replaced by a generated one
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	req.Header.Set("X-Request-ID", "has spaces")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	generated := w.Header().Get("X-Request-ID")
+	assert.Len(t, generated, 32)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, generated, resp["id"])
+}
+
+func TestChatCompletionsEndpoint_RecordsOutcomes(t *testing.T) {
+	newRouter := func(maxAttempts int, runtimeStore *recordingStore) (chi.Router, *config.Config) {
+		cfg := &config.Config{
+			LLMProviders: []config.LLMProvider{
+				{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+			},
+			APIKeys: []config.APIKeyConfig{
+				{ID: "test-client", Key: "test-key", AllowedProviders: []string{"*"}},
+			},
+			ModelAliases: map[string]string{"gpt-4o": "openai-prod:gpt-4o"},
+			Policy: config.Policy{
+				Retry: config.RetryConfig{MaxAttempts: maxAttempts, Timeout: time.Second},
+			},
+		}
+		reg := provider.NewRegistry()
+		reg.Register(&mockProviderWithRetry{})
+		logger := log.NewLogger(&config.Logging{})
+		selector := balancer.NewSelector(cfg, runtimeStore, logger)
+		r := chi.NewRouter()
+		SetupRoutes(r, selector, logger, reg, runtimeStore)
+		return r, cfg
+	}
+	body, _ := json.Marshal(map[string]any{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+	})
+
+	// Two failed attempts followed by a success
+	runtimeStore := &recordingStore{}
+	r, _ := newRouter(3, runtimeStore)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	outcomes := runtimeStore.points(store.MetricRequest)
+	require.Len(t, outcomes, 3)
+	for i, p := range outcomes {
+		assert.Equal(t, strconv.Itoa(i+1), p.Tags[store.TagAttempt])
+		assert.Equal(t, "openai-prod", p.Tags["provider"])
+		assert.Equal(t, "test-key", p.Tags["client_key"])
+		assert.Equal(t, "false", p.Tags[store.TagFallback])
+	}
+	assert.Equal(t, store.OutcomeError, outcomes[0].Tags[store.TagOutcome])
+	assert.Equal(t, provider.ErrorClassOther, outcomes[0].Tags[store.TagErrorClass])
+	assert.Equal(t, "false", outcomes[1].Tags[store.TagFinal])
+	assert.Equal(t, store.OutcomeSuccess, outcomes[2].Tags[store.TagOutcome])
+	assert.Equal(t, "200", outcomes[2].Tags[store.TagStatus])
+	assert.Equal(t, "true", outcomes[2].Tags[store.TagFinal])
+
+	// A single failed attempt is the final outcome
+	runtimeStore = &recordingStore{}
+	r, _ = newRouter(1, runtimeStore)
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	outcomes = runtimeStore.points(store.MetricRequest)
+	require.Len(t, outcomes, 1)
+	assert.Equal(t, store.OutcomeError, outcomes[0].Tags[store.TagOutcome])
+	assert.Equal(t, "500", outcomes[0].Tags[store.TagStatus])
+	assert.Equal(t, "true", outcomes[0].Tags[store.TagFinal])
+
+	// Requests rejected before reaching a provider are recorded too
+	runtimeStore = &recordingStore{}
+	r, _ = newRouter(1, runtimeStore)
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader([]byte(`{}`)))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	outcomes = runtimeStore.points(store.MetricRequest)
+	require.Len(t, outcomes, 1)
+	assert.Equal(t, provider.ErrorClassInvalidRequest, outcomes[0].Tags[store.TagErrorClass])
+	assert.Equal(t, "0", outcomes[0].Tags[store.TagAttempt])
+
+	// Embeddings record their outcome as well
+	runtimeStore = &recordingStore{}
+	r, _ = newRouter(1, runtimeStore)
+	embBody, _ := json.Marshal(map[string]any{"model": "gpt-4o", "input": "hello"})
+	req = httptest.NewRequest("POST", "/v1/embeddings", bytes.NewReader(embBody))
+	req.Header.Set("Authorization", "Bearer test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	outcomes = runtimeStore.points(store.MetricRequest)
+	require.Len(t, outcomes, 1)
+	assert.Equal(t, "embeddings", outcomes[0].Tags[store.TagEndpoint])
+	assert.Equal(t, store.OutcomeSuccess, outcomes[0].Tags[store.TagOutcome])
+}
+
+// recordingStore keeps stored metrics in memory for assertions
+type recordingStore struct {
+	mockStore
+	mu      sync.Mutex
+	metrics []recordedMetric
+	usage   map[string]float64
+}
+
+type recordedMetric struct {
+	Name  string
+	Value float64
+	Tags  map[string]string
+}
+
+func (m *recordingStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, recordedMetric{Name: name, Value: value, Tags: tags})
+	return nil
+}
+
+func (m *recordingStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = map[string]float64{}
+	}
+	m.usage[metric] += delta
+	return nil
+}
+
+// usageOf returns the total increments of a usage metric across keys
+func (m *recordingStore) usageOf(metric string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage[metric]
+}
+
+func (m *recordingStore) points(name string) []recordedMetric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []recordedMetric
+	for _, p := range m.metrics {
+		if p.Name == name {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
 type mockProvider struct {
 	callCount int
+	lastModel string
 }
 
 func (m *mockProvider) Name() string { return "openai-prod" }
 func (m *mockProvider) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
 	m.callCount++
+	m.lastModel = req.Model
 	return &provider.LLMResponse{
 		Text:         "Hello back",
 		TokensUsed:   10,
@@ -511,6 +1538,71 @@ func (m *mockStore) ListAlgorithms() ([]string, error) {
 	return []string{"round_robin", "least_loaded", "hybrid"}, nil
 }
 
+// mockTokenCounter is a provider whose vendor counts tokens
+type mockTokenCounter struct {
+	mockProvider
+	tokens       int
+	err          error
+	lastModel    string
+	lastMessages []map[string]any
+	lastTools    []any
+}
+
+func (m *mockTokenCounter) Name() string { return "claude-prod" }
+func (m *mockTokenCounter) CountTokens(ctx context.Context, req *provider.LLMRequest) (int, error) {
+	m.lastModel = req.Model
+	m.lastMessages = req.Messages
+	m.lastTools = req.Tools
+	return m.tokens, m.err
+}
+
+// mockProviderRejecting fails every request the way an upstream rejects an invalid one
+type mockProviderRejecting struct {
+	mockProvider
+}
+
+func (m *mockProviderRejecting) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
+	m.callCount++
+	return nil, errors.New("API error: 400 - invalid request")
+}
+
+// mockProviderDisconnecting fails every request with a retryable error after its client goes away
+type mockProviderDisconnecting struct {
+	mockProvider
+	disconnect context.CancelFunc
+}
+
+func (m *mockProviderDisconnecting) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
+	m.callCount++
+	m.disconnect()
+	return nil, errors.New("API error: 503 - overloaded")
+}
+
+// mockProviderReplying answers each request with the next of its replies
+type mockProviderReplying struct {
+	mockProvider
+	mu       sync.Mutex
+	replies  []string
+	requests []*provider.LLMRequest
+}
+
+func (m *mockProviderReplying) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.callCount++
+	m.requests = append(m.requests, req)
+	text := m.replies[min(len(m.requests), len(m.replies))-1]
+	return &provider.LLMResponse{Text: text, TokensUsed: 10, InputTokens: 5, OutputTokens: 5, FinishReason: "stop"}, nil
+}
+
+func (m *mockProviderReplying) GenerateStream(ctx context.Context, req *provider.LLMRequest) (<-chan *provider.LLMStreamResponse, error) {
+	resp, _ := m.Generate(ctx, req)
+	streamChan := make(chan *provider.LLMStreamResponse, 1)
+	streamChan <- &provider.LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+	close(streamChan)
+	return streamChan, nil
+}
+
 type mockProviderWithRetry struct {
 	callCount int
 }
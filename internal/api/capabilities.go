@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// checkStreamSampling returns an error for sampling parameters a stream can't carry:
+// streamed responses have a single choice and no log probabilities
+func checkStreamSampling(opts *provider.SamplingOptions) error {
+	switch {
+	case opts.N > 1:
+		return &provider.ParamError{Param: provider.ParamN, Code: provider.ParamCodeUnsupported, Message: "n > 1 is not supported with stream"}
+	case opts.Logprobs:
+		return &provider.ParamError{Param: provider.ParamLogprobs, Code: provider.ParamCodeUnsupported, Message: "logprobs is not supported with stream"}
+	}
+	return nil
+}
+
+// usesTools reports whether a chat request offers the model tools or functions
+func usesTools(req map[string]any) bool {
+	for _, field := range []string{"tools", "functions"} {
+		if list, ok := req[field].([]any); ok && len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// usesVision reports whether any message of a chat request has image content
+func usesVision(req map[string]any) bool {
+	msgs, _ := req["messages"].([]any)
+	for _, msg := range msgs {
+		m, _ := msg.(map[string]any)
+		parts, _ := m["content"].([]any)
+		for _, part := range parts {
+			p, _ := part.(map[string]any)
+			if t, _ := p["type"].(string); t == "image_url" || t == "image" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesJSONMode reports whether a chat request asks for a JSON response format
+func usesJSONMode(req map[string]any) bool {
+	format, _ := req["response_format"].(map[string]any)
+	t, _ := format["type"].(string)
+	return t == "json_object" || t == "json_schema"
+}
+
+// checkCapabilities returns an error naming the first feature a chat request uses
+// that the model doesn't support. Models without known capabilities accept anything.
+func checkCapabilities(providerType string, spec config.ModelSpec, req map[string]any, stream bool) error {
+	caps := spec.Capabilities
+	if caps == nil {
+		return nil
+	}
+	jsonMode := caps.JSONMode || (caps.Tools && provider.EmulatesJSONMode(providerType))
+	switch {
+	case usesTools(req) && !caps.Tools:
+		return fmt.Errorf("model %s does not support tools", spec.Model)
+	case usesVision(req) && !caps.Vision:
+		return fmt.Errorf("model %s does not support image input", spec.Model)
+	case usesJSONMode(req) && !jsonMode:
+		return fmt.Errorf("model %s does not support response_format", spec.Model)
+	case stream && !caps.Streaming:
+		return fmt.Errorf("model %s does not support streaming", spec.Model)
+	}
+	return nil
+}
+
+// checkEmbeddingDims returns an error if an embeddings request asks for more
+// dimensions than the model produces
+func checkEmbeddingDims(spec config.ModelSpec, dimensions int) error {
+	if spec.Capabilities == nil || spec.Capabilities.EmbeddingDims == 0 || dimensions <= spec.Capabilities.EmbeddingDims {
+		return nil
+	}
+	return fmt.Errorf("model %s produces at most %d dimensions", spec.Model, spec.Capabilities.EmbeddingDims)
+}
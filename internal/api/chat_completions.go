@@ -3,9 +3,11 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,82 +17,73 @@ import (
 	"github.com/user/coo-llm/internal/log"
 	"github.com/user/coo-llm/internal/provider"
 	"github.com/user/coo-llm/internal/store"
+	"github.com/user/coo-llm/internal/tokenizer"
 )
 
 type ChatCompletionsHandler struct {
 	selector *balancer.Selector
 	logger   *log.Logger
 	reg      *provider.Registry
-	cfg      *config.Config
 	store    store.RuntimeStore
 }
 
-func NewChatCompletionsHandler(selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, cfg *config.Config, store store.RuntimeStore) *ChatCompletionsHandler {
-	return &ChatCompletionsHandler{selector: selector, logger: logger, reg: reg, cfg: cfg, store: store}
+// NewChatCompletionsHandler creates the handler. It reads the config in effect from
+// the selector on every request, so shared config changes apply without a restart.
+func NewChatCompletionsHandler(selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, store store.RuntimeStore) *ChatCompletionsHandler {
+	return &ChatCompletionsHandler{selector: selector, logger: logger, reg: reg, store: store}
 }
 
 func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request) {
-	var req map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+	cfg := h.selector.Config()
+	r, reqID := requestID(r)
+	w.Header().Set(log.RequestIDHeader, reqID)
+	outcomes := newOutcomeRecorder(h.store, h.selector.Health(), r, "chat", reqID, "")
 
-	model, ok := req["model"].(string)
-	if !ok {
-		http.Error(w, "model is required", http.StatusBadRequest)
+	req, err := decodeChatRequest(r.Body)
+	if err != nil {
+		writeParamError(w, err, outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
 		return
 	}
+	model, stream := req.Model, req.Stream
+	outcomes.model = model
+	if stream {
+		outcomes.endpoint = "chat_stream"
+	}
 
 	// Check API key permissions
 	allowedProviders, ok := r.Context().Value("allowed_providers").([]string)
 	if !ok {
-		http.Error(w, `{"error": {"message": "Authentication context missing", "type": "authentication_error"}}`, http.StatusInternalServerError)
+		writeAPIError(w, outcomes.finish(http.StatusInternalServerError, provider.ErrorClassOther), errorTypeServer, "", "", "Authentication context missing")
 		return
 	}
 
 	// Check if the requested model/provider is allowed for this API key
 	providerID := h.GetProviderFromModel(model)
 	if providerID != "" {
-		allowed := false
-		for _, allowedProvider := range allowedProviders {
-			if allowedProvider == "*" || allowedProvider == providerID {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			http.Error(w, `{"error": {"message": "Provider not allowed for this API key", "type": "authentication_error"}}`, http.StatusForbidden)
+		if !providerAllowed(allowedProviders, providerID) {
+			writeAPIError(w, outcomes.finish(http.StatusForbidden, provider.ErrorClassAuth), errorTypePermission, "", "model", "Provider not allowed for this API key")
 			return
 		}
 	}
 
-	// Extract messages
-	var messages []map[string]any
-	if msgs, ok := req["messages"].([]any); ok && len(msgs) > 0 {
-		messages = make([]map[string]any, len(msgs))
-		for i, msg := range msgs {
-			if m, ok := msg.(map[string]any); ok {
-				messages[i] = m
-			}
-		}
+	// JSON output is checked against the requested format once the response is back
+	structured, formatErr := newStructuredOutput(req.ResponseFormat)
+	if formatErr != nil {
+		writeParamError(w, formatErr, outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
+		return
 	}
+	sampling := req.Sampling // Checked against the provider once one is picked
 
-	// Extract prompt from last message for caching (backward compatibility)
-	var prompt string
-	if len(messages) > 0 {
-		if content, ok := messages[len(messages)-1]["content"].(string); ok {
-			prompt = content
-		}
-	}
+	messages := req.messages()
+	prompt := req.cachePrompt() // The cache key; empty when the response isn't cached
 
 	// Check cache if enabled
-	if h.cfg.Policy.Cache.Enabled && prompt != "" {
+	if cfg.Policy.Cache.Enabled && prompt != "" {
 		var cacheHit bool
 		var cachedResp string
 		var err error
 
-		if h.cfg.Policy.Cache.SemanticEnabled {
+		if cfg.Policy.Cache.SemanticEnabled {
 			// Semantic caching
 			cacheHit, cachedResp, err = h.checkSemanticCache(prompt)
 		} else {
@@ -102,9 +95,12 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 
 		if cacheHit {
 			// Return cached response
-			var cached map[string]any
+			var cached ChatCompletion
 			if json.Unmarshal([]byte(cachedResp), &cached) == nil {
-				cached["cache_hit"] = true
+				cached.ID = reqID
+				routing := routingInfo{CacheHit: true, Model: cached.Model}
+				routing.setHeaders(w)
+				outcomes.finish(http.StatusOK, "")
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(cached)
 				return
@@ -112,20 +108,21 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	maxTokens := 1000
-	if mt, ok := req["max_tokens"].(float64); ok {
-		maxTokens = int(mt)
-	}
-
-	stream := false
-	if s, ok := req["stream"].(bool); ok {
-		stream = s
-	}
+	maxTokens := req.maxTokens()
 
-	user := ""
-	if u, ok := req["user"].(string); ok {
-		user = u
+	// Requests too large for the model's context window are rerouted within its routing
+	// groups or rejected here, instead of failing upstream after the full latency
+	tools, _ := req.Params["tools"].([]any)
+	routedModel, promptTokens, fitErr := h.selector.FitContext(model, maxTokens, func(providerType, modelName string) int {
+		return tokenizer.CountMessages(providerType, modelName, messages, tools).Tokens
+	}, func(providerID string) bool {
+		return providerAllowed(allowedProviders, providerID)
+	})
+	if fitErr != nil {
+		writeContextLengthExceeded(w, fitErr.Error(), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
+		return
 	}
+	w.Header().Set(HeaderPromptTokens, strconv.Itoa(promptTokens))
 
 	// Retry logic
 	var resp *provider.LLMResponse
@@ -133,15 +130,15 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 	var key *config.Key
 	var modelName string
 	var latency int64
-	var err error
+	attempts := 0
 
-	retryCfg := h.cfg.Policy.Retry
+	retryCfg := cfg.Policy.Retry
 	if retryCfg.MaxAttempts == 0 {
 		retryCfg.MaxAttempts = 1 // Default no retry
 	}
 
 	for attempt := 0; attempt < retryCfg.MaxAttempts; attempt++ {
-		pCfg, _, modelName, err = h.selector.SelectBest(model)
+		pCfg, _, modelName, err = h.selector.SelectBest(routedModel)
 		if err != nil {
 			break
 		}
@@ -149,6 +146,23 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 			err = fmt.Errorf("no provider selected")
 			break
 		}
+		if spec, ok := h.selector.ModelSpec(pCfg, modelName); ok {
+			if capErr := checkCapabilities(pCfg.ProviderType(), spec, req.Params, stream); capErr != nil {
+				writeInvalidRequest(w, capErr.Error(), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
+				return
+			}
+		}
+		ignored, samplingErr := provider.CheckSampling(pCfg.ProviderType(), sampling)
+		if samplingErr != nil {
+			writeParamError(w, samplingErr, outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
+			return
+		}
+		w.Header().Del(HeaderIgnoredParams)
+		if len(ignored) > 0 {
+			w.Header().Set(HeaderIgnoredParams, strings.Join(ignored, ","))
+			logger := h.logger.GetLogger()
+			logger.Warn().Str("request_id", reqID).Str("provider", pCfg.ID).Strs("params", ignored).Msg("Sampling parameters the provider doesn't support were not sent")
+		}
 
 		// Check for recommended key in store
 		recommendKey := ""
@@ -189,16 +203,19 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 			break
 		}
 
-		// Update req usage immediately to avoid spam on this key
-		h.selector.UpdateUsage(pCfg.ID, key.ID, "req", 1)
+		// Update req usage immediately to avoid spam on this key; emulated choices
+		// take one vendor call each
+		h.selector.UpdateUsage(pCfg.ID, key.ID, "req", float64(provider.Calls(pCfg.ProviderType(), sampling)))
+		attempts++
 
-		// Limit max tokens by provider's limit
+		// Limit max tokens by the provider's limit and the model's max output
 		limitedMaxTokens := maxTokens
-		if pCfg.Limits.MaxTokens > 0 && limitedMaxTokens > pCfg.Limits.MaxTokens {
-			limitedMaxTokens = pCfg.Limits.MaxTokens
+		if limit := h.selector.MaxOutputTokens(pCfg, modelName); limit > 0 && limitedMaxTokens > limit {
+			limitedMaxTokens = limit
 		}
 
-		prov, err := h.reg.Get(pCfg.ID)
+		var prov provider.LLMProvider
+		prov, err = h.reg.Get(pCfg.ID)
 		if err != nil {
 			break
 		}
@@ -209,21 +226,30 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 			Model:     modelName,
 			MaxTokens: limitedMaxTokens,
 			Stream:    stream,
-			User:      user,
-			Params:    req,
+			User:      req.User,
+			Params:    req.Params,
+		}
+		providerReq.Sampling = sampling
+		if structured != nil {
+			providerReq.ResponseFormat = structured.format
 		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), retryCfg.Timeout)
 		attemptStart := time.Now()
 
 		if stream {
-			streamChan, err := prov.GenerateStream(ctx, providerReq)
+			var streamChan <-chan *provider.LLMStreamResponse
+			streamChan, err = prov.GenerateStream(ctx, providerReq)
 			if err != nil {
 				cancel()
+				outcomes.attempt(pCfg, key, modelName, false, time.Since(attemptStart).Milliseconds(), err)
+				h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
 				break
 			}
 
 			// Handle streaming response
+			routing := routingInfo{Provider: pCfg.ID, Model: modelName, KeyID: key.ID, Attempts: attempts}
+			routing.setHeaders(w)
 			w.Header().Set("Content-Type", "text/event-stream")
 			w.Header().Set("Cache-Control", "no-cache")
 			w.Header().Set("Connection", "keep-alive")
@@ -231,65 +257,80 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 			flusher, ok := w.(http.Flusher)
 			if !ok {
 				cancel()
-				http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+				writeAPIError(w, outcomes.finish(http.StatusInternalServerError, provider.ErrorClassOther), errorTypeServer, "", "", "Streaming not supported")
 				return
 			}
 
-			go func() {
-				defer cancel()
+			// Streams can outlast the server's write timeout; they end with the upstream stream.
+			// Not every ResponseWriter supports deadlines, so the error is ignored.
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+			// The stream is written before the handler returns, so shutdown waits for it
+			chunks := &chunkWriter{
+				w:            w,
+				flusher:      flusher,
+				id:           reqID,
+				model:        model,
+				fingerprint:  systemFingerprint(pCfg.ID, modelName),
+				created:      time.Now().Unix(),
+				includeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			}
+			var streamErr error
+			var usage *provider.Usage
+			var text strings.Builder
+			func() {
+				chunks.start()
+				var reason string
 				for chunk := range streamChan {
+					if chunk.Usage != nil {
+						usage = chunk.Usage
+					}
+					if chunk.Done && strings.HasPrefix(chunk.Text, "Error:") {
+						streamErr = errors.New(strings.TrimSpace(strings.TrimPrefix(chunk.Text, "Error:")))
+						chunks.fail(streamErr)
+						chunks.done()
+						return
+					}
+					// Providers without native streaming send the whole text with the last chunk
+					if chunk.Text != "" {
+						text.WriteString(chunk.Text)
+						chunks.content(chunk.Text)
+					}
+					if chunk.FinishReason != "" {
+						reason = chunk.FinishReason
+					}
 					if chunk.Done {
-						if chunk.Text != "" && !strings.HasPrefix(chunk.Text, "Error:") {
-							// Send final usage data
-							usageData := map[string]any{
-								"id":      fmt.Sprintf("%d", time.Now().UnixNano()),
-								"object":  "chat.completion.chunk",
-								"created": time.Now().Unix(),
-								"model":   model,
-								"choices": []map[string]any{
-									{
-										"index":         0,
-										"delta":         map[string]string{},
-										"finish_reason": chunk.FinishReason,
-									},
-								},
-								"usage": map[string]any{
-									"prompt_tokens":     0, // TODO: track properly
-									"completion_tokens": 0,
-									"total_tokens":      0,
-								},
-							}
-							data, _ := json.Marshal(usageData)
-							fmt.Fprintf(w, "data: %s\n\n", data)
-							flusher.Flush()
+						if usage == nil {
+							usage = estimateUsage(pCfg.ProviderType(), modelName, messages, tools, text.String())
 						}
-						fmt.Fprintf(w, "data: [DONE]\n\n")
-						flusher.Flush()
+						chunks.finish(reason, structured.streamResult(text.String()))
+						chunks.usage(newUsage(usage))
+						chunks.done()
 						return
 					}
-
-					chunkData := map[string]any{
-						"id":      fmt.Sprintf("%d", time.Now().UnixNano()),
-						"object":  "chat.completion.chunk",
-						"created": time.Now().Unix(),
-						"model":   model,
-						"choices": []map[string]any{
-							{
-								"index": 0,
-								"delta": map[string]any{
-									"content": chunk.Text,
-								},
-								"finish_reason": nil,
-							},
-						},
-					}
-					data, _ := json.Marshal(chunkData)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
 				}
 			}()
-
-			// Update usage for streaming (req already updated when selected)
+			// The outcome of a stream is known once it ends
+			if streamErr == nil && ctx.Err() != nil {
+				streamErr = ctx.Err()
+			}
+			cancel()
+			latency = time.Since(attemptStart).Milliseconds()
+			outcomes.attempt(pCfg, key, modelName, false, latency, streamErr)
+			outcomes.finish(http.StatusOK, "")
+
+			// Streams are billed like other requests. Text sent before a failure was generated,
+			// so its tokens count; a stream that failed before any text used none.
+			if usage == nil && (streamErr == nil || text.Len() > 0) {
+				usage = estimateUsage(pCfg.ProviderType(), modelName, messages, tools, text.String())
+			}
+			if streamErr != nil {
+				h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
+			}
+			if usage != nil {
+				h.updateKeyUsage(pCfg, key, usage, latency)
+			}
+			h.recordRequest(r, reqID, model, pCfg, key, modelName, latency, usage, streamErr)
 
 			// Calculate and cache recommended key for next time
 			if recommended := h.selector.GetRecommendedKey(pCfg, modelName); recommended != nil {
@@ -299,68 +340,88 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		resp, err = prov.Generate(ctx, providerReq)
+		resp, err = provider.GenerateChoices(ctx, prov, pCfg.ProviderType(), providerReq)
 		cancel()
 		latency = time.Since(attemptStart).Milliseconds()
+		if err == nil && resp == nil {
+			err = fmt.Errorf("provider returned nil response")
+		}
+		outcomes.attempt(pCfg, key, modelName, false, latency, err)
 
 		if err == nil {
-			// Extra safety check
-			if resp == nil {
-				err = fmt.Errorf("provider returned nil response")
-			} else {
-				// Success, update usage (req already updated when selected)
-				if key != nil {
-					h.selector.UpdateUsage(pCfg.ID, key.ID, "input_tokens", float64(resp.InputTokens))
-					h.selector.UpdateUsage(pCfg.ID, key.ID, "output_tokens", float64(resp.OutputTokens))
-					h.selector.UpdateUsage(pCfg.ID, key.ID, "tokens", float64(resp.TokensUsed))
-					h.selector.UpdateUsage(pCfg.ID, key.ID, "latency", float64(latency))
-				}
+			// Success, update usage (req already updated when selected)
+			if key != nil {
+				h.updateKeyUsage(pCfg, key, resp.Usage(), latency)
+			}
 
-				// Calculate and cache recommended key for next time
-				if recommended := h.selector.GetRecommendedKey(pCfg, modelName); recommended != nil {
-					cacheKey := "recommend_" + pCfg.ID
-					h.selector.SetCache(cacheKey, recommended.ID, 3600) // 1 hour TTL
-				}
-				break
+			// Calculate and cache recommended key for next time
+			if recommended := h.selector.GetRecommendedKey(pCfg, modelName); recommended != nil {
+				cacheKey := "recommend_" + pCfg.ID
+				h.selector.SetCache(cacheKey, recommended.ID, 3600) // 1 hour TTL
 			}
+			break
 		}
 		if err != nil {
-			// Error, update error usage
-			h.logger.LogRequest(r.Context(), &log.LogEntry{
-				Provider:  pCfg.ID,
-				Model:     model,
-				ReqID:     fmt.Sprintf("%d", time.Now().UnixNano()),
-				LatencyMS: latency,
-				Status:    500,
-				Tokens:    0,
-				Cost:      0,
-				Error:     err.Error(),
-			})
+			// Error, update error usage. Choices generated before one failed were billed
+			// by the vendor, so their usage counts.
+			if resp != nil && key != nil {
+				h.updateKeyUsage(pCfg, key, resp.Usage(), latency)
+				h.recordRequest(r, reqID, model, pCfg, key, modelName, latency, resp.Usage(), err)
+				resp = nil
+			} else {
+				h.logger.LogRequest(r.Context(), &log.LogEntry{
+					Provider:  pCfg.ID,
+					Model:     model,
+					ReqID:     reqID,
+					LatencyMS: latency,
+					Status:    statusForError(err),
+					Tokens:    0,
+					Cost:      0,
+					Error:     err.Error(),
+				})
+			}
 			if key != nil {
 				h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
 			}
+			// A request the upstream rejected fails the same way on every attempt
+			if !provider.Retryable(err) {
+				break
+			}
 			if attempt < retryCfg.MaxAttempts-1 {
-				time.Sleep(retryCfg.Interval)
+				select {
+				case <-time.After(retryCfg.Interval):
+				case <-r.Context().Done():
+				}
+			}
+			// Nobody is waiting for a retry once the client has gone
+			if r.Context().Err() != nil {
+				err = r.Context().Err()
+				break
 			}
 		}
 	}
 
 	// If primary provider failed and fallback is enabled, try fallback providers
-	if err != nil && h.cfg.Policy.Fallback.Enabled && !stream && pCfg != nil {
+	if err != nil && cfg.Policy.Fallback.Enabled && !stream && pCfg != nil && provider.Retryable(err) {
 		fallbackProviders := h.getFallbackProviders(pCfg.ID, modelName)
 		for _, fallbackID := range fallbackProviders {
 			if fallbackID == pCfg.ID {
 				continue // Skip same provider
 			}
+			if !h.selector.Health().Allow(fallbackID) {
+				continue // Circuit open after repeated failures
+			}
 
 			// Try fallback provider
-			fallbackPCfg, fallbackKey, fallbackModelName, fallbackResp, fallbackErr := h.tryFallbackProvider(fallbackID, modelName, req, stream)
+			attempts++
+			fallbackPCfg, fallbackKey, fallbackModelName, fallbackResp, fallbackLatency, fallbackErr := h.tryFallbackProvider(r, reqID, outcomes, fallbackID, modelName, req)
 			if fallbackErr == nil && fallbackResp != nil {
 				// Fallback success, use this response
 				pCfg = fallbackPCfg
 				key = fallbackKey
 				modelName = fallbackModelName
 				resp = fallbackResp
+				latency = fallbackLatency
 				err = nil
 				break
 			}
@@ -368,19 +429,113 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := outcomes.finish(provider.StatusForErrorClass(provider.ErrorClassUnavailable), provider.ErrorClassUnavailable)
+		writeAPIError(w, status, errorTypeForStatus(status), "", "", err.Error())
 		return
 	}
 
 	if resp == nil {
-		http.Error(w, "Provider returned nil response", http.StatusInternalServerError)
+		writeAPIError(w, outcomes.finish(http.StatusInternalServerError, provider.ErrorClassOther), errorTypeServer, "", "", "Provider returned nil response")
 		return
 	}
 
-	// Calculate cost (pricing is per 1 million tokens)
+	// Check JSON output against the requested format, asking the model once more to
+	// fix it when repair is enabled
+	var structuredStatus string
+	var structuredErr error
+	if structured != nil {
+		structuredStatus = structuredOutputValid
+		structuredErr = structured.validateResponse(resp)
+		// Responses with several choices are not repaired
+		if structuredErr != nil && cfg.Policy.StructuredOutput.Repair && len(resp.AllChoices()) == 1 {
+			attempts++
+			repairReq := &provider.LLMRequest{
+				Messages:       repairMessages(messages, resp.Text, structuredErr),
+				Model:          modelName,
+				MaxTokens:      maxTokens,
+				User:           req.User,
+				Params:         req.Params,
+				ResponseFormat: structured.format,
+				Sampling:       sampling,
+			}
+			repairResp, repairLatency, repairErr := h.repairStructuredOutput(r.Context(), outcomes, pCfg, key, repairReq)
+			latency += repairLatency
+			if repairErr == nil {
+				// The caller pays for both calls
+				resp = &provider.LLMResponse{
+					Text:              repairResp.Text,
+					InputTokens:       resp.InputTokens + repairResp.InputTokens,
+					CachedInputTokens: resp.CachedInputTokens + repairResp.CachedInputTokens,
+					OutputTokens:      resp.OutputTokens + repairResp.OutputTokens,
+					TokensUsed:        resp.TokensUsed + repairResp.TokensUsed,
+					FinishReason:      repairResp.FinishReason,
+					Choices:           repairResp.Choices,
+				}
+				if structuredErr = structured.validateResponse(resp); structuredErr == nil {
+					structuredStatus = structuredOutputRepaired
+				}
+			}
+		}
+		if structuredErr != nil {
+			structuredStatus = structuredOutputInvalid
+		}
+	}
+	outcomes.finish(http.StatusOK, "")
+
+	cost := h.recordRequest(r, reqID, model, pCfg, key, modelName, latency, resp.Usage(), nil)
+
+	openaiResp := newChatCompletion(reqID, model, systemFingerprint(pCfg.ID, modelName), time.Now().Unix(), resp)
+	if structuredErr != nil {
+		openaiResp.StructuredOutput = &StructuredOutputResult{Valid: false, Error: structuredErr.Error()}
+	}
+
+	// Cache response if enabled; output that failed validation isn't worth repeating
+	if cfg.Policy.Cache.Enabled && prompt != "" && structuredErr == nil {
+		respJSON, _ := json.Marshal(openaiResp)
+		if cfg.Policy.Cache.SemanticEnabled {
+			h.setSemanticCache(prompt, string(respJSON))
+		} else {
+			cacheKey := normalizeText(prompt)
+			h.selector.SetCache(cacheKey, string(respJSON), cfg.Policy.Cache.TTLSeconds)
+		}
+	}
+
+	routing := routingInfo{Provider: pCfg.ID, Model: modelName, KeyID: key.ID, Attempts: attempts, Cost: cost}
+	routing.setHeaders(w)
+	if structuredStatus != "" {
+		w.Header().Set(HeaderStructuredOutput, structuredStatus)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openaiResp)
+}
+
+// normalizeText creates cache key from text (lowercase, remove spaces)
+func normalizeText(text string) string {
+	// Simple normalization: lowercase, remove extra spaces
+	normalized := strings.ToLower(text)
+	normalized = strings.Join(strings.Fields(normalized), "")
+	return normalized
+}
+
+// updateKeyUsage adds the tokens and latency of a request to its key's usage counters
+func (h *ChatCompletionsHandler) updateKeyUsage(pCfg *config.Provider, key *config.Key, usage *provider.Usage, latency int64) {
+	h.selector.UpdateUsage(pCfg.ID, key.ID, "input_tokens", float64(usage.InputTokens))
+	h.selector.UpdateUsage(pCfg.ID, key.ID, "output_tokens", float64(usage.OutputTokens))
+	h.selector.UpdateUsage(pCfg.ID, key.ID, "tokens", float64(usage.TotalTokens))
+	h.selector.UpdateUsage(pCfg.ID, key.ID, "latency", float64(latency))
+}
+
+// recordRequest stores the latency, token and cost metrics of an answered request and
+// logs it. It returns the cost; a nil usage costs nothing.
+func (h *ChatCompletionsHandler) recordRequest(r *http.Request, reqID, model string, pCfg *config.Provider, key *config.Key, modelName string, latency int64, usage *provider.Usage, err error) float64 {
+	if usage == nil {
+		usage = &provider.Usage{}
+	}
+
+	// Calculate cost at the model's price
 	var cost float64
 	if key != nil {
-		cost = (float64(resp.InputTokens)*pCfg.Pricing.InputTokenCost + float64(resp.OutputTokens)*pCfg.Pricing.OutputTokenCost) / 1000000
+		cost = h.selector.Pricing(pCfg, modelName).Cost(usage.InputTokens, usage.CachedInputTokens, usage.OutputTokens)
 	}
 
 	// Get client API key from context
@@ -390,73 +545,35 @@ func (h *ChatCompletionsHandler) Handle(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Store metrics for historical data
-	providerName := pCfg.Name
-	if providerName == "" {
-		providerName = pCfg.ID
-	}
-	tags := map[string]string{"provider": providerName, "key": key.ID, "model": modelName, "client_key": clientKey}
+	tags := map[string]string{"provider": metricProviderTag(pCfg), "key": key.ID, "model": modelName, "client_key": clientKey, "request_id": reqID}
 	h.store.StoreMetric("latency", float64(latency), tags, time.Now().Unix())
-	h.store.StoreMetric("tokens", float64(resp.TokensUsed), tags, time.Now().Unix())
+	h.store.StoreMetric("tokens", float64(usage.TotalTokens), tags, time.Now().Unix())
 	h.store.StoreMetric("cost", cost, tags, time.Now().Unix())
 
 	// Log the request
-	reqID := fmt.Sprintf("%d", time.Now().UnixNano())
-	h.logger.LogRequest(r.Context(), &log.LogEntry{
+	entry := &log.LogEntry{
 		Provider:  pCfg.ID,
 		Model:     model,
 		ReqID:     reqID,
 		LatencyMS: latency,
 		Status:    200,
-		Tokens:    resp.TokensUsed,
+		Tokens:    usage.TotalTokens,
 		Cost:      cost,
-		Error:     "",
-	})
-
-	// Prepare response
-	openaiResp := map[string]any{
-		"id":      reqID,
-		"object":  "chat.completion",
-		"created": time.Now().Unix(),
-		"model":   model,
-		"choices": []map[string]any{
-			{
-				"index": 0,
-				"message": map[string]string{
-					"role":    "assistant",
-					"content": resp.Text,
-				},
-				"finish_reason": resp.FinishReason,
-			},
-		},
-		"usage": map[string]any{
-			"prompt_tokens":     resp.InputTokens,
-			"completion_tokens": resp.OutputTokens,
-			"total_tokens":      resp.TokensUsed,
-			"cost":              cost,
-		},
-	}
-
-	// Cache response if enabled
-	if h.cfg.Policy.Cache.Enabled && prompt != "" {
-		respJSON, _ := json.Marshal(openaiResp)
-		if h.cfg.Policy.Cache.SemanticEnabled {
-			h.setSemanticCache(prompt, string(respJSON))
-		} else {
-			cacheKey := normalizeText(prompt)
-			h.selector.SetCache(cacheKey, string(respJSON), h.cfg.Policy.Cache.TTLSeconds)
-		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(openaiResp)
+	if err != nil {
+		entry.Status = statusForError(err)
+		entry.Error = err.Error()
+	}
+	h.logger.LogRequest(r.Context(), entry)
+	return cost
 }
 
-// normalizeText creates cache key from text (lowercase, remove spaces)
-func normalizeText(text string) string {
-	// Simple normalization: lowercase, remove extra spaces
-	normalized := strings.ToLower(text)
-	normalized = strings.Join(strings.Fields(normalized), "")
-	return normalized
+// estimateUsage counts the tokens of a streamed request locally, for providers that
+// don't report usage for streams
+func estimateUsage(providerType, modelName string, messages []map[string]any, tools []any, text string) *provider.Usage {
+	input := tokenizer.CountMessages(providerType, modelName, messages, tools).Tokens
+	output := tokenizer.CountText(providerType, modelName, text).Tokens
+	return &provider.Usage{InputTokens: input, OutputTokens: output, TotalTokens: input + output}
 }
 
 // checkSemanticCache checks for semantically similar cached responses
@@ -470,19 +587,21 @@ func (h *ChatCompletionsHandler) checkSemanticCache(prompt string) (bool, string
 
 // setSemanticCache stores response with semantic embedding
 func (h *ChatCompletionsHandler) setSemanticCache(prompt, response string) {
+	cfg := h.selector.Config()
 	// TODO: Generate embedding and store with similarity search capability
 	// For now, fall back to exact match
 	cacheKey := normalizeText(prompt)
-	h.selector.SetCache(cacheKey, response, h.cfg.Policy.Cache.TTLSeconds)
+	h.selector.SetCache(cacheKey, response, cfg.Policy.Cache.TTLSeconds)
 }
 
 // GetProviderFromModel determines the provider ID from a model name
 func (h *ChatCompletionsHandler) GetProviderFromModel(model string) string {
+	cfg := h.selector.Config()
 	// 1. Check if model is in provider:model format
 	if colonIndex := strings.Index(model, ":"); colonIndex != -1 {
 		providerID := model[:colonIndex]
 		// Check if provider ID exists
-		for _, provider := range h.cfg.LLMProviders {
+		for _, provider := range cfg.LLMProviders {
 			if provider.ID == providerID {
 				return provider.ID
 			}
@@ -490,13 +609,13 @@ func (h *ChatCompletionsHandler) GetProviderFromModel(model string) string {
 	}
 
 	// 2. Check model aliases
-	if alias, exists := h.cfg.ModelAliases[model]; exists {
+	if alias, exists := cfg.ModelAliases[model]; exists {
 		// Parse provider from alias (format: "provider:model")
 		if colonIndex := strings.Index(alias, ":"); colonIndex != -1 {
 			providerTypeOrID := alias[:colonIndex]
 
 			// Check if it's already a provider ID (from llm_providers)
-			for _, provider := range h.cfg.LLMProviders {
+			for _, provider := range cfg.LLMProviders {
 				if provider.ID == providerTypeOrID {
 					return provider.ID
 				}
@@ -504,7 +623,7 @@ func (h *ChatCompletionsHandler) GetProviderFromModel(model string) string {
 
 			// If not found as ID, it might be a legacy type name
 			// Try to find provider with matching type
-			for _, provider := range h.cfg.LLMProviders {
+			for _, provider := range cfg.LLMProviders {
 				if provider.Type == providerTypeOrID {
 					return provider.ID
 				}
@@ -514,21 +633,21 @@ func (h *ChatCompletionsHandler) GetProviderFromModel(model string) string {
 
 	// 3. Fallback: try to infer from model name and find matching provider
 	if strings.Contains(model, "gpt") || strings.Contains(model, "openai") {
-		for _, provider := range h.cfg.LLMProviders {
+		for _, provider := range cfg.LLMProviders {
 			if provider.Type == "openai" {
 				return provider.ID
 			}
 		}
 	}
 	if strings.Contains(model, "gemini") {
-		for _, provider := range h.cfg.LLMProviders {
+		for _, provider := range cfg.LLMProviders {
 			if provider.Type == "gemini" {
 				return provider.ID
 			}
 		}
 	}
 	if strings.Contains(model, "claude") {
-		for _, provider := range h.cfg.LLMProviders {
+		for _, provider := range cfg.LLMProviders {
 			if provider.Type == "claude" {
 				return provider.ID
 			}
@@ -540,7 +659,8 @@ func (h *ChatCompletionsHandler) GetProviderFromModel(model string) string {
 
 // getFallbackProviders returns list of fallback provider IDs to try
 func (h *ChatCompletionsHandler) getFallbackProviders(primaryID, modelName string) []string {
-	fallbackCfg := h.cfg.Policy.Fallback
+	cfg := h.selector.Config()
+	fallbackCfg := cfg.Policy.Fallback
 
 	// If specific fallback providers configured, use them
 	if len(fallbackCfg.Providers) > 0 {
@@ -550,7 +670,7 @@ func (h *ChatCompletionsHandler) getFallbackProviders(primaryID, modelName strin
 
 	// Otherwise, try to find providers that might support similar models
 	var candidates []string
-	for _, lp := range h.cfg.LLMProviders {
+	for _, lp := range cfg.LLMProviders {
 		if lp.ID != primaryID {
 			// Simple heuristic: prefer providers with similar model names or OpenAI-compatible ones
 			if strings.Contains(lp.Model, modelName) ||
@@ -570,78 +690,106 @@ func (h *ChatCompletionsHandler) getFallbackProviders(primaryID, modelName strin
 }
 
 // tryFallbackProvider attempts to use a fallback provider and returns the response
-func (h *ChatCompletionsHandler) tryFallbackProvider(providerID, modelName string, req map[string]any, stream bool) (*config.Provider, *config.Key, string, *provider.LLMResponse, error) {
+func (h *ChatCompletionsHandler) tryFallbackProvider(r *http.Request, reqID string, outcomes *outcomeRecorder, providerID, modelName string, req *ChatCompletionRequest) (*config.Provider, *config.Key, string, *provider.LLMResponse, int64, error) {
+	cfg := h.selector.Config()
+	stream := req.Stream
 	// Select fallback provider
 	pCfg, key, resolvedModelName, err := h.selector.SelectBest(providerID + ":" + modelName)
 	if err != nil {
-		return nil, nil, "", nil, err
+		return nil, nil, "", nil, 0, err
+	}
+
+	// A fallback model must support the features the request uses
+	if spec, ok := h.selector.ModelSpec(pCfg, resolvedModelName); ok {
+		if err := checkCapabilities(pCfg.ProviderType(), spec, req.Params, stream); err != nil {
+			return nil, nil, "", nil, 0, err
+		}
+	}
+	if _, err := provider.CheckSampling(pCfg.ProviderType(), req.Sampling); err != nil {
+		return nil, nil, "", nil, 0, err
 	}
 
 	// Get provider instance
 	prov, err := h.reg.Get(pCfg.ID)
 	if err != nil {
-		return nil, nil, "", nil, err
+		return nil, nil, "", nil, 0, err
 	}
 
 	// Prepare request
-	maxTokens := 1000
-	if mt, ok := req["max_tokens"].(float64); ok {
-		maxTokens = int(mt)
-	}
-
-	user := ""
-	if u, ok := req["user"].(string); ok {
-		user = u
+	maxTokens := req.maxTokens()
+	if limit := h.selector.MaxOutputTokens(pCfg, resolvedModelName); limit > 0 && maxTokens > limit {
+		maxTokens = limit
 	}
 
 	providerReq := &provider.LLMRequest{
-		Prompt:    "", // Will be set from messages
-		Messages:  nil,
-		Model:     resolvedModelName,
-		MaxTokens: maxTokens,
-		Stream:    stream,
-		User:      user,
+		Messages:       req.messages(),
+		Model:          resolvedModelName,
+		MaxTokens:      maxTokens,
+		Stream:         stream,
+		User:           req.User,
+		ResponseFormat: req.ResponseFormat,
+		Sampling:       req.Sampling,
+	}
+
+	// A fallback model must fit the request in its context window
+	if spec, ok := h.selector.ModelSpec(pCfg, resolvedModelName); ok && spec.ContextWindow > 0 {
+		tools, _ := req.Params["tools"].([]any)
+		promptTokens := tokenizer.CountMessages(pCfg.ProviderType(), resolvedModelName, providerReq.Messages, tools).Tokens
+		if promptTokens+maxTokens > spec.ContextWindow {
+			return nil, nil, "", nil, 0, &balancer.ContextLengthError{Model: resolvedModelName, ContextWindow: spec.ContextWindow, PromptTokens: promptTokens, MaxTokens: maxTokens}
+		}
 	}
 
-	// Convert messages
-	if msgs, ok := req["messages"].([]any); ok {
-		providerReq.Messages = make([]map[string]any, len(msgs))
-		for i, msg := range msgs {
-			if msgMap, ok := msg.(map[string]any); ok {
-				providerReq.Messages[i] = msgMap
-			}
-		}
+	// Update req usage immediately to avoid spam on this key
+	if key != nil {
+		h.selector.UpdateUsage(pCfg.ID, key.ID, "req", float64(provider.Calls(pCfg.ProviderType(), req.Sampling)))
 	}
 
 	// Try the request
-	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Policy.Retry.Timeout)
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Policy.Retry.Timeout)
 	defer cancel()
 
+	start := time.Now()
 	var resp *provider.LLMResponse
 	if stream {
 		// For fallback, we don't handle streaming yet - just test if provider works
 		_, err = prov.GenerateStream(ctx, providerReq)
 	} else {
-		resp, err = prov.Generate(ctx, providerReq)
+		resp, err = provider.GenerateChoices(ctx, prov, pCfg.ProviderType(), providerReq)
 	}
+	latency := time.Since(start).Milliseconds()
+	outcomes.attempt(pCfg, key, resolvedModelName, true, latency, err)
 
 	if err != nil {
-		// Update error usage for fallback provider
+		// Update error usage for fallback provider, with the usage of choices generated
+		// before one failed
 		if key != nil {
 			h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
+			if resp != nil {
+				h.updateKeyUsage(pCfg, key, resp.Usage(), latency)
+				h.recordRequest(r, reqID, req.Model, pCfg, key, resolvedModelName, latency, resp.Usage(), err)
+			}
 		}
-		return nil, nil, "", nil, err
+		return nil, nil, "", nil, latency, err
 	}
 
-	return pCfg, key, resolvedModelName, resp, nil
+	return pCfg, key, resolvedModelName, resp, latency, nil
 }
 
-func SetupRoutes(r chi.Router, selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, cfg *config.Config, store store.RuntimeStore) {
-	handler := NewChatCompletionsHandler(selector, logger, reg, cfg, store)
-	r.With(AuthMiddleware(cfg.APIKeys)).Post("/v1/chat/completions", handler.Handle)
+// SetupRoutes registers the OpenAI-compatible routes. Client API keys, aliases and
+// policy are read from the selector's config in effect on every request.
+func SetupRoutes(r chi.Router, selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, store store.RuntimeStore) {
+	auth := AuthMiddlewareFunc(func() []config.APIKeyConfig { return selector.Config().APIKeys })
+
+	handler := NewChatCompletionsHandler(selector, logger, reg, store)
+	r.With(auth).Post("/v1/chat/completions", handler.Handle)
+
+	embeddingsHandler := NewEmbeddingsHandler(selector, logger, reg, store)
+	r.With(auth).Post("/v1/embeddings", embeddingsHandler.Handle)
 
-	embeddingsHandler := NewEmbeddingsHandler(selector, logger, reg, cfg, store)
-	r.With(AuthMiddleware(cfg.APIKeys)).Post("/v1/embeddings", embeddingsHandler.Handle)
+	tokenizeHandler := NewTokenizeHandler(selector, reg, logger)
+	r.With(auth).Post("/v1/tokenize", tokenizeHandler.Handle)
+	r.With(auth).Post("/v1/messages/count_tokens", tokenizeHandler.HandleCountTokens)
 
-	SetupModelsRoute(r, cfg)
+	setupLiveModelsRoute(r, selector, reg, auth)
 }
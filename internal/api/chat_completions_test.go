@@ -1,10 +1,14 @@
 package api
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/balancer"
 	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
 )
 
 func TestGetProviderFromModel(t *testing.T) {
@@ -21,7 +25,7 @@ func TestGetProviderFromModel(t *testing.T) {
 		},
 	}
 
-	handler := &ChatCompletionsHandler{cfg: cfg}
+	handler := &ChatCompletionsHandler{selector: balancer.NewSelector(cfg, nil, nil)}
 
 	// Test 1: Direct provider:model syntax
 	assert.Equal(t, "openai", handler.GetProviderFromModel("openai:gpt-4o"))
@@ -39,3 +43,54 @@ func TestGetProviderFromModel(t *testing.T) {
 	// Test 4: No match
 	assert.Equal(t, "", handler.GetProviderFromModel("unknown-model"))
 }
+
+func TestDecodeChatRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantParam string
+		wantCode  string
+	}{
+		{name: "string content", body: `{"model": "m", "messages": [{"role": "user", "content": "Hi"}]}`},
+		{name: "image part", body: `{"model": "m", "messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]}]}`},
+		{name: "assistant tool call without content", body: `{"model": "m", "messages": [{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "f", "arguments": "{}"}}]}]}`},
+		{name: "missing model", body: `{"messages": [{"role": "user", "content": "Hi"}]}`,
+			wantParam: "model", wantCode: "missing_required_parameter"},
+		{name: "empty messages", body: `{"model": "m", "messages": []}`,
+			wantParam: "messages", wantCode: "empty_array"},
+		{name: "messages not an array", body: `{"model": "m", "messages": "Hi"}`,
+			wantParam: "messages", wantCode: "invalid_type"},
+		{name: "object content", body: `{"model": "m", "messages": [{"role": "user", "content": {"text": "Hi"}}]}`,
+			wantParam: "messages.[0].content", wantCode: "invalid_type"},
+		{name: "missing content", body: `{"model": "m", "messages": [{"role": "user"}]}`,
+			wantParam: "messages.[0].content", wantCode: "missing_required_parameter"},
+		{name: "image part in a system message", body: `{"model": "m", "messages": [{"role": "system", "content": [{"type": "image_url", "image_url": {"url": "u"}}]}]}`,
+			wantParam: "messages.[0].content.[0].type", wantCode: "invalid_value"},
+		{name: "text part without text", body: `{"model": "m", "messages": [{"role": "user", "content": [{"type": "text"}]}]}`,
+			wantParam: "messages.[0].content.[0].text", wantCode: "missing_required_parameter"},
+		{name: "non-string text", body: `{"model": "m", "messages": [{"role": "user", "content": [{"type": "text", "text": 1}]}]}`,
+			wantParam: "messages.[0].content.[0].text", wantCode: "invalid_type"},
+		{name: "decimal max_tokens", body: `{"model": "m", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 1.5}`,
+			wantParam: "max_tokens", wantCode: "invalid_type"},
+		{name: "tool without a name", body: `{"model": "m", "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "function", "function": {}}]}`,
+			wantParam: "tools.[0].function.name", wantCode: "missing_required_parameter"},
+		{name: "invalid response_format", body: `{"model": "m", "messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "xml"}}`,
+			wantParam: "response_format", wantCode: "invalid_value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := decodeChatRequest(strings.NewReader(tt.body))
+			if tt.wantParam == "" {
+				require.NoError(t, err)
+				assert.Equal(t, "m", req.Model)
+				assert.Len(t, req.messages(), len(req.Messages))
+				return
+			}
+			var paramErr *provider.ParamError
+			require.ErrorAs(t, err, &paramErr)
+			assert.Equal(t, tt.wantParam, paramErr.Param)
+			assert.Equal(t, tt.wantCode, paramErr.Code)
+			assert.Contains(t, paramErr.Message, tt.wantParam)
+		})
+	}
+}
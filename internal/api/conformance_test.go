@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/log"
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// conformanceFixture is a request an OpenAI SDK sent and the response OpenAI's API
+// returned to it, recorded from real traffic
+type conformanceFixture struct {
+	Description string `json:"description"`
+	SDK         string `json:"sdk"`
+	Request     struct {
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"` // A string is sent as is
+	} `json:"request"`
+	Response struct {
+		Status      int               `json:"status"`
+		ContentType string            `json:"content_type"`
+		Body        any               `json:"body"`
+		Events      []json.RawMessage `json:"events"` // Server-sent events of a stream
+	} `json:"response"`
+	Optional []string `json:"optional"` // Fields of the recording the gateway may leave out
+}
+
+// mockProviderStreaming streams its reply in chunks, like vendors with native streaming
+type mockProviderStreaming struct {
+	mockProvider
+}
+
+func (m *mockProviderStreaming) GenerateStream(ctx context.Context, req *provider.LLMRequest) (<-chan *provider.LLMStreamResponse, error) {
+	streamChan := make(chan *provider.LLMStreamResponse, 4)
+	go func() {
+		defer close(streamChan)
+		streamChan <- &provider.LLMStreamResponse{Text: "Hello"}
+		streamChan <- &provider.LLMStreamResponse{Text: " back", FinishReason: "stop"}
+		streamChan <- &provider.LLMStreamResponse{Done: true}
+	}()
+	return streamChan, nil
+}
+
+func newConformanceRouter() http.Handler {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}}},
+		APIKeys:      []config.APIKeyConfig{{ID: "test-client", Key: "test-key", AllowedProviders: []string{"*"}}},
+		ModelAliases: map[string]string{"gpt-4o-mini": "openai-prod:gpt-4o-mini"},
+		Policy:       config.Policy{Strategy: "round_robin"},
+	}
+	reg := provider.NewRegistry()
+	reg.Register(&mockProviderStreaming{})
+	logger := log.NewLogger(&config.Logging{})
+	runtimeStore := &mockStore{}
+	r := chi.NewRouter()
+	SetupRoutes(r, balancer.NewSelector(cfg, runtimeStore, logger), logger, reg, runtimeStore)
+	return r
+}
+
+// jsonKind names the JSON type of a decoded value
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+// assertSameShape checks that got has the fields of the recorded value with the same
+// JSON types, and no others. Values may differ; array elements are checked against
+// the recorded element at the same index, or the last one.
+func assertSameShape(t *testing.T, path string, recorded, got any, optional []string) {
+	t.Helper()
+	if jsonKind(recorded) != jsonKind(got) {
+		t.Errorf("%s: got %s, OpenAI returns %s", path, jsonKind(got), jsonKind(recorded))
+		return
+	}
+	switch recorded := recorded.(type) {
+	case map[string]any:
+		got := got.(map[string]any)
+		for field := range got {
+			if _, ok := recorded[field]; !ok {
+				t.Errorf("%s: field %q is not in OpenAI's response", path, joinPath(path, field))
+			}
+		}
+		for field, value := range recorded {
+			fieldPath := joinPath(path, field)
+			if _, ok := got[field]; !ok {
+				if !slices.Contains(optional, fieldPath) {
+					t.Errorf("%s: missing field %q", path, fieldPath)
+				}
+				continue
+			}
+			assertSameShape(t, fieldPath, value, got[field], optional)
+		}
+	case []any:
+		got := got.([]any)
+		if len(recorded) == 0 {
+			return
+		}
+		for i, value := range got {
+			assertSameShape(t, path, recorded[min(i, len(recorded)-1)], value, optional)
+		}
+	}
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// readEvents returns the data of the server-sent events of a stream
+func readEvents(t *testing.T, body []byte) []string {
+	t.Helper()
+	var events []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+// TestOpenAIConformance replays requests recorded from OpenAI's SDKs and checks that
+// the gateway answers with the status, content type and body shape OpenAI did
+func TestOpenAIConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "openai", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	router := newConformanceRouter()
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			var fx conformanceFixture
+			require.NoError(t, json.Unmarshal(data, &fx))
+
+			body := []byte(fx.Request.Body)
+			var raw string
+			if json.Unmarshal(body, &raw) == nil {
+				body = []byte(raw)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+			for name, value := range fx.Request.Headers {
+				req.Header.Set(name, value)
+			}
+			req.Header.Set("Authorization", "Bearer test-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, fx.Response.Status, w.Code, "%s (%s): %s", fx.Description, fx.SDK, w.Body.String())
+			mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			require.NoError(t, err)
+			assert.Equal(t, fx.Response.ContentType, mediaType)
+
+			if fx.Response.Events == nil {
+				var got any
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+				assertSameShape(t, "", fx.Response.Body, got, fx.Optional)
+				if recorded, ok := fx.Response.Body.(map[string]any)["error"].(map[string]any); ok {
+					apiErr := got.(map[string]any)["error"].(map[string]any)
+					assert.Equal(t, recorded["type"], apiErr["type"])
+					assert.Equal(t, recorded["param"], apiErr["param"])
+					assert.Equal(t, recorded["code"], apiErr["code"])
+				}
+				return
+			}
+
+			// Streams match chunk by chunk: the role chunk, content chunks and the last chunk
+			recorded, events := fx.Response.Events, readEvents(t, w.Body.Bytes())
+			require.GreaterOrEqual(t, len(events), 3)
+			assert.Equal(t, "[DONE]", events[len(events)-1])
+			for i, event := range events[:len(events)-1] {
+				want := recorded[min(i, len(recorded)-3)]
+				if i == len(events)-2 {
+					want = recorded[len(recorded)-2]
+				}
+				var recordedChunk, got any
+				require.NoError(t, json.Unmarshal(want, &recordedChunk))
+				require.NoError(t, json.Unmarshal([]byte(event), &got), event)
+				assertSameShape(t, "", recordedChunk, got, fx.Optional)
+			}
+		})
+	}
+}
+
+// TestOpenAIConformance_GoClient checks that go-openai parses the gateway's responses,
+// including its errors
+func TestOpenAIConformance_GoClient(t *testing.T) {
+	server := httptest.NewServer(newConformanceRouter())
+	defer server.Close()
+	clientCfg := openai.DefaultConfig("test-key")
+	clientCfg.BaseURL = server.URL + "/v1"
+	client := openai.NewClientWithConfig(clientCfg)
+	ctx := context.Background()
+
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hello"}}
+	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{Model: "gpt-4o-mini", Messages: messages})
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "Hello back", resp.Choices[0].Message.Content)
+	assert.Equal(t, openai.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, 10, resp.Usage.TotalTokens)
+	assert.True(t, strings.HasPrefix(resp.SystemFingerprint, "fp_"))
+
+	stream, err := client.CreateChatCompletionStream(ctx, openai.ChatCompletionRequest{Model: "gpt-4o-mini", Messages: messages, Stream: true})
+	require.NoError(t, err)
+	defer stream.Close()
+	var text strings.Builder
+	var reason openai.FinishReason
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		if chunk.Choices[0].FinishReason != "" {
+			reason = chunk.Choices[0].FinishReason
+		}
+	}
+	assert.Equal(t, "Hello back", text.String())
+	assert.Equal(t, openai.FinishReasonStop, reason)
+
+	_, err = client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:    "gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessage{{Role: "robot", Content: "Hello"}},
+	})
+	var apiErr *openai.APIError
+	require.True(t, errors.As(err, &apiErr), err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.HTTPStatusCode)
+	assert.Equal(t, "invalid_request_error", apiErr.Type)
+	assert.Equal(t, "invalid_value", apiErr.Code)
+	require.NotNil(t, apiErr.Param)
+	assert.Equal(t, "messages.[0].role", *apiErr.Param)
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/user/coo-llm/internal/balancer"
-	"github.com/user/coo-llm/internal/config"
 	"github.com/user/coo-llm/internal/log"
 	"github.com/user/coo-llm/internal/provider"
 	"github.com/user/coo-llm/internal/store"
@@ -17,7 +16,6 @@ type EmbeddingsHandler struct {
 	selector *balancer.Selector
 	logger   *log.Logger
 	reg      *provider.Registry
-	cfg      *config.Config
 	store    store.RuntimeStore
 }
 
@@ -47,33 +45,36 @@ type Usage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
-func NewEmbeddingsHandler(selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, cfg *config.Config, store store.RuntimeStore) *EmbeddingsHandler {
+func NewEmbeddingsHandler(selector *balancer.Selector, logger *log.Logger, reg *provider.Registry, store store.RuntimeStore) *EmbeddingsHandler {
 	return &EmbeddingsHandler{
 		selector: selector,
 		logger:   logger,
 		reg:      reg,
-		cfg:      cfg,
 		store:    store,
 	}
 }
 
 func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	r, reqID := requestID(r)
+	w.Header().Set(log.RequestIDHeader, reqID)
+	outcomes := newOutcomeRecorder(h.store, h.selector.Health(), r, "embeddings", reqID, "")
 
 	// Parse request
 	var req EmbeddingsRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		writeInvalidRequest(w, fmt.Sprintf("Invalid JSON: %v", err), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
 		return
 	}
+	outcomes.model = req.Model
 
 	// Validate request
 	if req.Model == "" {
-		http.Error(w, "model is required", http.StatusBadRequest)
+		writeParamError(w, missingParam("model"), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
 		return
 	}
 	if req.Input == nil {
-		http.Error(w, "input is required", http.StatusBadRequest)
+		writeParamError(w, missingParam("input"), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
 		return
 	}
 
@@ -84,7 +85,7 @@ func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	pCfg, key, modelName, err := h.selector.SelectBest(req.Model)
 	if err != nil {
 		// TODO: Fix logger - h.logger.GetLogger().Error().Err(err).Str("model", req.Model).Msg("Failed to select provider")
-		http.Error(w, "No provider available for model", http.StatusServiceUnavailable)
+		writeAPIError(w, outcomes.finish(http.StatusServiceUnavailable, provider.ErrorClassUnavailable), errorTypeServer, "", "", "No provider available for model")
 		return
 	}
 
@@ -102,20 +103,27 @@ func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	case []string:
 		inputs = v
 	default:
-		http.Error(w, "input must be string or array of strings", http.StatusBadRequest)
+		writeAPIError(w, outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest), errorTypeInvalidRequest, errorCodeInvalidType, "input", "input must be string or array of strings")
 		return
 	}
 
 	if len(inputs) == 0 {
-		http.Error(w, "input cannot be empty", http.StatusBadRequest)
+		writeAPIError(w, outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest), errorTypeInvalidRequest, errorCodeEmptyArray, "input", "input cannot be empty")
 		return
 	}
 
+	if spec, ok := h.selector.ModelSpec(pCfg, modelName); ok {
+		if err := checkEmbeddingDims(spec, req.Dimensions); err != nil {
+			writeInvalidRequest(w, err.Error(), outcomes.finish(http.StatusBadRequest, provider.ErrorClassInvalidRequest))
+			return
+		}
+	}
+
 	// Get provider
 	prov, err := h.reg.Get(pCfg.ID)
 	if err != nil {
 		// TODO: Fix logger - Provider not found: %s, pCfg.ID
-		http.Error(w, "Provider not available", http.StatusServiceUnavailable)
+		writeAPIError(w, outcomes.finish(http.StatusServiceUnavailable, provider.ErrorClassUnavailable), errorTypeServer, "", "", "Provider not available")
 		return
 	}
 
@@ -131,7 +139,13 @@ func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make request
+	attemptStart := time.Now()
 	resp, err := prov.CreateEmbeddings(r.Context(), providerReq)
+	if err == nil && resp == nil {
+		err = fmt.Errorf("provider returned nil response")
+	}
+	outcomes.attempt(pCfg, key, modelName, false, time.Since(attemptStart).Milliseconds(), err)
+	status := outcomes.finish(http.StatusOK, "")
 	if err != nil {
 		// TODO: Fix logger - Embeddings request failed: %v for provider %s, err, pCfg.ID
 
@@ -140,7 +154,7 @@ func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 			h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
 		}
 
-		http.Error(w, fmt.Sprintf("Provider error: %v", err), http.StatusInternalServerError)
+		writeAPIError(w, status, errorTypeForStatus(status), "", "", fmt.Sprintf("Provider error: %v", err))
 		return
 	}
 
@@ -173,6 +187,12 @@ func (h *EmbeddingsHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return response
+	cost := h.selector.Pricing(pCfg, modelName).Cost(resp.Usage.PromptTokens, 0, 0)
+	routing := routingInfo{Provider: pCfg.ID, Model: modelName, Attempts: 1, Cost: cost}
+	if key != nil {
+		routing.KeyID = key.ID
+	}
+	routing.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(openaiResp)
 
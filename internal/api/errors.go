@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// OpenAI error types
+const (
+	errorTypeInvalidRequest = "invalid_request_error"
+	errorTypeAuthentication = "authentication_error"
+	errorTypePermission     = "permission_error"
+	errorTypeRateLimit      = "rate_limit_error"
+	errorTypeServer         = "server_error"
+)
+
+// OpenAI error codes not shared with provider.ParamError
+const (
+	errorCodeMissingParam          = "missing_required_parameter"
+	errorCodeInvalidType           = "invalid_type"
+	errorCodeEmptyArray            = "empty_array"
+	errorCodeBelowMinimum          = "integer_below_min_value"
+	errorCodeContextLengthExceeded = "context_length_exceeded"
+	errorCodeModelNotFound         = "model_not_found"
+	errorCodeInvalidAPIKey         = "invalid_api_key"
+)
+
+// APIError is the error object of OpenAI's API. Param and Code are null when they
+// don't apply.
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// errorResponse is the body of an error response
+type errorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// nullable returns nil for an empty string, which is encoded as null
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// writeAPIError writes an error response in OpenAI's format
+func writeAPIError(w http.ResponseWriter, status int, errType, code, param, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: APIError{
+		Message: message,
+		Type:    errType,
+		Param:   nullable(param),
+		Code:    nullable(code),
+	}})
+}
+
+// errorTypeForStatus returns the OpenAI error type of a failed request's status
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return errorTypeAuthentication
+	case status == http.StatusForbidden:
+		return errorTypePermission
+	case status == http.StatusTooManyRequests:
+		return errorTypeRateLimit
+	case status >= 500:
+		return errorTypeServer
+	}
+	return errorTypeInvalidRequest
+}
+
+// writeInvalidRequest writes an OpenAI-style invalid_request_error
+func writeInvalidRequest(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, status, errorTypeInvalidRequest, "", "", message)
+}
+
+// writeContextLengthExceeded writes OpenAI's error for a request too large for the
+// model's context window
+func writeContextLengthExceeded(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, status, errorTypeInvalidRequest, errorCodeContextLengthExceeded, "messages", message)
+}
+
+// writeParamError writes an OpenAI-style error naming the request parameter at fault
+func writeParamError(w http.ResponseWriter, err error, status int) {
+	var paramErr *provider.ParamError
+	if !errors.As(err, &paramErr) {
+		writeInvalidRequest(w, err.Error(), status)
+		return
+	}
+	writeAPIError(w, status, errorTypeInvalidRequest, paramErr.Code, paramErr.Param, paramErr.Message)
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// storePingTimeout bounds the store check of /readyz and the status endpoint
+const storePingTimeout = 2 * time.Second
+
+// HealthOptions describes the running build for the status endpoint
+type HealthOptions struct {
+	BuildVersion  string
+	ConfigVersion func() string    // Version of the shared config in effect, "" if unknown
+	Prober        *balancer.Prober // Runs on-demand probes; nil disables the probe endpoint
+}
+
+// HealthHandler serves liveness, readiness and dependency status
+type HealthHandler struct {
+	selector *balancer.Selector
+	store    store.RuntimeStore
+	reg      *provider.Registry
+	opts     HealthOptions
+	draining atomic.Bool
+}
+
+func NewHealthHandler(selector *balancer.Selector, store store.RuntimeStore, reg *provider.Registry, opts HealthOptions) *HealthHandler {
+	return &HealthHandler{selector: selector, store: store, reg: reg, opts: opts}
+}
+
+// SetDraining marks the instance as shutting down, so /readyz reports it unready
+// while in-flight requests finish
+func (h *HealthHandler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Draining reports whether SetDraining was called
+func (h *HealthHandler) Draining() bool {
+	return h.draining.Load()
+}
+
+// ProviderStatus is one provider's entry in the status report
+type ProviderStatus struct {
+	balancer.ProviderHealth
+	Type       string `json:"type,omitempty"`
+	Registered bool   `json:"registered"`
+	Keys       int    `json:"keys"`
+	Usable     bool   `json:"usable"`
+
+	KeyHealth []balancer.KeyHealth `json:"key_health,omitempty"` // Last probe result of each probed key
+}
+
+// StoreStatus is the runtime store's entry in the status report
+type StoreStatus struct {
+	Type      string  `json:"type"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// providerStatuses reports every configured provider, with the health of each probed
+// key if withKeys is set. A provider is usable when it is registered, has a key and
+// its circuit is not open.
+func (h *HealthHandler) providerStatuses(withKeys bool) []ProviderStatus {
+	cfg := h.selector.Config()
+	var statuses []ProviderStatus
+	add := func(id, typ string, keys int) {
+		status := ProviderStatus{ProviderHealth: h.selector.Health().Get(id), Type: typ, Keys: keys}
+		if h.reg != nil {
+			_, err := h.reg.Get(id)
+			status.Registered = err == nil
+		}
+		status.Usable = status.Registered && keys > 0 && status.Circuit != balancer.CircuitOpen
+		statuses = append(statuses, status)
+	}
+	for _, lp := range cfg.LLMProviders {
+		add(lp.ID, lp.Type, len(lp.APIKeys))
+	}
+	// Legacy providers are only loaded when there are no llm_providers
+	if len(cfg.LLMProviders) == 0 {
+		for _, p := range cfg.Providers {
+			add(p.ID, "", len(p.Keys))
+		}
+	}
+	if withKeys {
+		for i := range statuses {
+			statuses[i].KeyHealth = h.selector.ProbedKeys(statuses[i].Provider)
+		}
+	}
+	return statuses
+}
+
+// storeStatus pings the runtime store
+func (h *HealthHandler) storeStatus(ctx context.Context) StoreStatus {
+	status := StoreStatus{Type: h.selector.Config().Storage.Runtime.Type}
+	if h.store == nil {
+		status.Error = "no runtime store"
+		return status
+	}
+	ctx, cancel := context.WithTimeout(ctx, storePingTimeout)
+	defer cancel()
+	latency, err := store.Ping(ctx, h.store)
+	status.LatencyMS = float64(latency.Microseconds()) / 1000
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Healthz reports that the process is up and serving
+func (h *HealthHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the instance should receive traffic: it is not shutting
+// down, the runtime store answers and at least one provider is usable
+func (h *HealthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		writeHealthJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "draining"})
+		return
+	}
+
+	checks := map[string]string{"store": "ok", "providers": "ok"}
+	ready := true
+	if status := h.storeStatus(r.Context()); status.Error != "" {
+		checks["store"] = status.Error
+		ready = false
+	}
+	usable := 0
+	for _, p := range h.providerStatuses(false) {
+		if p.Usable {
+			usable++
+		}
+	}
+	if usable == 0 {
+		checks["providers"] = "no usable provider"
+		ready = false
+	}
+
+	if !ready {
+		writeHealthJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "unready", "checks": checks})
+		return
+	}
+	writeHealthJSON(w, http.StatusOK, map[string]any{"status": "ready", "checks": checks})
+}
+
+// Status reports the build, config version, store latency and provider health
+func (h *HealthHandler) Status(w http.ResponseWriter, r *http.Request) {
+	configVersion := ""
+	if h.opts.ConfigVersion != nil {
+		configVersion = h.opts.ConfigVersion()
+	}
+	writeHealthJSON(w, http.StatusOK, map[string]any{
+		"version":        h.opts.BuildVersion,
+		"config_version": configVersion,
+		"draining":       h.Draining(),
+		"store":          h.storeStatus(r.Context()),
+		"providers":      h.providerStatuses(true),
+	})
+}
+
+// Probe probes every key, or the keys of the provider given by ?provider=, and
+// returns their new status
+func (h *HealthHandler) Probe(w http.ResponseWriter, r *http.Request) {
+	if h.opts.Prober == nil {
+		http.Error(w, `{"error": "health checks not available"}`, http.StatusNotImplemented)
+		return
+	}
+	results := h.opts.Prober.Probe(r.Context(), r.URL.Query().Get("provider"))
+	if len(results) == 0 && r.URL.Query().Get("provider") != "" {
+		http.Error(w, `{"error": "provider not found or has no keys"}`, http.StatusNotFound)
+		return
+	}
+	writeHealthJSON(w, http.StatusOK, map[string]any{"keys": results})
+}
+
+func writeHealthJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// SetupHealthRoutes serves the probe endpoints outside /api, without authentication
+func SetupHealthRoutes(r chi.Router, h *HealthHandler) {
+	r.Get("/healthz", h.Healthz)
+	r.Get("/readyz", h.Readyz)
+}
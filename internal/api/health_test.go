@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+func newHealthTestHandler(t *testing.T) (*HealthHandler, *balancer.Selector, chi.Router) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}},
+		},
+		Storage: config.Storage{Runtime: config.RuntimeStore{Type: "memory"}},
+	}
+	memory, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	reg := provider.NewRegistry()
+	reg.Register(&mockProvider{})
+	selector := balancer.NewSelector(cfg, nil, nil)
+
+	health := NewHealthHandler(selector, memory, reg, HealthOptions{
+		BuildVersion:  "1.2.3",
+		ConfigVersion: func() string { return "42" },
+	})
+	r := chi.NewRouter()
+	SetupHealthRoutes(r, health)
+	r.Get("/admin/v1/status", health.Status)
+	return health, selector, r
+}
+
+func getHealth(r http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestHealthzAndReadyz(t *testing.T) {
+	health, selector, r := newHealthTestHandler(t)
+
+	assert.Equal(t, http.StatusOK, getHealth(r, "/healthz").Code)
+	w := getHealth(r, "/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"ready"`)
+
+	// No usable provider once the only one's circuit opens
+	for i := 0; i < balancer.DefaultCircuitFailureThreshold; i++ {
+		selector.Health().Record("openai-prod", errors.New("API error: 502 Bad Gateway"))
+	}
+	w = getHealth(r, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "no usable provider")
+
+	selector.Health().Record("openai-prod", nil)
+	assert.Equal(t, http.StatusOK, getHealth(r, "/readyz").Code)
+
+	// Draining on shutdown
+	health.SetDraining()
+	w = getHealth(r, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "draining")
+	assert.Equal(t, http.StatusOK, getHealth(r, "/healthz").Code, "liveness is unaffected by draining")
+}
+
+func TestStatus(t *testing.T) {
+	_, selector, r := newHealthTestHandler(t)
+	selector.Health().Record("openai-prod", errors.New("API error: 500 Internal Server Error"))
+
+	w := getHealth(r, "/admin/v1/status")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status struct {
+		Version       string           `json:"version"`
+		ConfigVersion string           `json:"config_version"`
+		Store         StoreStatus      `json:"store"`
+		Providers     []ProviderStatus `json:"providers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "1.2.3", status.Version)
+	assert.Equal(t, "42", status.ConfigVersion)
+	assert.Equal(t, "memory", status.Store.Type)
+	assert.Empty(t, status.Store.Error)
+	require.Len(t, status.Providers, 1)
+	p := status.Providers[0]
+	assert.Equal(t, "openai-prod", p.Provider)
+	assert.Equal(t, "openai", p.Type)
+	assert.True(t, p.Registered)
+	assert.True(t, p.Usable)
+	assert.Equal(t, balancer.CircuitClosed, p.Circuit)
+	assert.Equal(t, 1, p.ConsecutiveFailures)
+	assert.Contains(t, p.LastError, "500")
+	assert.Nil(t, p.LastSuccess)
+}
+
+func TestProbeEndpoint(t *testing.T) {
+	health, selector, r := newHealthTestHandler(t)
+	r.Post("/admin/v1/health/probe", health.Probe)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/v1/health/probe", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	health.opts.Prober = balancer.NewProber(selector, zerolog.Nop())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/v1/health/probe?provider=missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -4,55 +4,268 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/user/coo-llm/internal/balancer"
 	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
 )
 
+// modelsListTimeout bounds the vendor calls made to refresh the model list
+const modelsListTimeout = 10 * time.Second
+
+// modelCreated is the fixed creation time reported for every model, since the
+// vendors' own timestamps aren't available for all of them
+const modelCreated = 1677649963
+
 type ModelsHandler struct {
-	cfg *config.Config
+	config func() *config.Config
+	models *provider.ModelCache // Discovers vendor models; nil lists configured models only
 }
 
 func NewModelsHandler(cfg *config.Config) *ModelsHandler {
-	return &ModelsHandler{cfg: cfg}
+	return &ModelsHandler{config: func() *config.Config { return cfg }}
 }
 
-func (h *ModelsHandler) Handle(w http.ResponseWriter, r *http.Request) {
-	response := map[string]any{
-		"object": "list",
-		"data":   []any{},
+// Model is one entry of /v1/models. The fields after OwnedBy are only set by
+// /v1/models/{id}, the catalog ones when the model catalog knows the model.
+type Model struct {
+	ID       string `json:"id"`
+	Object   string `json:"object"`
+	Created  int64  `json:"created"`
+	OwnedBy  string `json:"owned_by"`
+	Provider string `json:"provider,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Model    string `json:"model,omitempty"`
+	AliasFor string `json:"alias_for,omitempty"`
+
+	ContextWindow   int                `json:"context_window,omitempty"`
+	MaxOutputTokens int                `json:"max_output_tokens,omitempty"`
+	Pricing         *ModelPricing      `json:"pricing,omitempty"`
+	Capabilities    *ModelCapabilities `json:"capabilities,omitempty"`
+}
+
+// ModelPricing is a model's price per 1 million tokens
+type ModelPricing struct {
+	Input       float64 `json:"input"`
+	Output      float64 `json:"output"`
+	CachedInput float64 `json:"cached_input,omitempty"`
+}
+
+// ModelCapabilities are the request features a model supports
+type ModelCapabilities struct {
+	Tools         bool `json:"tools"`
+	Vision        bool `json:"vision"`
+	JSONMode      bool `json:"json_mode"`
+	Streaming     bool `json:"streaming"`
+	EmbeddingDims int  `json:"embedding_dims,omitempty"`
+}
+
+// setSpec fills in the catalog fields from spec
+func (m *Model) setSpec(spec config.ModelSpec) {
+	m.ContextWindow = spec.ContextWindow
+	m.MaxOutputTokens = spec.MaxOutputTokens
+	if spec.Pricing != (config.Pricing{}) {
+		m.Pricing = &ModelPricing{Input: spec.Pricing.InputTokenCost, Output: spec.Pricing.OutputTokenCost, CachedInput: spec.Pricing.CachedInputTokenCost}
 	}
+	if c := spec.Capabilities; c != nil {
+		m.Capabilities = &ModelCapabilities{Tools: c.Tools, Vision: c.Vision, JSONMode: c.JSONMode, Streaming: c.Streaming, EmbeddingDims: c.EmbeddingDims}
+	}
+}
 
-	for alias := range h.cfg.ModelAliases {
-		response["data"] = append(response["data"].([]any), map[string]any{
-			"id":       alias,
-			"object":   "model",
-			"created":  1677649963,
-			"owned_by": "coo-llm",
-		})
+// providerAllowed reports whether an API key's allowed providers include providerID
+func providerAllowed(allowed []string, providerID string) bool {
+	for _, p := range allowed {
+		if p == "*" || p == providerID {
+			return true
+		}
+	}
+	return false
+}
+
+// routableProviders lists the providers requests can be routed to, with their type
+// and default model
+func routableProviders(cfg *config.Config) []config.LLMProvider {
+	if len(cfg.LLMProviders) > 0 {
+		return cfg.LLMProviders
+	}
+	// Legacy providers are only loaded when there are no llm_providers
+	var providers []config.LLMProvider
+	for _, p := range cfg.Providers {
+		providers = append(providers, config.LLMProvider{ID: p.ID, Type: p.ID, Model: "gpt-4"})
+	}
+	return providers
+}
+
+// aliasProvider returns the provider an alias target routes to, matching the
+// target's prefix against provider IDs first and types second, or "" if none does
+func aliasProvider(cfg *config.Config, target string) string {
+	prefix, _, ok := strings.Cut(target, ":")
+	if !ok {
+		return ""
+	}
+	providers := routableProviders(cfg)
+	for _, p := range providers {
+		if p.ID == prefix {
+			return p.ID
+		}
+	}
+	for _, p := range providers {
+		if p.Type == prefix {
+			return p.ID
+		}
+	}
+	return ""
+}
+
+// list returns every model the caller may route to: provider:model for each
+// provider's default and discovered models, then the aliases, each group sorted
+func (h *ModelsHandler) list(ctx context.Context, cfg *config.Config, allowed []string) []Model {
+	providers := routableProviders(cfg)
+	discovered := make([][]string, len(providers))
+	ttl := cfg.Policy.ModelsCacheTTL
+	if ttl == 0 {
+		ttl = provider.DefaultModelCacheTTL
+	}
+	if h.models != nil && ttl > 0 {
+		ctx, cancel := context.WithTimeout(ctx, modelsListTimeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for i, p := range providers {
+			if !providerAllowed(allowed, p.ID) {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, id string) {
+				defer wg.Done()
+				// A vendor without a working model list still offers its default model
+				discovered[i], _ = h.models.Models(ctx, id, ttl)
+			}(i, p.ID)
+		}
+		wg.Wait()
+	}
+
+	var models []Model
+	seen := make(map[string]bool)
+	for i, p := range providers {
+		if !providerAllowed(allowed, p.ID) {
+			continue
+		}
+		var names []string
+		if p.Model != "" {
+			names = append(names, p.Model)
+		}
+		names = append(names, discovered[i]...)
+		var ids []string
+		for _, name := range names {
+			id := p.ID + ":" + name
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			models = append(models, Model{ID: id, Object: "model", Created: modelCreated, OwnedBy: p.ID})
+		}
+	}
+
+	aliases := make([]string, 0, len(cfg.ModelAliases))
+	for alias, target := range cfg.ModelAliases {
+		if id := aliasProvider(cfg, target); id == "" || providerAllowed(allowed, id) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		models = append(models, Model{ID: alias, Object: "model", Created: modelCreated, OwnedBy: "coo-llm"})
+	}
+	return models
+}
+
+func (h *ModelsHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	allowed, _ := r.Context().Value("allowed_providers").([]string)
+	models := h.list(r.Context(), h.config(), allowed)
+	if models == nil {
+		models = []Model{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(map[string]any{
+		"object": "list",
+		"data":   models,
+	})
+}
+
+// Get returns one model of the list, with the provider and upstream model it routes
+// to. Model IDs may contain slashes, so the ID is the rest of the path.
+func (h *ModelsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "*")
+	cfg := h.config()
+	allowed, _ := r.Context().Value("allowed_providers").([]string)
+
+	for _, m := range h.list(r.Context(), cfg, allowed) {
+		if m.ID != id {
+			continue
+		}
+		target := id
+		if aliasTarget, ok := cfg.ModelAliases[id]; ok {
+			m.AliasFor = aliasTarget
+			target = aliasTarget
+		}
+		if prefix, model, ok := strings.Cut(target, ":"); ok {
+			m.Model = model
+			m.Provider = prefix
+			if providerID := aliasProvider(cfg, target); providerID != "" {
+				m.Provider = providerID
+			}
+			for _, p := range routableProviders(cfg) {
+				if p.ID == m.Provider {
+					m.Type = p.Type
+				}
+			}
+			if spec, ok := provider.NewCatalog(cfg.Models).Lookup(m.Provider, m.Type, m.Model); ok {
+				m.setSpec(spec)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+		return
+	}
+
+	writeAPIError(w, http.StatusNotFound, errorTypeInvalidRequest, errorCodeModelNotFound, "model", "The model does not exist or you do not have access to it")
 }
 
 // AuthMiddleware checks for Authorization header (Bearer token)
 func AuthMiddleware(apiKeyConfigs []config.APIKeyConfig) func(http.Handler) http.Handler {
+	return AuthMiddlewareFunc(func() []config.APIKeyConfig { return apiKeyConfigs })
+}
+
+// AuthMiddlewareFunc is AuthMiddleware with the API keys looked up on every request,
+// so key changes apply to the routes it protects without a restart
+func AuthMiddlewareFunc(apiKeys func() []config.APIKeyConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			auth := r.Header.Get("Authorization")
+			if apiKey := r.Header.Get("x-api-key"); auth == "" && apiKey != "" {
+				auth = "Bearer " + apiKey // Anthropic clients send the key in x-api-key
+			}
 			if auth == "" {
-				http.Error(w, `{"error": {"message": "Missing API key", "type": "authentication_error"}}`, http.StatusUnauthorized)
+				writeAPIError(w, http.StatusUnauthorized, errorTypeAuthentication, "", "", "Missing API key")
 				return
 			}
 
 			if !strings.HasPrefix(auth, "Bearer ") {
-				http.Error(w, `{"error": {"message": "Invalid API key format", "type": "authentication_error"}}`, http.StatusUnauthorized)
+				writeAPIError(w, http.StatusUnauthorized, errorTypeAuthentication, errorCodeInvalidAPIKey, "", "Invalid API key format")
 				return
 			}
 
 			token := strings.TrimPrefix(auth, "Bearer ")
+			apiKeyConfigs := apiKeys()
 
 			// If no API keys are configured, accept any token (for development)
 			if len(apiKeyConfigs) == 0 {
@@ -73,7 +286,7 @@ func AuthMiddleware(apiKeyConfigs []config.APIKeyConfig) func(http.Handler) http
 			}
 
 			if !valid {
-				http.Error(w, `{"error": {"message": "Invalid API key", "type": "authentication_error"}}`, http.StatusUnauthorized)
+				writeAPIError(w, http.StatusUnauthorized, errorTypeAuthentication, errorCodeInvalidAPIKey, "", "Invalid API key")
 				return
 			}
 
@@ -88,4 +301,13 @@ func AuthMiddleware(apiKeyConfigs []config.APIKeyConfig) func(http.Handler) http
 func SetupModelsRoute(r chi.Router, cfg *config.Config) {
 	handler := NewModelsHandler(cfg)
 	r.With(AuthMiddleware(cfg.APIKeys)).Get("/v1/models", handler.Handle)
+	r.With(AuthMiddleware(cfg.APIKeys)).Get("/v1/models/*", handler.Get)
+}
+
+// setupLiveModelsRoute serves /v1/models from the selector's config in effect, with
+// the models of the registered providers discovered from their vendors
+func setupLiveModelsRoute(r chi.Router, selector *balancer.Selector, reg *provider.Registry, auth func(http.Handler) http.Handler) {
+	handler := &ModelsHandler{config: selector.Config, models: provider.NewModelCache(reg)}
+	r.With(auth).Get("/v1/models", handler.Handle)
+	r.With(auth).Get("/v1/models/*", handler.Get)
 }
@@ -0,0 +1,536 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// defaultMaxTokens is the completion limit of requests that don't set one
+const defaultMaxTokens = 1000
+
+// Message roles of OpenAI's chat API
+const (
+	roleSystem    = "system"
+	roleDeveloper = "developer"
+	roleUser      = "user"
+	roleAssistant = "assistant"
+	roleTool      = "tool"
+	roleFunction  = "function"
+)
+
+// contentPartTypes lists the content part types each role may send
+var contentPartTypes = map[string][]string{
+	roleSystem:    {"text"},
+	roleDeveloper: {"text"},
+	roleUser:      {"text", "image_url", "input_audio", "file"},
+	roleAssistant: {"text", "refusal"},
+	roleTool:      {"text"},
+}
+
+// ChatCompletionRequest is the body of a chat completions request. Fields the gateway
+// doesn't read are passed to providers through Params.
+type ChatCompletionRequest struct {
+	Model               string         `json:"model"`
+	Messages            []ChatMessage  `json:"messages"`
+	MaxTokens           *int           `json:"max_tokens"`
+	MaxCompletionTokens *int           `json:"max_completion_tokens"`
+	Stream              bool           `json:"stream"`
+	StreamOptions       *StreamOptions `json:"stream_options"`
+	User                string         `json:"user"`
+	Tools               []Tool         `json:"tools"`
+
+	ResponseFormat *provider.ResponseFormat  `json:"-"` // nil for text responses
+	Sampling       *provider.SamplingOptions `json:"-"`
+	Params         map[string]any            `json:"-"` // The whole body
+}
+
+// StreamOptions are the options of a streamed request
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatMessage is a message of a chat request
+type ChatMessage struct {
+	Role         string          `json:"role"`
+	Content      json.RawMessage `json:"content"` // A string or a list of content parts
+	Name         string          `json:"name"`
+	ToolCalls    []ToolCall      `json:"tool_calls"`
+	ToolCallID   string          `json:"tool_call_id"`
+	FunctionCall json.RawMessage `json:"function_call"`
+
+	text  *string       // Content when it's a string
+	parts []ContentPart // Content when it's a list of parts
+}
+
+// Text returns the content of a message sent as a string
+func (m *ChatMessage) Text() (string, bool) {
+	if m.text == nil {
+		return "", false
+	}
+	return *m.text, true
+}
+
+// ContentPart is a part of a message's content
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     *string   `json:"text"`
+	ImageURL *ImageURL `json:"image_url"`
+	Refusal  *string   `json:"refusal"`
+}
+
+// ImageURL is the image of an image_url content part
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail"`
+}
+
+// ToolCall is a tool call of an assistant message
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// Tool is a tool offered to the model
+type Tool struct {
+	Type     string              `json:"type"`
+	Function *FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition describes a function tool
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+	Strict      *bool           `json:"strict"`
+}
+
+// maxTokens returns the completion limit of the request
+func (r *ChatCompletionRequest) maxTokens() int {
+	switch {
+	case r.MaxCompletionTokens != nil:
+		return *r.MaxCompletionTokens
+	case r.MaxTokens != nil:
+		return *r.MaxTokens
+	}
+	return defaultMaxTokens
+}
+
+// messages returns the messages as sent, in the form providers take
+func (r *ChatCompletionRequest) messages() []map[string]any {
+	return chatMessages(r.Params)
+}
+
+// prompt returns the content of the last message when it's a string
+func (r *ChatCompletionRequest) prompt() string {
+	if len(r.Messages) == 0 {
+		return ""
+	}
+	text, _ := r.Messages[len(r.Messages)-1].Text()
+	return text
+}
+
+// cachePrompt returns the text a response to the request is cached by: its prompt,
+// followed by the sampling parameters that shape the answer. Responses a cached answer
+// can't stand in for aren't cached, so it is "" for streamed requests, requests with a
+// response_format and requests for several choices.
+func (r *ChatCompletionRequest) cachePrompt() string {
+	prompt := r.prompt()
+	if prompt == "" || r.Stream || r.ResponseFormat != nil {
+		return ""
+	}
+	if r.Sampling == nil {
+		return prompt
+	}
+	if r.Sampling.N > 1 {
+		return ""
+	}
+	sampling := *r.Sampling
+	sampling.User = "" // Doesn't change the answer
+	data, _ := json.Marshal(sampling)
+	if defaults, _ := json.Marshal(provider.SamplingOptions{}); string(data) == string(defaults) {
+		return prompt
+	}
+	return prompt + "\n" + string(data)
+}
+
+// decodeChatRequest reads a chat completions request and checks it the way OpenAI
+// does. Errors are *provider.ParamError naming the parameter at fault.
+func decodeChatRequest(body io.Reader) (*ChatCompletionRequest, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, &provider.ParamError{Message: fmt.Sprintf("could not read the request body: %v", err)}
+	}
+	var params map[string]any
+	if err := json.Unmarshal(data, &params); err != nil || params == nil {
+		return nil, &provider.ParamError{Message: "We could not parse the JSON body of your request. The body must be a JSON object."}
+	}
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, paramTypeError(err, "")
+	}
+	req.Params = params
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	if req.ResponseFormat, err = provider.ParseResponseFormat(params["response_format"]); err != nil {
+		return nil, &provider.ParamError{Param: "response_format", Code: provider.ParamCodeInvalidValue, Message: err.Error()}
+	}
+	if req.Sampling, err = provider.ParseSamplingOptions(params); err != nil {
+		return nil, err
+	}
+	if req.Stream {
+		if err := checkStreamSampling(req.Sampling); err != nil {
+			return nil, err
+		}
+	}
+	return &req, nil
+}
+
+// validate checks the parameters the gateway reads
+func (r *ChatCompletionRequest) validate() error {
+	if r.Model == "" {
+		return missingParam("model")
+	}
+	if _, ok := r.Params["messages"]; !ok {
+		return missingParam("messages")
+	}
+	if len(r.Messages) == 0 {
+		return &provider.ParamError{Param: "messages", Code: errorCodeEmptyArray, Message: "Invalid 'messages': empty array. Expected an array with minimum length 1, but got an empty array instead."}
+	}
+	for i := range r.Messages {
+		if err := r.Messages[i].validate(fmt.Sprintf("messages.[%d]", i)); err != nil {
+			return err
+		}
+	}
+	if err := checkTokenLimit("max_tokens", r.MaxTokens); err != nil {
+		return err
+	}
+	if err := checkTokenLimit("max_completion_tokens", r.MaxCompletionTokens); err != nil {
+		return err
+	}
+	if r.StreamOptions != nil && !r.Stream {
+		return &provider.ParamError{Param: "stream_options", Message: "The 'stream_options' parameter is only allowed when 'stream' is enabled."}
+	}
+	for i, tool := range r.Tools {
+		param := fmt.Sprintf("tools.[%d]", i)
+		if tool.Type != "function" {
+			return invalidValue(param+".type", tool.Type, "function")
+		}
+		if tool.Function == nil {
+			return missingParam(param + ".function")
+		}
+		if tool.Function.Name == "" {
+			return missingParam(param + ".function.name")
+		}
+	}
+	return nil
+}
+
+// validate checks a message and parses its content. param names the message.
+func (m *ChatMessage) validate(param string) error {
+	if m.Role == "" {
+		return missingParam(param + ".role")
+	}
+	allowed, ok := contentPartTypes[m.Role]
+	if !ok && m.Role != roleFunction {
+		return invalidValue(param+".role", m.Role, roleSystem, roleAssistant, roleUser, roleFunction, roleTool, roleDeveloper)
+	}
+
+	content := strings.TrimSpace(string(m.Content))
+	switch {
+	case content == "" || content == "null":
+		// Assistant messages calling tools may leave out the content
+		if m.Role != roleAssistant || (len(m.ToolCalls) == 0 && len(m.FunctionCall) == 0) {
+			return missingParam(param + ".content")
+		}
+	case content[0] == '"':
+		var text string
+		if err := json.Unmarshal(m.Content, &text); err != nil {
+			return paramTypeError(err, param+".content")
+		}
+		m.text = &text
+	case content[0] == '[' && allowed != nil:
+		if err := m.parseParts(param+".content", allowed); err != nil {
+			return err
+		}
+	default:
+		expected := "one of a string or array of objects"
+		if allowed == nil {
+			expected = "a string"
+		}
+		return &provider.ParamError{Param: param + ".content", Code: errorCodeInvalidType, Message: fmt.Sprintf("Invalid type for '%s.content': expected %s, but got %s instead.", param, expected, jsonValueName(content))}
+	}
+
+	switch {
+	case m.Role == roleTool && m.ToolCallID == "":
+		return missingParam(param + ".tool_call_id")
+	case m.Role == roleFunction && m.Name == "":
+		return missingParam(param + ".name")
+	}
+	return nil
+}
+
+// parseParts parses a content sent as a list of parts of the allowed types
+func (m *ChatMessage) parseParts(param string, allowed []string) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(m.Content, &raw); err != nil {
+		return paramTypeError(err, param)
+	}
+	m.parts = make([]ContentPart, len(raw))
+	for i, data := range raw {
+		partParam := fmt.Sprintf("%s.[%d]", param, i)
+		part := &m.parts[i]
+		if err := json.Unmarshal(data, part); err != nil {
+			return paramTypeError(err, partParam)
+		}
+		if part.Type == "" {
+			return missingParam(partParam + ".type")
+		}
+		if !slices.Contains(allowed, part.Type) {
+			return invalidValue(partParam+".type", part.Type, allowed...)
+		}
+		switch {
+		case part.Type == "text" && part.Text == nil:
+			return missingParam(partParam + ".text")
+		case part.Type == "image_url" && (part.ImageURL == nil || part.ImageURL.URL == ""):
+			return missingParam(partParam + ".image_url.url")
+		case part.Type == "refusal" && part.Refusal == nil:
+			return missingParam(partParam + ".refusal")
+		}
+	}
+	return nil
+}
+
+// checkTokenLimit returns an error for a completion token limit below 1
+func checkTokenLimit(param string, limit *int) error {
+	if limit == nil || *limit >= 1 {
+		return nil
+	}
+	return &provider.ParamError{Param: param, Code: errorCodeBelowMinimum, Message: fmt.Sprintf("Invalid '%s': integer below minimum value. Expected a value >= 1, but got %d instead.", param, *limit)}
+}
+
+// missingParam returns OpenAI's error for a required parameter left out
+func missingParam(param string) *provider.ParamError {
+	return &provider.ParamError{Param: param, Code: errorCodeMissingParam, Message: fmt.Sprintf("Missing required parameter: '%s'.", param)}
+}
+
+// invalidValue returns OpenAI's error for a parameter outside its supported values
+func invalidValue(param, value string, supported ...string) *provider.ParamError {
+	quoted := make([]string, len(supported))
+	for i, s := range supported {
+		quoted[i] = "'" + s + "'"
+	}
+	return &provider.ParamError{Param: param, Code: provider.ParamCodeInvalidValue, Message: fmt.Sprintf("Invalid value for '%s': '%s'. Supported values are: %s.", param, value, strings.Join(quoted, ", "))}
+}
+
+// paramTypeError returns OpenAI's invalid_type error for a JSON type error. prefix
+// names the value that was decoded.
+func paramTypeError(err error, prefix string) *provider.ParamError {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return &provider.ParamError{Param: prefix, Message: fmt.Sprintf("Invalid '%s': %v", prefix, err)}
+	}
+	param := prefix
+	if field := openAIParam(typeErr.Field); field != "" {
+		if param != "" {
+			param += "."
+		}
+		param += field
+	}
+	return &provider.ParamError{Param: param, Code: errorCodeInvalidType, Message: fmt.Sprintf("Invalid type for '%s': expected %s, but got %s instead.", param, jsonTypeName(typeErr.Type), jsonValueName(typeErr.Value))}
+}
+
+// openAIParam converts a JSON field path such as messages.0.role to OpenAI's
+// notation, messages.[0].role
+func openAIParam(field string) string {
+	if field == "" {
+		return ""
+	}
+	segments := strings.Split(field, ".")
+	for i, s := range segments {
+		if _, err := strconv.Atoi(s); err == nil {
+			segments[i] = "[" + s + "]"
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// jsonTypeName describes the JSON type expected for a Go type
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// jsonValueName describes a JSON value, given as a value or as the description of
+// json.UnmarshalTypeError such as "number 1.5"
+func jsonValueName(value string) string {
+	switch {
+	case value == "":
+		return "nothing"
+	case strings.HasPrefix(value, "number "):
+		return "a decimal"
+	case value == "number" || strings.IndexAny(value[:1], "-0123456789") == 0:
+		return "an integer"
+	case value == "string" || value[0] == '"':
+		return "a string"
+	case value == "bool" || value == "true" || value == "false":
+		return "a boolean"
+	case value == "array" || value[0] == '[':
+		return "an array"
+	}
+	return "an object"
+}
+
+// ChatCompletion is the response to a chat completions request
+type ChatCompletion struct {
+	ID                string                 `json:"id"`
+	Object            string                 `json:"object"`
+	Created           int64                  `json:"created"`
+	Model             string                 `json:"model"`
+	SystemFingerprint string                 `json:"system_fingerprint"`
+	Choices           []ChatCompletionChoice `json:"choices"`
+	Usage             CompletionUsage        `json:"usage"`
+
+	// StructuredOutput reports JSON output that failed validation against the
+	// requested response_format
+	StructuredOutput *StructuredOutputResult `json:"structured_output,omitempty"`
+}
+
+// ChatCompletionChoice is a choice of a chat completion
+type ChatCompletionChoice struct {
+	Index        int                `json:"index"`
+	Message      ResponseMessage    `json:"message"`
+	Logprobs     *provider.Logprobs `json:"logprobs"`
+	FinishReason string             `json:"finish_reason"`
+}
+
+// ResponseMessage is the message of a chat completion choice
+type ResponseMessage struct {
+	Role    string  `json:"role"`
+	Content *string `json:"content"`
+	Refusal *string `json:"refusal"`
+}
+
+// CompletionUsage is the token usage of a chat completion
+type CompletionUsage struct {
+	PromptTokens        int                 `json:"prompt_tokens"`
+	CompletionTokens    int                 `json:"completion_tokens"`
+	TotalTokens         int                 `json:"total_tokens"`
+	PromptTokensDetails PromptTokensDetails `json:"prompt_tokens_details"`
+}
+
+// PromptTokensDetails breaks down the prompt tokens of a request
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// StructuredOutputResult is the validation result of JSON output
+type StructuredOutputResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// ChatCompletionChunk is a chunk of a streamed chat completion
+type ChatCompletionChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint"`
+	Choices           []ChunkChoice `json:"choices"`
+
+	// StructuredOutput is set on the finish chunk of a response_format request, once
+	// the streamed output has been checked
+	StructuredOutput *StructuredOutputResult `json:"structured_output,omitempty"`
+}
+
+// ChunkChoice is the choice of a chunk
+type ChunkChoice struct {
+	Index        int                `json:"index"`
+	Delta        ChunkDelta         `json:"delta"`
+	Logprobs     *provider.Logprobs `json:"logprobs"`
+	FinishReason *string            `json:"finish_reason"`
+}
+
+// ChunkDelta is the part of the message a chunk adds
+type ChunkDelta struct {
+	Role    string  `json:"role,omitempty"`
+	Content *string `json:"content,omitempty"`
+}
+
+// newUsage returns the usage object of a request
+func newUsage(usage *provider.Usage) CompletionUsage {
+	return CompletionUsage{
+		PromptTokens:        usage.InputTokens,
+		CompletionTokens:    usage.OutputTokens,
+		TotalTokens:         usage.TotalTokens,
+		PromptTokensDetails: PromptTokensDetails{CachedTokens: usage.CachedInputTokens},
+	}
+}
+
+// newChatCompletion returns the response to a request a provider answered
+func newChatCompletion(id, model, fingerprint string, created int64, resp *provider.LLMResponse) *ChatCompletion {
+	completion := &ChatCompletion{
+		ID:                id,
+		Object:            "chat.completion",
+		Created:           created,
+		Model:             model,
+		SystemFingerprint: fingerprint,
+		Usage:             newUsage(resp.Usage()),
+	}
+	for i, choice := range resp.AllChoices() {
+		text := choice.Text
+		completion.Choices = append(completion.Choices, ChatCompletionChoice{
+			Index:        i,
+			Message:      ResponseMessage{Role: roleAssistant, Content: &text},
+			Logprobs:     choice.Logprobs,
+			FinishReason: finishReason(choice.FinishReason),
+		})
+	}
+	return completion
+}
+
+// finishReason returns the reason a choice ended, "stop" when the provider didn't say
+func finishReason(reason string) string {
+	if reason == "" {
+		return "stop"
+	}
+	return reason
+}
+
+// systemFingerprint identifies the backend that produced a response: the provider
+// and model. It changes when the request is routed elsewhere, as OpenAI's does when
+// its backend changes.
+func systemFingerprint(providerID, model string) string {
+	sum := sha256.Sum256([]byte(providerID + ":" + model))
+	return "fp_" + hex.EncodeToString(sum[:])[:10]
+}
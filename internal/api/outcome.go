@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// outcomeRecorder stores request outcome metrics for one incoming request
+type outcomeRecorder struct {
+	store     store.RuntimeStore
+	health    *balancer.HealthTracker
+	endpoint  string
+	requestID string
+	clientKey string
+	model     string
+	attempts  int
+	pending   *store.RequestOutcome
+}
+
+func newOutcomeRecorder(s store.RuntimeStore, health *balancer.HealthTracker, r *http.Request, endpoint, reqID, model string) *outcomeRecorder {
+	clientKey, _ := r.Context().Value("api_key").(string)
+	return &outcomeRecorder{store: s, health: health, endpoint: endpoint, requestID: reqID, clientKey: clientKey, model: model}
+}
+
+// attempt notes the result of one upstream attempt and returns the client status for it.
+// The previous attempt is recorded as non-final; the latest one is held until finish.
+func (o *outcomeRecorder) attempt(pCfg *config.Provider, key *config.Key, modelName string, fallback bool, latencyMS int64, err error) int {
+	if o == nil {
+		return statusForError(err)
+	}
+	o.flush()
+	o.attempts++
+	outcome := &store.RequestOutcome{
+		Model:     modelName,
+		Endpoint:  o.endpoint,
+		Status:    http.StatusOK,
+		Attempt:   o.attempts,
+		Fallback:  fallback,
+		LatencyMS: latencyMS,
+	}
+	if pCfg != nil {
+		outcome.Provider = metricProviderTag(pCfg)
+		if o.health != nil {
+			o.health.Record(pCfg.ID, err)
+		}
+	}
+	if key != nil {
+		outcome.KeyID = key.ID
+	}
+	if err != nil {
+		_, outcome.ErrorClass = provider.ClassifyError(err)
+		outcome.Status = provider.StatusForErrorClass(outcome.ErrorClass)
+	}
+	o.pending = outcome
+	return outcome.Status
+}
+
+// followUp records a failed follow-up call made for the held attempt, such as a
+// structured output repair, as non-final. The held attempt still answers the request,
+// so it stays pending for finish, and the provider's circuit isn't charged for a
+// request that was served.
+func (o *outcomeRecorder) followUp(pCfg *config.Provider, key *config.Key, modelName string, latencyMS int64, err error) {
+	if o == nil {
+		return
+	}
+	answered, health := o.pending, o.health
+	o.pending, o.health = nil, nil
+	o.attempt(pCfg, key, modelName, false, latencyMS, err)
+	o.flush()
+	o.pending, o.health = answered, health
+}
+
+// finish records the attempt that decided the response as final and returns its status.
+// Requests that never reached a provider are recorded with the given status and class.
+func (o *outcomeRecorder) finish(status int, errorClass string) int {
+	if o == nil {
+		return status
+	}
+	if o.pending != nil {
+		pending := o.pending
+		o.pending = nil
+		pending.Final = true
+		o.record(*pending)
+		return pending.Status
+	}
+	o.record(store.RequestOutcome{
+		Model:      o.model,
+		Endpoint:   o.endpoint,
+		Status:     status,
+		ErrorClass: errorClass,
+		Final:      true,
+	})
+	return status
+}
+
+// flush records a held attempt as non-final
+func (o *outcomeRecorder) flush() {
+	if o.pending != nil {
+		o.record(*o.pending)
+		o.pending = nil
+	}
+}
+
+func (o *outcomeRecorder) record(outcome store.RequestOutcome) {
+	if o.store == nil {
+		return
+	}
+	outcome.ClientKey = o.clientKey
+	outcome.RequestID = o.requestID
+	if outcome.Model == "" {
+		outcome.Model = o.model
+	}
+	store.RecordOutcome(o.store, outcome)
+}
+
+// statusForError maps an upstream error to the status returned to the client
+func statusForError(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	_, class := provider.ClassifyError(err)
+	return provider.StatusForErrorClass(class)
+}
+
+// metricProviderTag returns the provider tag value used for stored metrics
+func metricProviderTag(pCfg *config.Provider) string {
+	if pCfg.Name != "" {
+		return pCfg.Name
+	}
+	return pCfg.ID
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/user/coo-llm/internal/log"
+)
+
+// Routing decision headers returned on API responses
+const (
+	HeaderProvider = "x-coo-provider"
+	HeaderModel    = "x-coo-model"
+	HeaderKeyID    = "x-coo-key-id"
+	HeaderAttempts = "x-coo-attempts"
+	HeaderCache    = "x-coo-cache"
+	HeaderCost     = "x-coo-cost"
+
+	// HeaderPromptTokens is the prompt size estimated before the request is sent
+	HeaderPromptTokens = "x-coo-prompt-tokens"
+
+	// HeaderStructuredOutput reports whether a JSON response_format response was
+	// "valid", "repaired" or "invalid"
+	HeaderStructuredOutput = "x-coo-structured-output"
+
+	// HeaderIgnoredParams lists the sampling parameters the provider doesn't support,
+	// which were not sent
+	HeaderIgnoredParams = "x-coo-ignored-params"
+)
+
+// exposedHeaders lists response headers browsers are allowed to read
+var exposedHeaders = []string{
+	log.RequestIDHeader,
+	HeaderProvider,
+	HeaderModel,
+	HeaderKeyID,
+	HeaderAttempts,
+	HeaderCache,
+	HeaderCost,
+	HeaderPromptTokens,
+	HeaderStructuredOutput,
+	HeaderIgnoredParams,
+}
+
+// RequestIDMiddleware accepts X-Request-ID from the client or generates one,
+// stores it in the request context and echoes it on the response
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := log.RequestIDFromContext(r.Context())
+		if reqID == "" {
+			reqID = r.Header.Get(log.RequestIDHeader)
+			if !log.ValidRequestID(reqID) {
+				reqID = log.NewRequestID()
+			}
+			r = r.WithContext(log.WithRequestID(r.Context(), reqID))
+		}
+		w.Header().Set(log.RequestIDHeader, reqID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the request ID for r, generating one if the middleware did not run
+func requestID(r *http.Request) (*http.Request, string) {
+	if reqID := log.RequestIDFromContext(r.Context()); reqID != "" {
+		return r, reqID
+	}
+	reqID := r.Header.Get(log.RequestIDHeader)
+	if !log.ValidRequestID(reqID) {
+		reqID = log.NewRequestID()
+	}
+	return r.WithContext(log.WithRequestID(r.Context(), reqID)), reqID
+}
+
+// routingInfo describes how a request was served, reported via x-coo-* headers
+type routingInfo struct {
+	Provider string
+	Model    string
+	KeyID    string
+	Attempts int
+	CacheHit bool
+	Cost     float64
+}
+
+// setHeaders writes the routing decision headers; must be called before the body is written
+func (ri *routingInfo) setHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	if ri.Provider != "" {
+		h.Set(HeaderProvider, ri.Provider)
+	}
+	if ri.Model != "" {
+		h.Set(HeaderModel, ri.Model)
+	}
+	if ri.KeyID != "" {
+		h.Set(HeaderKeyID, ri.KeyID)
+	}
+	if ri.Attempts > 0 {
+		h.Set(HeaderAttempts, strconv.Itoa(ri.Attempts))
+	}
+	if ri.CacheHit {
+		h.Set(HeaderCache, "hit")
+	} else {
+		h.Set(HeaderCache, "miss")
+	}
+	h.Set(HeaderCost, strconv.FormatFloat(ri.Cost, 'f', -1, 64))
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// chunkWriter writes a streamed chat completion as server-sent events, in the chunks
+// OpenAI sends: the role first, then the content, then the finish reason
+type chunkWriter struct {
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	id           string
+	model        string
+	fingerprint  string
+	created      int64
+	includeUsage bool // stream_options.include_usage
+}
+
+// usageChunk is a chunk of a stream that reports usage: null on every chunk but the
+// last, which has no choices
+type usageChunk struct {
+	ChatCompletionChunk
+	Usage *CompletionUsage `json:"usage"`
+}
+
+// event writes a server-sent event
+func (c *chunkWriter) event(data string) {
+	fmt.Fprintf(c.w, "data: %s\n\n", data)
+	c.flusher.Flush()
+}
+
+// chunk writes a chunk with the given choices
+func (c *chunkWriter) chunk(choices []ChunkChoice, usage *CompletionUsage, structured *StructuredOutputResult) {
+	chunk := ChatCompletionChunk{
+		ID:                c.id,
+		Object:            "chat.completion.chunk",
+		Created:           c.created,
+		Model:             c.model,
+		SystemFingerprint: c.fingerprint,
+		Choices:           choices,
+		StructuredOutput:  structured,
+	}
+	var data []byte
+	if c.includeUsage {
+		data, _ = json.Marshal(usageChunk{ChatCompletionChunk: chunk, Usage: usage})
+	} else {
+		data, _ = json.Marshal(chunk)
+	}
+	c.event(string(data))
+}
+
+// send writes a chunk with one choice
+func (c *chunkWriter) send(delta ChunkDelta, finishReason *string) {
+	c.chunk([]ChunkChoice{{Delta: delta, FinishReason: finishReason}}, nil, nil)
+}
+
+// start writes the first chunk, which carries the role
+func (c *chunkWriter) start() {
+	empty := ""
+	c.send(ChunkDelta{Role: roleAssistant, Content: &empty}, nil)
+}
+
+// content writes a chunk of the message content
+func (c *chunkWriter) content(text string) {
+	c.send(ChunkDelta{Content: &text}, nil)
+}
+
+// finish writes the last chunk of the choice, with the validation result of its JSON
+// output when the request had a response_format
+func (c *chunkWriter) finish(reason string, structured *StructuredOutputResult) {
+	reason = finishReason(reason)
+	c.chunk([]ChunkChoice{{FinishReason: &reason}}, nil, structured)
+}
+
+// usage writes the chunk with the usage of the request, when the client asked for it
+func (c *chunkWriter) usage(usage CompletionUsage) {
+	if c.includeUsage {
+		c.chunk([]ChunkChoice{}, &usage, nil)
+	}
+}
+
+// fail writes an error event, which OpenAI's SDKs raise as an API error
+func (c *chunkWriter) fail(err error) {
+	data, _ := json.Marshal(errorResponse{Error: APIError{Message: err.Error(), Type: errorTypeServer}})
+	c.event(string(data))
+}
+
+// done ends the stream
+func (c *chunkWriter) done() {
+	c.event("[DONE]")
+}
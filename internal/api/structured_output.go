@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// Structured output statuses reported in the x-coo-structured-output header
+const (
+	structuredOutputValid    = "valid"
+	structuredOutputRepaired = "repaired"
+	structuredOutputInvalid  = "invalid"
+)
+
+// responseSchemaURL names the response schema inside the schema compiler
+const responseSchemaURL = "response_format.json"
+
+// structuredOutput checks responses against the response_format of a request
+type structuredOutput struct {
+	format *provider.ResponseFormat
+	schema *jsonschema.Schema // nil when any JSON object will do
+}
+
+// newStructuredOutput compiles the schema of a chat request's response_format. It
+// returns nil for requests that don't ask for JSON output.
+func newStructuredOutput(format *provider.ResponseFormat) (*structuredOutput, error) {
+	if format == nil {
+		return nil, nil
+	}
+	so := &structuredOutput{format: format}
+	if schema := format.Schema(); schema != nil {
+		data, err := json.Marshal(schema)
+		if err != nil {
+			return nil, err
+		}
+		compiler := jsonschema.NewCompiler()
+		if err := compiler.AddResource(responseSchemaURL, bytes.NewReader(data)); err != nil {
+			return nil, invalidSchema(err)
+		}
+		if so.schema, err = compiler.Compile(responseSchemaURL); err != nil {
+			return nil, invalidSchema(err)
+		}
+	}
+	return so, nil
+}
+
+// invalidSchema returns the error for a response_format schema that doesn't compile
+func invalidSchema(err error) error {
+	return &provider.ParamError{
+		Param:   "response_format.json_schema.schema",
+		Code:    provider.ParamCodeInvalidValue,
+		Message: fmt.Sprintf("invalid response_format.json_schema.schema: %v", err),
+	}
+}
+
+// stripCodeFence returns text without a surrounding Markdown code fence, which some
+// models add around JSON even in JSON mode
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") || !strings.HasSuffix(text, "```") || len(text) < 6 {
+		return text
+	}
+	body := strings.TrimSuffix(text[3:], "```")
+	if newline := strings.IndexByte(body, '\n'); newline >= 0 {
+		body = body[newline+1:] // Drop the language tag, e.g. ```json
+	}
+	return strings.TrimSpace(body)
+}
+
+// validate returns the response text as JSON without any code fence, and an error if
+// it isn't a JSON object or doesn't match the schema
+func (so *structuredOutput) validate(text string) (string, error) {
+	text = stripCodeFence(text)
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return text, fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if so.schema != nil {
+		if err := so.schema.Validate(v); err != nil {
+			return text, fmt.Errorf("response does not match the schema: %w", err)
+		}
+		return text, nil
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return text, fmt.Errorf("response is not a JSON object")
+	}
+	return text, nil
+}
+
+// validateResponse validates every choice of a response, replacing the text of valid
+// ones with their JSON without a code fence. It returns the first validation error.
+func (so *structuredOutput) validateResponse(resp *provider.LLMResponse) error {
+	var firstErr error
+	check := func(text *string) {
+		cleaned, err := so.validate(*text)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		*text = cleaned
+	}
+	check(&resp.Text)
+	for i := range resp.Choices {
+		check(&resp.Choices[i].Text)
+	}
+	return firstErr
+}
+
+// streamResult validates the text of a streamed response, which has already been sent,
+// so the result is reported in the stream instead. It is nil without a response_format.
+func (so *structuredOutput) streamResult(text string) *StructuredOutputResult {
+	if so == nil {
+		return nil
+	}
+	if _, err := so.validate(text); err != nil {
+		return &StructuredOutputResult{Valid: false, Error: err.Error()}
+	}
+	return &StructuredOutputResult{Valid: true}
+}
+
+// repairMessages returns the messages of a request asking the model to fix output
+// that failed validation
+func repairMessages(messages []map[string]any, output string, validationErr error) []map[string]any {
+	repair := make([]map[string]any, 0, len(messages)+2)
+	repair = append(repair, messages...)
+	return append(repair,
+		map[string]any{"role": "assistant", "content": output},
+		map[string]any{"role": "user", "content": fmt.Sprintf(
+			"Your response was rejected: %v. Reply again with only the corrected JSON, without any other text.", validationErr)},
+	)
+}
+
+// repairStructuredOutput sends a repair request to the provider and key that produced
+// the invalid output, accounting for it like any other attempt. A repair that succeeds
+// answers the request; one that fails is recorded as a non-final attempt.
+func (h *ChatCompletionsHandler) repairStructuredOutput(parent context.Context, outcomes *outcomeRecorder, pCfg *config.Provider, key *config.Key, providerReq *provider.LLMRequest) (*provider.LLMResponse, int64, error) {
+	prov, err := h.reg.Get(pCfg.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit := h.selector.MaxOutputTokens(pCfg, providerReq.Model); limit > 0 && providerReq.MaxTokens > limit {
+		providerReq.MaxTokens = limit
+	}
+	h.selector.UpdateUsage(pCfg.ID, key.ID, "req", 1)
+
+	ctx, cancel := context.WithTimeout(parent, h.selector.Config().Policy.Retry.Timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := prov.Generate(ctx, providerReq)
+	latency := time.Since(start).Milliseconds()
+	if err == nil && resp == nil {
+		err = fmt.Errorf("provider returned nil response")
+	}
+	if err != nil {
+		// The original output is returned, so the request's outcome stays that attempt's
+		outcomes.followUp(pCfg, key, providerReq.Model, latency, err)
+		h.selector.UpdateUsage(pCfg.ID, key.ID, "errors", 1)
+		return nil, latency, err
+	}
+	outcomes.attempt(pCfg, key, providerReq.Model, false, latency, nil)
+
+	h.updateKeyUsage(pCfg, key, resp.Usage(), latency)
+	return resp, latency, nil
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/user/coo-llm/internal/balancer"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/log"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/tokenizer"
+)
+
+// vendorCountTimeout bounds a call to a vendor's token count endpoint
+const vendorCountTimeout = 10 * time.Second
+
+// TokenizeHandler counts the prompt tokens of a request without sending it, so clients
+// can trim history before they do
+type TokenizeHandler struct {
+	selector *balancer.Selector
+	reg      *provider.Registry
+	logger   *log.Logger
+}
+
+func NewTokenizeHandler(selector *balancer.Selector, reg *provider.Registry, logger *log.Logger) *TokenizeHandler {
+	return &TokenizeHandler{selector: selector, reg: reg, logger: logger}
+}
+
+// TokenizeResponse is the response of /v1/tokenize
+type TokenizeResponse struct {
+	Object        string `json:"object"`
+	Model         string `json:"model"`    // Upstream model the request resolves to
+	Provider      string `json:"provider"` // Provider ID the request resolves to
+	InputTokens   int    `json:"input_tokens"`
+	Method        string `json:"method"`             // "tiktoken", "vendor" or "heuristic"
+	Encoding      string `json:"encoding,omitempty"` // tiktoken encoding, when counted with one
+	ContextWindow int    `json:"context_window,omitempty"`
+}
+
+// chatMessages returns the messages of a chat request; entries that aren't objects are left nil
+func chatMessages(req map[string]any) []map[string]any {
+	msgs, ok := req["messages"].([]any)
+	if !ok || len(msgs) == 0 {
+		return nil
+	}
+	messages := make([]map[string]any, len(msgs))
+	for i, msg := range msgs {
+		if m, ok := msg.(map[string]any); ok {
+			messages[i] = m
+		}
+	}
+	return messages
+}
+
+// count counts a prompt for a provider's model. OpenAI models are counted locally with
+// tiktoken. Other models are counted by the vendor when the provider supports it, and
+// estimated locally when it doesn't or the call fails.
+func (h *TokenizeHandler) count(ctx context.Context, pCfg *config.Provider, modelName string, messages []map[string]any, tools []any) tokenizer.Count {
+	local := tokenizer.CountMessages(pCfg.ProviderType(), modelName, messages, tools)
+	if local.Method == tokenizer.MethodTiktoken {
+		return local
+	}
+	prov, err := h.reg.Get(pCfg.ID)
+	if err != nil {
+		return local
+	}
+	counter, ok := prov.(provider.TokenCounter)
+	if !ok {
+		return local
+	}
+	ctx, cancel := context.WithTimeout(ctx, vendorCountTimeout)
+	defer cancel()
+	tokens, err := counter.CountTokens(ctx, &provider.LLMRequest{Model: modelName, Messages: messages, Tools: tools})
+	if err != nil {
+		logger := h.logger.GetLogger()
+		logger.Warn().Err(err).Str("operation", "count_tokens").Str("provider", pCfg.ID).Msg("Vendor token count failed, using local estimate")
+		return local
+	}
+	return tokenizer.Count{Tokens: tokens, Method: tokenizer.MethodVendor}
+}
+
+// resolve returns the provider and upstream model of a model the caller may use. On
+// failure it returns the status and message to respond with.
+func (h *TokenizeHandler) resolve(r *http.Request, model string) (*config.Provider, string, int, string) {
+	pCfg, modelName, err := h.selector.Resolve(model)
+	if err != nil {
+		return nil, "", http.StatusNotFound, "The model does not exist or you do not have access to it"
+	}
+	allowed, _ := r.Context().Value("allowed_providers").([]string)
+	if !providerAllowed(allowed, pCfg.ID) {
+		return nil, "", http.StatusForbidden, "Provider not allowed for this API key"
+	}
+	return pCfg, modelName, http.StatusOK, ""
+}
+
+// Handle serves POST /v1/tokenize, which takes a chat completions request body
+func (h *TokenizeHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidRequest(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, _ := req["model"].(string)
+	if model == "" {
+		writeInvalidRequest(w, "model is required", http.StatusBadRequest)
+		return
+	}
+	pCfg, modelName, status, message := h.resolve(r, model)
+	if pCfg == nil {
+		writeAPIError(w, status, errorTypeForStatus(status), "", "", message)
+		return
+	}
+
+	tools, _ := req["tools"].([]any)
+	count := h.count(r.Context(), pCfg, modelName, chatMessages(req), tools)
+	resp := TokenizeResponse{
+		Object:      "tokenize",
+		Model:       modelName,
+		Provider:    pCfg.ID,
+		InputTokens: count.Tokens,
+		Method:      count.Method,
+		Encoding:    count.Encoding,
+	}
+	if spec, ok := h.selector.ModelSpec(pCfg, modelName); ok {
+		resp.ContextWindow = spec.ContextWindow
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeAnthropicError writes an error in the shape of Anthropic's API
+func writeAnthropicError(w http.ResponseWriter, errType, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": "error", "error": map[string]string{"type": errType, "message": message}})
+}
+
+// anthropicMessages converts an Anthropic Messages request to chat messages, with its
+// top-level system prompt as the first message. Content blocks are kept as content parts.
+func anthropicMessages(req map[string]any) []map[string]any {
+	var messages []map[string]any
+	switch system := req["system"].(type) {
+	case string:
+		if system != "" {
+			messages = append(messages, map[string]any{"role": "system", "content": system})
+		}
+	case []any:
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+	return append(messages, chatMessages(req)...)
+}
+
+// HandleCountTokens serves POST /v1/messages/count_tokens, which takes an Anthropic
+// Messages request body and answers like Anthropic's endpoint of the same name
+func (h *TokenizeHandler) HandleCountTokens(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, "invalid_request_error", err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, _ := req["model"].(string)
+	if model == "" {
+		writeAnthropicError(w, "invalid_request_error", "model: Field required", http.StatusBadRequest)
+		return
+	}
+	pCfg, modelName, status, message := h.resolve(r, model)
+	if pCfg == nil {
+		errType := "not_found_error"
+		if status == http.StatusForbidden {
+			errType = "permission_error"
+		}
+		writeAnthropicError(w, errType, message, status)
+		return
+	}
+
+	tools, _ := req["tools"].([]any)
+	count := h.count(r.Context(), pCfg, modelName, anthropicMessages(req), tools)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"input_tokens": count.Tokens})
+}
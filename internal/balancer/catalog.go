@@ -0,0 +1,33 @@
+package balancer
+
+import (
+	"github.com/user/coo-llm/internal/config"
+)
+
+// ModelSpec returns the catalog entry of a provider's model, from the config's models
+// or the built-in catalog, or false if neither knows the model
+func (s *Selector) ModelSpec(pCfg *config.Provider, model string) (config.ModelSpec, bool) {
+	return s.catalog.Load().Lookup(pCfg.ID, pCfg.ProviderType(), model)
+}
+
+// Pricing returns the price of a provider's model: the catalog's when it has one,
+// otherwise the provider-wide pricing
+func (s *Selector) Pricing(pCfg *config.Provider, model string) config.Pricing {
+	if spec, ok := s.ModelSpec(pCfg, model); ok && spec.Pricing != (config.Pricing{}) {
+		return spec.Pricing
+	}
+	return pCfg.Pricing
+}
+
+// MaxOutputTokens returns the most output tokens a request to a provider's model may
+// ask for: the lower of the provider's limits.max_tokens and the model's max output,
+// or 0 if neither is known
+func (s *Selector) MaxOutputTokens(pCfg *config.Provider, model string) int {
+	limit := pCfg.Limits.MaxTokens
+	if spec, ok := s.ModelSpec(pCfg, model); ok && spec.MaxOutputTokens > 0 {
+		if limit <= 0 || spec.MaxOutputTokens < limit {
+			limit = spec.MaxOutputTokens
+		}
+	}
+	return limit
+}
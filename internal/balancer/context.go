@@ -0,0 +1,113 @@
+package balancer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContextLengthError is returned for a request whose prompt and completion don't fit
+// the model's context window
+type ContextLengthError struct {
+	Model         string
+	ContextWindow int
+	PromptTokens  int
+	MaxTokens     int
+}
+
+// Error reads like OpenAI's, so clients that match on it keep working
+func (e *ContextLengthError) Error() string {
+	return fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.",
+		e.ContextWindow, e.PromptTokens+e.MaxTokens, e.PromptTokens, e.MaxTokens)
+}
+
+// PromptEstimator estimates the prompt tokens of a request for a provider type and model
+type PromptEstimator func(providerType, model string) int
+
+// contextFit is a model with the request's size for it
+type contextFit struct {
+	model         string
+	contextWindow int
+	promptTokens  int
+	maxTokens     int
+}
+
+func (f contextFit) fits() bool {
+	return f.contextWindow <= 0 || f.promptTokens+f.maxTokens <= f.contextWindow
+}
+
+// fitFor sizes a request for a model. Max tokens are capped like they are when the
+// request is sent.
+func (s *Selector) fitFor(model string, maxTokens int, estimate PromptEstimator) (contextFit, string, bool) {
+	pCfg, modelName, err := s.Resolve(model)
+	if err != nil {
+		return contextFit{}, "", false
+	}
+	if limit := s.MaxOutputTokens(pCfg, modelName); limit > 0 && maxTokens > limit {
+		maxTokens = limit
+	}
+	fit := contextFit{model: model, promptTokens: estimate(pCfg.ProviderType(), modelName), maxTokens: maxTokens}
+	if spec, ok := s.ModelSpec(pCfg, modelName); ok {
+		fit.contextWindow = spec.ContextWindow
+	}
+	return fit, pCfg.ID + ":" + modelName, true
+}
+
+// FitContext returns the model a request should be sent to and its estimated prompt
+// tokens. That is the requested model when the prompt and max tokens fit its context
+// window, or when the window isn't known. Otherwise it is the member of a routing group
+// of the model with the smallest window that fits the request, among the providers
+// allow accepts (nil allows all), or a *ContextLengthError if there is none.
+func (s *Selector) FitContext(model string, maxTokens int, estimate PromptEstimator, allow func(providerID string) bool) (string, int, error) {
+	fit, resolved, ok := s.fitFor(model, maxTokens, estimate)
+	if !ok {
+		// Unroutable models fail when they are selected
+		return model, 0, nil
+	}
+	if fit.fits() {
+		return model, fit.promptTokens, nil
+	}
+
+	var best *contextFit
+	for _, group := range s.Config().RoutingGroups {
+		if !groupHas(group.Models, model, resolved) {
+			continue
+		}
+		for _, member := range group.Models {
+			if member == model || member == resolved {
+				continue
+			}
+			candidate, candidateResolved, ok := s.fitFor(member, maxTokens, estimate)
+			if !ok || candidate.contextWindow <= 0 || !candidate.fits() {
+				continue
+			}
+			if allow != nil {
+				if providerID, _, _ := strings.Cut(candidateResolved, ":"); !allow(providerID) {
+					continue
+				}
+			}
+			if best == nil || candidate.contextWindow < best.contextWindow {
+				best = &candidate
+			}
+		}
+	}
+	if best != nil {
+		return best.model, best.promptTokens, nil
+	}
+	return "", fit.promptTokens, &ContextLengthError{
+		Model:         model,
+		ContextWindow: fit.contextWindow,
+		PromptTokens:  fit.promptTokens,
+		MaxTokens:     fit.maxTokens,
+	}
+}
+
+func groupHas(members []string, names ...string) bool {
+	for _, m := range members {
+		for _, name := range names {
+			if m == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/config"
+)
+
+func TestFitContext(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai-prod", Type: "openai", APIKeys: []string{"sk-test"}, Model: "gpt-4"},
+			{ID: "claude-prod", Type: "claude", APIKeys: []string{"sk-ant"}, Model: "claude-3-5-sonnet-20241022"},
+		},
+		ModelAliases: map[string]string{"smart": "openai-prod:gpt-4"},
+		RoutingGroups: []config.RoutingGroup{
+			{Name: "chat", Models: []string{"openai-prod:gpt-4", "claude-prod:claude-3-5-sonnet-20241022", "openai-prod:gpt-4o", "openai-prod:gpt-3.5-turbo"}},
+		},
+	}
+	selector := NewSelector(cfg, newMockStoreProvider(), newTestLogger())
+	prompt := func(tokens int) PromptEstimator {
+		return func(providerType, model string) int { return tokens }
+	}
+
+	// A request that fits its model stays on it
+	model, tokens, err := selector.FitContext("smart", 1000, prompt(5000), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "smart", model)
+	assert.Equal(t, 5000, tokens)
+
+	// Oversize requests go to the smallest window that fits them
+	model, _, err = selector.FitContext("smart", 1000, prompt(10000), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "openai-prod:gpt-3.5-turbo", model)
+	model, _, err = selector.FitContext("openai-prod:gpt-4", 1000, prompt(100000), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "openai-prod:gpt-4o", model)
+
+	// Members of providers that aren't allowed are skipped
+	model, _, err = selector.FitContext("smart", 1000, prompt(150000), func(providerID string) bool { return providerID != "claude-prod" })
+	var ctxErr *ContextLengthError
+	require.ErrorAs(t, err, &ctxErr)
+	assert.Empty(t, model)
+	assert.Equal(t, ContextLengthError{Model: "smart", ContextWindow: 8192, PromptTokens: 150000, MaxTokens: 1000}, *ctxErr)
+	assert.Contains(t, err.Error(), "maximum context length is 8192 tokens. However, you requested 151000 tokens (150000 in the messages, 1000 in the completion)")
+
+	model, _, err = selector.FitContext("smart", 1000, prompt(150000), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "claude-prod:claude-3-5-sonnet-20241022", model)
+
+	// Models without a known window are passed through
+	model, tokens, err = selector.FitContext("openai-prod:my-finetune", 1000, prompt(1000000), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "openai-prod:my-finetune", model)
+	assert.Equal(t, 1000000, tokens)
+}
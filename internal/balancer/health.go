@@ -0,0 +1,115 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// CircuitState is whether a provider is receiving traffic
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // Normal operation
+	CircuitOpen     CircuitState = "open"      // Too many consecutive failures; skipped as a fallback
+	CircuitHalfOpen CircuitState = "half_open" // Cooldown over; the next attempt decides
+)
+
+// Circuit breaker defaults
+const (
+	DefaultCircuitFailureThreshold = 5
+	DefaultCircuitCooldown         = 30 * time.Second
+)
+
+// ProviderHealth is the recent outcome history of one provider
+type ProviderHealth struct {
+	Provider            string       `json:"provider"`
+	LastSuccess         *time.Time   `json:"last_success,omitempty"`
+	LastError           string       `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time   `json:"last_error_at,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Circuit             CircuitState `json:"circuit"`
+	openedAt            time.Time
+}
+
+// HealthTracker records upstream outcomes per provider and keeps a circuit for each.
+// A circuit opens after FailureThreshold consecutive upstream failures, half-opens
+// after Cooldown and closes again on the next success.
+type HealthTracker struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	mu        sync.Mutex
+	providers map[string]*ProviderHealth
+	now       func() time.Time
+}
+
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{
+		FailureThreshold: DefaultCircuitFailureThreshold,
+		Cooldown:         DefaultCircuitCooldown,
+		providers:        make(map[string]*ProviderHealth),
+		now:              time.Now,
+	}
+}
+
+// countsAsFailure reports whether err says something about the provider itself,
+// rather than the request or one key
+func countsAsFailure(err error) bool {
+	_, class := provider.ClassifyError(err)
+	switch class {
+	case provider.ErrorClassTimeout, provider.ErrorClassUpstream5xx, provider.ErrorClassUnavailable, provider.ErrorClassOther:
+		return true
+	}
+	return false
+}
+
+// Record notes the outcome of one upstream call. Errors caused by the request or a
+// single key, such as invalid requests and rate limits, leave the circuit alone.
+func (t *HealthTracker) Record(providerID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.getLocked(providerID)
+	now := t.now()
+	if err == nil {
+		h.LastSuccess = &now
+		h.ConsecutiveFailures = 0
+		h.Circuit = CircuitClosed
+		return
+	}
+	h.LastError = err.Error()
+	h.LastErrorAt = &now
+	if !countsAsFailure(err) {
+		return
+	}
+	h.ConsecutiveFailures++
+	if h.Circuit == CircuitHalfOpen || h.ConsecutiveFailures >= t.FailureThreshold {
+		h.Circuit = CircuitOpen
+		h.openedAt = now
+	}
+}
+
+// Allow reports whether a provider's circuit lets traffic through
+func (t *HealthTracker) Allow(providerID string) bool {
+	return t.Get(providerID).Circuit != CircuitOpen
+}
+
+// Get returns a provider's health, with a closed circuit for providers never seen
+func (t *HealthTracker) Get(providerID string) ProviderHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.getLocked(providerID)
+}
+
+func (t *HealthTracker) getLocked(providerID string) *ProviderHealth {
+	h, ok := t.providers[providerID]
+	if !ok {
+		h = &ProviderHealth{Provider: providerID, Circuit: CircuitClosed}
+		t.providers[providerID] = h
+	}
+	if h.Circuit == CircuitOpen && t.now().Sub(h.openedAt) >= t.Cooldown {
+		h.Circuit = CircuitHalfOpen
+	}
+	return h
+}
@@ -0,0 +1,51 @@
+package balancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTrackerCircuit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tracker := NewHealthTracker()
+	tracker.FailureThreshold = 3
+	tracker.now = func() time.Time { return now }
+
+	// Unknown providers are allowed
+	assert.True(t, tracker.Allow("openai"))
+	assert.Equal(t, CircuitClosed, tracker.Get("openai").Circuit)
+
+	// Request errors and rate limits don't count against the provider
+	tracker.Record("openai", errors.New("API error: 400 Bad Request"))
+	tracker.Record("openai", errors.New("API error: 429 Too Many Requests"))
+	assert.Zero(t, tracker.Get("openai").ConsecutiveFailures)
+	assert.Equal(t, "API error: 429 Too Many Requests", tracker.Get("openai").LastError)
+
+	for i := 0; i < 3; i++ {
+		tracker.Record("openai", errors.New("API error: 503 Service Unavailable"))
+	}
+	health := tracker.Get("openai")
+	assert.Equal(t, CircuitOpen, health.Circuit)
+	assert.Equal(t, 3, health.ConsecutiveFailures)
+	require.NotNil(t, health.LastErrorAt)
+	assert.False(t, tracker.Allow("openai"))
+
+	// After the cooldown one attempt is let through; a failure opens the circuit again
+	now = now.Add(DefaultCircuitCooldown)
+	assert.Equal(t, CircuitHalfOpen, tracker.Get("openai").Circuit)
+	tracker.Record("openai", errors.New("request timed out"))
+	assert.Equal(t, CircuitOpen, tracker.Get("openai").Circuit)
+
+	// A success closes it
+	now = now.Add(DefaultCircuitCooldown)
+	tracker.Record("openai", nil)
+	health = tracker.Get("openai")
+	assert.Equal(t, CircuitClosed, health.Circuit)
+	assert.Zero(t, health.ConsecutiveFailures)
+	require.NotNil(t, health.LastSuccess)
+	assert.Equal(t, now, *health.LastSuccess)
+}
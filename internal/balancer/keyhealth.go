@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/user/coo-llm/internal/config"
+)
+
+// KeyStatus is the result of actively probing a key
+type KeyStatus string
+
+const (
+	KeyHealthy  KeyStatus = "healthy"
+	KeyDegraded KeyStatus = "degraded" // Slow, or failing for a reason that may pass
+	KeyDead     KeyStatus = "dead"     // Revoked, out of credit, or failing repeatedly
+)
+
+// KeyHealth is the last probe result for one key, shared through the runtime store
+type KeyHealth struct {
+	Provider  string    `json:"provider"`
+	KeyID     string    `json:"key_id"`
+	Status    KeyStatus `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	Failures  int       `json:"failures"` // Consecutive failed probes
+}
+
+// keyHealthRefresh is how long a key status read from the store is used before it is
+// read again. Probes made by this instance update it at once.
+const keyHealthRefresh = 10 * time.Second
+
+// keyHealthCache keeps key statuses in memory, so selection doesn't read the store for
+// every key of every request
+type keyHealthCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedKeyHealth
+}
+
+type cachedKeyHealth struct {
+	health KeyHealth
+	ok     bool // False if the key had no status
+	readAt time.Time
+}
+
+func (c *keyHealthCache) get(cacheKey string, now time.Time) (cachedKeyHealth, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[cacheKey]
+	if !ok || now.Sub(entry.readAt) >= keyHealthRefresh {
+		return cachedKeyHealth{}, false
+	}
+	return entry, true
+}
+
+func (c *keyHealthCache) set(cacheKey string, entry cachedKeyHealth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedKeyHealth)
+	}
+	c.entries[cacheKey] = entry
+}
+
+// keyHealthCacheKey is the runtime store cache key holding a key's KeyHealth
+func keyHealthCacheKey(providerID, keyID string) string {
+	return "key_health:" + providerID + ":" + keyID
+}
+
+// KeyHealth returns the last probe result for a key, or false if it hasn't been
+// probed or the result expired. Results are read from the store at most every
+// keyHealthRefresh, so probes by other instances show up within that time.
+func (s *Selector) KeyHealth(providerID, keyID string) (KeyHealth, bool) {
+	if s.store == nil {
+		return KeyHealth{}, false
+	}
+	cacheKey := keyHealthCacheKey(providerID, keyID)
+	now := time.Now()
+	if entry, ok := s.keyHealth.get(cacheKey, now); ok {
+		return entry.health, entry.ok
+	}
+	entry := cachedKeyHealth{readAt: now}
+	if data, err := s.store.GetCache(cacheKey); err == nil && data != "" {
+		entry.ok = json.Unmarshal([]byte(data), &entry.health) == nil
+	}
+	if !entry.ok {
+		entry.health = KeyHealth{}
+	}
+	s.keyHealth.set(cacheKey, entry)
+	return entry.health, entry.ok
+}
+
+// ProbedKeys returns the last probe result of each of a provider's keys that has one
+func (s *Selector) ProbedKeys(providerID string) []KeyHealth {
+	var results []KeyHealth
+	for _, target := range probeTargets(s.Config(), providerID) {
+		if health, ok := s.KeyHealth(target.providerID, target.keyID); ok {
+			results = append(results, health)
+		}
+	}
+	return results
+}
+
+// setKeyHealth stores a probe result until ttl passes
+func (s *Selector) setKeyHealth(health KeyHealth, ttl time.Duration) error {
+	if s.store == nil {
+		return nil
+	}
+	data, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	cacheKey := keyHealthCacheKey(health.Provider, health.KeyID)
+	if err := s.store.SetCache(cacheKey, string(data), int64(ttl.Seconds())); err != nil {
+		return err
+	}
+	s.keyHealth.set(cacheKey, cachedKeyHealth{health: health, ok: true, readAt: time.Now()})
+	return nil
+}
+
+// healthyKeys narrows a provider to its best probed keys: healthy or unprobed keys
+// first, then degraded ones. Dead keys are dropped unless every key is dead, in
+// which case the provider is returned unchanged and selection works as without probing.
+func (s *Selector) healthyKeys(pCfg *config.Provider) *config.Provider {
+	if !s.Config().Policy.HealthCheck.Enabled || len(pCfg.Keys) < 2 {
+		return pCfg
+	}
+	var healthy, degraded []config.Key
+	for _, key := range pCfg.Keys {
+		health, ok := s.KeyHealth(pCfg.ID, key.ID)
+		switch {
+		case !ok || health.Status == KeyHealthy:
+			healthy = append(healthy, key)
+		case health.Status == KeyDegraded:
+			degraded = append(degraded, key)
+		}
+	}
+	keys := healthy
+	if len(keys) == 0 {
+		keys = degraded
+	}
+	if len(keys) == 0 || len(keys) == len(pCfg.Keys) {
+		return pCfg
+	}
+	narrowed := *pCfg
+	narrowed.Keys = keys
+	return &narrowed
+}
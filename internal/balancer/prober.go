@@ -0,0 +1,239 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+)
+
+// Health check defaults, used when the config leaves them at zero
+const (
+	DefaultProbeInterval        = 5 * time.Minute
+	DefaultProbeJitter          = 30 * time.Second
+	DefaultProbeTimeout         = 10 * time.Second
+	DefaultProbeDegradedLatency = 5 * time.Second
+	DefaultProbeDeadAfter       = 3
+)
+
+// Probe methods
+const (
+	ProbeGenerate   = "generate"
+	ProbeListModels = "list_models"
+)
+
+// probeTarget is one key of one provider
+type probeTarget struct {
+	providerID string
+	keyID      string
+	llmCfg     *provider.LLMConfig
+}
+
+// Prober periodically calls every key of every provider and records the result as
+// KeyHealth in the runtime store, where the Selector reads it. Settings come from
+// policy.health_check of the config in effect at the start of each round.
+//
+// Background rounds run one after another. On-demand probes run alongside them, so
+// they never wait behind a round's jitter.
+type Prober struct {
+	selector    *Selector
+	logger      zerolog.Logger
+	newProvider func(*provider.LLMConfig) (provider.LLMProvider, error)
+}
+
+func NewProber(selector *Selector, logger zerolog.Logger) *Prober {
+	return &Prober{selector: selector, logger: logger, newProvider: provider.NewLLMProvider}
+}
+
+// healthCheckSettings fills in the defaults
+func healthCheckSettings(hc config.HealthCheck) config.HealthCheck {
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultProbeInterval
+	}
+	if hc.Jitter == 0 {
+		hc.Jitter = DefaultProbeJitter
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DefaultProbeTimeout
+	}
+	if hc.Method == "" {
+		hc.Method = ProbeGenerate
+	}
+	if hc.DegradedLatency <= 0 {
+		hc.DegradedLatency = DefaultProbeDegradedLatency
+	}
+	if hc.DeadAfter <= 0 {
+		hc.DeadAfter = DefaultProbeDeadAfter
+	}
+	return hc
+}
+
+// probeTargets lists every key to probe, optionally of one provider only
+func probeTargets(cfg *config.Config, providerID string) []probeTarget {
+	var targets []probeTarget
+	for _, lp := range cfg.LLMProviders {
+		if providerID != "" && lp.ID != providerID {
+			continue
+		}
+		for _, apiKey := range lp.APIKeys {
+			targets = append(targets, probeTarget{
+				providerID: lp.ID,
+				keyID:      keyID(lp.ID, apiKey),
+				llmCfg:     &provider.LLMConfig{Type: provider.ProviderType(lp.Type), APIKeys: []string{apiKey}, BaseURL: lp.BaseURL, Model: lp.Model},
+			})
+		}
+	}
+	// Legacy providers are only loaded when there are no llm_providers
+	if len(cfg.LLMProviders) == 0 {
+		for _, p := range cfg.Providers {
+			if providerID != "" && p.ID != providerID {
+				continue
+			}
+			for _, key := range p.Keys {
+				targets = append(targets, probeTarget{
+					providerID: p.ID,
+					keyID:      key.ID,
+					llmCfg:     &provider.LLMConfig{Type: provider.ProviderType(p.ID), APIKeys: []string{key.Secret}, BaseURL: p.BaseURL, Model: "gpt-4"},
+				})
+			}
+		}
+	}
+	return targets
+}
+
+// Probe checks every key now, or only the keys of providerID if it is not empty,
+// without jitter. It returns the new status of each key.
+func (p *Prober) Probe(ctx context.Context, providerID string) []KeyHealth {
+	return p.round(ctx, providerID, 0)
+}
+
+// round probes the targets concurrently, each after a random delay of up to jitter
+func (p *Prober) round(ctx context.Context, providerID string, jitter time.Duration) []KeyHealth {
+	cfg := p.selector.Config()
+	hc := healthCheckSettings(cfg.Policy.HealthCheck)
+	targets := probeTargets(cfg, providerID)
+	results := make([]KeyHealth, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target probeTarget) {
+			defer wg.Done()
+			// Spread probes out so a round doesn't hit every provider at once
+			if jitter > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				case <-ctx.Done():
+					return
+				}
+			}
+			results[i] = p.probeKey(ctx, target, hc)
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+// probeKey calls one key and records its new status
+func (p *Prober) probeKey(ctx context.Context, target probeTarget, hc config.HealthCheck) KeyHealth {
+	previous, _ := p.selector.KeyHealth(target.providerID, target.keyID)
+	health := KeyHealth{Provider: target.providerID, KeyID: target.keyID, CheckedAt: time.Now()}
+
+	start := time.Now()
+	err := p.call(ctx, target, hc)
+	health.LatencyMS = time.Since(start).Milliseconds()
+
+	switch {
+	case err == nil:
+		health.Status = KeyHealthy
+		if time.Since(start) >= hc.DegradedLatency {
+			health.Status = KeyDegraded
+			health.Error = fmt.Sprintf("slow probe: %dms", health.LatencyMS)
+		}
+	case errors.Is(err, context.Canceled):
+		return previous
+	default:
+		health.Error = err.Error()
+		health.Failures = previous.Failures + 1
+		health.Status = KeyDegraded
+		if keyIsDead(err) || health.Failures >= hc.DeadAfter {
+			health.Status = KeyDead
+		}
+	}
+
+	// The circuit hears about the provider itself, as with real requests
+	p.selector.Health().Record(target.providerID, err)
+
+	// Results outlive a missed round, then expire so a stopped prober doesn't pin keys
+	if err := p.selector.setKeyHealth(health, 3*hc.Interval); err != nil {
+		p.logger.Error().Err(err).Str("operation", "SetKeyHealth").Str("provider", health.Provider).Str("key_id", health.KeyID).Msg("store operation failed")
+	}
+	if health.Status != previous.Status {
+		p.logger.Info().Str("provider", health.Provider).Str("key_id", health.KeyID).Str("status", string(health.Status)).Str("error", health.Error).Msg("key health changed")
+	}
+	return health
+}
+
+// call makes the cheapest request the probe method allows, with a single-key provider
+func (p *Prober) call(ctx context.Context, target probeTarget, hc config.HealthCheck) error {
+	prov, err := p.newProvider(target.llmCfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	if hc.Method == ProbeListModels {
+		_, err = prov.ListModels(ctx)
+		return err
+	}
+	_, err = prov.Generate(ctx, &provider.LLMRequest{
+		Messages:  []map[string]any{{"role": "user", "content": "ping"}},
+		Model:     target.llmCfg.Model,
+		MaxTokens: 1,
+	})
+	return err
+}
+
+// keyIsDead reports whether an error means the key won't work until someone fixes it
+func keyIsDead(err error) bool {
+	status, class := provider.ClassifyError(err)
+	if class == provider.ErrorClassAuth || status == 402 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"insufficient_quota", "insufficient credit", "billing", "credit balance", "account deactivated"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start probes every interval, plus up to the configured jitter per key, until ctx
+// is done. Rounds are skipped while policy.health_check is disabled.
+func (p *Prober) Start(ctx context.Context) {
+	go func() {
+		for {
+			hc := healthCheckSettings(p.selector.Config().Policy.HealthCheck)
+			if hc.Enabled {
+				jitter := hc.Jitter
+				if jitter < 0 {
+					jitter = 0
+				}
+				p.round(ctx, "", jitter)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(hc.Interval):
+			}
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/provider"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// probeProvider answers probes with the error scripted for its key
+type probeProvider struct {
+	provider.LLMProvider
+	err error
+}
+
+func (p *probeProvider) Generate(ctx context.Context, req *provider.LLMRequest) (*provider.LLMResponse, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &provider.LLMResponse{Text: "p"}, nil
+}
+
+func TestProberMarksKeysAndFeedsSelection(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai", Type: "openai", APIKeys: []string{"sk-good", "sk-flaky", "sk-revoked"}, Model: "gpt-4o-mini"},
+		},
+		Policy: config.Policy{Algorithm: "round_robin", HealthCheck: config.HealthCheck{Enabled: true, DeadAfter: 2}},
+	}
+	memory, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	selector := NewSelector(cfg, store.NewStoreProviderWrapper(memory, store.NewSimpleConfigStore(memory)), nil)
+
+	var mu sync.Mutex
+	errs := map[string]error{
+		"sk-flaky":   errors.New("API error: 503 Service Unavailable"),
+		"sk-revoked": errors.New("API error: 401 Unauthorized"),
+	}
+	prober := NewProber(selector, zerolog.Nop())
+	prober.newProvider = func(c *provider.LLMConfig) (provider.LLMProvider, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return &probeProvider{err: errs[c.APIKeys[0]]}, nil
+	}
+
+	status := func(results []KeyHealth) map[string]KeyStatus {
+		byKey := map[string]KeyStatus{}
+		for _, r := range results {
+			byKey[r.KeyID] = r.Status
+		}
+		return byKey
+	}
+	good, flaky, revoked := keyID("openai", "sk-good"), keyID("openai", "sk-flaky"), keyID("openai", "sk-revoked")
+
+	// A revoked key is dead at once; a transient failure only degrades a key
+	got := status(prober.Probe(context.Background(), ""))
+	assert.Equal(t, map[string]KeyStatus{good: KeyHealthy, flaky: KeyDegraded, revoked: KeyDead}, got)
+
+	// Selection only uses the healthy key
+	for i := 0; i < 20; i++ {
+		_, key, _, err := selector.SelectBest("openai:gpt-4o-mini")
+		require.NoError(t, err)
+		assert.Equal(t, good, key.ID)
+	}
+
+	// Repeated failures kill a key; recovery makes it healthy again
+	got = status(prober.Probe(context.Background(), "openai"))
+	assert.Equal(t, KeyDead, got[flaky])
+	mu.Lock()
+	errs["sk-flaky"] = nil
+	mu.Unlock()
+	got = status(prober.Probe(context.Background(), "openai"))
+	assert.Equal(t, KeyHealthy, got[flaky])
+	health, ok := selector.KeyHealth("openai", flaky)
+	require.True(t, ok)
+	assert.Zero(t, health.Failures)
+	assert.Len(t, selector.ProbedKeys("openai"), 3)
+
+	// With every key dead, selection carries on as if nothing was probed
+	mu.Lock()
+	errs["sk-good"] = errors.New("API error: 401 Unauthorized")
+	errs["sk-flaky"] = errors.New("API error: 401 Unauthorized")
+	mu.Unlock()
+	prober.Probe(context.Background(), "")
+	_, key, _, err := selector.SelectBest("openai:gpt-4o-mini")
+	require.NoError(t, err)
+	assert.NotNil(t, key)
+
+	// Probes of an unknown provider do nothing
+	assert.Empty(t, prober.Probe(context.Background(), "missing"))
+}
+
+func TestKeyIsDead(t *testing.T) {
+	assert.True(t, keyIsDead(errors.New("API error: 401 Unauthorized")))
+	assert.True(t, keyIsDead(errors.New("status code: 429, insufficient_quota: You exceeded your current quota")))
+	assert.True(t, keyIsDead(errors.New("API error: 402 Payment Required")))
+	assert.False(t, keyIsDead(errors.New("API error: 429 Too Many Requests")))
+	assert.False(t, keyIsDead(errors.New("request timed out")))
+}
+
+// countingStore counts the key status reads that reach the store
+type countingStore struct {
+	store.StoreProvider
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingStore) GetCache(key string) (string, error) {
+	if strings.HasPrefix(key, "key_health:") {
+		c.mu.Lock()
+		c.reads++
+		c.mu.Unlock()
+	}
+	return c.StoreProvider.GetCache(key)
+}
+
+func TestKeyHealthIsCachedInMemory(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{
+			{ID: "openai", Type: "openai", APIKeys: []string{"sk-good", "sk-revoked"}, Model: "gpt-4o-mini"},
+		},
+		Policy: config.Policy{Algorithm: "round_robin", HealthCheck: config.HealthCheck{Enabled: true, Jitter: time.Hour}},
+	}
+	memory, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	counting := &countingStore{StoreProvider: store.NewStoreProviderWrapper(memory, store.NewSimpleConfigStore(memory))}
+	selector := NewSelector(cfg, counting, nil)
+	prober := NewProber(selector, zerolog.Nop())
+	prober.newProvider = func(c *provider.LLMConfig) (provider.LLMProvider, error) {
+		if c.APIKeys[0] == "sk-revoked" {
+			return &probeProvider{err: errors.New("API error: 401 Unauthorized")}, nil
+		}
+		return &probeProvider{}, nil
+	}
+
+	// A background round waiting out its jitter doesn't hold up an on-demand probe
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	prober.Start(ctx)
+	done := make(chan []KeyHealth)
+	go func() { done <- prober.Probe(context.Background(), "") }()
+	select {
+	case results := <-done:
+		assert.Len(t, results, 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("on-demand probe waited for the background round")
+	}
+
+	// Probe results are seen at once, and selection doesn't read them from the store
+	counting.mu.Lock()
+	counting.reads = 0
+	counting.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		_, key, _, err := selector.SelectBest("openai:gpt-4o-mini")
+		require.NoError(t, err)
+		assert.Equal(t, keyID("openai", "sk-good"), key.ID)
+	}
+	counting.mu.Lock()
+	assert.Zero(t, counting.reads)
+	counting.mu.Unlock()
+}
@@ -7,51 +7,96 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/user/coo-llm/internal/config"
 	"github.com/user/coo-llm/internal/log"
+	"github.com/user/coo-llm/internal/provider"
 	"github.com/user/coo-llm/internal/store"
 )
 
 type Selector struct {
-	cfg    *config.Config
-	store  store.StoreProvider
-	logger *log.Logger
+	cfg     atomic.Pointer[config.Config]
+	catalog atomic.Pointer[provider.Catalog] // Built from cfg's models when cfg is stored
+	mu      sync.Mutex                       // Serializes config updates
+	store   store.StoreProvider
+	logger  *log.Logger
+	health  *HealthTracker
+
+	keyHealth keyHealthCache // Probe results read from the store
 }
 
 func NewSelector(cfg *config.Config, store store.StoreProvider, logger *log.Logger) *Selector {
-	return &Selector{cfg: cfg, store: store, logger: logger}
+	s := &Selector{store: store, logger: logger, health: NewHealthTracker()}
+	s.storeConfig(cfg)
+	return s
 }
 
-// getCurrentPolicy loads the current policy from store, with fallback to config
+// Config returns the config in effect. It is replaced, never modified, so callers
+// can keep using it for the rest of a request.
+func (s *Selector) Config() *config.Config {
+	return s.cfg.Load()
+}
+
+// Health returns the upstream health and circuit state of each provider
+func (s *Selector) Health() *HealthTracker {
+	return s.health
+}
+
+// SetConfig replaces the config in effect
+func (s *Selector) SetConfig(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storeConfig(cfg)
+}
+
+// ApplySharedConfig merges the settings shared between instances into the config in effect
+func (s *Selector) ApplySharedConfig(shared *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storeConfig(config.MergeShared(s.cfg.Load(), shared))
+}
+
+// storeConfig puts cfg in effect along with the model catalog built from it
+func (s *Selector) storeConfig(cfg *config.Config) {
+	s.catalog.Store(provider.NewCatalog(cfg.Models))
+	s.cfg.Store(cfg)
+}
+
+// getCurrentPolicy returns the policy of the config in effect
 func (s *Selector) getCurrentPolicy() config.Policy {
-	// Try to load from store first
-	storedCfg, err := s.store.LoadConfig()
-	if err == nil && storedCfg != nil {
-		return storedCfg.Policy
-	}
+	return s.Config().Policy
+}
 
-	// Fallback to static config
-	if s.logger != nil {
-		logger := s.logger.GetLogger()
-		logger.Warn().Err(err).Msg("Failed to load policy from store, using static config")
+func (s *Selector) SelectBest(model string) (*config.Provider, *config.Key, string, error) {
+	pCfg, modelName, err := s.Resolve(model)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	key, err := s.selectKey(pCfg, modelName)
+	if err != nil {
+		return nil, nil, "", err
 	}
-	return s.cfg.Policy
+	return pCfg, key, modelName, nil
 }
 
-func (s *Selector) SelectBest(model string) (*config.Provider, *config.Key, string, error) {
+// Resolve returns the provider and model name a model or alias routes to, without
+// selecting a key
+func (s *Selector) Resolve(model string) (*config.Provider, string, error) {
 	// Resolve provider from model alias
-	providerID, modelName := s.resolveModel(model)
+	cfg := s.Config()
+	providerID, modelName := s.resolveModel(cfg, model)
 	if providerID == "" {
-		return nil, nil, "", fmt.Errorf("model not found: %s", model)
+		return nil, "", fmt.Errorf("model not found: %s", model)
 	}
 
 	// Try LLMProviders first (new format)
-	for i := range s.cfg.LLMProviders {
-		if s.cfg.LLMProviders[i].ID == providerID {
+	for i := range cfg.LLMProviders {
+		if cfg.LLMProviders[i].ID == providerID {
 			// Convert LLMProvider to Provider format for backward compatibility
-			lp := s.cfg.LLMProviders[i]
+			lp := cfg.LLMProviders[i]
 			sessionLimit := lp.Limits.SessionLimit
 			if sessionLimit == 0 {
 				sessionLimit = lp.Limits.TokensPerMin * 60
@@ -62,11 +107,8 @@ func (s *Selector) SelectBest(model string) (*config.Provider, *config.Key, stri
 			}
 			keys := make([]config.Key, len(lp.APIKeys))
 			for j, apiKey := range lp.APIKeys {
-				// Use hash of API key as stable ID for consistency
-				h := sha256.Sum256([]byte(apiKey))
-				keyID := fmt.Sprintf("%s-%x", lp.ID, h[:8])
 				keys[j] = config.Key{
-					ID:                keyID,
+					ID:                keyID(lp.ID, apiKey),
 					Secret:            apiKey,
 					LimitReqPerMin:    lp.Limits.ReqPerMin,
 					LimitTokensPerMin: lp.Limits.TokensPerMin,
@@ -74,45 +116,43 @@ func (s *Selector) SelectBest(model string) (*config.Provider, *config.Key, stri
 					SessionType:       sessionType,
 				}
 			}
-			llmProvider := &config.Provider{
+			return &config.Provider{
 				ID:      lp.ID,
 				Name:    lp.Name,
+				Type:    lp.Type,
 				BaseURL: lp.BaseURL,
 				Limits:  lp.Limits,
 				Pricing: lp.Pricing,
 				Keys:    keys,
-			}
-			key, err := s.selectKey(llmProvider, modelName)
-			if err != nil {
-				return nil, nil, "", err
-			}
-			return llmProvider, key, modelName, nil
+			}, modelName, nil
 		}
 	}
 
 	// Fallback to legacy Providers
-	for i := range s.cfg.Providers {
-		if s.cfg.Providers[i].ID == providerID {
-			pCfg := &s.cfg.Providers[i]
-			key, err := s.selectKey(pCfg, modelName)
-			if err != nil {
-				return nil, nil, "", err
-			}
-			return pCfg, key, modelName, nil
+	for i := range cfg.Providers {
+		if cfg.Providers[i].ID == providerID {
+			return &cfg.Providers[i], modelName, nil
 		}
 	}
 
-	return nil, nil, "", fmt.Errorf("provider not found: %s", providerID)
+	return nil, "", fmt.Errorf("provider not found: %s", providerID)
 }
 
-func (s *Selector) resolveModel(model string) (string, string) {
+// keyID derives a stable key ID from a hash of the API key, so usage survives restarts
+// without exposing the key
+func keyID(providerID, apiKey string) string {
+	h := sha256.Sum256([]byte(apiKey))
+	return fmt.Sprintf("%s-%x", providerID, h[:8])
+}
+
+func (s *Selector) resolveModel(cfg *config.Config, model string) (string, string) {
 	// Check if model is in provider:model format
 	if colonIndex := strings.Index(model, ":"); colonIndex != -1 {
 		return model[:colonIndex], model[colonIndex+1:]
 	}
 
 	// Check model aliases
-	if alias, ok := s.cfg.ModelAliases[model]; ok {
+	if alias, ok := cfg.ModelAliases[model]; ok {
 		// Parse alias like "openai:gpt-4o"
 		parts := strings.Split(alias, ":")
 		if len(parts) == 2 {
@@ -126,6 +166,7 @@ func (s *Selector) resolveModel(model string) (string, string) {
 
 func (s *Selector) selectKey(pCfg *config.Provider, model string) (*config.Key, error) {
 	policy := s.getCurrentPolicy()
+	pCfg = s.healthyKeys(pCfg)
 	switch policy.Algorithm {
 	case "round_robin":
 		return s.selectRoundRobin(pCfg)
@@ -261,7 +302,7 @@ func (s *Selector) selectHybrid(pCfg *config.Provider, model string, policy conf
 	return best, nil
 }
 
-func (s *Selector) calculateScore(pCfg *config.Provider, key *config.Key, _ string, policy config.Policy) float64 {
+func (s *Selector) calculateScore(pCfg *config.Provider, key *config.Key, model string, policy config.Policy) float64 {
 	w := policy.HybridWeights
 
 	providerID := pCfg.ID
@@ -270,15 +311,20 @@ func (s *Selector) calculateScore(pCfg *config.Provider, key *config.Key, _ stri
 	errorScore, _ := s.store.GetUsage(providerID, key.ID, "errors")
 	latency, _ := s.store.GetUsage(providerID, key.ID, "latency")
 
-	// Estimate cost based on average tokens (assume 1000 tokens per request for simplicity)
-	avgTokens := 1000.0
-	estimatedCost := (pCfg.Pricing.InputTokenCost + pCfg.Pricing.OutputTokenCost) * avgTokens / 1000000
+	// Estimate the cost of a request to this model from the key's average request
+	// size, assuming 1000 tokens until it has served any
+	avgTokens := 1000
+	if reqUsage > 0 && tokenUsage > 0 {
+		avgTokens = int(tokenUsage / reqUsage)
+	}
+	pricing := s.Pricing(pCfg, model)
+	estimatedCost := (pricing.Cost(avgTokens, 0, 0) + pricing.Cost(0, 0, avgTokens)) / 2
 
 	score := w.ReqRatio*reqUsage + w.TokenRatio*tokenUsage + w.ErrorScore*errorScore + w.Latency*latency + w.CostRatio*estimatedCost
 
-	// Prioritize providers with higher MaxTokens (subtract to lower score)
-	if pCfg.Limits.MaxTokens > 0 {
-		score -= float64(pCfg.Limits.MaxTokens) / 1000.0 * 0.1 // Small weight for MaxTokens
+	// Prioritize models with a higher output limit (subtract to lower score)
+	if maxTokens := s.MaxOutputTokens(pCfg, model); maxTokens > 0 {
+		score -= float64(maxTokens) / 1000.0 * 0.1 // Small weight for MaxTokens
 	}
 
 	return score
@@ -302,6 +348,7 @@ func (s *Selector) SelectKeyForProvider(pCfg *config.Provider, model string) (*c
 
 func (s *Selector) GetRecommendedKey(pCfg *config.Provider, model string) *config.Key {
 	policy := s.getCurrentPolicy()
+	pCfg = s.healthyKeys(pCfg)
 	var best *config.Key
 	minScore := math.MaxFloat64
 	for i := range pCfg.Keys {
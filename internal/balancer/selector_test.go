@@ -186,11 +186,11 @@ func TestResolveModel(t *testing.T) {
 
 	selector := NewSelector(cfg, store, newTestLogger())
 
-	providerID, modelName := selector.resolveModel("gpt-4o")
+	providerID, modelName := selector.resolveModel(cfg, "gpt-4o")
 	assert.Equal(t, "openai", providerID)
 	assert.Equal(t, "gpt-4o", modelName)
 
-	providerID, modelName = selector.resolveModel("unknown")
+	providerID, modelName = selector.resolveModel(cfg, "unknown")
 	assert.Equal(t, "openai", providerID)
 	assert.Equal(t, "unknown", modelName)
 }
@@ -316,8 +316,48 @@ func TestCalculateScore(t *testing.T) {
 		SessionType:  "1h",
 	}
 	score := selector.calculateScore(pCfg, key, "gpt-4o", cfg.Policy)
-	expected := 0.2*10 + 0.3*1000 + 0.2*1 + 0.1*200 + 0.2*(0.01+0.02)*1000/1000000 - 4000.0/1000.0*0.1
-	assert.InDelta(t, expected, score, 0.001)
+	// gpt-4o is priced from the catalog, at the key's average of 100 tokens per request
+	expected := 0.2*10 + 0.3*1000 + 0.2*1 + 0.1*200 + 0.2*(100*2.5+100*10)/2/1000000 - 4000.0/1000.0*0.1
+	assert.InDelta(t, expected, score, 1e-9)
+
+	// Models the catalog doesn't know use the provider's pricing
+	score = selector.calculateScore(pCfg, key, "custom-model", cfg.Policy)
+	expected = 0.2*10 + 0.3*1000 + 0.2*1 + 0.1*200 + 0.2*(100*0.01+100*0.02)/2/1000000 - 4000.0/1000.0*0.1
+	assert.InDelta(t, expected, score, 1e-9)
+}
+
+func TestModelSpecPricingAndMaxOutput(t *testing.T) {
+	cfg := &config.Config{
+		Models: []config.ModelSpec{
+			{Provider: "openai-cheap", Model: "gpt-4o", Pricing: config.Pricing{InputTokenCost: 1}},
+		},
+	}
+	selector := NewSelector(cfg, newMockStoreProvider(), newTestLogger())
+	pCfg := &config.Provider{ID: "openai-prod", Type: "openai", Pricing: config.Pricing{InputTokenCost: 7, OutputTokenCost: 7}}
+
+	assert.Equal(t, config.Pricing{InputTokenCost: 2.5, OutputTokenCost: 10, CachedInputTokenCost: 1.25}, selector.Pricing(pCfg, "gpt-4o-2024-08-06"))
+	assert.Equal(t, pCfg.Pricing, selector.Pricing(pCfg, "my-finetune"))
+
+	// Overrides for one provider ID only change that provider's price
+	cheap := &config.Provider{ID: "openai-cheap", Type: "openai"}
+	assert.Equal(t, config.Pricing{InputTokenCost: 1, OutputTokenCost: 10, CachedInputTokenCost: 1.25}, selector.Pricing(cheap, "gpt-4o"))
+
+	assert.Equal(t, 16384, selector.MaxOutputTokens(pCfg, "gpt-4o"))
+	pCfg.Limits.MaxTokens = 1000
+	assert.Equal(t, 1000, selector.MaxOutputTokens(pCfg, "gpt-4o"))
+	assert.Equal(t, 1000, selector.MaxOutputTokens(pCfg, "my-finetune"))
+
+	// Legacy providers are looked up by their ID as the type
+	legacy := &config.Provider{ID: "claude"}
+	spec, ok := selector.ModelSpec(legacy, "claude-3-5-sonnet-20241022")
+	require.True(t, ok)
+	assert.Equal(t, 200000, spec.ContextWindow)
+
+	// The catalog follows the config in effect
+	selector.SetConfig(&config.Config{})
+	assert.Equal(t, config.Pricing{InputTokenCost: 2.5, OutputTokenCost: 10, CachedInputTokenCost: 1.25}, selector.Pricing(cheap, "gpt-4o"))
+	selector.ApplySharedConfig(cfg)
+	assert.Equal(t, config.Pricing{InputTokenCost: 1, OutputTokenCost: 10, CachedInputTokenCost: 1.25}, selector.Pricing(cheap, "gpt-4o"))
 }
 
 func TestUpdateUsage(t *testing.T) {
@@ -333,3 +373,29 @@ func TestUpdateUsage(t *testing.T) {
 	val, _ = store.GetUsage("openai", "key1", "req")
 	assert.Equal(t, 8.0, val)
 }
+
+func TestSelectorApplySharedConfig(t *testing.T) {
+	cfg := &config.Config{
+		LLMProviders: []config.LLMProvider{{ID: "openai", Type: "openai", APIKeys: []string{"sk-test"}, Model: "gpt-4o"}},
+		Policy:       config.Policy{Algorithm: "round_robin"},
+	}
+	selector := NewSelector(cfg, newMockStoreProvider(), newTestLogger())
+
+	_, _, model, err := selector.SelectBest("fast")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", model, "without an alias the model name is used as is")
+
+	shared := &config.Config{
+		ModelAliases: map[string]string{"fast": "openai:gpt-4o-mini"},
+		Policy:       config.Policy{Algorithm: "least_loaded"},
+	}
+	selector.ApplySharedConfig(shared)
+
+	assert.Equal(t, "least_loaded", selector.getCurrentPolicy().Algorithm)
+	pCfg, key, model, err := selector.SelectBest("fast")
+	require.NoError(t, err)
+	assert.Equal(t, "openai", pCfg.ID)
+	assert.Equal(t, "gpt-4o-mini", model)
+	assert.Equal(t, "sk-test", key.Secret, "provider keys stay local")
+	assert.Equal(t, "round_robin", cfg.Policy.Algorithm, "the original config is not modified")
+}
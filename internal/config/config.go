@@ -18,15 +18,17 @@ type APIKeyConfig struct {
 }
 
 type Config struct {
-	Version      string            `yaml:"version" mapstructure:"version"`
-	Server       Server            `yaml:"server" mapstructure:"server"`
-	Logging      Logging           `yaml:"logging" mapstructure:"logging"`
-	Storage      Storage           `yaml:"storage" mapstructure:"storage"`
-	LLMProviders []LLMProvider     `yaml:"llm_providers" mapstructure:"llm_providers"`
-	Providers    []Provider        `yaml:"providers" mapstructure:"providers"` // Legacy
-	APIKeys      []APIKeyConfig    `yaml:"api_keys" mapstructure:"api_keys"`
-	ModelAliases map[string]string `yaml:"model_aliases" mapstructure:"model_aliases"`
-	Policy       Policy            `yaml:"policy" mapstructure:"policy"`
+	Version       string            `yaml:"version" mapstructure:"version"`
+	Server        Server            `yaml:"server" mapstructure:"server"`
+	Logging       Logging           `yaml:"logging" mapstructure:"logging"`
+	Storage       Storage           `yaml:"storage" mapstructure:"storage"`
+	LLMProviders  []LLMProvider     `yaml:"llm_providers" mapstructure:"llm_providers"`
+	Providers     []Provider        `yaml:"providers" mapstructure:"providers"` // Legacy
+	APIKeys       []APIKeyConfig    `yaml:"api_keys" mapstructure:"api_keys"`
+	ModelAliases  map[string]string `yaml:"model_aliases" mapstructure:"model_aliases"`
+	Models        []ModelSpec       `yaml:"models" mapstructure:"models"`                 // Overrides of the built-in model catalog
+	RoutingGroups []RoutingGroup    `yaml:"routing_groups" mapstructure:"routing_groups"` // Interchangeable models a request may be rerouted between
+	Policy        Policy            `yaml:"policy" mapstructure:"policy"`
 }
 
 type LLMProvider struct {
@@ -53,6 +55,13 @@ type Server struct {
 	AdminAPIKey string `yaml:"admin_api_key" mapstructure:"admin_api_key"`
 	WebUI       WebUI  `yaml:"webui" mapstructure:"webui"`
 	CORS        CORS   `yaml:"cors" mapstructure:"cors"`
+
+	// Connection and shutdown timeouts. Zero uses the default, negative disables.
+	ReadTimeout     time.Duration `yaml:"read_timeout,omitempty" mapstructure:"read_timeout"`         // Reading a whole request
+	WriteTimeout    time.Duration `yaml:"write_timeout,omitempty" mapstructure:"write_timeout"`       // Writing a non-streaming response
+	IdleTimeout     time.Duration `yaml:"idle_timeout,omitempty" mapstructure:"idle_timeout"`         // Keep-alive connections between requests
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay,omitempty" mapstructure:"shutdown_delay"`     // Serving after /readyz turns unready, so load balancers stop routing here
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty" mapstructure:"shutdown_timeout"` // Draining in-flight requests and streams
 }
 
 type WebUI struct {
@@ -104,13 +113,33 @@ type BatchConfig struct {
 }
 
 type Storage struct {
-	Config  ConfigStore  `yaml:"config" mapstructure:"config"`
-	Runtime RuntimeStore `yaml:"runtime" mapstructure:"runtime"`
+	Config    ConfigStore     `yaml:"config" mapstructure:"config"`
+	Runtime   RuntimeStore    `yaml:"runtime" mapstructure:"runtime"`
+	Retention RetentionConfig `yaml:"retention" mapstructure:"retention"`
+	Buffer    BufferConfig    `yaml:"write_buffer" mapstructure:"write_buffer"`
+}
+
+// BufferConfig enables write-behind batching of usage increments and metric points
+type BufferConfig struct {
+	Enabled       bool          `yaml:"enabled" mapstructure:"enabled"`
+	FlushInterval time.Duration `yaml:"flush_interval" mapstructure:"flush_interval"` // How often pending writes are flushed
+	MaxPending    int           `yaml:"max_pending" mapstructure:"max_pending"`       // Pending writes that trigger an early flush
+}
+
+// RetentionConfig controls how long runtime data is kept. Zero uses the default, negative keeps data forever.
+type RetentionConfig struct {
+	Enabled            bool          `yaml:"enabled" mapstructure:"enabled"`
+	CompactionInterval time.Duration `yaml:"compaction_interval" mapstructure:"compaction_interval"` // How often the compactor runs
+	UsageHistory       time.Duration `yaml:"usage_history" mapstructure:"usage_history"`             // Raw usage history for sliding windows
+	MetricsRaw         time.Duration `yaml:"metrics_raw" mapstructure:"metrics_raw"`                 // Raw metric points before hourly rollup
+	MetricsHourly      time.Duration `yaml:"metrics_hourly" mapstructure:"metrics_hourly"`           // Hourly rollups before daily rollup
+	MetricsDaily       time.Duration `yaml:"metrics_daily" mapstructure:"metrics_daily"`             // Daily rollups before deletion
 }
 
 type ConfigStore struct {
-	Type string `yaml:"type" mapstructure:"type"`
-	Path string `yaml:"path" mapstructure:"path"`
+	Type         string        `yaml:"type" mapstructure:"type"`
+	Path         string        `yaml:"path" mapstructure:"path"`
+	SyncInterval time.Duration `yaml:"sync_interval,omitempty" mapstructure:"sync_interval"` // How often the shared config is checked for changes; negative disables
 }
 
 type RuntimeStore struct {
@@ -122,17 +151,31 @@ type RuntimeStore struct {
 	TableUsage   string `yaml:"table_usage" mapstructure:"table_usage"`
 	TableCache   string `yaml:"table_cache" mapstructure:"table_cache"`
 	TableHistory string `yaml:"table_history" mapstructure:"table_history"`
+	TableMetrics string `yaml:"table_metrics,omitempty" mapstructure:"table_metrics"` // DynamoDB metrics table, defaults to table_history
+	Endpoint     string `yaml:"endpoint,omitempty" mapstructure:"endpoint"`           // DynamoDB endpoint override, e.g. DynamoDB Local
+	// HTTP store client settings (type: http)
+	Timeout    time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+	MaxRetries int           `yaml:"max_retries,omitempty" mapstructure:"max_retries"`
 }
 
 type Provider struct {
 	ID      string  `yaml:"id" mapstructure:"id"`
 	Name    string  `yaml:"name,omitempty" mapstructure:"name,omitempty"`
+	Type    string  `yaml:"type,omitempty" mapstructure:"type,omitempty"` // Defaults to the ID
 	BaseURL string  `yaml:"base_url" mapstructure:"base_url"`
 	Keys    []Key   `yaml:"keys" mapstructure:"keys"`
 	Limits  Limits  `yaml:"limits" mapstructure:"limits"`
 	Pricing Pricing `yaml:"pricing" mapstructure:"pricing"`
 }
 
+// ProviderType returns the provider's type, which for legacy providers is their ID
+func (p *Provider) ProviderType() string {
+	if p.Type != "" {
+		return p.Type
+	}
+	return p.ID
+}
+
 type Key struct {
 	ID                string `yaml:"id" mapstructure:"id"`
 	Secret            string `yaml:"secret" mapstructure:"secret"`
@@ -142,9 +185,54 @@ type Key struct {
 	SessionType       string `yaml:"session_type" mapstructure:"session_type"`
 }
 
+// Pricing is in cost per 1 million tokens
 type Pricing struct {
-	InputTokenCost  float64 `yaml:"input_token_cost" mapstructure:"input_token_cost"`
-	OutputTokenCost float64 `yaml:"output_token_cost" mapstructure:"output_token_cost"`
+	InputTokenCost       float64 `yaml:"input_token_cost" mapstructure:"input_token_cost"`
+	OutputTokenCost      float64 `yaml:"output_token_cost" mapstructure:"output_token_cost"`
+	CachedInputTokenCost float64 `yaml:"cached_input_token_cost,omitempty" mapstructure:"cached_input_token_cost"` // Input tokens read from the vendor's prompt cache; 0 bills them as input
+}
+
+// Cost returns the cost of a request. cachedInputTokens are the part of inputTokens
+// served from the vendor's prompt cache.
+func (p Pricing) Cost(inputTokens, cachedInputTokens, outputTokens int) float64 {
+	cachedCost := p.CachedInputTokenCost
+	if cachedCost == 0 {
+		cachedCost = p.InputTokenCost
+	}
+	uncached := inputTokens - cachedInputTokens
+	if uncached < 0 {
+		uncached = 0
+	}
+	return (float64(uncached)*p.InputTokenCost + float64(cachedInputTokens)*cachedCost + float64(outputTokens)*p.OutputTokenCost) / 1000000
+}
+
+// ModelSpec describes one model for cost calculation, routing and request validation.
+// Entries in the config override the built-in catalog: zero fields keep the built-in
+// value, and capabilities replace the built-in ones when set.
+type ModelSpec struct {
+	Provider        string             `yaml:"provider" mapstructure:"provider"` // Provider type, or the ID of one provider
+	Model           string             `yaml:"model" mapstructure:"model"`
+	Pricing         Pricing            `yaml:"pricing" mapstructure:"pricing"`
+	ContextWindow   int                `yaml:"context_window" mapstructure:"context_window"`       // Input plus output tokens
+	MaxOutputTokens int                `yaml:"max_output_tokens" mapstructure:"max_output_tokens"` // Per request
+	Capabilities    *ModelCapabilities `yaml:"capabilities,omitempty" mapstructure:"capabilities"`
+}
+
+// ModelCapabilities are the request features a model supports
+type ModelCapabilities struct {
+	Tools         bool `yaml:"tools" mapstructure:"tools"`
+	Vision        bool `yaml:"vision" mapstructure:"vision"`
+	JSONMode      bool `yaml:"json_mode" mapstructure:"json_mode"`
+	Streaming     bool `yaml:"streaming" mapstructure:"streaming"`
+	EmbeddingDims int  `yaml:"embedding_dims,omitempty" mapstructure:"embedding_dims"` // Output dimensions of embedding models
+}
+
+// RoutingGroup lists models, as "provider:model", that can serve the same requests.
+// A request too large for its model's context window is sent to the member with the
+// smallest window that fits it.
+type RoutingGroup struct {
+	Name   string   `yaml:"name" mapstructure:"name"`
+	Models []string `yaml:"models" mapstructure:"models"`
 }
 
 type Policy struct {
@@ -155,6 +243,22 @@ type Policy struct {
 	Retry         RetryConfig    `yaml:"retry" mapstructure:"retry"`
 	Fallback      FallbackConfig `yaml:"fallback" mapstructure:"fallback"`
 	Cache         CacheConfig    `yaml:"cache" mapstructure:"cache"`
+	HealthCheck   HealthCheck    `yaml:"health_check" mapstructure:"health_check"`
+
+	StructuredOutput StructuredOutput `yaml:"structured_output" mapstructure:"structured_output"`
+
+	ModelsCacheTTL time.Duration `yaml:"models_cache_ttl" mapstructure:"models_cache_ttl"` // How long discovered models are kept; negative disables discovery
+}
+
+// HealthCheck controls active probing of provider keys. Zero durations use the defaults.
+type HealthCheck struct {
+	Enabled         bool          `yaml:"enabled" mapstructure:"enabled"`
+	Interval        time.Duration `yaml:"interval" mapstructure:"interval"`                 // Between probe rounds
+	Jitter          time.Duration `yaml:"jitter" mapstructure:"jitter"`                     // Random delay before each key's probe in a round
+	Timeout         time.Duration `yaml:"timeout" mapstructure:"timeout"`                   // Per probe
+	Method          string        `yaml:"method" mapstructure:"method"`                     // "generate" (one-token completion) or "list_models"
+	DegradedLatency time.Duration `yaml:"degraded_latency" mapstructure:"degraded_latency"` // Successful probes slower than this mark the key degraded
+	DeadAfter       int           `yaml:"dead_after" mapstructure:"dead_after"`             // Consecutive failed probes before a key is dead
 }
 
 type CacheConfig struct {
@@ -171,6 +275,11 @@ type RetryConfig struct {
 	Interval    time.Duration `yaml:"interval" mapstructure:"interval"`         // Interval between retries
 }
 
+// StructuredOutput controls how responses to JSON response_format requests are checked
+type StructuredOutput struct {
+	Repair bool `yaml:"repair" mapstructure:"repair"` // Ask the model once more to fix output that fails validation
+}
+
 type FallbackConfig struct {
 	Enabled      bool     `yaml:"enabled" mapstructure:"enabled"`             // Enable fallback to other providers
 	MaxProviders int      `yaml:"max_providers" mapstructure:"max_providers"` // Max fallback providers to try
@@ -212,17 +321,19 @@ func LoadConfig(path string) (*Config, error) {
 			return nil, fmt.Errorf("config file does not exist: %s", path)
 		}
 
-		viper.SetConfigFile(path)
-		viper.SetConfigType("yaml")
-		viper.AutomaticEnv()
-		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+		// A fresh viper instance per load, so a reload doesn't see keys from an earlier file
+		v := viper.New()
+		v.SetConfigFile(path)
+		v.SetConfigType("yaml")
+		v.AutomaticEnv()
+		v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 
-		if err := viper.ReadInConfig(); err != nil {
+		if err := v.ReadInConfig(); err != nil {
 			return nil, fmt.Errorf("failed to read config: %w", err)
 		}
 
 		// Unmarshal directly to struct (keep env var placeholders)
-		if err := viper.Unmarshal(&cfg); err != nil {
+		if err := v.Unmarshal(&cfg); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 		}
 	} else {
@@ -338,6 +449,30 @@ func ValidateConfig(cfg *Config) error {
 	if len(cfg.LLMProviders) == 0 && len(cfg.Providers) == 0 {
 		return fmt.Errorf("at least one provider is required")
 	}
+	for i, m := range cfg.Models {
+		if m.Provider == "" || m.Model == "" {
+			return fmt.Errorf("models[%d]: provider and model are required", i)
+		}
+		if m.ContextWindow < 0 || m.MaxOutputTokens < 0 {
+			return fmt.Errorf("models[%d]: context_window and max_output_tokens must not be negative", i)
+		}
+		if m.ContextWindow > 0 && m.MaxOutputTokens > m.ContextWindow {
+			return fmt.Errorf("models[%d]: max_output_tokens exceeds context_window", i)
+		}
+	}
+	for i, g := range cfg.RoutingGroups {
+		if g.Name == "" {
+			return fmt.Errorf("routing_groups[%d]: name is required", i)
+		}
+		if len(g.Models) < 2 {
+			return fmt.Errorf("routing_groups[%d]: at least two models are required", i)
+		}
+		for _, m := range g.Models {
+			if !strings.Contains(m, ":") {
+				return fmt.Errorf("routing_groups[%d]: model %q must be provider:model", i, m)
+			}
+		}
+	}
 	// Add more validations as needed
 	return nil
 }
@@ -346,8 +481,12 @@ func ValidateConfig(cfg *Config) error {
 func MaskSensitiveConfig(cfg *Config) *Config {
 	safeCfg := *cfg
 
-	// Remove sensitive providers entirely (they contain API keys)
-	safeCfg.LLMProviders = nil
+	// Share provider settings without their API keys
+	safeCfg.LLMProviders = make([]LLMProvider, len(cfg.LLMProviders))
+	for i, p := range cfg.LLMProviders {
+		p.APIKeys = nil
+		safeCfg.LLMProviders[i] = p
+	}
 
 	// Mask admin API key
 	if len(safeCfg.Server.AdminAPIKey) > 4 {
@@ -365,6 +504,33 @@ func MaskSensitiveConfig(cfg *Config) *Config {
 	return &safeCfg
 }
 
+// MergeShared returns a copy of local with the settings instances share taken from
+// shared: policy, model aliases, the model catalog, routing groups, client API keys, and the model,
+// pricing and limits of providers local already has. Provider credentials and everything else stay local.
+func MergeShared(local, shared *Config) *Config {
+	merged := *local
+	merged.Policy = shared.Policy
+	merged.ModelAliases = shared.ModelAliases
+	merged.Models = shared.Models
+	merged.RoutingGroups = shared.RoutingGroups
+	merged.APIKeys = shared.APIKeys
+
+	sharedProviders := make(map[string]LLMProvider, len(shared.LLMProviders))
+	for _, p := range shared.LLMProviders {
+		sharedProviders[p.ID] = p
+	}
+	merged.LLMProviders = make([]LLMProvider, len(local.LLMProviders))
+	for i, p := range local.LLMProviders {
+		if sp, ok := sharedProviders[p.ID]; ok {
+			p.Model = sp.Model
+			p.Pricing = sp.Pricing
+			p.Limits = sp.Limits
+		}
+		merged.LLMProviders[i] = p
+	}
+	return &merged
+}
+
 func SaveConfig(cfg *Config, path string) error {
 	data, err := yaml.Marshal(cfg)
 	if err != nil {
@@ -93,3 +93,75 @@ llm_providers:
 	assert.Equal(t, "${TEST_API_KEY}", cfg.LLMProviders[0].APIKeys[0])
 	assert.Equal(t, "${TEST_ADMIN_KEY}", cfg.Server.AdminAPIKey)
 }
+
+func TestMergeShared(t *testing.T) {
+	local := &Config{
+		Server: Server{Listen: ":2906", AdminAPIKey: "local-admin"},
+		LLMProviders: []LLMProvider{
+			{ID: "openai", Type: "openai", APIKeys: []string{"sk-local"}, Model: "gpt-4o", Limits: Limits{ReqPerMin: 100}},
+			{ID: "gemini", Type: "gemini", APIKeys: []string{"g-local"}, Model: "gemini-1.5-pro"},
+		},
+		Policy: Policy{Algorithm: "hybrid"},
+	}
+	other := *local
+	other.LLMProviders = []LLMProvider{{ID: "openai", Type: "openai", APIKeys: []string{"sk-other"}, Model: "gpt-4o-mini", Limits: Limits{ReqPerMin: 20}}}
+	other.Policy = Policy{Algorithm: "round_robin"}
+	other.ModelAliases = map[string]string{"fast": "openai:gpt-4o-mini"}
+	other.RoutingGroups = []RoutingGroup{{Name: "gpt", Models: []string{"openai:gpt-4", "openai:gpt-4o"}}}
+	other.APIKeys = []APIKeyConfig{{ID: "team", Key: "client-key", AllowedProviders: []string{"*"}}}
+	other.Server.AdminAPIKey = "other-admin"
+	shared := MaskSensitiveConfig(&other)
+	assert.Nil(t, shared.LLMProviders[0].APIKeys, "provider keys are not shared")
+
+	merged := MergeShared(local, shared)
+	assert.Equal(t, "round_robin", merged.Policy.Algorithm)
+	assert.Equal(t, "openai:gpt-4o-mini", merged.ModelAliases["fast"])
+	assert.Equal(t, other.RoutingGroups, merged.RoutingGroups)
+	require.Len(t, merged.APIKeys, 1)
+	assert.Equal(t, "client-key", merged.APIKeys[0].Key)
+
+	// Provider settings are shared, credentials and unknown providers stay local
+	require.Len(t, merged.LLMProviders, 2)
+	assert.Equal(t, "gpt-4o-mini", merged.LLMProviders[0].Model)
+	assert.Equal(t, 20, merged.LLMProviders[0].Limits.ReqPerMin)
+	assert.Equal(t, []string{"sk-local"}, merged.LLMProviders[0].APIKeys)
+	assert.Equal(t, "gemini-1.5-pro", merged.LLMProviders[1].Model)
+	assert.Equal(t, "local-admin", merged.Server.AdminAPIKey)
+
+	// The local config is left untouched
+	assert.Equal(t, "hybrid", local.Policy.Algorithm)
+	assert.Equal(t, "gpt-4o", local.LLMProviders[0].Model)
+}
+
+func TestPricingCost(t *testing.T) {
+	p := Pricing{InputTokenCost: 2, OutputTokenCost: 8, CachedInputTokenCost: 0.5}
+	assert.InDelta(t, (800*2+200*0.5+100*8)/1000000.0, p.Cost(1000, 200, 100), 1e-12)
+
+	// Without a cached price, cached tokens are billed as input
+	p.CachedInputTokenCost = 0
+	assert.InDelta(t, (1000*2+100*8)/1000000.0, p.Cost(1000, 200, 100), 1e-12)
+}
+
+func TestValidateConfigModels(t *testing.T) {
+	cfg := &Config{Version: "1", Server: Server{Listen: ":2906"}, LLMProviders: []LLMProvider{{ID: "openai", Type: "openai"}}}
+	cfg.Models = []ModelSpec{{Provider: "openai", Model: "gpt-4o", ContextWindow: 128000, MaxOutputTokens: 16384}}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Models = []ModelSpec{{Model: "gpt-4o"}}
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.Models = []ModelSpec{{Provider: "openai", Model: "gpt-4o", ContextWindow: 1000, MaxOutputTokens: 2000}}
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateConfigRoutingGroups(t *testing.T) {
+	cfg := &Config{Version: "1", Server: Server{Listen: ":2906"}, LLMProviders: []LLMProvider{{ID: "openai", Type: "openai"}}}
+	cfg.RoutingGroups = []RoutingGroup{{Name: "gpt", Models: []string{"openai:gpt-4", "openai:gpt-4o"}}}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.RoutingGroups = []RoutingGroup{{Models: []string{"openai:gpt-4", "openai:gpt-4o"}}}
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.RoutingGroups = []RoutingGroup{{Name: "gpt", Models: []string{"openai:gpt-4"}}}
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.RoutingGroups = []RoutingGroup{{Name: "gpt", Models: []string{"openai:gpt-4", "gpt-4o"}}}
+	assert.Error(t, ValidateConfig(cfg))
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a burst of file events must be quiet before onChange runs.
+// Editors and Kubernetes ConfigMap updates write a file in several steps.
+const watchDebounce = 500 * time.Millisecond
+
+// Watch calls onChange after the config file at path is written, created, renamed
+// or replaced, until ctx is done. It watches the file's directory, so atomic saves
+// and ConfigMap symlink swaps are seen as well as in-place writes.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	name := filepath.Base(path)
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// ConfigMaps swap a "..data" symlink rather than touching the file itself
+				base := filepath.Base(event.Name)
+				if base != name && base != "..data" {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					debounce = time.After(watchDebounce)
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			case <-debounce:
+				debounce = nil
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
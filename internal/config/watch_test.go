@@ -0,0 +1,38 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("version: \"1.0\"\n"), 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var changes atomic.Int32
+	require.NoError(t, Watch(ctx, path, func() { changes.Add(1) }))
+
+	// Other files in the directory are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("x"), 0o644))
+
+	// An atomic save and a burst of writes are reported once
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("version: \"2.0\"\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, path))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, os.WriteFile(path, []byte("version: \"3.0\"\n"), 0o644))
+	}
+	require.Eventually(t, func() bool { return changes.Load() == 1 }, 3*time.Second, 20*time.Millisecond)
+	time.Sleep(2 * watchDebounce)
+	assert.Equal(t, int32(1), changes.Load())
+}
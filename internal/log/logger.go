@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -11,8 +12,9 @@ import (
 )
 
 type Logger struct {
-	cfg    *config.Logging
-	logger zerolog.Logger
+	cfg     *config.Logging
+	logger  zerolog.Logger
+	sending sync.WaitGroup // Entries still being sent to log providers
 }
 
 type LogEntry struct {
@@ -41,12 +43,34 @@ func NewLogger(cfg *config.Logging) *Logger {
 
 func (l *Logger) LogRequest(ctx context.Context, entry *LogEntry) {
 	entry.Timestamp = time.Now().Format(time.RFC3339)
+	if entry.ReqID == "" {
+		entry.ReqID = RequestIDFromContext(ctx)
+	}
 	data, _ := json.Marshal(entry)
-	l.logger.Info().RawJSON("entry", data).Msg("request")
+	l.logger.Info().Str("request_id", entry.ReqID).RawJSON("entry", data).Msg("request")
 
 	// Send to providers if configured
 	for _, p := range l.cfg.Providers {
-		go l.sendToProvider(p, entry)
+		l.sending.Add(1)
+		go func(p config.LogProvider) {
+			defer l.sending.Done()
+			l.sendToProvider(p, entry)
+		}(p)
+	}
+}
+
+// Flush waits for entries still being sent to log providers, or until ctx is done
+func (l *Logger) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
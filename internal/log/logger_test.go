@@ -61,3 +61,44 @@ func TestSendToProvider(t *testing.T) {
 	// Test that it calls sendHTTP
 	logger.sendToProvider(cfg.Providers[0], entry)
 }
+
+func TestRequestIDContext(t *testing.T) {
+	assert.Equal(t, "", RequestIDFromContext(context.Background()))
+
+	ctx := WithRequestID(context.Background(), "req-abc")
+	assert.Equal(t, "req-abc", RequestIDFromContext(ctx))
+
+	// LogRequest fills a missing ReqID from the context
+	logger := NewLogger(&config.Logging{})
+	entry := &LogEntry{Provider: "openai"}
+	logger.LogRequest(ctx, entry)
+	assert.Equal(t, "req-abc", entry.ReqID)
+}
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, ValidRequestID("req-123_abc.DEF"))
+	assert.False(t, ValidRequestID(""))
+	assert.False(t, ValidRequestID("has space"))
+	assert.False(t, ValidRequestID("bad\nnewline"))
+	assert.False(t, ValidRequestID(string(make([]byte, 200))))
+
+	id := NewRequestID()
+	assert.Len(t, id, 32)
+	assert.True(t, ValidRequestID(id))
+	assert.NotEqual(t, id, NewRequestID())
+}
+
+func TestFlush(t *testing.T) {
+	cfg := &config.Logging{
+		Providers: []config.LogProvider{
+			{Type: "http", Name: "test", Endpoint: "http://example.com"},
+			{Type: "stdout", Name: "other"},
+		},
+	}
+	logger := NewLogger(cfg)
+
+	for i := 0; i < 10; i++ {
+		logger.LogRequest(context.Background(), &LogEntry{Provider: "openai"})
+	}
+	assert.NoError(t, logger.Flush(context.Background()))
+}
@@ -0,0 +1,156 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/user/coo-llm/internal/config"
+)
+
+// Capability sets shared by the built-in catalog
+var (
+	capsChat       = &config.ModelCapabilities{Tools: true, JSONMode: true, Streaming: true}
+	capsChatVision = &config.ModelCapabilities{Tools: true, Vision: true, JSONMode: true, Streaming: true}
+	capsClaude     = &config.ModelCapabilities{Tools: true, Vision: true, Streaming: true}
+	capsTextOnly   = &config.ModelCapabilities{Tools: true, Streaming: true}
+)
+
+// embeddingCaps describes an embedding model with the given output dimensions
+func embeddingCaps(dims int) *config.ModelCapabilities {
+	return &config.ModelCapabilities{EmbeddingDims: dims}
+}
+
+// builtinModels holds list prices (per 1 million tokens) and limits of well-known
+// models, keyed by provider type. Config entries override them.
+var builtinModels = []config.ModelSpec{
+	// OpenAI
+	{Provider: "openai", Model: "gpt-4o", Pricing: config.Pricing{InputTokenCost: 2.5, OutputTokenCost: 10, CachedInputTokenCost: 1.25}, ContextWindow: 128000, MaxOutputTokens: 16384, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4o-mini", Pricing: config.Pricing{InputTokenCost: 0.15, OutputTokenCost: 0.6, CachedInputTokenCost: 0.075}, ContextWindow: 128000, MaxOutputTokens: 16384, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4.1", Pricing: config.Pricing{InputTokenCost: 2, OutputTokenCost: 8, CachedInputTokenCost: 0.5}, ContextWindow: 1047576, MaxOutputTokens: 32768, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4.1-mini", Pricing: config.Pricing{InputTokenCost: 0.4, OutputTokenCost: 1.6, CachedInputTokenCost: 0.1}, ContextWindow: 1047576, MaxOutputTokens: 32768, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4.1-nano", Pricing: config.Pricing{InputTokenCost: 0.1, OutputTokenCost: 0.4, CachedInputTokenCost: 0.025}, ContextWindow: 1047576, MaxOutputTokens: 32768, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4-turbo", Pricing: config.Pricing{InputTokenCost: 10, OutputTokenCost: 30}, ContextWindow: 128000, MaxOutputTokens: 4096, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "gpt-4", Pricing: config.Pricing{InputTokenCost: 30, OutputTokenCost: 60}, ContextWindow: 8192, MaxOutputTokens: 8192, Capabilities: capsTextOnly},
+	{Provider: "openai", Model: "gpt-3.5-turbo", Pricing: config.Pricing{InputTokenCost: 0.5, OutputTokenCost: 1.5}, ContextWindow: 16385, MaxOutputTokens: 4096, Capabilities: capsChat},
+	{Provider: "openai", Model: "o1", Pricing: config.Pricing{InputTokenCost: 15, OutputTokenCost: 60, CachedInputTokenCost: 7.5}, ContextWindow: 200000, MaxOutputTokens: 100000, Capabilities: capsChatVision},
+	{Provider: "openai", Model: "o1-mini", Pricing: config.Pricing{InputTokenCost: 1.1, OutputTokenCost: 4.4, CachedInputTokenCost: 0.55}, ContextWindow: 128000, MaxOutputTokens: 65536, Capabilities: &config.ModelCapabilities{Streaming: true}},
+	{Provider: "openai", Model: "o3-mini", Pricing: config.Pricing{InputTokenCost: 1.1, OutputTokenCost: 4.4, CachedInputTokenCost: 0.55}, ContextWindow: 200000, MaxOutputTokens: 100000, Capabilities: capsChat},
+	{Provider: "openai", Model: "text-embedding-3-small", Pricing: config.Pricing{InputTokenCost: 0.02}, ContextWindow: 8191, Capabilities: embeddingCaps(1536)},
+	{Provider: "openai", Model: "text-embedding-3-large", Pricing: config.Pricing{InputTokenCost: 0.13}, ContextWindow: 8191, Capabilities: embeddingCaps(3072)},
+	{Provider: "openai", Model: "text-embedding-ada-002", Pricing: config.Pricing{InputTokenCost: 0.1}, ContextWindow: 8191, Capabilities: embeddingCaps(1536)},
+
+	// Anthropic
+	{Provider: "claude", Model: "claude-opus-4", Pricing: config.Pricing{InputTokenCost: 15, OutputTokenCost: 75, CachedInputTokenCost: 1.5}, ContextWindow: 200000, MaxOutputTokens: 32000, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-sonnet-4", Pricing: config.Pricing{InputTokenCost: 3, OutputTokenCost: 15, CachedInputTokenCost: 0.3}, ContextWindow: 200000, MaxOutputTokens: 64000, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-3-7-sonnet", Pricing: config.Pricing{InputTokenCost: 3, OutputTokenCost: 15, CachedInputTokenCost: 0.3}, ContextWindow: 200000, MaxOutputTokens: 64000, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-3-5-sonnet", Pricing: config.Pricing{InputTokenCost: 3, OutputTokenCost: 15, CachedInputTokenCost: 0.3}, ContextWindow: 200000, MaxOutputTokens: 8192, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-3-5-haiku", Pricing: config.Pricing{InputTokenCost: 0.8, OutputTokenCost: 4, CachedInputTokenCost: 0.08}, ContextWindow: 200000, MaxOutputTokens: 8192, Capabilities: capsTextOnly},
+	{Provider: "claude", Model: "claude-3-opus", Pricing: config.Pricing{InputTokenCost: 15, OutputTokenCost: 75, CachedInputTokenCost: 1.5}, ContextWindow: 200000, MaxOutputTokens: 4096, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-3-sonnet", Pricing: config.Pricing{InputTokenCost: 3, OutputTokenCost: 15}, ContextWindow: 200000, MaxOutputTokens: 4096, Capabilities: capsClaude},
+	{Provider: "claude", Model: "claude-3-haiku", Pricing: config.Pricing{InputTokenCost: 0.25, OutputTokenCost: 1.25, CachedInputTokenCost: 0.03}, ContextWindow: 200000, MaxOutputTokens: 4096, Capabilities: capsClaude},
+
+	// Google
+	{Provider: "gemini", Model: "gemini-2.5-pro", Pricing: config.Pricing{InputTokenCost: 1.25, OutputTokenCost: 10, CachedInputTokenCost: 0.31}, ContextWindow: 1048576, MaxOutputTokens: 65536, Capabilities: capsChatVision},
+	{Provider: "gemini", Model: "gemini-2.5-flash", Pricing: config.Pricing{InputTokenCost: 0.3, OutputTokenCost: 2.5, CachedInputTokenCost: 0.075}, ContextWindow: 1048576, MaxOutputTokens: 65536, Capabilities: capsChatVision},
+	{Provider: "gemini", Model: "gemini-2.0-flash", Pricing: config.Pricing{InputTokenCost: 0.1, OutputTokenCost: 0.4, CachedInputTokenCost: 0.025}, ContextWindow: 1048576, MaxOutputTokens: 8192, Capabilities: capsChatVision},
+	{Provider: "gemini", Model: "gemini-1.5-pro", Pricing: config.Pricing{InputTokenCost: 1.25, OutputTokenCost: 5}, ContextWindow: 2097152, MaxOutputTokens: 8192, Capabilities: capsChatVision},
+	{Provider: "gemini", Model: "gemini-1.5-flash", Pricing: config.Pricing{InputTokenCost: 0.075, OutputTokenCost: 0.3}, ContextWindow: 1048576, MaxOutputTokens: 8192, Capabilities: capsChatVision},
+	{Provider: "gemini", Model: "gemini-1.0-pro", Pricing: config.Pricing{InputTokenCost: 0.5, OutputTokenCost: 1.5}, ContextWindow: 32760, MaxOutputTokens: 8192, Capabilities: capsTextOnly},
+	{Provider: "gemini", Model: "text-embedding-004", ContextWindow: 2048, Capabilities: embeddingCaps(768)},
+
+	// xAI
+	{Provider: "grok", Model: "grok-3", Pricing: config.Pricing{InputTokenCost: 3, OutputTokenCost: 15}, ContextWindow: 131072, MaxOutputTokens: 131072, Capabilities: capsChat},
+	{Provider: "grok", Model: "grok-3-mini", Pricing: config.Pricing{InputTokenCost: 0.3, OutputTokenCost: 0.5}, ContextWindow: 131072, MaxOutputTokens: 131072, Capabilities: capsChat},
+	{Provider: "grok", Model: "grok-2", Pricing: config.Pricing{InputTokenCost: 2, OutputTokenCost: 10}, ContextWindow: 131072, MaxOutputTokens: 131072, Capabilities: capsChat},
+	{Provider: "grok", Model: "grok-beta", Pricing: config.Pricing{InputTokenCost: 5, OutputTokenCost: 15}, ContextWindow: 131072, MaxOutputTokens: 131072, Capabilities: capsChat},
+
+	// Mistral
+	{Provider: "mistral", Model: "mistral-large-latest", Pricing: config.Pricing{InputTokenCost: 2, OutputTokenCost: 6}, ContextWindow: 131072, MaxOutputTokens: 131072, Capabilities: capsChat},
+	{Provider: "mistral", Model: "mistral-small-latest", Pricing: config.Pricing{InputTokenCost: 0.2, OutputTokenCost: 0.6}, ContextWindow: 32768, MaxOutputTokens: 32768, Capabilities: capsChat},
+	{Provider: "mistral", Model: "codestral-latest", Pricing: config.Pricing{InputTokenCost: 0.3, OutputTokenCost: 0.9}, ContextWindow: 256000, MaxOutputTokens: 256000, Capabilities: capsChat},
+	{Provider: "mistral", Model: "mistral-embed", Pricing: config.Pricing{InputTokenCost: 0.1}, ContextWindow: 8192, Capabilities: embeddingCaps(1024)},
+
+	// Cohere
+	{Provider: "cohere", Model: "command-r-plus", Pricing: config.Pricing{InputTokenCost: 2.5, OutputTokenCost: 10}, ContextWindow: 128000, MaxOutputTokens: 4000, Capabilities: capsChat},
+	{Provider: "cohere", Model: "command-r", Pricing: config.Pricing{InputTokenCost: 0.15, OutputTokenCost: 0.6}, ContextWindow: 128000, MaxOutputTokens: 4000, Capabilities: capsChat},
+	{Provider: "cohere", Model: "embed-english-v3.0", Pricing: config.Pricing{InputTokenCost: 0.1}, ContextWindow: 512, Capabilities: embeddingCaps(1024)},
+	{Provider: "cohere", Model: "embed-multilingual-v3.0", Pricing: config.Pricing{InputTokenCost: 0.1}, ContextWindow: 512, Capabilities: embeddingCaps(1024)},
+
+	// Voyage
+	{Provider: "voyage", Model: "voyage-3.5", Pricing: config.Pricing{InputTokenCost: 0.06}, ContextWindow: 32000, Capabilities: embeddingCaps(1024)},
+	{Provider: "voyage", Model: "voyage-3.5-lite", Pricing: config.Pricing{InputTokenCost: 0.02}, ContextWindow: 32000, Capabilities: embeddingCaps(1024)},
+	{Provider: "voyage", Model: "voyage-3-large", Pricing: config.Pricing{InputTokenCost: 0.18}, ContextWindow: 32000, Capabilities: embeddingCaps(1024)},
+	{Provider: "voyage", Model: "voyage-code-3", Pricing: config.Pricing{InputTokenCost: 0.18}, ContextWindow: 32000, Capabilities: embeddingCaps(1024)},
+}
+
+// Catalog looks up model specs in the config's models, then the built-in catalog
+type Catalog struct {
+	overrides []config.ModelSpec
+}
+
+func NewCatalog(overrides []config.ModelSpec) *Catalog {
+	return &Catalog{overrides: overrides}
+}
+
+// findModel returns the entry in specs for a model served by providers of any of
+// the given names. Versioned names such as "gpt-4o-2024-08-06" fall back to the
+// longest entry they extend with a "-".
+func findModel(specs []config.ModelSpec, model string, providers ...string) (config.ModelSpec, bool) {
+	var best config.ModelSpec
+	found := false
+	for _, name := range providers {
+		if name == "" {
+			continue
+		}
+		for _, spec := range specs {
+			if spec.Provider != name {
+				continue
+			}
+			if spec.Model == model {
+				return spec, true
+			}
+			if strings.HasPrefix(model, spec.Model+"-") && len(spec.Model) > len(best.Model) {
+				best, found = spec, true
+			}
+		}
+		if found {
+			return best, true
+		}
+	}
+	return best, found
+}
+
+// Lookup returns the spec of a model served by the provider with the given ID and
+// type. Config entries for the provider ID win over ones for its type, and their
+// non-zero fields override the built-in entry. It returns false if neither knows
+// the model.
+func (c *Catalog) Lookup(providerID, providerType, model string) (config.ModelSpec, bool) {
+	spec, ok := findModel(builtinModels, model, providerType)
+	override, overridden := findModel(c.overrides, model, providerID, providerType)
+	if !overridden {
+		return spec, ok
+	}
+	if !ok {
+		return override, true
+	}
+
+	if override.Pricing.InputTokenCost != 0 {
+		spec.Pricing.InputTokenCost = override.Pricing.InputTokenCost
+	}
+	if override.Pricing.OutputTokenCost != 0 {
+		spec.Pricing.OutputTokenCost = override.Pricing.OutputTokenCost
+	}
+	if override.Pricing.CachedInputTokenCost != 0 {
+		spec.Pricing.CachedInputTokenCost = override.Pricing.CachedInputTokenCost
+	}
+	if override.ContextWindow != 0 {
+		spec.ContextWindow = override.ContextWindow
+	}
+	if override.MaxOutputTokens != 0 {
+		spec.MaxOutputTokens = override.MaxOutputTokens
+	}
+	if override.Capabilities != nil {
+		spec.Capabilities = override.Capabilities
+	}
+	spec.Provider = override.Provider
+	return spec, true
+}
@@ -3,6 +3,7 @@ package provider
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -36,8 +37,11 @@ func (p *ClaudeProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		if currentKey == "" {
 			return nil, fmt.Errorf("no API key available")
 		}
-		client := anthropic.NewClient(option.WithAPIKey(currentKey))
-		p.client = client
+		clientOpts := []option.RequestOption{option.WithAPIKey(currentKey)}
+		if p.cfg.BaseURL != "" {
+			clientOpts = append(clientOpts, option.WithBaseURL(p.cfg.BaseURL))
+		}
+		p.client = anthropic.NewClient(clientOpts...)
 
 		maxTokens := req.MaxTokens
 		if maxTokens == 0 {
@@ -48,30 +52,7 @@ func (p *ClaudeProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		if req.Model != "" {
 			modelName = req.Model
 		}
-		// Convert messages to Claude format
-		var messages []anthropic.MessageParam
-		if len(req.Messages) > 0 {
-			messages = make([]anthropic.MessageParam, len(req.Messages))
-			for i, msg := range req.Messages {
-				role, _ := msg["role"].(string)
-				content, _ := msg["content"].(string)
-
-				switch role {
-				case "user":
-					messages[i] = anthropic.NewUserMessage(anthropic.NewTextBlock(content))
-				case "assistant":
-					messages[i] = anthropic.NewAssistantMessage(anthropic.NewTextBlock(content))
-				default:
-					// Default to user message
-					messages[i] = anthropic.NewUserMessage(anthropic.NewTextBlock(content))
-				}
-			}
-		} else {
-			// Fallback to single message
-			messages = []anthropic.MessageParam{
-				anthropic.NewUserMessage(anthropic.NewTextBlock(req.Prompt)),
-			}
-		}
+		messages := claudeMessages(req)
 
 		claudeReq := anthropic.MessageNewParams{
 			Model:     anthropic.Model(modelName),
@@ -79,13 +60,22 @@ func (p *ClaudeProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 			Messages:  messages,
 		}
 
-		// Add params
-		if temp, ok := req.Params["temperature"].(float64); ok {
-			claudeReq.Temperature = anthropic.Float(temp)
+		// Add sampling params
+		opts := req.SamplingOptions()
+		if opts.Temperature != nil {
+			claudeReq.Temperature = anthropic.Float(*opts.Temperature)
 		}
-		if topP, ok := req.Params["top_p"].(float64); ok {
-			claudeReq.TopP = anthropic.Float(topP)
+		if opts.TopP != nil {
+			claudeReq.TopP = anthropic.Float(*opts.TopP)
 		}
+		if opts.TopK != nil {
+			claudeReq.TopK = anthropic.Int(int64(*opts.TopK))
+		}
+		claudeReq.StopSequences = opts.Stop
+		if opts.User != "" {
+			claudeReq.Metadata = anthropic.MetadataParam{UserID: anthropic.String(opts.User)}
+		}
+		setClaudeResponseFormat(&claudeReq, req.ResponseFormat)
 
 		resp, err := p.client.Messages.New(ctx, claudeReq)
 
@@ -95,24 +85,38 @@ func (p *ClaudeProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 				switch content := block.AsAny().(type) {
 				case anthropic.TextBlock:
 					text += content.Text
+				case anthropic.ToolUseBlock:
+					// Structured output comes back as the input of the forced tool call
+					if content.Name == claudeJSONTool {
+						text = string(content.Input)
+					}
 				}
 			}
 
 			if text != "" {
-				tokensUsed := int(resp.Usage.InputTokens + resp.Usage.OutputTokens)
+				// Anthropic counts cache reads apart from input tokens; they are reported
+				// as part of the input, like OpenAI does
+				inputTokens := int(resp.Usage.InputTokens + resp.Usage.CacheReadInputTokens)
+				tokensUsed := inputTokens + int(resp.Usage.OutputTokens)
 				// Update usage
 				p.cfg.UpdateUsage(1, tokensUsed)
 
 				return &LLMResponse{
-					Text:         text,
-					InputTokens:  int(resp.Usage.InputTokens),
-					OutputTokens: int(resp.Usage.OutputTokens),
-					TokensUsed:   tokensUsed,
-					FinishReason: string(resp.StopReason),
+					Text:              text,
+					InputTokens:       inputTokens,
+					CachedInputTokens: int(resp.Usage.CacheReadInputTokens),
+					OutputTokens:      int(resp.Usage.OutputTokens),
+					TokensUsed:        tokensUsed,
+					FinishReason:      string(resp.StopReason),
 				}, nil
 			}
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("Claude API error: %w", err)
+		}
+
 		// If error and not last attempt, try next key
 		if attempt < maxRetries-1 {
 			p.cfg.NextAPIKey()
@@ -139,7 +143,7 @@ func (p *ClaudeProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 			streamChan <- &LLMStreamResponse{Text: fmt.Sprintf("Error: %v", err), Done: true}
 			return
 		}
-		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true, Usage: resp.Usage()}
 	}()
 
 	return streamChan, nil
@@ -150,6 +154,140 @@ func (p *ClaudeProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 	return nil, fmt.Errorf("embeddings not supported by Claude provider")
 }
 
+// messageText returns a message's content as text: a string as is, or the text of
+// its text parts joined by newlines
+func messageText(content any) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []any:
+		var texts []string
+		for _, part := range c {
+			p, _ := part.(map[string]any)
+			if text, ok := p["text"].(string); ok && p["type"] == "text" {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
+
+// splitSystem returns the text of a request's system messages, joined by blank lines,
+// and its other messages
+func splitSystem(messages []map[string]any) (string, []map[string]any) {
+	var system []string
+	rest := make([]map[string]any, 0, len(messages))
+	for _, msg := range messages {
+		if msg["role"] == "system" {
+			if text := messageText(msg["content"]); text != "" {
+				system = append(system, text)
+			}
+			continue
+		}
+		rest = append(rest, msg)
+	}
+	return strings.Join(system, "\n\n"), rest
+}
+
+// toolSpec returns the name, description and parameter schema of a tool definition in
+// OpenAI's shape ({"type": "function", "function": {...}}) or Anthropic's ({"name": ...,
+// "input_schema": {...}})
+func toolSpec(tool any) (name, description string, schema map[string]any, ok bool) {
+	t, _ := tool.(map[string]any)
+	if fn, isFunction := t["function"].(map[string]any); isFunction {
+		name, _ = fn["name"].(string)
+		description, _ = fn["description"].(string)
+		schema, _ = fn["parameters"].(map[string]any)
+	} else {
+		name, _ = t["name"].(string)
+		description, _ = t["description"].(string)
+		schema, _ = t["input_schema"].(map[string]any)
+	}
+	return name, description, schema, name != ""
+}
+
+// claudeMessages converts a request's messages to Claude's format, or its prompt
+// when it has none
+func claudeMessages(req *LLMRequest) []anthropic.MessageParam {
+	if len(req.Messages) == 0 {
+		return []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock(req.Prompt)),
+		}
+	}
+	messages := make([]anthropic.MessageParam, len(req.Messages))
+	for i, msg := range req.Messages {
+		role, _ := msg["role"].(string)
+		content := messageText(msg["content"])
+
+		switch role {
+		case "user":
+			messages[i] = anthropic.NewUserMessage(anthropic.NewTextBlock(content))
+		case "assistant":
+			messages[i] = anthropic.NewAssistantMessage(anthropic.NewTextBlock(content))
+		default:
+			// Default to user message
+			messages[i] = anthropic.NewUserMessage(anthropic.NewTextBlock(content))
+		}
+	}
+	return messages
+}
+
+// CountTokens counts the prompt tokens of a request with Anthropic's count_tokens API
+func (p *ClaudeProvider) CountTokens(ctx context.Context, req *LLMRequest) (int, error) {
+	opts := []option.RequestOption{option.WithAPIKey(p.cfg.SelectLeastLoadedKey())}
+	if p.cfg.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(p.cfg.BaseURL))
+	}
+	client := anthropic.NewClient(opts...)
+
+	modelName := p.cfg.Model
+	if req.Model != "" {
+		modelName = req.Model
+	}
+	// System messages go in the system prompt, where Anthropic counts them
+	system, messages := splitSystem(req.Messages)
+	countReq := *req
+	countReq.Messages = messages
+	params := anthropic.MessageCountTokensParams{
+		Model:    anthropic.Model(modelName),
+		Messages: claudeMessages(&countReq),
+	}
+	if system != "" {
+		params.System = anthropic.MessageCountTokensParamsSystemUnion{OfString: anthropic.String(system)}
+	}
+	for _, tool := range req.Tools {
+		name, description, schema, ok := toolSpec(tool)
+		if !ok {
+			continue
+		}
+		t := anthropic.ToolParam{Name: name, InputSchema: claudeInputSchema(schema)}
+		if description != "" {
+			t.Description = anthropic.String(description)
+		}
+		params.Tools = append(params.Tools, anthropic.MessageCountTokensToolUnionParam{OfTool: &t})
+	}
+	resp, err := client.Messages.CountTokens(ctx, params)
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.InputTokens), nil
+}
+
+// ListModels fetches the models the key can use from the Anthropic API
 func (p *ClaudeProvider) ListModels(ctx context.Context) ([]string, error) {
-	return []string{"claude-3-opus", "claude-3-sonnet", "claude-3-haiku"}, nil
+	opts := []option.RequestOption{option.WithAPIKey(p.cfg.APIKey())}
+	if p.cfg.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(p.cfg.BaseURL))
+	}
+	client := anthropic.NewClient(opts...)
+	var models []string
+	iter := client.Models.ListAutoPaging(ctx, anthropic.ModelListParams{})
+	for iter.Next() {
+		models = append(models, iter.Current().ID)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return models, nil
 }
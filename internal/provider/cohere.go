@@ -10,6 +10,9 @@ import (
 	"time"
 )
 
+// cohereBaseURL is the API root used when base_url is not set
+const cohereBaseURL = "https://api.cohere.ai/v1"
+
 type CohereProvider struct {
 	cfg    *LLMConfig
 	client *http.Client
@@ -22,6 +25,12 @@ type CohereChatRequest struct {
 	Temperature float64         `json:"temperature,omitempty"`
 	TopP        float64         `json:"p,omitempty"`
 	Stream      bool            `json:"stream,omitempty"`
+
+	TopK             int      `json:"k,omitempty"`
+	StopSequences    []string `json:"stop_sequences,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	PresencePenalty  float64  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
 }
 
 type CohereMessage struct {
@@ -111,13 +120,25 @@ func (p *CohereProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		MaxTokens: req.MaxTokens,
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		cohereReq.Temperature = temp
+	// Add sampling params
+	opts := req.SamplingOptions()
+	if opts.Temperature != nil {
+		cohereReq.Temperature = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		cohereReq.TopP = *opts.TopP
+	}
+	if opts.TopK != nil {
+		cohereReq.TopK = *opts.TopK
 	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		cohereReq.TopP = topP
+	if opts.PresencePenalty != nil {
+		cohereReq.PresencePenalty = *opts.PresencePenalty
 	}
+	if opts.FrequencyPenalty != nil {
+		cohereReq.FrequencyPenalty = *opts.FrequencyPenalty
+	}
+	cohereReq.StopSequences = opts.Stop
+	cohereReq.Seed = opts.Seed
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -140,7 +161,7 @@ func (p *CohereProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.cohere.ai/v1/chat", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(cohereBaseURL)+"/chat", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -159,8 +180,9 @@ func (p *CohereProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
-			if attempt == maxRetries-1 {
-				return nil, fmt.Errorf("Cohere API error: %s - %s", resp.Status, string(body))
+			statusErr := fmt.Errorf("Cohere API error: %s - %s", resp.Status, string(body))
+			if attempt == maxRetries-1 || !Retryable(statusErr) {
+				return nil, statusErr
 			}
 			continue
 		}
@@ -207,7 +229,7 @@ func (p *CohereProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 			streamChan <- &LLMStreamResponse{Text: fmt.Sprintf("Error: %v", err), Done: true}
 			return
 		}
-		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true, Usage: resp.Usage()}
 	}()
 
 	return streamChan, nil
@@ -247,7 +269,7 @@ func (p *CohereProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.cohere.ai/v1/embed", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(cohereBaseURL)+"/embed", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create embedding request: %w", err)
 		}
@@ -266,8 +288,9 @@ func (p *CohereProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
-			if attempt == maxRetries-1 {
-				return nil, fmt.Errorf("Cohere embeddings API error: %s - %s", resp.Status, string(body))
+			statusErr := fmt.Errorf("Cohere embeddings API error: %s - %s", resp.Status, string(body))
+			if attempt == maxRetries-1 || !Retryable(statusErr) {
+				return nil, statusErr
 			}
 			continue
 		}
@@ -308,15 +331,7 @@ func (p *CohereProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the model catalog from the Cohere API
 func (p *CohereProvider) ListModels(ctx context.Context) ([]string, error) {
-	return []string{
-		"command-r-plus",
-		"command-r",
-		"command",
-		"command-light",
-		"embed-english-v3.0",
-		"embed-multilingual-v3.0",
-		"embed-english-light-v3.0",
-		"embed-multilingual-light-v3.0",
-	}, nil
+	return fetchModelIDs(ctx, p.client, p.cfg.baseURL(cohereBaseURL)+"/models", bearerHeader(p.cfg.APIKey()))
 }
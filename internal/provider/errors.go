@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+// Error classes reported with request outcome metrics
+const (
+	ErrorClassTimeout        = "timeout"
+	ErrorClassRateLimit      = "rate_limit"
+	ErrorClassAuth           = "auth"
+	ErrorClassUpstream5xx    = "upstream_5xx"
+	ErrorClassContentFilter  = "content_filter"
+	ErrorClassInvalidRequest = "invalid_request"
+	ErrorClassCanceled       = "canceled"
+	ErrorClassUnavailable    = "unavailable"
+	ErrorClassOther          = "other"
+)
+
+// statusInText matches upstream status codes embedded in error messages, e.g. "API error: 429 Too Many Requests"
+var statusInText = regexp.MustCompile(`\b(?:status(?: code)?[:= ]*|error: )([1-5][0-9]{2})\b`)
+
+// ClassifyError returns the upstream HTTP status (0 if unknown) and error class for a provider error
+func ClassifyError(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, ErrorClassTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return 0, ErrorClassCanceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, ErrorClassTimeout
+	}
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return 0, ErrorClassContentFilter
+	}
+
+	status := upstreamStatus(err)
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "content_filter") || strings.Contains(msg, "content filter") || strings.Contains(msg, "content management policy") {
+		return status, ErrorClassContentFilter
+	}
+	if status != 0 {
+		return status, classForStatus(status)
+	}
+
+	switch {
+	case strings.Contains(msg, "deadline exceeded") || strings.Contains(msg, "timeout") || strings.Contains(msg, "timed out"):
+		return 0, ErrorClassTimeout
+	case strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests") || strings.Contains(msg, "resourceexhausted") || strings.Contains(msg, "quota"):
+		return 0, ErrorClassRateLimit
+	case strings.Contains(msg, "unauthenticated") || strings.Contains(msg, "permissiondenied") || strings.Contains(msg, "invalid api key") || strings.Contains(msg, "no api key"):
+		return 0, ErrorClassAuth
+	case strings.Contains(msg, "code = unavailable") || strings.Contains(msg, "code = internal"):
+		return 0, ErrorClassUpstream5xx
+	}
+	return 0, ErrorClassOther
+}
+
+// upstreamStatus extracts the HTTP status from SDK error types, falling back to the error text
+func upstreamStatus(err error) int {
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) && openaiErr.HTTPStatusCode > 0 {
+		return openaiErr.HTTPStatusCode
+	}
+	var openaiReqErr *openai.RequestError
+	if errors.As(err, &openaiReqErr) && openaiReqErr.HTTPStatusCode > 0 {
+		return openaiReqErr.HTTPStatusCode
+	}
+	var anthropicErr *anthropic.Error
+	if errors.As(err, &anthropicErr) && anthropicErr.StatusCode > 0 {
+		return anthropicErr.StatusCode
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) && googleErr.Code > 0 {
+		return googleErr.Code
+	}
+	var httpCoder interface{ HTTPCode() int }
+	if errors.As(err, &httpCoder) && httpCoder.HTTPCode() > 0 {
+		return httpCoder.HTTPCode()
+	}
+
+	if m := statusInText.FindStringSubmatch(strings.ToLower(err.Error())); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status
+	}
+	return 0
+}
+
+func classForStatus(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrorClassRateLimit
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorClassAuth
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrorClassTimeout
+	case status >= 500:
+		return ErrorClassUpstream5xx
+	case status >= 400:
+		return ErrorClassInvalidRequest
+	}
+	return ErrorClassOther
+}
+
+// StatusForErrorClass returns the HTTP status returned to clients for a failed request
+func StatusForErrorClass(class string) int {
+	switch class {
+	case ErrorClassTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorClassRateLimit:
+		return http.StatusTooManyRequests
+	case ErrorClassAuth, ErrorClassUpstream5xx:
+		return http.StatusBadGateway
+	case ErrorClassContentFilter, ErrorClassInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorClassCanceled:
+		return 499
+	case ErrorClassUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Retryable reports whether a failed request may succeed if sent again. Requests the
+// upstream rejected as invalid or filtered fail the same way with any key or provider,
+// and a canceled request has no client left to answer.
+func Retryable(err error) bool {
+	_, class := ClassifyError(err)
+	return class != ErrorClassInvalidRequest && class != ErrorClassContentFilter && class != ErrorClassCanceled
+}
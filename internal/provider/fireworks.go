@@ -8,6 +8,9 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// fireworksBaseURL is the API root used when base_url is not set
+const fireworksBaseURL = "https://api.fireworks.ai/inference/v1"
+
 type FireworksProvider struct {
 	cfg    *LLMConfig
 	client *openai.Client
@@ -15,7 +18,7 @@ type FireworksProvider struct {
 
 func NewFireworksProvider(cfg *LLMConfig) *FireworksProvider {
 	config := openai.DefaultConfig(cfg.APIKey())
-	config.BaseURL = "https://api.fireworks.ai/inference/v1"
+	config.BaseURL = cfg.baseURL(fireworksBaseURL)
 	client := openai.NewClientWithConfig(config)
 	return &FireworksProvider{cfg: cfg, client: client}
 }
@@ -62,18 +65,13 @@ func (p *FireworksProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 		modelName = req.Model
 	}
 	chatReq := openai.ChatCompletionRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		chatReq.Temperature = float32(temp)
-	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		chatReq.TopP = float32(topP)
-	}
+	setOpenAISampling(&chatReq, ProviderFireworks, req.SamplingOptions())
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -90,7 +88,7 @@ func (p *FireworksProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api.fireworks.ai/inference/v1"
+		config.BaseURL = p.cfg.baseURL(fireworksBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		resp, err := p.client.CreateChatCompletion(ctx, chatReq)
@@ -103,9 +101,15 @@ func (p *FireworksProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 				OutputTokens: resp.Usage.CompletionTokens,
 				TokensUsed:   resp.Usage.TotalTokens,
 				FinishReason: string(resp.Choices[0].FinishReason),
+				Choices:      openAIChoices(resp.Choices),
 			}, nil
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("Fireworks API error: %w", err)
+		}
+
 		// If error and not last attempt, continue to next key
 		if attempt == maxRetries-1 {
 			// Last attempt failed
@@ -133,14 +137,18 @@ func (p *FireworksProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderFireworks, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -151,11 +159,12 @@ func (p *FireworksProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -163,6 +172,9 @@ func (p *FireworksProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -194,7 +206,7 @@ func (p *FireworksProvider) CreateEmbeddings(ctx context.Context, req *Embedding
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api.fireworks.ai/inference/v1"
+		config.BaseURL = p.cfg.baseURL(fireworksBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		modelName := p.cfg.Model
@@ -249,17 +261,15 @@ func (p *FireworksProvider) CreateEmbeddings(ctx context.Context, req *Embedding
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the models the key can use from the Fireworks API
 func (p *FireworksProvider) ListModels(ctx context.Context) ([]string, error) {
-	// Fireworks supports various open-source models
-	return []string{
-		"accounts/fireworks/models/llama-v3-8b-instruct",
-		"accounts/fireworks/models/llama-v3-70b-instruct",
-		"accounts/fireworks/models/mixtral-8x7b-instruct",
-		"accounts/fireworks/models/qwen2-72b-instruct",
-		"accounts/fireworks/models/yi-large",
-		"accounts/fireworks/models/gemma-7b-it",
-		"accounts/fireworks/models/llama-v2-7b-chat",
-		"accounts/fireworks/models/llama-v2-13b-chat",
-		"accounts/fireworks/models/llama-v2-70b-chat",
-	}, nil
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
 }
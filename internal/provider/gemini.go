@@ -2,9 +2,12 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -55,14 +58,21 @@ func (p *GeminiProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		model.GenerationConfig = genai.GenerationConfig{
 			MaxOutputTokens: &maxTokens,
 		}
-		if temp, ok := req.Params["temperature"].(float64); ok {
-			temp32 := float32(temp)
+		opts := req.SamplingOptions()
+		if opts.Temperature != nil {
+			temp32 := float32(*opts.Temperature)
 			model.GenerationConfig.Temperature = &temp32
 		}
-		if topP, ok := req.Params["top_p"].(float64); ok {
-			topP32 := float32(topP)
+		if opts.TopP != nil {
+			topP32 := float32(*opts.TopP)
 			model.GenerationConfig.TopP = &topP32
 		}
+		if opts.TopK != nil {
+			topK32 := int32(*opts.TopK)
+			model.GenerationConfig.TopK = &topK32
+		}
+		model.GenerationConfig.StopSequences = opts.Stop
+		setGeminiResponseFormat(&model.GenerationConfig, req.ResponseFormat)
 
 		// Handle conversation history
 		var resp *genai.GenerateContentResponse
@@ -118,6 +128,11 @@ func (p *GeminiProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 			}
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("Gemini API error: %w", err)
+		}
+
 		// If error and not last attempt, try next key
 		if attempt < maxRetries-1 {
 			p.cfg.NextAPIKey()
@@ -144,7 +159,7 @@ func (p *GeminiProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 			streamChan <- &LLMStreamResponse{Text: fmt.Sprintf("Error: %v", err), Done: true}
 			return
 		}
-		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true, Usage: resp.Usage()}
 	}()
 
 	return streamChan, nil
@@ -229,6 +244,69 @@ func (p *GeminiProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// CountTokens counts the prompt tokens of a request with Gemini's countTokens API
+func (p *GeminiProvider) CountTokens(ctx context.Context, req *LLMRequest) (int, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.cfg.SelectLeastLoadedKey()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	defer client.Close()
+
+	modelName := p.cfg.Model
+	if req.Model != "" {
+		modelName = req.Model
+	}
+	model := client.GenerativeModel(modelName)
+	system, messages := splitSystem(req.Messages)
+	if system != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(system))
+	}
+	var functions []*genai.FunctionDeclaration
+	for _, tool := range req.Tools {
+		if name, description, schema, ok := toolSpec(tool); ok {
+			functions = append(functions, &genai.FunctionDeclaration{Name: name, Description: description, Parameters: geminiSchema(schema)})
+		}
+	}
+	if len(functions) > 0 {
+		model.Tools = []*genai.Tool{{FunctionDeclarations: functions}}
+	}
+
+	var parts []genai.Part
+	for _, msg := range messages {
+		if content := messageText(msg["content"]); content != "" {
+			parts = append(parts, genai.Text(content))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, genai.Text(req.Prompt))
+	}
+	resp, err := model.CountTokens(ctx, parts...)
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.TotalTokens), nil
+}
+
+// ListModels fetches the models the key can use from the Gemini API, without the
+// "models/" prefix the API puts on their names
 func (p *GeminiProvider) ListModels(ctx context.Context) ([]string, error) {
-	return []string{"gemini-1.5-pro", "gemini-1.5-flash", "gemini-1.0-pro"}, nil
+	client, err := genai.NewClient(ctx, option.WithAPIKey(p.cfg.APIKey()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	defer client.Close()
+
+	var models []string
+	iter := client.ListModels(ctx)
+	for {
+		info, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, strings.TrimPrefix(info.Name, "models/"))
+	}
+	return models, nil
 }
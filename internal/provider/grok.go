@@ -8,6 +8,9 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// grokBaseURL is the API root used when base_url is not set
+const grokBaseURL = "https://api.x.ai/v1"
+
 type GrokProvider struct {
 	cfg    *LLMConfig
 	client *openai.Client
@@ -15,7 +18,7 @@ type GrokProvider struct {
 
 func NewGrokProvider(cfg *LLMConfig) *GrokProvider {
 	config := openai.DefaultConfig(cfg.APIKey())
-	config.BaseURL = "https://api.x.ai/v1"
+	config.BaseURL = cfg.baseURL(grokBaseURL)
 	client := openai.NewClientWithConfig(config)
 	return &GrokProvider{cfg: cfg, client: client}
 }
@@ -37,13 +40,15 @@ func (p *GrokProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRespo
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderGrok, req.SamplingOptions())
 
 	resp, err := p.client.CreateChatCompletion(ctx, request)
 	if err != nil {
@@ -60,6 +65,7 @@ func (p *GrokProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRespo
 		OutputTokens: resp.Usage.CompletionTokens,
 		TokensUsed:   resp.Usage.TotalTokens,
 		FinishReason: string(resp.Choices[0].FinishReason),
+		Choices:      openAIChoices(resp.Choices),
 	}, nil
 }
 
@@ -77,14 +83,18 @@ func (p *GrokProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<-c
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderGrok, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -95,11 +105,12 @@ func (p *GrokProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<-c
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -107,6 +118,9 @@ func (p *GrokProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<-c
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -138,7 +152,7 @@ func (p *GrokProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRequ
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api.x.ai/v1"
+		config.BaseURL = p.cfg.baseURL(grokBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		modelName := p.cfg.Model
@@ -193,7 +207,15 @@ func (p *GrokProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRequ
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the models the key can use from the xAI API
 func (p *GrokProvider) ListModels(ctx context.Context) ([]string, error) {
-	// Grok typically supports grok-beta and similar models
-	return []string{"grok-beta"}, nil
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
 }
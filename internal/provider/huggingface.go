@@ -8,6 +8,9 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// huggingFaceBaseURL is the API root used when base_url is not set
+const huggingFaceBaseURL = "https://api-inference.huggingface.co/v1"
+
 type HuggingFaceProvider struct {
 	cfg    *LLMConfig
 	client *openai.Client
@@ -15,7 +18,7 @@ type HuggingFaceProvider struct {
 
 func NewHuggingFaceProvider(cfg *LLMConfig) *HuggingFaceProvider {
 	config := openai.DefaultConfig(cfg.APIKey())
-	config.BaseURL = "https://api-inference.huggingface.co/v1"
+	config.BaseURL = cfg.baseURL(huggingFaceBaseURL)
 	client := openai.NewClientWithConfig(config)
 	return &HuggingFaceProvider{cfg: cfg, client: client}
 }
@@ -62,18 +65,13 @@ func (p *HuggingFaceProvider) Generate(ctx context.Context, req *LLMRequest) (*L
 		modelName = req.Model
 	}
 	chatReq := openai.ChatCompletionRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		chatReq.Temperature = float32(temp)
-	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		chatReq.TopP = float32(topP)
-	}
+	setOpenAISampling(&chatReq, ProviderHuggingFace, req.SamplingOptions())
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -90,7 +88,7 @@ func (p *HuggingFaceProvider) Generate(ctx context.Context, req *LLMRequest) (*L
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api-inference.huggingface.co/v1"
+		config.BaseURL = p.cfg.baseURL(huggingFaceBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		resp, err := p.client.CreateChatCompletion(ctx, chatReq)
@@ -103,9 +101,15 @@ func (p *HuggingFaceProvider) Generate(ctx context.Context, req *LLMRequest) (*L
 				OutputTokens: resp.Usage.CompletionTokens,
 				TokensUsed:   resp.Usage.TotalTokens,
 				FinishReason: string(resp.Choices[0].FinishReason),
+				Choices:      openAIChoices(resp.Choices),
 			}, nil
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("Hugging Face API error: %w", err)
+		}
+
 		// If error and not last attempt, continue to next key
 		if attempt == maxRetries-1 {
 			// Last attempt failed
@@ -133,14 +137,18 @@ func (p *HuggingFaceProvider) GenerateStream(ctx context.Context, req *LLMReques
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderHuggingFace, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -151,11 +159,12 @@ func (p *HuggingFaceProvider) GenerateStream(ctx context.Context, req *LLMReques
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -163,6 +172,9 @@ func (p *HuggingFaceProvider) GenerateStream(ctx context.Context, req *LLMReques
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -194,7 +206,7 @@ func (p *HuggingFaceProvider) CreateEmbeddings(ctx context.Context, req *Embeddi
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api-inference.huggingface.co/v1"
+		config.BaseURL = p.cfg.baseURL(huggingFaceBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		modelName := p.cfg.Model
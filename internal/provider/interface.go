@@ -20,6 +20,12 @@ type LLMProvider interface {
 	ListModels(ctx context.Context) ([]string, error)
 }
 
+// TokenCounter is implemented by providers whose vendor counts the prompt tokens of a
+// request without running it
+type TokenCounter interface {
+	CountTokens(ctx context.Context, req *LLMRequest) (int, error)
+}
+
 // ProviderType represents the type of LLM provider
 type ProviderType string
 
@@ -76,6 +82,14 @@ func (c *LLMConfig) APIKey() string {
 	return ""
 }
 
+// baseURL returns the configured base URL, or def when none is set
+func (c *LLMConfig) baseURL(def string) string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return def
+}
+
 // InitUsages initializes usage tracking for keys
 func (c *LLMConfig) InitUsages() {
 	c.mu.Lock()
@@ -167,15 +181,93 @@ type LLMRequest struct {
 	Stream    bool             `json:"stream,omitempty"`
 	User      string           `json:"user,omitempty"`
 	Params    map[string]any   `json:"params,omitempty"`
+	Tools     []any            `json:"tools,omitempty"` // Tool definitions, in OpenAI's or Anthropic's shape; only read by CountTokens
+
+	ResponseFormat *ResponseFormat  `json:"response_format,omitempty"` // JSON output, mapped to the vendor's structured output feature
+	Sampling       *SamplingOptions `json:"-"`                         // Read from Params when nil
+}
+
+// SamplingOptions returns the request's sampling options, read from Params when they
+// weren't set. Invalid parameters are left out.
+func (r *LLMRequest) SamplingOptions() *SamplingOptions {
+	if r.Sampling != nil {
+		return r.Sampling
+	}
+	opts, err := ParseSamplingOptions(r.Params)
+	if err != nil {
+		opts = &SamplingOptions{}
+	}
+	if opts.User == "" {
+		opts.User = r.User
+	}
+	return opts
 }
 
 // LLMResponse represents the response from LLM
 type LLMResponse struct {
-	Text         string `json:"text"`
-	InputTokens  int    `json:"input_tokens"`
-	OutputTokens int    `json:"output_tokens"`
-	TokensUsed   int    `json:"tokens_used"` // Total
-	FinishReason string `json:"finish_reason"`
+	Text              string `json:"text"`
+	InputTokens       int    `json:"input_tokens"`
+	CachedInputTokens int    `json:"cached_input_tokens,omitempty"` // Part of InputTokens read from the vendor's prompt cache
+	OutputTokens      int    `json:"output_tokens"`
+	TokensUsed        int    `json:"tokens_used"` // Total
+	FinishReason      string `json:"finish_reason"`
+
+	// Choices holds every choice when providers report them; Text and FinishReason
+	// are the first one's
+	Choices []ResponseChoice `json:"choices,omitempty"`
+}
+
+// Usage returns the token usage of a response
+func (r *LLMResponse) Usage() *Usage {
+	return &Usage{
+		InputTokens:       r.InputTokens,
+		CachedInputTokens: r.CachedInputTokens,
+		OutputTokens:      r.OutputTokens,
+		TotalTokens:       r.TokensUsed,
+	}
+}
+
+// Usage is the token usage of a request
+type Usage struct {
+	InputTokens       int `json:"input_tokens"`
+	CachedInputTokens int `json:"cached_input_tokens,omitempty"` // Part of InputTokens read from the vendor's prompt cache
+	OutputTokens      int `json:"output_tokens"`
+	TotalTokens       int `json:"total_tokens"`
+}
+
+// AllChoices returns the choices of a response, which has at least the one of its Text
+func (r *LLMResponse) AllChoices() []ResponseChoice {
+	if len(r.Choices) > 0 {
+		return r.Choices
+	}
+	return []ResponseChoice{{Text: r.Text, FinishReason: r.FinishReason}}
+}
+
+// ResponseChoice is one of the choices of a response
+type ResponseChoice struct {
+	Text         string    `json:"text"`
+	FinishReason string    `json:"finish_reason"`
+	Logprobs     *Logprobs `json:"logprobs,omitempty"`
+}
+
+// Logprobs are the log probabilities of a choice's tokens, in OpenAI's format
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+// TokenLogprob is the log probability of a token and of the likeliest alternatives
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob is the log probability of an alternative token
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
 // LLMStreamResponse represents a streaming response chunk
@@ -183,6 +275,7 @@ type LLMStreamResponse struct {
 	Text         string `json:"text,omitempty"`
 	FinishReason string `json:"finish_reason,omitempty"`
 	Done         bool   `json:"done"`
+	Usage        *Usage `json:"usage,omitempty"` // Set on the last chunk when the vendor reports it
 }
 
 // EmbeddingsRequest represents a request to create embeddings
@@ -10,6 +10,9 @@ import (
 	"time"
 )
 
+// mistralBaseURL is the API root used when base_url is not set
+const mistralBaseURL = "https://api.mistral.ai/v1"
+
 type MistralProvider struct {
 	cfg    *LLMConfig
 	client *http.Client
@@ -22,6 +25,14 @@ type MistralChatRequest struct {
 	Temperature float64   `json:"temperature,omitempty"`
 	TopP        float64   `json:"top_p,omitempty"`
 	Stream      bool      `json:"stream,omitempty"`
+
+	Stop             []string `json:"stop,omitempty"`
+	RandomSeed       *int     `json:"random_seed,omitempty"`
+	PresencePenalty  float64  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
+	N                int      `json:"n,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"` // Same shape as OpenAI's
 }
 
 type MistralChatResponse struct {
@@ -87,17 +98,30 @@ func (p *MistralProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRe
 	}
 
 	mistralReq := MistralChatRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: req.ResponseFormat,
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		mistralReq.Temperature = temp
+	// Add sampling params
+	opts := req.SamplingOptions()
+	if opts.Temperature != nil {
+		mistralReq.Temperature = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		mistralReq.TopP = *opts.TopP
+	}
+	if opts.PresencePenalty != nil {
+		mistralReq.PresencePenalty = *opts.PresencePenalty
 	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		mistralReq.TopP = topP
+	if opts.FrequencyPenalty != nil {
+		mistralReq.FrequencyPenalty = *opts.FrequencyPenalty
+	}
+	mistralReq.Stop = opts.Stop
+	mistralReq.RandomSeed = opts.Seed
+	if opts.N > 1 {
+		mistralReq.N = opts.N
 	}
 
 	// Retry with different keys if fail (max 3 attempts)
@@ -121,7 +145,7 @@ func (p *MistralProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRe
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.mistral.ai/v1/chat/completions", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(mistralBaseURL)+"/chat/completions", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -140,8 +164,9 @@ func (p *MistralProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRe
 
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
-			if attempt == maxRetries-1 {
-				return nil, fmt.Errorf("Mistral API error: %s - %s", resp.Status, string(body))
+			statusErr := fmt.Errorf("Mistral API error: %s - %s", resp.Status, string(body))
+			if attempt == maxRetries-1 || !Retryable(statusErr) {
+				return nil, statusErr
 			}
 			continue
 		}
@@ -158,12 +183,17 @@ func (p *MistralProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRe
 			// Update usage
 			p.cfg.UpdateUsage(1, mistralResp.Usage.TotalTokens)
 
+			choices := make([]ResponseChoice, len(mistralResp.Choices))
+			for i, c := range mistralResp.Choices {
+				choices[i] = ResponseChoice{Text: c.Message.Content, FinishReason: c.FinishReason}
+			}
 			return &LLMResponse{
 				Text:         mistralResp.Choices[0].Message.Content,
 				InputTokens:  mistralResp.Usage.PromptTokens,
 				OutputTokens: mistralResp.Usage.CompletionTokens,
 				TokensUsed:   mistralResp.Usage.TotalTokens,
 				FinishReason: mistralResp.Choices[0].FinishReason,
+				Choices:      choices,
 			}, nil
 		}
 	}
@@ -182,7 +212,7 @@ func (p *MistralProvider) GenerateStream(ctx context.Context, req *LLMRequest) (
 			streamChan <- &LLMStreamResponse{Text: fmt.Sprintf("Error: %v", err), Done: true}
 			return
 		}
-		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true, Usage: resp.Usage()}
 	}()
 
 	return streamChan, nil
@@ -262,7 +292,7 @@ func (p *MistralProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsR
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.mistral.ai/v1/embeddings", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(mistralBaseURL)+"/embeddings", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create embedding request: %w", err)
 		}
@@ -281,8 +311,9 @@ func (p *MistralProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsR
 
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
-			if attempt == maxRetries-1 {
-				return nil, fmt.Errorf("Mistral embeddings API error: %s - %s", resp.Status, string(body))
+			statusErr := fmt.Errorf("Mistral embeddings API error: %s - %s", resp.Status, string(body))
+			if attempt == maxRetries-1 || !Retryable(statusErr) {
+				return nil, statusErr
 			}
 			continue
 		}
@@ -317,13 +348,7 @@ func (p *MistralProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsR
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the models the key can use from the Mistral API
 func (p *MistralProvider) ListModels(ctx context.Context) ([]string, error) {
-	return []string{
-		"mistral-large-latest",
-		"mistral-medium",
-		"mistral-small",
-		"mistral-7b-instruct",
-		"mistral-8x7b-instruct",
-		"mistral-embed",
-	}, nil
+	return fetchModelIDs(ctx, p.client, p.cfg.baseURL(mistralBaseURL)+"/models", bearerHeader(p.cfg.APIKey()))
 }
@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultModelCacheTTL is how long discovered models are kept when the config leaves
+// policy.models_cache_ttl at zero
+const DefaultModelCacheTTL = time.Hour
+
+// modelListRetry is how long a failed model list is remembered when there is no good
+// list to fall back on, so a vendor that is down isn't called on every request
+const modelListRetry = time.Minute
+
+// fetchModelIDs GETs a vendor's model list endpoint. It understands the OpenAI shape
+// ({"data": [{"id": ...}]}), a bare array of models and Cohere's {"models": [{"name": ...}]}.
+func fetchModelIDs(ctx context.Context, client *http.Client, url string, header http.Header) ([]string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		for _, v := range values {
+			httpReq.Header.Add(name, v)
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("API error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	type model struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	var list struct {
+		Data   []model `json:"data"`
+		Models []model `json:"models"`
+	}
+	var models []model
+	if err := json.Unmarshal(body, &models); err != nil {
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("failed to decode model list: %w", err)
+		}
+		models = append(list.Data, list.Models...)
+	}
+
+	ids := make([]string, 0, len(models))
+	for _, m := range models {
+		switch {
+		case m.ID != "":
+			ids = append(ids, m.ID)
+		case m.Name != "":
+			ids = append(ids, m.Name)
+		}
+	}
+	return ids, nil
+}
+
+// bearerHeader is the auth header most vendors expect
+func bearerHeader(apiKey string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + apiKey}}
+}
+
+type modelCacheEntry struct {
+	provider  Provider // The instance the list came from; a reload registers new ones
+	models    []string
+	err       error // Set when the refresh failed and there was no good list to keep
+	fetchedAt time.Time
+}
+
+// fresh reports whether the entry can be served without calling the vendor. Failures
+// are kept for at most modelListRetry.
+func (e modelCacheEntry) fresh(now time.Time, ttl time.Duration) bool {
+	if e.err != nil {
+		ttl = min(ttl, modelListRetry)
+	}
+	return now.Sub(e.fetchedAt) < ttl
+}
+
+// ModelCache keeps each registered provider's model list for a TTL, so listing
+// models doesn't call every vendor on every request
+type ModelCache struct {
+	reg *Registry
+
+	mu       sync.Mutex
+	entries  map[string]modelCacheEntry
+	now      func() time.Time
+	inflight singleflight.Group
+}
+
+func NewModelCache(reg *Registry) *ModelCache {
+	return &ModelCache{reg: reg, entries: make(map[string]modelCacheEntry), now: time.Now}
+}
+
+// Models returns the sorted models of a provider, calling its ListModels when the
+// cached list is older than ttl. Callers that find the list stale at the same time
+// share one refresh. A failed refresh keeps serving the last good list until the next
+// ttl passes; when there is none, the error is cached for up to modelListRetry.
+func (c *ModelCache) Models(ctx context.Context, providerID string, ttl time.Duration) ([]string, error) {
+	p, err := c.reg.Get(providerID)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := c.entry(providerID, p); ok && entry.fresh(c.now(), ttl) {
+		return entry.models, entry.err
+	}
+
+	v, _, _ := c.inflight.Do(providerID, func() (any, error) {
+		entry, ok := c.entry(providerID, p)
+		if ok && entry.fresh(c.now(), ttl) {
+			return entry, nil
+		}
+		models, err := p.ListModels(ctx)
+		switch {
+		case err == nil:
+			models = append([]string(nil), models...)
+			sort.Strings(models)
+			entry = modelCacheEntry{provider: p, models: models}
+		case ok && entry.err == nil:
+			// Keep the last good list
+		default:
+			entry = modelCacheEntry{provider: p, err: err}
+		}
+		entry.fetchedAt = c.now()
+
+		c.mu.Lock()
+		c.entries[providerID] = entry
+		c.mu.Unlock()
+		return entry, nil
+	})
+	entry := v.(modelCacheEntry)
+	return entry.models, entry.err
+}
+
+// entry returns the cached list of a provider, if it came from instance p
+func (c *ModelCache) entry(providerID string, p Provider) (modelCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[providerID]
+	return entry, ok && entry.provider == p
+}
@@ -64,18 +64,13 @@ func (p *OpenAIProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		modelName = req.Model
 	}
 	chatReq := openai.ChatCompletionRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		chatReq.Temperature = float32(temp)
-	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		chatReq.TopP = float32(topP)
-	}
+	setOpenAISampling(&chatReq, ProviderOpenAI, req.SamplingOptions())
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -101,15 +96,26 @@ func (p *OpenAIProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMRes
 		if err == nil && len(resp.Choices) > 0 {
 			// Update usage
 			p.cfg.UpdateUsage(1, resp.Usage.TotalTokens)
+			var cachedTokens int
+			if resp.Usage.PromptTokensDetails != nil {
+				cachedTokens = resp.Usage.PromptTokensDetails.CachedTokens
+			}
 			return &LLMResponse{
-				Text:         resp.Choices[0].Message.Content,
-				InputTokens:  resp.Usage.PromptTokens,
-				OutputTokens: resp.Usage.CompletionTokens,
-				TokensUsed:   resp.Usage.TotalTokens,
-				FinishReason: string(resp.Choices[0].FinishReason),
+				Text:              resp.Choices[0].Message.Content,
+				InputTokens:       resp.Usage.PromptTokens,
+				CachedInputTokens: cachedTokens,
+				OutputTokens:      resp.Usage.CompletionTokens,
+				TokensUsed:        resp.Usage.TotalTokens,
+				FinishReason:      string(resp.Choices[0].FinishReason),
+				Choices:           openAIChoices(resp.Choices),
 			}, nil
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("OpenAI API error: %w", err)
+		}
+
 		// If error and not last attempt, continue to next key
 		if attempt == maxRetries-1 {
 			// Last attempt failed
@@ -137,14 +143,18 @@ func (p *OpenAIProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderOpenAI, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -155,11 +165,12 @@ func (p *OpenAIProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -167,6 +178,9 @@ func (p *OpenAIProvider) GenerateStream(ctx context.Context, req *LLMRequest) (<
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -254,7 +268,28 @@ func (p *OpenAIProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the models the key can use from the OpenAI API
 func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
-	// OpenAI has many models, return common ones
-	return []string{"gpt-4", "gpt-4-turbo", "gpt-4o", "gpt-3.5-turbo"}, nil
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// openAIUsage converts the usage reported by an OpenAI-compatible API
+func openAIUsage(u *openai.Usage) *Usage {
+	usage := &Usage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+	if u.PromptTokensDetails != nil {
+		usage.CachedInputTokens = u.PromptTokensDetails.CachedTokens
+	}
+	return usage
 }
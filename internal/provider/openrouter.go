@@ -8,6 +8,9 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// openRouterBaseURL is the API root used when base_url is not set
+const openRouterBaseURL = "https://openrouter.ai/api/v1"
+
 type OpenRouterProvider struct {
 	cfg    *LLMConfig
 	client *openai.Client
@@ -15,7 +18,7 @@ type OpenRouterProvider struct {
 
 func NewOpenRouterProvider(cfg *LLMConfig) *OpenRouterProvider {
 	config := openai.DefaultConfig(cfg.APIKey())
-	config.BaseURL = "https://openrouter.ai/api/v1"
+	config.BaseURL = cfg.baseURL(openRouterBaseURL)
 	client := openai.NewClientWithConfig(config)
 	return &OpenRouterProvider{cfg: cfg, client: client}
 }
@@ -62,18 +65,13 @@ func (p *OpenRouterProvider) Generate(ctx context.Context, req *LLMRequest) (*LL
 		modelName = req.Model
 	}
 	chatReq := openai.ChatCompletionRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		chatReq.Temperature = float32(temp)
-	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		chatReq.TopP = float32(topP)
-	}
+	setOpenAISampling(&chatReq, ProviderOpenRouter, req.SamplingOptions())
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -90,7 +88,7 @@ func (p *OpenRouterProvider) Generate(ctx context.Context, req *LLMRequest) (*LL
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://openrouter.ai/api/v1"
+		config.BaseURL = p.cfg.baseURL(openRouterBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		resp, err := p.client.CreateChatCompletion(ctx, chatReq)
@@ -103,9 +101,15 @@ func (p *OpenRouterProvider) Generate(ctx context.Context, req *LLMRequest) (*LL
 				OutputTokens: resp.Usage.CompletionTokens,
 				TokensUsed:   resp.Usage.TotalTokens,
 				FinishReason: string(resp.Choices[0].FinishReason),
+				Choices:      openAIChoices(resp.Choices),
 			}, nil
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("OpenRouter API error: %w", err)
+		}
+
 		// If error and not last attempt, continue to next key
 		if attempt == maxRetries-1 {
 			// Last attempt failed
@@ -133,14 +137,18 @@ func (p *OpenRouterProvider) GenerateStream(ctx context.Context, req *LLMRequest
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderOpenRouter, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -151,11 +159,12 @@ func (p *OpenRouterProvider) GenerateStream(ctx context.Context, req *LLMRequest
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -163,6 +172,9 @@ func (p *OpenRouterProvider) GenerateStream(ctx context.Context, req *LLMRequest
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -194,7 +206,7 @@ func (p *OpenRouterProvider) CreateEmbeddings(ctx context.Context, req *Embeddin
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://openrouter.ai/api/v1"
+		config.BaseURL = p.cfg.baseURL(openRouterBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		modelName := p.cfg.Model
@@ -249,19 +261,15 @@ func (p *OpenRouterProvider) CreateEmbeddings(ctx context.Context, req *Embeddin
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the models the key can use from the OpenRouter API
 func (p *OpenRouterProvider) ListModels(ctx context.Context) ([]string, error) {
-	// OpenRouter supports hundreds of models from various providers
-	// Return some popular ones
-	return []string{
-		"anthropic/claude-3.5-sonnet",
-		"openai/gpt-4o",
-		"openai/gpt-4o-mini",
-		"meta-llama/llama-3.2-90b-instruct",
-		"google/gemini-pro-1.5",
-		"mistralai/mistral-7b-instruct",
-		"anthropic/claude-3-haiku",
-		"openai/gpt-3.5-turbo",
-		"meta-llama/llama-3.1-70b-instruct",
-		"anthropic/claude-3-opus",
-	}, nil
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
 }
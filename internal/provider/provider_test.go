@@ -2,9 +2,19 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/user/coo-llm/internal/config"
@@ -74,12 +84,555 @@ func TestOpenAIProvider_Name(t *testing.T) {
 	assert.Equal(t, "openai", p.Name())
 }
 
+// modelListServer serves body at path, checking the bearer key
+func modelListServer(t *testing.T, path, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test" {
+			http.Error(w, `{"error": {"message": "invalid api key"}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 func TestOpenAIProvider_ListModels(t *testing.T) {
-	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"test"}}
+	srv := modelListServer(t, "/v1/models", `{"object": "list", "data": [{"id": "gpt-4o", "object": "model"}, {"id": "gpt-4o-mini", "object": "model"}]}`)
+	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"test"}, BaseURL: srv.URL + "/v1"}
 	p := NewOpenAIProvider(&cfg)
 	models, err := p.ListModels(context.Background())
 	require.NoError(t, err)
-	assert.Contains(t, models, "gpt-4o")
+	assert.Equal(t, []string{"gpt-4o", "gpt-4o-mini"}, models)
+
+	cfg.APIKeys = []string{"revoked"}
+	_, err = NewOpenAIProvider(&cfg).ListModels(context.Background())
+	status, class := ClassifyError(err)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, ErrorClassAuth, class)
+}
+
+func TestOpenAIProvider_InvalidRequestNotRetried(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "maximum context length exceeded", "type": "invalid_request_error", "code": "context_length_exceeded"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"a", "b", "c"}, BaseURL: srv.URL + "/v1"}
+
+	_, err := NewOpenAIProvider(&cfg).Generate(context.Background(), &LLMRequest{Model: "gpt-4", Prompt: "hi"})
+	require.Error(t, err)
+	assert.False(t, Retryable(err))
+	assert.Equal(t, 1, calls, "other keys are not tried for a rejected request")
+}
+
+func TestHTTPProviders_InvalidRequestNotRetried(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "context_length_exceeded"}`))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := &LLMConfig{APIKeys: []string{"a", "b", "c"}, BaseURL: srv.URL}
+	genReq := &LLMRequest{Model: "m", Prompt: "hi"}
+	embedReq := &EmbeddingsRequest{Model: "m", Input: []string{"hi"}}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"mistral", func() error { _, err := NewMistralProvider(cfg).Generate(context.Background(), genReq); return err }},
+		{"mistral embeddings", func() error {
+			_, err := NewMistralProvider(cfg).CreateEmbeddings(context.Background(), embedReq)
+			return err
+		}},
+		{"cohere", func() error { _, err := NewCohereProvider(cfg).Generate(context.Background(), genReq); return err }},
+		{"cohere embeddings", func() error {
+			_, err := NewCohereProvider(cfg).CreateEmbeddings(context.Background(), embedReq)
+			return err
+		}},
+		{"replicate", func() error { _, err := NewReplicateProvider(cfg).Generate(context.Background(), genReq); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			err := tt.call()
+			require.Error(t, err)
+			assert.False(t, Retryable(err))
+			assert.Equal(t, 1, calls, "other keys are not tried for a rejected request")
+		})
+	}
+}
+
+func TestClaudeProvider_CountTokens(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages/count_tokens" || r.Header.Get("X-Api-Key") != "test" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"input_tokens": 14}`))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := LLMConfig{Type: ProviderClaude, APIKeys: []string{"test"}, BaseURL: srv.URL, Model: "claude-3-opus"}
+
+	var p LLMProvider = NewClaudeProvider(&cfg)
+	counter, ok := p.(TokenCounter)
+	require.True(t, ok)
+	tokens, err := counter.CountTokens(context.Background(), &LLMRequest{Messages: []map[string]any{
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": []any{map[string]any{"type": "text", "text": "hello"}, map[string]any{"type": "text", "text": "world"}}},
+	}, Tools: []any{
+		map[string]any{"type": "function", "function": map[string]any{"name": "get_weather", "description": "Current weather", "parameters": map[string]any{
+			"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}, "required": []any{"city"},
+		}}},
+		map[string]any{"name": "lookup", "input_schema": map[string]any{"type": "object"}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 14, tokens)
+	assert.Equal(t, "claude-3-opus", body["model"])
+	assert.Contains(t, fmt.Sprint(body["messages"]), "hello\nworld")
+
+	// System messages go in the system prompt, and tools are counted too
+	assert.Equal(t, "Be brief.", body["system"])
+	assert.NotContains(t, fmt.Sprint(body["messages"]), "Be brief.")
+	tools, _ := body["tools"].([]any)
+	require.Len(t, tools, 2)
+	weather, _ := tools[0].(map[string]any)
+	assert.Equal(t, "get_weather", weather["name"])
+	assert.Equal(t, "Current weather", weather["description"])
+	assert.Equal(t, map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}, "required": []any{"city"}}, weather["input_schema"])
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	rf, err := ParseResponseFormat(nil)
+	require.NoError(t, err)
+	assert.Nil(t, rf)
+
+	rf, err = ParseResponseFormat(map[string]any{"type": "text"})
+	require.NoError(t, err)
+	assert.Nil(t, rf)
+
+	rf, err = ParseResponseFormat(map[string]any{"type": "json_object"})
+	require.NoError(t, err)
+	assert.Equal(t, ResponseFormatJSONObject, rf.Type)
+	assert.Nil(t, rf.Schema())
+
+	rf, err = ParseResponseFormat(map[string]any{"type": "json_schema", "json_schema": map[string]any{
+		"name": "person", "strict": true, "schema": map[string]any{"type": "object"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "person", rf.JSONSchema.Name)
+	assert.True(t, rf.JSONSchema.Strict)
+	assert.Equal(t, map[string]any{"type": "object"}, rf.Schema())
+
+	_, err = ParseResponseFormat(map[string]any{"type": "json_schema", "json_schema": map[string]any{"schema": map[string]any{}}})
+	assert.ErrorContains(t, err, "name is required")
+	_, err = ParseResponseFormat(map[string]any{"type": "xml"})
+	assert.Error(t, err)
+	_, err = ParseResponseFormat("json")
+	assert.Error(t, err)
+}
+
+func TestGeminiSchema(t *testing.T) {
+	schema := geminiSchema(map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name": map[string]any{"type": "string", "description": "Full name"},
+			"tags": map[string]any{"type": "array", "items": map[string]any{"type": "string", "enum": []any{"a", "b"}}},
+			"age":  map[string]any{"type": []any{"integer", "null"}},
+		},
+		"required": []any{"name"},
+	})
+	assert.Equal(t, genai.TypeObject, schema.Type)
+	assert.Equal(t, []string{"name"}, schema.Required)
+	assert.Equal(t, genai.TypeString, schema.Properties["name"].Type)
+	assert.Equal(t, "Full name", schema.Properties["name"].Description)
+	assert.Equal(t, genai.TypeArray, schema.Properties["tags"].Type)
+	assert.Equal(t, []string{"a", "b"}, schema.Properties["tags"].Items.Enum)
+	assert.Equal(t, genai.TypeInteger, schema.Properties["age"].Type)
+	assert.True(t, schema.Properties["age"].Nullable)
+}
+
+func TestResponseFormat_Wire(t *testing.T) {
+	rf := &ResponseFormat{Type: ResponseFormatJSONSchema, JSONSchema: &JSONSchemaFormat{
+		Name:   "person",
+		Schema: map[string]any{"type": "object", "properties": map[string]any{"name": map[string]any{"type": "string"}}, "required": []any{"name"}},
+	}}
+
+	var openaiBody map[string]any
+	openaiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&openaiBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "{\"name\": \"Ada\"}"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 3, "completion_tokens": 4, "total_tokens": 7}}`))
+	}))
+	t.Cleanup(openaiSrv.Close)
+	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"test"}, BaseURL: openaiSrv.URL + "/v1"}
+	resp, err := NewOpenAIProvider(&cfg).Generate(context.Background(), &LLMRequest{Model: "gpt-4o", Prompt: "hi", ResponseFormat: rf})
+	require.NoError(t, err)
+	assert.Equal(t, `{"name": "Ada"}`, resp.Text)
+	format := openaiBody["response_format"].(map[string]any)
+	assert.Equal(t, "json_schema", format["type"])
+	assert.Equal(t, "person", format["json_schema"].(map[string]any)["name"])
+
+	var claudeBody map[string]any
+	claudeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&claudeBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-3-opus", "stop_reason": "tool_use",
+			"content": [{"type": "tool_use", "id": "tu_1", "name": "json_response", "input": {"name": "Ada"}}],
+			"usage": {"input_tokens": 3, "output_tokens": 4}}`))
+	}))
+	t.Cleanup(claudeSrv.Close)
+	cfg = LLMConfig{Type: ProviderClaude, APIKeys: []string{"test"}, BaseURL: claudeSrv.URL, Model: "claude-3-opus"}
+	resp, err = NewClaudeProvider(&cfg).Generate(context.Background(), &LLMRequest{Prompt: "hi", ResponseFormat: rf})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "Ada"}`, resp.Text)
+	assert.Equal(t, map[string]any{"type": "tool", "name": "json_response"}, claudeBody["tool_choice"])
+	tool := claudeBody["tools"].([]any)[0].(map[string]any)
+	assert.Equal(t, "json_response", tool["name"])
+	assert.Equal(t, []any{"name"}, tool["input_schema"].(map[string]any)["required"])
+}
+
+func TestOpenAIProvider_StreamUsage(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices": [{"index": 0, "delta": {"content": "Hi"}, "finish_reason": "stop"}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices": [], "usage": {"prompt_tokens": 8, "completion_tokens": 1, "total_tokens": 9, "prompt_tokens_details": {"cached_tokens": 2}}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"test"}, BaseURL: srv.URL + "/v1"}
+	streamChan, err := NewOpenAIProvider(&cfg).GenerateStream(context.Background(), &LLMRequest{Model: "gpt-4o", Prompt: "hi", Stream: true})
+	require.NoError(t, err)
+
+	var text string
+	var last *LLMStreamResponse
+	for chunk := range streamChan {
+		text += chunk.Text
+		last = chunk
+	}
+	assert.Equal(t, map[string]any{"include_usage": true}, body["stream_options"])
+	assert.Equal(t, "Hi", text)
+	require.NotNil(t, last)
+	assert.True(t, last.Done)
+	assert.Equal(t, &Usage{InputTokens: 8, CachedInputTokens: 2, OutputTokens: 1, TotalTokens: 9}, last.Usage)
+}
+
+func TestParseSamplingOptions(t *testing.T) {
+	opts, err := ParseSamplingOptions(map[string]any{
+		"temperature": 0.5, "top_p": 0.9, "top_k": float64(40), "stop": "END", "seed": float64(7),
+		"presence_penalty": -1.5, "frequency_penalty": 1.0, "logit_bias": map[string]any{"50256": float64(-100)},
+		"n": float64(3), "logprobs": true, "top_logprobs": float64(2), "user": "u-1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, *opts.Temperature)
+	assert.Equal(t, 40, *opts.TopK)
+	assert.Equal(t, []string{"END"}, opts.Stop)
+	assert.Equal(t, 7, *opts.Seed)
+	assert.Equal(t, map[string]int{"50256": -100}, opts.LogitBias)
+	assert.Equal(t, 3, opts.N)
+	assert.Equal(t, 2, opts.TopLogprobs)
+	assert.Equal(t, "u-1", opts.User)
+
+	opts, err = ParseSamplingOptions(map[string]any{"model": "gpt-4o"})
+	require.NoError(t, err)
+	assert.Empty(t, opts.set())
+
+	tests := []struct {
+		params map[string]any
+		param  string
+	}{
+		{map[string]any{"temperature": 2.5}, "temperature"},
+		{map[string]any{"top_p": "high"}, "top_p"},
+		{map[string]any{"n": 1.5}, "n"},
+		{map[string]any{"n": float64(0)}, "n"},
+		{map[string]any{"stop": []any{"a", "b", "c", "d", "e"}}, "stop"},
+		{map[string]any{"stop": []any{"a", float64(1)}}, "stop"},
+		{map[string]any{"logit_bias": map[string]any{"1": float64(101)}}, "logit_bias"},
+		{map[string]any{"top_logprobs": float64(3)}, "top_logprobs"},
+		{map[string]any{"user": float64(1)}, "user"},
+	}
+	for _, tt := range tests {
+		_, err := ParseSamplingOptions(tt.params)
+		var paramErr *ParamError
+		require.ErrorAs(t, err, &paramErr, "%v", tt.params)
+		assert.Equal(t, tt.param, paramErr.Param)
+		assert.Equal(t, ParamCodeInvalidValue, paramErr.Code)
+	}
+}
+
+func TestCheckSampling(t *testing.T) {
+	seed := 1
+	opts := &SamplingOptions{Seed: &seed, N: 2, Stop: []string{"END"}, LogitBias: map[string]int{"1": 5}}
+	ignored, err := CheckSampling("claude", opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ParamSeed, ParamLogitBias}, ignored)
+	assert.Equal(t, SamplingEmulated, SamplingSupportFor("claude", ParamN))
+	assert.Equal(t, SamplingNative, SamplingSupportFor("openai", ParamN))
+
+	ignored, err = CheckSampling("openai", opts)
+	require.NoError(t, err)
+	assert.Empty(t, ignored)
+
+	_, err = CheckSampling("gemini", &SamplingOptions{Logprobs: true})
+	var paramErr *ParamError
+	require.ErrorAs(t, err, &paramErr)
+	assert.Equal(t, ParamLogprobs, paramErr.Param)
+	assert.Equal(t, ParamCodeUnsupported, paramErr.Code)
+
+	ignored, err = CheckSampling("custom-vendor", &SamplingOptions{Logprobs: true, Seed: &seed})
+	require.NoError(t, err)
+	assert.Empty(t, ignored)
+}
+
+func TestSampling_Wire(t *testing.T) {
+	var openaiBody map[string]any
+	openaiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&openaiBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [
+			{"index": 0, "message": {"role": "assistant", "content": "one"}, "finish_reason": "stop",
+			 "logprobs": {"content": [{"token": "one", "logprob": -0.1, "bytes": [111, 110, 101], "top_logprobs": []}]}},
+			{"index": 1, "message": {"role": "assistant", "content": "two"}, "finish_reason": "length"}],
+			"usage": {"prompt_tokens": 3, "completion_tokens": 4, "total_tokens": 7}}`))
+	}))
+	t.Cleanup(openaiSrv.Close)
+	opts, err := ParseSamplingOptions(map[string]any{
+		"temperature": 0.2, "stop": []any{"END"}, "seed": float64(7), "n": float64(2), "logprobs": true, "user": "u-1", "top_k": float64(5),
+	})
+	require.NoError(t, err)
+	cfg := LLMConfig{Type: ProviderOpenAI, APIKeys: []string{"test"}, BaseURL: openaiSrv.URL + "/v1"}
+	resp, err := NewOpenAIProvider(&cfg).Generate(context.Background(), &LLMRequest{Model: "gpt-4o", Prompt: "hi", Sampling: opts})
+	require.NoError(t, err)
+	assert.InDelta(t, 0.2, openaiBody["temperature"], 1e-6)
+	assert.Equal(t, []any{"END"}, openaiBody["stop"])
+	assert.Equal(t, float64(7), openaiBody["seed"])
+	assert.Equal(t, float64(2), openaiBody["n"])
+	assert.Equal(t, true, openaiBody["logprobs"])
+	assert.Equal(t, "u-1", openaiBody["user"])
+	assert.NotContains(t, openaiBody, "top_k")
+	require.Len(t, resp.Choices, 2)
+	assert.Equal(t, "two", resp.Choices[1].Text)
+	assert.Equal(t, "length", resp.Choices[1].FinishReason)
+	assert.Equal(t, []int{111, 110, 101}, resp.Choices[0].Logprobs.Content[0].Bytes)
+
+	var claudeBody map[string]any
+	claudeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&claudeBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-3-opus", "stop_reason": "end_turn",
+			"content": [{"type": "text", "text": "hello"}], "usage": {"input_tokens": 3, "output_tokens": 4}}`))
+	}))
+	t.Cleanup(claudeSrv.Close)
+	cfg = LLMConfig{Type: ProviderClaude, APIKeys: []string{"test"}, BaseURL: claudeSrv.URL, Model: "claude-3-opus"}
+	_, err = NewClaudeProvider(&cfg).Generate(context.Background(), &LLMRequest{Prompt: "hi", Sampling: opts})
+	require.NoError(t, err)
+	assert.Equal(t, float64(5), claudeBody["top_k"])
+	assert.Equal(t, []any{"END"}, claudeBody["stop_sequences"])
+	assert.Equal(t, map[string]any{"user_id": "u-1"}, claudeBody["metadata"])
+	assert.NotContains(t, claudeBody, "seed")
+}
+
+// countingProvider answers every request with its call number, failing call failAt
+type countingProvider struct {
+	LLMProvider
+	calls     atomic.Int32
+	active    atomic.Int32
+	maxActive atomic.Int32
+	failAt    int32
+}
+
+func (p *countingProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMResponse, error) {
+	n := p.calls.Add(1)
+	active := p.active.Add(1)
+	defer p.active.Add(-1)
+	for {
+		seen := p.maxActive.Load()
+		if active <= seen || p.maxActive.CompareAndSwap(seen, active) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n == p.failAt {
+		return nil, errors.New("API error: 500 - overloaded")
+	}
+	return &LLMResponse{Text: fmt.Sprint(n), InputTokens: 2, OutputTokens: 3, TokensUsed: 5, FinishReason: "stop"}, nil
+}
+
+func TestGenerateChoices(t *testing.T) {
+	p := &countingProvider{}
+	req := &LLMRequest{Prompt: "hi", Sampling: &SamplingOptions{N: 3}}
+	resp, err := GenerateChoices(context.Background(), p, "claude", req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), p.calls.Load())
+	require.Len(t, resp.Choices, 3)
+	assert.Equal(t, resp.Choices[0].Text, resp.Text)
+	assert.Equal(t, 6, resp.InputTokens)
+	assert.Equal(t, 15, resp.TokensUsed)
+
+	// Calls are made a few at a time
+	p = &countingProvider{}
+	resp, err = GenerateChoices(context.Background(), p, "claude", &LLMRequest{Prompt: "hi", Sampling: &SamplingOptions{N: 20}})
+	require.NoError(t, err)
+	assert.Len(t, resp.Choices, 20)
+	assert.LessOrEqual(t, p.maxActive.Load(), int32(emulatedChoicesParallelism))
+	assert.Equal(t, 20, Calls("claude", &SamplingOptions{N: 20}))
+	assert.Equal(t, 1, Calls("openai", &SamplingOptions{N: 20}))
+
+	// A failed call stops the rest; the usage of the calls that succeeded is returned
+	p = &countingProvider{failAt: 2}
+	resp, err = GenerateChoices(context.Background(), p, "claude", &LLMRequest{Prompt: "hi", Sampling: &SamplingOptions{N: 20}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Empty(t, resp.Choices)
+	assert.Less(t, p.calls.Load(), int32(20))
+	assert.Equal(t, 5*(int(p.calls.Load())-1), resp.TokensUsed)
+
+	// Vendors that return several choices are called once
+	p = &countingProvider{}
+	_, err = GenerateChoices(context.Background(), p, "openai", req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), p.calls.Load())
+}
+
+func TestHTTPProviders_ListModels(t *testing.T) {
+	together := modelListServer(t, "/models", `[{"id": "meta-llama/Llama-3.3-70B-Instruct-Turbo", "type": "chat"}]`)
+	models, err := NewTogetherProvider(&LLMConfig{APIKeys: []string{"test"}, BaseURL: together.URL}).ListModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"meta-llama/Llama-3.3-70B-Instruct-Turbo"}, models)
+
+	mistral := modelListServer(t, "/v1/models", `{"object": "list", "data": [{"id": "mistral-large-latest"}]}`)
+	models, err = NewMistralProvider(&LLMConfig{APIKeys: []string{"test"}, BaseURL: mistral.URL + "/v1/"}).ListModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mistral-large-latest"}, models)
+
+	cohere := modelListServer(t, "/v1/models", `{"models": [{"name": "command-r-plus"}, {"name": "embed-english-v3.0"}]}`)
+	models, err = NewCohereProvider(&LLMConfig{APIKeys: []string{"test"}, BaseURL: cohere.URL + "/v1"}).ListModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"command-r-plus", "embed-english-v3.0"}, models)
+
+	_, err = NewCohereProvider(&LLMConfig{APIKeys: []string{"other"}, BaseURL: cohere.URL + "/v1"}).ListModels(context.Background())
+	_, class := ClassifyError(err)
+	assert.Equal(t, ErrorClassAuth, class)
+}
+
+// listingProvider returns models, or err when it is set. When release is set, each
+// call waits for it to be closed.
+type listingProvider struct {
+	mockProvider
+	models  []string
+	err     error
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (m *listingProvider) ListModels(ctx context.Context) ([]string, error) {
+	m.calls.Add(1)
+	if m.release != nil {
+		<-m.release
+	}
+	return m.models, m.err
+}
+
+func TestModelCache(t *testing.T) {
+	p := &listingProvider{mockProvider: mockProvider{name: "openai"}, models: []string{"gpt-4o", "gpt-4"}}
+	reg := NewRegistry()
+	reg.Register(p)
+	cache := NewModelCache(reg)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	models, err := cache.Models(context.Background(), "openai", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gpt-4", "gpt-4o"}, models)
+
+	// Served from the cache until the TTL passes
+	p.models = []string{"gpt-5"}
+	models, _ = cache.Models(context.Background(), "openai", time.Minute)
+	assert.Equal(t, []string{"gpt-4", "gpt-4o"}, models)
+	assert.Equal(t, int32(1), p.calls.Load())
+
+	now = now.Add(2 * time.Minute)
+	models, _ = cache.Models(context.Background(), "openai", time.Minute)
+	assert.Equal(t, []string{"gpt-5"}, models)
+
+	// A failed refresh keeps the last good list
+	now = now.Add(2 * time.Minute)
+	p.err = errors.New("API error: 503 - unavailable")
+	models, err = cache.Models(context.Background(), "openai", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gpt-5"}, models)
+
+	// A reload registers a new instance, whose list is fetched afresh
+	fresh := &listingProvider{mockProvider: mockProvider{name: "openai"}, err: errors.New("API error: 401 - bad key")}
+	reg.Register(fresh)
+	_, err = cache.Models(context.Background(), "openai", time.Minute)
+	assert.Error(t, err)
+
+	_, err = cache.Models(context.Background(), "missing", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestModelCache_Failures(t *testing.T) {
+	p := &listingProvider{mockProvider: mockProvider{name: "openai"}, err: errors.New("API error: 503 - unavailable")}
+	reg := NewRegistry()
+	reg.Register(p)
+	cache := NewModelCache(reg)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	// Without a good list the failure is cached, for less than the TTL
+	for range 5 {
+		_, err := cache.Models(context.Background(), "openai", time.Hour)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), p.calls.Load())
+
+	now = now.Add(modelListRetry)
+	p.err = nil
+	p.models = []string{"gpt-4o"}
+	models, err := cache.Models(context.Background(), "openai", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gpt-4o"}, models)
+	assert.Equal(t, int32(2), p.calls.Load())
+}
+
+func TestModelCache_ConcurrentRefresh(t *testing.T) {
+	p := &listingProvider{mockProvider: mockProvider{name: "openai"}, models: []string{"gpt-4o"}, release: make(chan struct{})}
+	reg := NewRegistry()
+	reg.Register(p)
+	cache := NewModelCache(reg)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			models, err := cache.Models(context.Background(), "openai", time.Hour)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"gpt-4o"}, models)
+		}()
+	}
+	require.Eventually(t, func() bool { return p.calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(p.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), p.calls.Load())
 }
 
 func TestGrokProvider_Name(t *testing.T) {
@@ -89,11 +642,12 @@ func TestGrokProvider_Name(t *testing.T) {
 }
 
 func TestGrokProvider_ListModels(t *testing.T) {
-	cfg := LLMConfig{Type: ProviderGrok, APIKeys: []string{"test"}}
+	srv := modelListServer(t, "/v1/models", `{"object": "list", "data": [{"id": "grok-4", "object": "model"}]}`)
+	cfg := LLMConfig{Type: ProviderGrok, APIKeys: []string{"test"}, BaseURL: srv.URL + "/v1"}
 	p := NewGrokProvider(&cfg)
 	models, err := p.ListModels(context.Background())
 	require.NoError(t, err)
-	assert.Contains(t, models, "grok-beta")
+	assert.Equal(t, []string{"grok-4"}, models)
 }
 
 func TestLLMConfig_APIKey(t *testing.T) {
@@ -201,3 +755,79 @@ func (m *mockProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRequ
 func (m *mockProvider) ListModels(ctx context.Context) ([]string, error) {
 	return []string{"model1"}, nil
 }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		class  string
+	}{
+		{context.DeadlineExceeded, 0, ErrorClassTimeout},
+		{fmt.Errorf("OpenAI API error after 3 attempts: %w", context.DeadlineExceeded), 0, ErrorClassTimeout},
+		{context.Canceled, 0, ErrorClassCanceled},
+		{&openai.APIError{HTTPStatusCode: 429, Message: "slow down"}, 429, ErrorClassRateLimit},
+		{fmt.Errorf("wrapped: %w", &openai.APIError{HTTPStatusCode: 401}), 401, ErrorClassAuth},
+		{&openai.APIError{HTTPStatusCode: 400, Code: "content_filter", Message: "blocked by content_filter"}, 400, ErrorClassContentFilter},
+		{fmt.Errorf("Cohere API error: 503 Service Unavailable - down"), 503, ErrorClassUpstream5xx},
+		{fmt.Errorf("Cohere API error: 400 Bad Request - bad"), 400, ErrorClassInvalidRequest},
+		{fmt.Errorf("rpc error: code = ResourceExhausted desc = quota"), 0, ErrorClassRateLimit},
+		{fmt.Errorf("something odd"), 0, ErrorClassOther},
+	}
+	for _, c := range cases {
+		status, class := ClassifyError(c.err)
+		assert.Equal(t, c.status, status, c.err.Error())
+		assert.Equal(t, c.class, class, c.err.Error())
+	}
+
+	status, class := ClassifyError(nil)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "", class)
+
+	assert.True(t, Retryable(errors.New("API error: 503 - overloaded")))
+	assert.False(t, Retryable(errors.New("API error: 400 - bad request")))
+	assert.False(t, Retryable(fmt.Errorf("request failed: %w", context.Canceled)))
+	assert.True(t, Retryable(context.DeadlineExceeded))
+
+	assert.Equal(t, 429, StatusForErrorClass(ErrorClassRateLimit))
+	assert.Equal(t, 504, StatusForErrorClass(ErrorClassTimeout))
+	assert.Equal(t, 502, StatusForErrorClass(ErrorClassUpstream5xx))
+	assert.Equal(t, 500, StatusForErrorClass(ErrorClassOther))
+}
+
+func TestCatalogLookup(t *testing.T) {
+	catalog := NewCatalog([]config.ModelSpec{
+		{Provider: "openai", Model: "gpt-4o", ContextWindow: 64000},
+		{Provider: "azure-east", Model: "gpt-4o", Capabilities: &config.ModelCapabilities{Streaming: true}},
+		{Provider: "together", Model: "meta-llama/Llama-3.3-70B-Instruct-Turbo", Pricing: config.Pricing{InputTokenCost: 0.88, OutputTokenCost: 0.88}, ContextWindow: 131072},
+	})
+
+	// Built-in entry with the config's non-zero fields on top
+	spec, ok := catalog.Lookup("openai-prod", "openai", "gpt-4o")
+	require.True(t, ok)
+	assert.Equal(t, 64000, spec.ContextWindow)
+	assert.Equal(t, 16384, spec.MaxOutputTokens)
+	assert.Equal(t, 2.5, spec.Pricing.InputTokenCost)
+	assert.True(t, spec.Capabilities.Vision)
+
+	// An entry for a provider ID wins over the type's, and capabilities replace the built-in ones
+	spec, ok = catalog.Lookup("azure-east", "openai", "gpt-4o")
+	require.True(t, ok)
+	assert.Equal(t, 128000, spec.ContextWindow)
+	assert.False(t, spec.Capabilities.Tools)
+
+	// Dated versions fall back to the longest matching entry
+	spec, ok = catalog.Lookup("openai-prod", "openai", "gpt-4o-mini-2024-07-18")
+	require.True(t, ok)
+	assert.Equal(t, "gpt-4o-mini", spec.Model)
+
+	// Models only the config knows
+	spec, ok = catalog.Lookup("together", "together", "meta-llama/Llama-3.3-70B-Instruct-Turbo")
+	require.True(t, ok)
+	assert.Equal(t, 131072, spec.ContextWindow)
+	assert.Nil(t, spec.Capabilities)
+
+	_, ok = catalog.Lookup("openai-prod", "openai", "my-finetune")
+	assert.False(t, ok)
+	_, ok = catalog.Lookup("gemini-prod", "gemini", "gpt-4o")
+	assert.False(t, ok)
+}
@@ -50,6 +50,21 @@ func (r *Registry) List() []string {
 	return names
 }
 
+// Replace swaps in the providers of other in one step. Requests that already hold a
+// provider keep using it; later lookups see the new set.
+func (r *Registry) Replace(other *Registry) {
+	other.mu.RLock()
+	providers := make(map[string]Provider, len(other.providers))
+	for id, p := range other.providers {
+		providers[id] = p
+	}
+	other.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = providers
+}
+
 func (r *Registry) LoadFromConfig(cfg *config.Config) error {
 	// Load new LLMProviders
 	for _, lp := range cfg.LLMProviders {
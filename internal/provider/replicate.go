@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// replicateBaseURL is the API root used when base_url is not set
+const replicateBaseURL = "https://api.replicate.com/v1"
+
 type ReplicateProvider struct {
 	cfg    *LLMConfig
 	client *http.Client
@@ -57,11 +61,21 @@ func (p *ReplicateProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 	if req.MaxTokens > 0 {
 		input["max_tokens"] = req.MaxTokens
 	}
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		input["temperature"] = temp
+	opts := req.SamplingOptions()
+	if opts.Temperature != nil {
+		input["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		input["top_p"] = *opts.TopP
+	}
+	if opts.TopK != nil {
+		input["top_k"] = *opts.TopK
 	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		input["top_p"] = topP
+	if len(opts.Stop) > 0 {
+		input["stop_sequences"] = strings.Join(opts.Stop, ",") // Replicate's language models take one comma-separated string
+	}
+	if opts.Seed != nil {
+		input["seed"] = *opts.Seed
 	}
 
 	replicateReq := ReplicatePredictionRequest{
@@ -90,7 +104,7 @@ func (p *ReplicateProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.replicate.com/v1/predictions", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(replicateBaseURL)+"/predictions", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -109,8 +123,9 @@ func (p *ReplicateProvider) Generate(ctx context.Context, req *LLMRequest) (*LLM
 
 		if resp.StatusCode != http.StatusCreated {
 			body, _ := io.ReadAll(resp.Body)
-			if attempt == maxRetries-1 {
-				return nil, fmt.Errorf("Replicate API error: %s - %s", resp.Status, string(body))
+			statusErr := fmt.Errorf("Replicate API error: %s - %s", resp.Status, string(body))
+			if attempt == maxRetries-1 || !Retryable(statusErr) {
+				return nil, statusErr
 			}
 			continue
 		}
@@ -180,7 +195,7 @@ func (p *ReplicateProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 			streamChan <- &LLMStreamResponse{Text: fmt.Sprintf("Error: %v", err), Done: true}
 			return
 		}
-		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true}
+		streamChan <- &LLMStreamResponse{Text: resp.Text, FinishReason: resp.FinishReason, Done: true, Usage: resp.Usage()}
 	}()
 
 	return streamChan, nil
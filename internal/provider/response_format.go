@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Response format types of the OpenAI response_format parameter
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// claudeJSONTool is the tool Claude is made to call to return structured output,
+// since it has no JSON mode of its own
+const claudeJSONTool = "json_response"
+
+// EmulatesJSONMode reports whether a provider type returns JSON output through tool
+// calls, so its models that support tools support response_format without a JSON mode
+func EmulatesJSONMode(providerType string) bool {
+	return ProviderType(providerType) == ProviderClaude
+}
+
+// ResponseFormat is the OpenAI response_format of a chat request, asking for JSON
+// output that optionally matches a JSON schema
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat is the schema of a json_schema response format
+type JSONSchemaFormat struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      bool           `json:"strict,omitempty"`
+}
+
+// ParseResponseFormat reads the response_format of a chat request. It returns nil
+// for a missing or text format.
+func ParseResponseFormat(v any) (*ResponseFormat, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var rf ResponseFormat
+	if err := json.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("invalid response_format: %w", err)
+	}
+	switch rf.Type {
+	case ResponseFormatText:
+		return nil, nil
+	case ResponseFormatJSONObject:
+		rf.JSONSchema = nil
+		return &rf, nil
+	case ResponseFormatJSONSchema:
+		if rf.JSONSchema == nil || rf.JSONSchema.Name == "" {
+			return nil, fmt.Errorf("response_format.json_schema.name is required")
+		}
+		return &rf, nil
+	}
+	return nil, fmt.Errorf("invalid response_format.type %q: expected text, json_object or json_schema", rf.Type)
+}
+
+// Schema returns the JSON schema the response must match, or nil if any JSON
+// object will do
+func (rf *ResponseFormat) Schema() map[string]any {
+	if rf == nil || rf.JSONSchema == nil {
+		return nil
+	}
+	return rf.JSONSchema.Schema
+}
+
+// openAIResponseFormat converts a response format for OpenAI-compatible APIs
+func openAIResponseFormat(rf *ResponseFormat) *openai.ChatCompletionResponseFormat {
+	if rf == nil {
+		return nil
+	}
+	format := &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatType(rf.Type)}
+	if rf.JSONSchema != nil {
+		schema, _ := json.Marshal(rf.JSONSchema.Schema)
+		format.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:        rf.JSONSchema.Name,
+			Description: rf.JSONSchema.Description,
+			Schema:      json.RawMessage(schema),
+			Strict:      rf.JSONSchema.Strict,
+		}
+	}
+	return format
+}
+
+// geminiSchema converts a JSON schema to Gemini's schema subset: types, formats,
+// descriptions, enums, items, properties and required fields. A ["<type>", "null"]
+// type becomes a nullable type.
+func geminiSchema(s map[string]any) *genai.Schema {
+	if s == nil {
+		return nil
+	}
+	schema := &genai.Schema{}
+	switch t := s["type"].(type) {
+	case string:
+		schema.Type = geminiType(t)
+	case []any:
+		for _, v := range t {
+			if name, _ := v.(string); name == "null" {
+				schema.Nullable = true
+			} else if name != "" {
+				schema.Type = geminiType(name)
+			}
+		}
+	}
+	schema.Format, _ = s["format"].(string)
+	schema.Description, _ = s["description"].(string)
+	if nullable, ok := s["nullable"].(bool); ok {
+		schema.Nullable = nullable
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		for _, v := range enum {
+			schema.Enum = append(schema.Enum, fmt.Sprint(v))
+		}
+	}
+	if items, ok := s["items"].(map[string]any); ok {
+		schema.Items = geminiSchema(items)
+	}
+	if props, ok := s["properties"].(map[string]any); ok {
+		schema.Properties = make(map[string]*genai.Schema, len(props))
+		for name, prop := range props {
+			p, _ := prop.(map[string]any)
+			schema.Properties[name] = geminiSchema(p)
+		}
+	}
+	if required, ok := s["required"].([]any); ok {
+		for _, v := range required {
+			if name, ok := v.(string); ok {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+	return schema
+}
+
+func geminiType(t string) genai.Type {
+	switch t {
+	case "string":
+		return genai.TypeString
+	case "number":
+		return genai.TypeNumber
+	case "integer":
+		return genai.TypeInteger
+	case "boolean":
+		return genai.TypeBoolean
+	case "array":
+		return genai.TypeArray
+	case "object":
+		return genai.TypeObject
+	}
+	return genai.TypeUnspecified
+}
+
+// setGeminiResponseFormat asks Gemini for a JSON response matching the format's schema
+func setGeminiResponseFormat(cfg *genai.GenerationConfig, rf *ResponseFormat) {
+	if rf == nil {
+		return
+	}
+	cfg.ResponseMIMEType = "application/json"
+	cfg.ResponseSchema = geminiSchema(rf.Schema())
+}
+
+// claudeInputSchema converts a JSON schema to the input schema of a Claude tool
+func claudeInputSchema(schema map[string]any) anthropic.ToolInputSchemaParam {
+	inputSchema := anthropic.ToolInputSchemaParam{}
+	if schema == nil {
+		return inputSchema
+	}
+	extra := make(map[string]any, len(schema))
+	for k, v := range schema {
+		switch k {
+		case "type":
+		case "properties":
+			inputSchema.Properties = v
+		case "required":
+			required, _ := v.([]any)
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					inputSchema.Required = append(inputSchema.Required, name)
+				}
+			}
+		default:
+			extra[k] = v
+		}
+	}
+	inputSchema.ExtraFields = extra
+	return inputSchema
+}
+
+// setClaudeResponseFormat makes Claude return structured output by forcing a call to
+// a tool whose input schema is the response schema. The tool input is the response.
+func setClaudeResponseFormat(params *anthropic.MessageNewParams, rf *ResponseFormat) {
+	if rf == nil {
+		return
+	}
+	tool := anthropic.ToolUnionParamOfTool(claudeInputSchema(rf.Schema()), claudeJSONTool)
+	description := "Respond with a JSON object."
+	if rf.JSONSchema != nil && rf.JSONSchema.Description != "" {
+		description = rf.JSONSchema.Description
+	}
+	tool.OfTool.Description = anthropic.String(description)
+	params.Tools = append(params.Tools, tool)
+	params.ToolChoice = anthropic.ToolChoiceParamOfTool(claudeJSONTool)
+}
@@ -0,0 +1,492 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Sampling parameters of the OpenAI chat completions API
+const (
+	ParamTemperature      = "temperature"
+	ParamTopP             = "top_p"
+	ParamTopK             = "top_k"
+	ParamStop             = "stop"
+	ParamSeed             = "seed"
+	ParamPresencePenalty  = "presence_penalty"
+	ParamFrequencyPenalty = "frequency_penalty"
+	ParamLogitBias        = "logit_bias"
+	ParamN                = "n"
+	ParamLogprobs         = "logprobs" // Covers top_logprobs, which requires it
+	ParamUser             = "user"
+)
+
+// Codes of parameter errors, as OpenAI reports them
+const (
+	ParamCodeInvalidValue = "invalid_value"
+	ParamCodeUnsupported  = "unsupported_parameter"
+)
+
+// maxChoices is the largest n OpenAI accepts
+const maxChoices = 128
+
+// SamplingOptions are the sampling parameters of a chat request. Nil pointers and zero
+// values leave the vendor's default.
+type SamplingOptions struct {
+	Temperature      *float64
+	TopP             *float64
+	TopK             *int
+	Stop             []string
+	Seed             *int
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	LogitBias        map[string]int
+	N                int // Choices to return; 0 and 1 both mean one
+	Logprobs         bool
+	TopLogprobs      int
+	User             string
+}
+
+// ParamError is a request parameter with an invalid value, or one the provider can't
+// serve. Param and Code are reported to clients like OpenAI does.
+type ParamError struct {
+	Param   string
+	Code    string
+	Message string
+}
+
+func (e *ParamError) Error() string {
+	return e.Message
+}
+
+func invalidParam(param, format string, args ...any) *ParamError {
+	return &ParamError{Param: param, Code: ParamCodeInvalidValue, Message: fmt.Sprintf(format, args...)}
+}
+
+// ParseSamplingOptions reads the sampling parameters of a chat request body, checking
+// their types and ranges the way OpenAI does
+func ParseSamplingOptions(params map[string]any) (*SamplingOptions, error) {
+	opts := &SamplingOptions{}
+	var err error
+	if opts.Temperature, err = floatParam(params, ParamTemperature, 0, 2); err != nil {
+		return nil, err
+	}
+	if opts.TopP, err = floatParam(params, ParamTopP, 0, 1); err != nil {
+		return nil, err
+	}
+	if opts.TopK, err = intParam(params, ParamTopK, 0, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	if opts.Seed, err = intParam(params, ParamSeed, math.MinInt64, math.MaxInt64); err != nil {
+		return nil, err
+	}
+	if opts.PresencePenalty, err = floatParam(params, ParamPresencePenalty, -2, 2); err != nil {
+		return nil, err
+	}
+	if opts.FrequencyPenalty, err = floatParam(params, ParamFrequencyPenalty, -2, 2); err != nil {
+		return nil, err
+	}
+
+	switch stop := params[ParamStop].(type) {
+	case nil:
+	case string:
+		opts.Stop = []string{stop}
+	case []any:
+		if len(stop) > 4 {
+			return nil, invalidParam(ParamStop, "stop takes up to 4 sequences, got %d", len(stop))
+		}
+		for _, s := range stop {
+			seq, ok := s.(string)
+			if !ok {
+				return nil, invalidParam(ParamStop, "stop must be a string or an array of strings")
+			}
+			opts.Stop = append(opts.Stop, seq)
+		}
+	default:
+		return nil, invalidParam(ParamStop, "stop must be a string or an array of strings")
+	}
+
+	switch bias := params[ParamLogitBias].(type) {
+	case nil:
+	case map[string]any:
+		opts.LogitBias = make(map[string]int, len(bias))
+		for token, v := range bias {
+			b, ok := v.(float64)
+			if !ok || b != math.Trunc(b) || b < -100 || b > 100 {
+				return nil, invalidParam(ParamLogitBias, "logit_bias values must be integers between -100 and 100")
+			}
+			opts.LogitBias[token] = int(b)
+		}
+	default:
+		return nil, invalidParam(ParamLogitBias, "logit_bias must be an object of token IDs to biases")
+	}
+
+	n, err := intParam(params, ParamN, 1, maxChoices)
+	if err != nil {
+		return nil, err
+	}
+	if n != nil {
+		opts.N = *n
+	}
+
+	switch logprobs := params[ParamLogprobs].(type) {
+	case nil:
+	case bool:
+		opts.Logprobs = logprobs
+	default:
+		return nil, invalidParam(ParamLogprobs, "logprobs must be a boolean")
+	}
+	topLogprobs, err := intParam(params, "top_logprobs", 0, 20)
+	if err != nil {
+		return nil, err
+	}
+	if topLogprobs != nil {
+		if !opts.Logprobs {
+			return nil, invalidParam("top_logprobs", "top_logprobs requires logprobs to be true")
+		}
+		opts.TopLogprobs = *topLogprobs
+	}
+
+	switch user := params[ParamUser].(type) {
+	case nil:
+	case string:
+		opts.User = user
+	default:
+		return nil, invalidParam(ParamUser, "user must be a string")
+	}
+	return opts, nil
+}
+
+func floatParam(params map[string]any, name string, min, max float64) (*float64, error) {
+	v, ok := params[name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, invalidParam(name, "%s must be a number", name)
+	}
+	if f < min || f > max {
+		return nil, invalidParam(name, "%s must be between %g and %g, got %g", name, min, max, f)
+	}
+	return &f, nil
+}
+
+func intParam(params map[string]any, name string, min, max float64) (*int, error) {
+	v, ok := params[name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) {
+		return nil, invalidParam(name, "%s must be an integer", name)
+	}
+	if f < min || f > max {
+		return nil, invalidParam(name, "%s must be between %.0f and %.0f, got %.0f", name, min, max, f)
+	}
+	i := int(f)
+	return &i, nil
+}
+
+// set lists the parameters opts sets away from their defaults
+func (o *SamplingOptions) set() []string {
+	var params []string
+	add := func(param string, isSet bool) {
+		if isSet {
+			params = append(params, param)
+		}
+	}
+	add(ParamTemperature, o.Temperature != nil)
+	add(ParamTopP, o.TopP != nil)
+	add(ParamTopK, o.TopK != nil)
+	add(ParamStop, len(o.Stop) > 0)
+	add(ParamSeed, o.Seed != nil)
+	add(ParamPresencePenalty, o.PresencePenalty != nil)
+	add(ParamFrequencyPenalty, o.FrequencyPenalty != nil)
+	add(ParamLogitBias, len(o.LogitBias) > 0)
+	add(ParamN, o.N > 1)
+	add(ParamLogprobs, o.Logprobs)
+	add(ParamUser, o.User != "")
+	return params
+}
+
+// openAISampling is what OpenAI-compatible APIs take, under the same names
+var openAISampling = map[string]string{
+	ParamTemperature:      "temperature",
+	ParamTopP:             "top_p",
+	ParamStop:             "stop",
+	ParamSeed:             "seed",
+	ParamPresencePenalty:  "presence_penalty",
+	ParamFrequencyPenalty: "frequency_penalty",
+	ParamLogitBias:        "logit_bias",
+	ParamN:                "n",
+	ParamLogprobs:         "logprobs",
+	ParamUser:             "user",
+}
+
+// without returns a copy of a table without some parameters
+func without(table map[string]string, params ...string) map[string]string {
+	t := make(map[string]string, len(table))
+	for k, v := range table {
+		t[k] = v
+	}
+	for _, p := range params {
+		delete(t, p)
+	}
+	return t
+}
+
+// samplingTables map the sampling parameters each provider type sends to the vendor's
+// name for them. top_k can't be sent through the OpenAI client, so OpenAI-compatible
+// vendors that take it don't get it.
+var samplingTables = map[ProviderType]map[string]string{
+	ProviderOpenAI:      openAISampling,
+	ProviderFireworks:   openAISampling,
+	ProviderGrok:        without(openAISampling, ParamLogitBias),
+	ProviderTogether:    without(openAISampling, ParamLogprobs),
+	ProviderOpenRouter:  without(openAISampling, ParamN),
+	ProviderHuggingFace: without(openAISampling, ParamN, ParamLogitBias),
+	ProviderMistral: {
+		ParamTemperature:      "temperature",
+		ParamTopP:             "top_p",
+		ParamStop:             "stop",
+		ParamSeed:             "random_seed",
+		ParamPresencePenalty:  "presence_penalty",
+		ParamFrequencyPenalty: "frequency_penalty",
+		ParamN:                "n",
+	},
+	ProviderCohere: {
+		ParamTemperature:      "temperature",
+		ParamTopP:             "p",
+		ParamTopK:             "k",
+		ParamStop:             "stop_sequences",
+		ParamSeed:             "seed",
+		ParamPresencePenalty:  "presence_penalty",
+		ParamFrequencyPenalty: "frequency_penalty",
+	},
+	ProviderGemini: {
+		ParamTemperature: "temperature",
+		ParamTopP:        "topP",
+		ParamTopK:        "topK",
+		ParamStop:        "stopSequences",
+	},
+	ProviderClaude: {
+		ParamTemperature: "temperature",
+		ParamTopP:        "top_p",
+		ParamTopK:        "top_k",
+		ParamStop:        "stop_sequences",
+		ParamUser:        "metadata.user_id",
+	},
+	ProviderReplicate: {
+		ParamTemperature: "temperature",
+		ParamTopP:        "top_p",
+		ParamTopK:        "top_k",
+		ParamStop:        "stop_sequences",
+		ParamSeed:        "seed",
+	},
+}
+
+// SamplingSupport is how a provider type handles a sampling parameter
+type SamplingSupport int
+
+const (
+	SamplingNative      SamplingSupport = iota // Sent to the vendor
+	SamplingEmulated                           // Done by the gateway: n, with one call per choice
+	SamplingIgnored                            // Not sent; the request goes ahead without it
+	SamplingUnsupported                        // Fails the request, since the response wouldn't be what was asked for
+)
+
+// SamplingSupportFor returns how a provider type handles a sampling parameter.
+// Provider types without a table are sent every parameter.
+func SamplingSupportFor(providerType, param string) SamplingSupport {
+	table, ok := samplingTables[ProviderType(providerType)]
+	if !ok {
+		return SamplingNative
+	}
+	if _, ok := table[param]; ok {
+		return SamplingNative
+	}
+	switch param {
+	case ParamN:
+		return SamplingEmulated
+	case ParamStop, ParamLogprobs:
+		return SamplingUnsupported
+	}
+	return SamplingIgnored
+}
+
+// CheckSampling returns the parameters opts sets that a provider type ignores, or a
+// ParamError for the first one it can't serve
+func CheckSampling(providerType string, opts *SamplingOptions) ([]string, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	var ignored []string
+	for _, param := range opts.set() {
+		switch SamplingSupportFor(providerType, param) {
+		case SamplingIgnored:
+			ignored = append(ignored, param)
+		case SamplingUnsupported:
+			return nil, &ParamError{Param: param, Code: ParamCodeUnsupported, Message: fmt.Sprintf("%s is not supported by %s models", param, providerType)}
+		}
+	}
+	return ignored, nil
+}
+
+// takes reports whether a provider type sends a sampling parameter to its vendor
+func takes(providerType ProviderType, param string) bool {
+	return SamplingSupportFor(string(providerType), param) == SamplingNative
+}
+
+// setOpenAISampling sets the sampling parameters a provider type takes on an
+// OpenAI-compatible request
+func setOpenAISampling(chatReq *openai.ChatCompletionRequest, providerType ProviderType, opts *SamplingOptions) {
+	if opts.Temperature != nil && takes(providerType, ParamTemperature) {
+		chatReq.Temperature = float32(*opts.Temperature)
+	}
+	if opts.TopP != nil && takes(providerType, ParamTopP) {
+		chatReq.TopP = float32(*opts.TopP)
+	}
+	if takes(providerType, ParamStop) {
+		chatReq.Stop = opts.Stop
+	}
+	if takes(providerType, ParamSeed) {
+		chatReq.Seed = opts.Seed
+	}
+	if opts.PresencePenalty != nil && takes(providerType, ParamPresencePenalty) {
+		chatReq.PresencePenalty = float32(*opts.PresencePenalty)
+	}
+	if opts.FrequencyPenalty != nil && takes(providerType, ParamFrequencyPenalty) {
+		chatReq.FrequencyPenalty = float32(*opts.FrequencyPenalty)
+	}
+	if takes(providerType, ParamLogitBias) {
+		chatReq.LogitBias = opts.LogitBias
+	}
+	if opts.N > 1 && takes(providerType, ParamN) {
+		chatReq.N = opts.N
+	}
+	if opts.Logprobs && takes(providerType, ParamLogprobs) {
+		chatReq.LogProbs = true
+		chatReq.TopLogProbs = opts.TopLogprobs
+	}
+	if takes(providerType, ParamUser) {
+		chatReq.User = opts.User
+	}
+}
+
+// openAIChoices converts the choices of an OpenAI-compatible response
+func openAIChoices(choices []openai.ChatCompletionChoice) []ResponseChoice {
+	converted := make([]ResponseChoice, len(choices))
+	for i, c := range choices {
+		converted[i] = ResponseChoice{Text: c.Message.Content, FinishReason: string(c.FinishReason)}
+		if c.LogProbs == nil {
+			continue
+		}
+		logprobs := &Logprobs{Content: make([]TokenLogprob, len(c.LogProbs.Content))}
+		for j, lp := range c.LogProbs.Content {
+			token := TokenLogprob{Token: lp.Token, Logprob: lp.LogProb, Bytes: byteValues(lp.Bytes), TopLogprobs: []TopLogprob{}}
+			for _, top := range lp.TopLogProbs {
+				token.TopLogprobs = append(token.TopLogprobs, TopLogprob{Token: top.Token, Logprob: top.LogProb, Bytes: byteValues(top.Bytes)})
+			}
+			logprobs.Content[j] = token
+		}
+		converted[i].Logprobs = logprobs
+	}
+	return converted
+}
+
+// byteValues returns bytes as the list of integers OpenAI reports
+func byteValues(b []byte) []int {
+	if b == nil {
+		return nil
+	}
+	values := make([]int, len(b))
+	for i, v := range b {
+		values[i] = int(v)
+	}
+	return values
+}
+
+// emulatedChoicesParallelism bounds the calls GenerateChoices makes at once for one
+// request, so a large n doesn't burst a single key
+const emulatedChoicesParallelism = 4
+
+// Calls returns the number of vendor calls a request takes on a provider type: one
+// per choice when the provider can't return several choices itself, otherwise one
+func Calls(providerType string, opts *SamplingOptions) int {
+	if opts == nil || opts.N <= 1 || SamplingSupportFor(providerType, ParamN) != SamplingEmulated {
+		return 1
+	}
+	return opts.N
+}
+
+// GenerateChoices runs a request on a provider. When the request asks for several
+// choices and the provider type can't return them itself, it makes one call per
+// choice, a few at a time, and combines them, adding up their usage. If a call
+// fails, the rest are cancelled and the error is returned with a response holding
+// the usage of the calls that succeeded, since the vendor bills them.
+func GenerateChoices(ctx context.Context, p LLMProvider, providerType string, req *LLMRequest) (*LLMResponse, error) {
+	n := Calls(providerType, req.SamplingOptions())
+	if n == 1 {
+		return p.Generate(ctx, req)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	responses := make([]*LLMResponse, n)
+	var failOnce sync.Once
+	var failErr error
+	sem := make(chan struct{}, emulatedChoicesParallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp, err := p.Generate(ctx, req)
+			if err == nil && resp == nil {
+				err = fmt.Errorf("provider returned nil response")
+			}
+			if err != nil {
+				failOnce.Do(func() {
+					failErr = err
+					cancel()
+				})
+				return
+			}
+			responses[i] = resp
+		}(i)
+	}
+	wg.Wait()
+
+	combined := &LLMResponse{}
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		combined.InputTokens += resp.InputTokens
+		combined.CachedInputTokens += resp.CachedInputTokens
+		combined.OutputTokens += resp.OutputTokens
+		combined.TokensUsed += resp.TokensUsed
+		combined.Choices = append(combined.Choices, resp.AllChoices()[0])
+	}
+	if failErr == nil && len(combined.Choices) < n {
+		failErr = ctx.Err() // Cancelled before every call was made
+	}
+	if failErr != nil {
+		combined.Choices = nil
+		return combined, failErr
+	}
+	combined.Text = combined.Choices[0].Text
+	combined.FinishReason = combined.Choices[0].FinishReason
+	return combined, nil
+}
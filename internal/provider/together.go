@@ -8,6 +8,9 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// togetherBaseURL is the API root used when base_url is not set
+const togetherBaseURL = "https://api.together.xyz/v1"
+
 type TogetherProvider struct {
 	cfg    *LLMConfig
 	client *openai.Client
@@ -15,7 +18,7 @@ type TogetherProvider struct {
 
 func NewTogetherProvider(cfg *LLMConfig) *TogetherProvider {
 	config := openai.DefaultConfig(cfg.APIKey())
-	config.BaseURL = "https://api.together.xyz/v1"
+	config.BaseURL = cfg.baseURL(togetherBaseURL)
 	client := openai.NewClientWithConfig(config)
 	return &TogetherProvider{cfg: cfg, client: client}
 }
@@ -62,18 +65,13 @@ func (p *TogetherProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMR
 		modelName = req.Model
 	}
 	chatReq := openai.ChatCompletionRequest{
-		Model:     modelName,
-		Messages:  messages,
-		MaxTokens: req.MaxTokens,
+		Model:          modelName,
+		Messages:       messages,
+		MaxTokens:      req.MaxTokens,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
-	// Add custom params
-	if temp, ok := req.Params["temperature"].(float64); ok {
-		chatReq.Temperature = float32(temp)
-	}
-	if topP, ok := req.Params["top_p"].(float64); ok {
-		chatReq.TopP = float32(topP)
-	}
+	setOpenAISampling(&chatReq, ProviderTogether, req.SamplingOptions())
 
 	// Retry with different keys if fail (max 3 attempts)
 	maxRetries := 3
@@ -90,7 +88,7 @@ func (p *TogetherProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMR
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api.together.xyz/v1"
+		config.BaseURL = p.cfg.baseURL(togetherBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		resp, err := p.client.CreateChatCompletion(ctx, chatReq)
@@ -103,9 +101,15 @@ func (p *TogetherProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMR
 				OutputTokens: resp.Usage.CompletionTokens,
 				TokensUsed:   resp.Usage.TotalTokens,
 				FinishReason: string(resp.Choices[0].FinishReason),
+				Choices:      openAIChoices(resp.Choices),
 			}, nil
 		}
 
+		// Another key won't fix a request the API rejected
+		if err != nil && !Retryable(err) {
+			return nil, fmt.Errorf("Together AI API error: %w", err)
+		}
+
 		// If error and not last attempt, continue to next key
 		if attempt == maxRetries-1 {
 			// Last attempt failed
@@ -133,14 +137,18 @@ func (p *TogetherProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 	}
 
 	request := openai.ChatCompletionRequest{
-		Model:    p.cfg.Model,
-		Messages: messages,
-		Stream:   true,
+		Model:          p.cfg.Model,
+		Messages:       messages,
+		Stream:         true,
+		ResponseFormat: openAIResponseFormat(req.ResponseFormat),
 	}
 
 	if req.MaxTokens > 0 {
 		request.MaxTokens = req.MaxTokens
 	}
+	setOpenAISampling(&request, ProviderTogether, req.SamplingOptions())
+
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // Reported in a last chunk without choices
 
 	stream, err := p.client.CreateChatCompletionStream(ctx, request)
 	if err != nil {
@@ -151,11 +159,12 @@ func (p *TogetherProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 		defer close(streamChan)
 		defer stream.Close()
 
+		var usage *Usage
 		for {
 			response, err := stream.Recv()
 			if err != nil {
 				if err == io.EOF {
-					streamChan <- &LLMStreamResponse{Done: true}
+					streamChan <- &LLMStreamResponse{Done: true, Usage: usage}
 					return
 				}
 				// Send error as a response
@@ -163,6 +172,9 @@ func (p *TogetherProvider) GenerateStream(ctx context.Context, req *LLMRequest)
 				return
 			}
 
+			if response.Usage != nil {
+				usage = openAIUsage(response.Usage)
+			}
 			if len(response.Choices) > 0 {
 				choice := response.Choices[0]
 				streamChan <- &LLMStreamResponse{
@@ -194,7 +206,7 @@ func (p *TogetherProvider) CreateEmbeddings(ctx context.Context, req *Embeddings
 		}
 
 		config := openai.DefaultConfig(currentKey)
-		config.BaseURL = "https://api.together.xyz/v1"
+		config.BaseURL = p.cfg.baseURL(togetherBaseURL)
 		p.client = openai.NewClientWithConfig(config)
 
 		modelName := p.cfg.Model
@@ -249,22 +261,8 @@ func (p *TogetherProvider) CreateEmbeddings(ctx context.Context, req *Embeddings
 	return nil, fmt.Errorf("unexpected error in retry loop")
 }
 
+// ListModels fetches the model catalog from the Together API, which returns a bare
+// array rather than the OpenAI list object
 func (p *TogetherProvider) ListModels(ctx context.Context) ([]string, error) {
-	// Together AI supports many models, return popular ones
-	return []string{
-		"meta-llama/Llama-3.3-70B-Instruct-Turbo",
-		"meta-llama/Llama-3.2-3B-Instruct-Turbo",
-		"meta-llama/Llama-3.2-11B-Vision-Instruct-Turbo",
-		"meta-llama/Llama-3.2-90B-Vision-Instruct-Turbo",
-		"mistralai/Mistral-7B-Instruct-v0.1",
-		"mistralai/Mixtral-8x7B-Instruct-v0.1",
-		"microsoft/WizardLM-2-8x22B",
-		"databricks/dbrx-instruct",
-		"google/gemma-2-9b-it",
-		"google/gemma-2-27b-it",
-		"Qwen/Qwen2.5-72B-Instruct-Turbo",
-		"Qwen/Qwen2.5-Coder-32B-Instruct",
-		"meta-llama/Llama-3-8B-Instruct-Turbo",
-		"meta-llama/Llama-3-70B-Instruct-Turbo",
-	}, nil
+	return fetchModelIDs(ctx, nil, p.cfg.baseURL(togetherBaseURL)+"/models", bearerHeader(p.cfg.APIKey()))
 }
@@ -10,6 +10,9 @@ import (
 	"time"
 )
 
+// voyageBaseURL is the API root used when base_url is not set
+const voyageBaseURL = "https://api.voyageai.com/v1"
+
 type VoyageProvider struct {
 	cfg    *LLMConfig
 	client *http.Client
@@ -93,7 +96,7 @@ func (p *VoyageProvider) CreateEmbeddings(ctx context.Context, req *EmbeddingsRe
 		}
 
 		httpReq, err := http.NewRequestWithContext(ctx, "POST",
-			"https://api.voyageai.com/v1/embeddings", bytes.NewBuffer(reqBody))
+			p.cfg.baseURL(voyageBaseURL)+"/embeddings", bytes.NewBuffer(reqBody))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create embedding request: %w", err)
 		}
@@ -0,0 +1,346 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultBufferFlushInterval is how often buffered writes are flushed when no interval is set
+const DefaultBufferFlushInterval = time.Second
+
+// DefaultBufferMaxPending is the number of pending writes that triggers an early flush
+const DefaultBufferMaxPending = 1000
+
+// bufferRequeueFactor bounds the metric points kept for retry after failed flushes, as a multiple of MaxPending
+const bufferRequeueFactor = 10
+
+// BufferedStoreOptions configures NewBufferedStore
+type BufferedStoreOptions struct {
+	FlushInterval time.Duration // How often pending writes are flushed; default 1s
+	MaxPending    int           // Pending usage counters plus metric points that trigger an early flush; default 1000
+}
+
+// BufferedStore is a write-behind RuntimeStore. It coalesces usage increments per
+// counter and queues metric points in memory, then writes them to the backend in
+// batches every FlushInterval, when MaxPending writes are waiting, and on Close.
+//
+// Usage reads add the pending deltas to the backend's values, so rate limits on this
+// instance see every increment immediately. While a batch is being written it may be
+// counted twice for a moment, which errs on the side of limiting. Other instances see
+// the increments once they are flushed. Pending deltas count toward any window, and
+// the backend records them at flush time rather than at increment time.
+type BufferedStore struct {
+	backend RuntimeStore
+	logger  zerolog.Logger
+
+	mu       sync.Mutex
+	usage    map[usageID]float64 // Coalesced increments not yet flushed
+	inflight map[usageID]float64 // Increments being written by the current flush
+	metrics  []MetricWrite
+
+	flushMu       sync.Mutex // Serializes flushes
+	flushInterval time.Duration
+	maxPending    int
+	kick          chan struct{}
+	stop          chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewBufferedStore wraps backend and starts the background flush loop; Close stops it
+func NewBufferedStore(backend RuntimeStore, opts BufferedStoreOptions, logger zerolog.Logger) *BufferedStore {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultBufferFlushInterval
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DefaultBufferMaxPending
+	}
+	b := &BufferedStore{
+		backend:       backend,
+		logger:        logger,
+		usage:         make(map[usageID]float64),
+		inflight:      make(map[usageID]float64),
+		flushInterval: opts.FlushInterval,
+		maxPending:    opts.MaxPending,
+		kick:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Backend returns the wrapped store
+func (b *BufferedStore) Backend() RuntimeStore {
+	return b.backend
+}
+
+func (b *BufferedStore) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		case <-b.kick:
+		}
+		if err := b.Flush(); err != nil {
+			b.logger.Error().Err(err).Str("operation", "Flush").Msg("store operation failed")
+		}
+	}
+}
+
+// Pending returns the number of usage counters and metric points waiting to be flushed
+func (b *BufferedStore) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.usage) + len(b.metrics)
+}
+
+// kickIfFullLocked starts an early flush when MaxPending writes are waiting. b.mu must be held.
+func (b *BufferedStore) kickIfFullLocked() {
+	if len(b.usage)+len(b.metrics) < b.maxPending {
+		return
+	}
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes every pending increment and metric point to the backend. Writes that
+// fail are kept and retried on the next flush.
+func (b *BufferedStore) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	usage, metrics := b.usage, b.metrics
+	b.usage, b.metrics = make(map[usageID]float64), nil
+	b.inflight = usage
+	b.mu.Unlock()
+
+	if len(usage) == 0 && len(metrics) == 0 {
+		return nil
+	}
+
+	increments := make([]UsageIncrement, 0, len(usage))
+	for id, delta := range usage {
+		increments = append(increments, UsageIncrement{Provider: id.Provider, KeyID: id.KeyID, Metric: id.Metric, Delta: delta})
+	}
+	failedUsage, usageErr := b.writeUsage(increments)
+	failedMetrics, metricsErr := b.writeMetrics(metrics)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight = make(map[usageID]float64)
+	for _, item := range failedUsage {
+		b.usage[usageID{item.Provider, item.KeyID, item.Metric}] += item.Delta
+	}
+	if len(failedMetrics) > 0 {
+		requeued := append(failedMetrics, b.metrics...)
+		if limit := b.maxPending * bufferRequeueFactor; len(requeued) > limit {
+			b.logger.Warn().Int("dropped", len(requeued)-limit).Msg("dropping buffered metric points after failed flushes")
+			requeued = requeued[len(requeued)-limit:]
+		}
+		b.metrics = requeued
+	}
+
+	if usageErr != nil {
+		return fmt.Errorf("failed to flush %d usage counters: %w", len(failedUsage), usageErr)
+	}
+	if metricsErr != nil {
+		return fmt.Errorf("failed to flush %d metric points: %w", len(failedMetrics), metricsErr)
+	}
+	b.logger.Debug().Str("operation", "Flush").Int("usage", len(increments)).Int("metrics", len(metrics)).Msg("store operation")
+	return nil
+}
+
+// writeUsage applies increments in one batch when the backend supports it, and
+// returns the ones that were not applied
+func (b *BufferedStore) writeUsage(items []UsageIncrement) ([]UsageIncrement, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	if batch, ok := b.backend.(BatchWriter); ok {
+		if err := batch.IncrementUsageBatch(items); err != nil {
+			return items, err
+		}
+		return nil, nil
+	}
+	for i, item := range items {
+		if err := b.backend.IncrementUsage(item.Provider, item.KeyID, item.Metric, item.Delta); err != nil {
+			return items[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// writeMetrics stores points in one batch when the backend supports it, and
+// returns the ones that were not stored
+func (b *BufferedStore) writeMetrics(points []MetricWrite) ([]MetricWrite, error) {
+	if len(points) == 0 {
+		return nil, nil
+	}
+	if batch, ok := b.backend.(BatchWriter); ok {
+		if err := batch.StoreMetricBatch(points); err != nil {
+			return points, err
+		}
+		return nil, nil
+	}
+	for i, p := range points {
+		if err := b.backend.StoreMetric(p.Name, p.Value, p.Tags, p.Timestamp); err != nil {
+			return points[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// localUsage returns the pending and in-flight deltas of one counter
+func (b *BufferedStore) localUsage(id usageID) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.usage[id] + b.inflight[id]
+}
+
+func (b *BufferedStore) GetUsage(provider, keyID, metric string) (float64, error) {
+	// Read the local view first so a flush finishing in between counts twice rather than not at all
+	local := b.localUsage(usageID{provider, keyID, metric})
+	total, err := b.backend.GetUsage(provider, keyID, metric)
+	if err != nil {
+		return 0, err
+	}
+	return total + local, nil
+}
+
+// SetUsage flushes pending writes first so earlier increments don't land on top of the new value
+func (b *BufferedStore) SetUsage(provider, keyID, metric string, value float64) error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.backend.SetUsage(provider, keyID, metric, value)
+}
+
+func (b *BufferedStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.usage[usageID{provider, keyID, metric}] += delta
+	b.kickIfFullLocked()
+	return nil
+}
+
+func (b *BufferedStore) IncrementUsageBatch(items []UsageIncrement) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, item := range items {
+		b.usage[usageID{item.Provider, item.KeyID, item.Metric}] += item.Delta
+	}
+	b.kickIfFullLocked()
+	return nil
+}
+
+func (b *BufferedStore) GetUsageInWindow(provider, keyID, metric string, windowSeconds int64) (float64, error) {
+	local := b.localUsage(usageID{provider, keyID, metric})
+	total, err := b.backend.GetUsageInWindow(provider, keyID, metric, windowSeconds)
+	if err != nil {
+		return 0, err
+	}
+	if windowSeconds <= 0 {
+		return total, nil
+	}
+	return total + local, nil
+}
+
+func (b *BufferedStore) SetCache(key, value string, ttlSeconds int64) error {
+	return b.backend.SetCache(key, value, ttlSeconds)
+}
+
+func (b *BufferedStore) GetCache(key string) (string, error) {
+	return b.backend.GetCache(key)
+}
+
+func (b *BufferedStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
+	return b.StoreMetricBatch([]MetricWrite{{Name: name, Value: value, Tags: tags, Timestamp: timestamp}})
+}
+
+func (b *BufferedStore) StoreMetricBatch(points []MetricWrite) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metrics = append(b.metrics, points...)
+	b.kickIfFullLocked()
+	return nil
+}
+
+// flushForRead writes pending points before a metrics query so it sees them
+func (b *BufferedStore) flushForRead(operation string) {
+	if err := b.Flush(); err != nil {
+		b.logger.Warn().Err(err).Str("operation", operation).Msg("failed to flush pending writes before query")
+	}
+}
+
+// GetMetrics flushes pending points first; metric queries are rare next to writes
+func (b *BufferedStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
+	b.flushForRead("GetMetrics")
+	return b.backend.GetMetrics(name, tags, start, end)
+}
+
+// QueryTimeSeries pushes the query down when the backend aggregates natively
+func (b *BufferedStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	b.flushForRead("QueryTimeSeries")
+	if native, ok := b.backend.(TimeSeriesStore); ok {
+		return native.QueryTimeSeries(q)
+	}
+	points, err := b.backend.GetMetrics(q.Name, q.Tags, q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+	return AggregatePoints(points, q), nil
+}
+
+// Compact flushes pending writes and delegates to the backend when it supports compaction
+func (b *BufferedStore) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	c, ok := b.backend.(Compactor)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	b.flushForRead("Compact")
+	return c.Compact(ctx, policy, now)
+}
+
+// ApplyRetention delegates to the backend when it enforces retention natively
+func (b *BufferedStore) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	if a, ok := b.backend.(RetentionApplier); ok {
+		return a.ApplyRetention(ctx, policy)
+	}
+	return ErrNotSupported
+}
+
+// StorageStats delegates to the backend when it can report its size
+func (b *BufferedStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	if p, ok := b.backend.(StorageStatsProvider); ok {
+		return p.StorageStats(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+// Close stops the flush loop, flushes pending writes and closes the backend if it is an io.Closer
+func (b *BufferedStore) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		<-b.done
+	})
+	err := b.Flush()
+	if closer, ok := b.backend.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
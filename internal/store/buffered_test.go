@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore records the batches written to a memory store and can fail them
+type countingStore struct {
+	*MemoryStore
+	mu           sync.Mutex
+	usageBatches [][]UsageIncrement
+	metricWrites int
+	fail         bool
+}
+
+func (c *countingStore) IncrementUsageBatch(items []UsageIncrement) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail {
+		return errors.New("backend unavailable")
+	}
+	c.usageBatches = append(c.usageBatches, items)
+	return c.MemoryStore.IncrementUsageBatch(items)
+}
+
+func (c *countingStore) StoreMetricBatch(points []MetricWrite) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail {
+		return errors.New("backend unavailable")
+	}
+	c.metricWrites += len(points)
+	return c.MemoryStore.StoreMetricBatch(points)
+}
+
+func (c *countingStore) setFail(fail bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail = fail
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	m, err := NewMemoryStore(MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	return &countingStore{MemoryStore: m}
+}
+
+func TestBufferedStoreCoalescesAndKeepsLocalView(t *testing.T) {
+	backend := newCountingStore(t)
+	b := NewBufferedStore(backend, BufferedStoreOptions{FlushInterval: time.Hour}, zerolog.Nop())
+	defer b.Close()
+
+	// A chat completion's increments are visible locally before they reach the backend
+	require.NoError(t, backend.SetUsage("openai", "key1", "req", 10))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.IncrementUsage("openai", "key1", "req", 1))
+		require.NoError(t, b.IncrementUsage("openai", "key1", "tokens", 100))
+	}
+	require.NoError(t, b.StoreMetric("latency", 120, map[string]string{"provider": "openai"}, time.Now().Unix()))
+	assert.Equal(t, 3, b.Pending())
+
+	total, err := b.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, total)
+	window, err := b.GetUsageInWindow("openai", "key1", "tokens", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 500.0, window)
+	stored, err := backend.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, stored, "nothing is written before a flush")
+
+	// One flush writes one coalesced batch
+	require.NoError(t, b.Flush())
+	require.Len(t, backend.usageBatches, 1)
+	assert.Len(t, backend.usageBatches[0], 2)
+	assert.Equal(t, 1, backend.metricWrites)
+	assert.Zero(t, b.Pending())
+	total, err = b.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, total, "flushed increments are not counted twice")
+
+	// Metric queries see pending points
+	require.NoError(t, b.StoreMetric("latency", 80, map[string]string{"provider": "openai"}, time.Now().Unix()))
+	points, err := b.GetMetrics("latency", map[string]string{"provider": "openai"}, 0, time.Now().Unix())
+	require.NoError(t, err)
+	assert.Len(t, points, 2)
+}
+
+func TestBufferedStoreFlushTriggersAndRetries(t *testing.T) {
+	backend := newCountingStore(t)
+	b := NewBufferedStore(backend, BufferedStoreOptions{FlushInterval: time.Hour, MaxPending: 3}, zerolog.Nop())
+
+	// Reaching MaxPending flushes without waiting for the interval
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.StoreMetric("cost", float64(i), nil, now))
+	}
+	require.Eventually(t, func() bool { return b.Pending() == 0 }, time.Second, 5*time.Millisecond)
+
+	// Failed writes stay pending and counted, and go out with the next flush
+	backend.setFail(true)
+	require.NoError(t, b.IncrementUsage("openai", "key1", "req", 2))
+	require.NoError(t, b.StoreMetric("cost", 9, nil, now))
+	assert.Error(t, b.Flush())
+	assert.Equal(t, 2, b.Pending())
+	total, err := b.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, total)
+
+	// Close flushes what is left
+	backend.setFail(false)
+	require.NoError(t, b.IncrementUsage("openai", "key1", "req", 1))
+	require.NoError(t, b.Close())
+	total, err = backend.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, total)
+	assert.Equal(t, 4, backend.metricWrites)
+}
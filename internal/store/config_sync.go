@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/config"
+)
+
+// configVersionKey is the cache key SimpleConfigStore bumps on every save
+const configVersionKey = "config:version"
+
+// DefaultConfigSyncInterval is how often the shared config is checked when no interval is set
+const DefaultConfigSyncInterval = 5 * time.Second
+
+// ConfigSync polls a ConfigStore for changes made by other instances and passes
+// each new config to apply. Stores implementing ConfigVersioner are polled for
+// their version only; others are loaded and compared by content.
+type ConfigSync struct {
+	configs  ConfigStore
+	interval time.Duration
+	apply    func(*config.Config)
+	logger   zerolog.Logger
+
+	mu      sync.Mutex
+	version string // Version of the last applied config
+}
+
+// NewConfigSync creates a sync; Start begins polling. A zero interval uses the default.
+func NewConfigSync(configs ConfigStore, interval time.Duration, apply func(*config.Config), logger zerolog.Logger) *ConfigSync {
+	if interval == 0 {
+		interval = DefaultConfigSyncInterval
+	}
+	return &ConfigSync{configs: configs, interval: interval, apply: apply, logger: logger}
+}
+
+// Version returns the version of the last applied config, "" before the first one
+func (c *ConfigSync) Version() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// Check loads the stored config and applies it if it changed since the last check.
+// It reports whether a new config was applied.
+func (c *ConfigSync) Check() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var version string
+	if v, ok := c.configs.(ConfigVersioner); ok {
+		var err error
+		if version, err = v.ConfigVersion(); err != nil {
+			return false, err
+		}
+		if version == "" || version == c.version {
+			return false, nil
+		}
+	}
+
+	cfg, err := c.configs.LoadConfig()
+	if err != nil {
+		return false, err
+	}
+	if version == "" {
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return false, err
+		}
+		sum := sha256.Sum256(data)
+		version = hex.EncodeToString(sum[:8])
+		if version == c.version {
+			return false, nil
+		}
+	}
+
+	c.apply(cfg)
+	c.version = version
+	c.logger.Info().Str("version", version).Msg("applied shared config")
+	return true, nil
+}
+
+// Start polls every interval until ctx is done. A negative interval disables polling.
+func (c *ConfigSync) Start(ctx context.Context) {
+	if c.interval < 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := c.Check(); err != nil {
+				c.logger.Warn().Err(err).Msg("failed to check shared config")
+			}
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/config"
+)
+
+// unversionedConfigStore hides SimpleConfigStore's ConfigVersion
+type unversionedConfigStore struct {
+	ConfigStore
+}
+
+func TestConfigSyncAppliesChanges(t *testing.T) {
+	shared, err := NewMemoryStore(MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	for name, configs := range map[string]ConfigStore{
+		"versioned":   NewSimpleConfigStore(shared),
+		"unversioned": unversionedConfigStore{NewSimpleConfigStore(shared)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var applied []*config.Config
+			sync := NewConfigSync(configs, 0, func(cfg *config.Config) { applied = append(applied, cfg) }, zerolog.Nop())
+
+			// Another instance saves a config
+			other := NewSimpleConfigStore(shared)
+			require.NoError(t, other.SaveConfig(&config.Config{Policy: config.Policy{Algorithm: "round_robin"}}))
+			changed, err := sync.Check()
+			require.NoError(t, err)
+			assert.True(t, changed)
+			require.Len(t, applied, 1)
+			assert.Equal(t, "round_robin", applied[0].Policy.Algorithm)
+			assert.NotEmpty(t, sync.Version())
+
+			// Nothing changed since
+			changed, err = sync.Check()
+			require.NoError(t, err)
+			assert.False(t, changed)
+
+			require.NoError(t, other.SaveConfig(&config.Config{Policy: config.Policy{Algorithm: "least_loaded"}}))
+			changed, err = sync.Check()
+			require.NoError(t, err)
+			assert.True(t, changed)
+			require.Len(t, applied, 2)
+			assert.Equal(t, "least_loaded", applied[1].Policy.Algorithm)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package store_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/store"
+	"github.com/user/coo-llm/internal/store/storetest"
+)
+
+// Backends that need a running service are checked when their address is set:
+// REDIS_ADDR, POSTGRES_DSN and MONGODB_URI. Without REDIS_ADDR, Redis runs against
+// miniredis; DynamoDB runs against an in-process fake. CI starts the services.
+//
+// InfluxDB is not run: it is a metrics backend, and its usage counters (read, then
+// write a new point) and cache (no TTL) don't meet the runtime store contract.
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	newStore := func(t *testing.T) *store.SQLStore {
+		s, err := store.NewSQLStore(filepath.Join(t.TempDir(), "store.db"), zerolog.Nop())
+		require.NoError(t, err)
+		return s
+	}
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore { return newStore(t) })
+	storetest.RunConfigStore(t, func(t *testing.T) store.ConfigStore { return store.NewSimpleConfigStore(newStore(t)) })
+}
+
+func TestPostgresStoreConformance(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+		s, err := store.NewSQLStore(dsn, zerolog.Nop())
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	newStore := func(t *testing.T) store.RuntimeStore {
+		s, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+		require.NoError(t, err)
+		return s
+	}
+	storetest.RunRuntimeStore(t, newStore)
+	storetest.RunConfigStore(t, func(t *testing.T) store.ConfigStore { return store.NewSimpleConfigStore(newStore(t)) })
+}
+
+func TestBufferedStoreConformance(t *testing.T) {
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+		backend, err := store.NewSQLStore(filepath.Join(t.TempDir(), "store.db"), zerolog.Nop())
+		require.NoError(t, err)
+		b := store.NewBufferedStore(backend, store.BufferedStoreOptions{FlushInterval: 50 * time.Millisecond}, zerolog.Nop())
+		t.Cleanup(func() { b.Close() })
+		return b
+	})
+}
+
+func TestHTTPStoreConformance(t *testing.T) {
+	newStore := func(t *testing.T) *store.HTTPStore {
+		backend, err := store.NewMemoryStore(store.MemoryStoreOptions{}, zerolog.Nop())
+		require.NoError(t, err)
+		server := httptest.NewServer(store.NewHTTPStoreServer(backend, store.NewSimpleConfigStore(backend), "test-key", zerolog.Nop()).Handler())
+		t.Cleanup(server.Close)
+		return store.NewHTTPStore(server.URL, "test-key", zerolog.Nop())
+	}
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore { return newStore(t) })
+	storetest.RunConfigStore(t, func(t *testing.T) store.ConfigStore { return newStore(t) })
+}
+
+func TestDynamoDBStoreConformance(t *testing.T) {
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+		fake := storetest.NewFakeDynamoDB("usage", "cache", "history")
+		return storetest.NewDynamoDBStore(t, fake, store.DynamoDBOptions{TableUsage: "usage", TableCache: "cache", TableHistory: "history"})
+	})
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+		if addr == "" {
+			return store.NewRedisStore(newMiniredis(t).Addr(), "", zerolog.Nop())
+		}
+		return store.NewRedisStore(addr, os.Getenv("REDIS_PASSWORD"), zerolog.Nop())
+	})
+}
+
+// newMiniredis starts a miniredis server, which stands in for Redis including its Lua
+// scripting. Its clock only moves when told to, so it is moved along with real time
+// for keys to expire.
+func newMiniredis(t *testing.T) *miniredis.Miniredis {
+	m := miniredis.RunT(t)
+	const tick = 50 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.FastForward(tick)
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		ticker.Stop()
+		close(done)
+	})
+	return m
+}
+
+func TestMongoDBStoreConformance(t *testing.T) {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+	storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+		s, err := store.NewMongoDBStore(uri, "coo_llm_conformance", zerolog.Nop())
+		require.NoError(t, err)
+		return s
+	})
+}
@@ -3,7 +3,11 @@ package store
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,24 +17,63 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// dynamoMetricsMaxDays bounds how many daily partitions one metrics query reads
+const dynamoMetricsMaxDays = 400
+
+// dynamoBatchWriteSize is the most items BatchWriteItem accepts per request
+const dynamoBatchWriteSize = 25
+
 type DynamoDBStore struct {
 	client       *dynamodb.Client
 	logger       zerolog.Logger
 	tableUsage   string
 	tableCache   string
 	tableHistory string
+	tableMetrics string
+
+	historyRetention atomic.Int64  // Seconds until history items expire via TTL, 0 to keep them
+	metricsRetention atomic.Int64  // Seconds until metric points expire via TTL, 0 to keep them
+	seq              atomic.Uint64 // Sort key suffix keeping items written in the same second distinct
+	queryPageSize    int32         // Query page limit, 0 for the DynamoDB default
+}
+
+// DynamoDBOptions configures NewDynamoDBStoreWithOptions
+type DynamoDBOptions struct {
+	TableUsage   string
+	TableCache   string
+	TableHistory string
+	TableMetrics string // Defaults to TableHistory, which has the same key schema
+	Endpoint     string // Endpoint override for DynamoDB Local and compatible services
 }
 
 func NewDynamoDBStore(region, tableUsage, tableCache, tableHistory string, logger zerolog.Logger) (*DynamoDBStore, error) {
+	return NewDynamoDBStoreWithOptions(region, DynamoDBOptions{
+		TableUsage:   tableUsage,
+		TableCache:   tableCache,
+		TableHistory: tableHistory,
+	}, logger)
+}
+
+func NewDynamoDBStoreWithOptions(region string, opts DynamoDBOptions, logger zerolog.Logger) (*DynamoDBStore, error) {
 	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
 	if err != nil {
 		return nil, err
 	}
 
-	client := dynamodb.NewFromConfig(cfg)
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
+	if opts.TableMetrics == "" {
+		opts.TableMetrics = opts.TableHistory
+	}
 
 	// Test connection by describing tables
-	tables := []string{tableUsage, tableCache, tableHistory}
+	tables := []string{opts.TableUsage, opts.TableCache, opts.TableHistory}
+	if opts.TableMetrics != opts.TableHistory {
+		tables = append(tables, opts.TableMetrics)
+	}
 	for _, table := range tables {
 		_, err = client.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{
 			TableName: aws.String(table),
@@ -40,13 +83,23 @@ func NewDynamoDBStore(region, tableUsage, tableCache, tableHistory string, logge
 		}
 	}
 
-	return &DynamoDBStore{
+	d := &DynamoDBStore{
 		client:       client,
 		logger:       logger,
-		tableUsage:   tableUsage,
-		tableCache:   tableCache,
-		tableHistory: tableHistory,
-	}, nil
+		tableUsage:   opts.TableUsage,
+		tableCache:   opts.TableCache,
+		tableHistory: opts.TableHistory,
+		tableMetrics: opts.TableMetrics,
+	}
+	// Different instances start at different suffixes so their items don't collide
+	d.seq.Store(uint64(time.Now().UnixNano()))
+	return d, nil
+}
+
+// sortKey returns a numeric sort key that orders by timestamp; the fraction keeps items
+// written in the same second distinct
+func (d *DynamoDBStore) sortKey(timestamp int64) string {
+	return fmt.Sprintf("%d.%09d", timestamp, d.seq.Add(1)%1e9)
 }
 
 func (d *DynamoDBStore) getUsageKey(provider, keyID, metric string) map[string]types.AttributeValue {
@@ -133,10 +186,13 @@ func (d *DynamoDBStore) IncrementUsage(provider, keyID, metric string, delta flo
 	timestamp := time.Now().Unix()
 	historyItem := map[string]types.AttributeValue{
 		"pk":        &types.AttributeValueMemberS{Value: fmt.Sprintf("HISTORY#%s#%s#%s", provider, keyID, metric)},
-		"sk":        &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", timestamp)},
+		"sk":        &types.AttributeValueMemberN{Value: d.sortKey(timestamp)},
 		"delta":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.6f", delta)},
 		"timestamp": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", timestamp)},
 	}
+	if retention := d.historyRetention.Load(); retention > 0 {
+		historyItem["expires_at"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", timestamp+retention)}
+	}
 
 	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(d.tableHistory),
@@ -188,23 +244,21 @@ func (d *DynamoDBStore) GetUsageInWindow(provider, keyID, metric string, windowS
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":pk":    &types.AttributeValueMemberS{Value: fmt.Sprintf("HISTORY#%s#%s#%s", provider, keyID, metric)},
 			":start": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", start)},
-			":end":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", now)},
+			":end":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d.999999999", now)},
 		},
 	}
 
-	result, err := d.client.Query(ctx, queryInput)
-	if err != nil {
-		d.logger.Error().Err(err).Str("operation", "GetUsageInWindow").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Int64("windowSeconds", windowSeconds).Msg("store operation failed")
-		return 0, err
-	}
-
 	total := 0.0
-	for _, item := range result.Items {
-		if deltaAttr, ok := item["delta"]; ok {
-			if deltaStr, ok := deltaAttr.(*types.AttributeValueMemberN); ok {
-				if delta, err := strconv.ParseFloat(deltaStr.Value, 64); err == nil {
-					total += delta
-				}
+	paginator := dynamodb.NewQueryPaginator(d.client, queryInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			d.logger.Error().Err(err).Str("operation", "GetUsageInWindow").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Int64("windowSeconds", windowSeconds).Msg("store operation failed")
+			return 0, err
+		}
+		for _, item := range page.Items {
+			if delta, ok := dynamoNumber(item["delta"]); ok {
+				total += delta
 			}
 		}
 	}
@@ -216,13 +270,15 @@ func (d *DynamoDBStore) GetUsageInWindow(provider, keyID, metric string, windowS
 func (d *DynamoDBStore) SetCache(key, value string, ttlSeconds int64) error {
 	ctx := context.Background()
 
-	expiry := time.Now().Add(time.Duration(ttlSeconds) * time.Second).Unix()
-
 	item := map[string]types.AttributeValue{
-		"pk":     &types.AttributeValueMemberS{Value: fmt.Sprintf("CACHE#%s", key)},
-		"sk":     &types.AttributeValueMemberS{Value: "DATA"},
-		"value":  &types.AttributeValueMemberS{Value: value},
-		"expiry": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiry)},
+		"pk":    &types.AttributeValueMemberS{Value: fmt.Sprintf("CACHE#%s", key)},
+		"sk":    &types.AttributeValueMemberS{Value: "DATA"},
+		"value": &types.AttributeValueMemberS{Value: value},
+	}
+	// Entries without a TTL never expire
+	if ttlSeconds > 0 {
+		expiry := time.Now().Add(time.Duration(ttlSeconds) * time.Second).Unix()
+		item["expiry"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiry)}
 	}
 
 	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
@@ -285,12 +341,265 @@ func (d *DynamoDBStore) GetCache(key string) (string, error) {
 	return valueStr.Value, nil
 }
 
+// metricPartition returns the partition key of a metric's UTC day bucket
+func metricPartition(name string, timestamp int64) string {
+	return fmt.Sprintf("METRIC#%s#%s", name, time.Unix(timestamp, 0).UTC().Format("2006-01-02"))
+}
+
+func (d *DynamoDBStore) metricItem(name string, value float64, tags map[string]string, timestamp int64) (map[string]types.AttributeValue, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("metric %s: value %v is not a valid DynamoDB number", name, value)
+	}
+
+	tagAttrs := make(map[string]types.AttributeValue, len(tags))
+	for k, v := range tags {
+		tagAttrs[k] = &types.AttributeValueMemberS{Value: v}
+	}
+	item := map[string]types.AttributeValue{
+		"pk":        &types.AttributeValueMemberS{Value: metricPartition(name, timestamp)},
+		"sk":        &types.AttributeValueMemberN{Value: d.sortKey(timestamp)},
+		"name":      &types.AttributeValueMemberS{Value: name},
+		"value":     &types.AttributeValueMemberN{Value: strconv.FormatFloat(value, 'f', -1, 64)},
+		"timestamp": &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)},
+		"tags":      &types.AttributeValueMemberM{Value: tagAttrs},
+	}
+	if retention := d.metricsRetention.Load(); retention > 0 {
+		item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp+retention, 10)}
+	}
+	return item, nil
+}
+
 func (d *DynamoDBStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
-	// TODO: implement DynamoDB metric storage
+	item, err := d.metricItem(name, value, tags, timestamp)
+	if err != nil {
+		d.logger.Error().Err(err).Str("operation", "StoreMetric").Str("name", name).Msg("store operation failed")
+		return err
+	}
+
+	_, err = d.client.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableMetrics),
+		Item:      item,
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Str("operation", "StoreMetric").Str("name", name).Float64("value", value).Int64("timestamp", timestamp).Msg("store operation failed")
+		return err
+	}
+	return nil
+}
+
+// StoreMetricBatch writes points with BatchWriteItem, 25 per request, retrying unprocessed items
+func (d *DynamoDBStore) StoreMetricBatch(points []MetricWrite) error {
+	ctx := context.Background()
+	for i := 0; i < len(points); i += dynamoBatchWriteSize {
+		chunk := points[i:min(i+dynamoBatchWriteSize, len(points))]
+		requests := make([]types.WriteRequest, 0, len(chunk))
+		for _, p := range chunk {
+			item, err := d.metricItem(p.Name, p.Value, p.Tags, p.Timestamp)
+			if err != nil {
+				d.logger.Error().Err(err).Str("operation", "StoreMetricBatch").Str("name", p.Name).Msg("store operation failed")
+				return err
+			}
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+		}
+
+		pending := map[string][]types.WriteRequest{d.tableMetrics: requests}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > 0 {
+				if attempt > 5 {
+					err := fmt.Errorf("%d metric points left unprocessed", len(pending[d.tableMetrics]))
+					d.logger.Error().Err(err).Str("operation", "StoreMetricBatch").Msg("store operation failed")
+					return err
+				}
+				time.Sleep(time.Duration(50<<(attempt-1)) * time.Millisecond)
+			}
+			out, err := d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				d.logger.Error().Err(err).Str("operation", "StoreMetricBatch").Int("points", len(chunk)).Msg("store operation failed")
+				return err
+			}
+			pending = out.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// IncrementUsageBatch applies increments one by one; each needs its own history item and counter update
+func (d *DynamoDBStore) IncrementUsageBatch(items []UsageIncrement) error {
+	for _, item := range items {
+		if err := d.IncrementUsage(item.Provider, item.KeyID, item.Metric, item.Delta); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// GetMetrics queries each UTC day partition in the range, paging through results and
+// filtering tags on the server
 func (d *DynamoDBStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
-	// TODO: implement DynamoDB metric query
-	return []MetricPoint{}, nil
+	ctx := context.Background()
+	if end < start {
+		return []MetricPoint{}, nil
+	}
+	if oldest := end - dynamoMetricsMaxDays*86400; start < oldest {
+		start = oldest
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":start": &types.AttributeValueMemberN{Value: strconv.FormatInt(start, 10)},
+		":end":   &types.AttributeValueMemberN{Value: strconv.FormatInt(end, 10) + ".999999999"},
+	}
+	var filter *string
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		names["#tags"] = "tags"
+		conditions := make([]string, 0, len(keys))
+		for i, k := range keys {
+			names[fmt.Sprintf("#t%d", i)] = k
+			values[fmt.Sprintf(":t%d", i)] = &types.AttributeValueMemberS{Value: tags[k]}
+			conditions = append(conditions, fmt.Sprintf("#tags.#t%d = :t%d", i, i))
+		}
+		filter = aws.String(strings.Join(conditions, " AND "))
+	} else {
+		names = nil
+	}
+
+	points := []MetricPoint{}
+	lastDay := time.Unix(end, 0).UTC().Truncate(24 * time.Hour)
+	for day := time.Unix(start, 0).UTC().Truncate(24 * time.Hour); !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		dayValues := make(map[string]types.AttributeValue, len(values)+1)
+		for k, v := range values {
+			dayValues[k] = v
+		}
+		dayValues[":pk"] = &types.AttributeValueMemberS{Value: metricPartition(name, day.Unix())}
+
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(d.tableMetrics),
+			KeyConditionExpression:    aws.String("pk = :pk AND sk BETWEEN :start AND :end"),
+			FilterExpression:          filter,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: dayValues,
+		}
+		if d.queryPageSize > 0 {
+			input.Limit = aws.Int32(d.queryPageSize)
+		}
+
+		paginator := dynamodb.NewQueryPaginator(d.client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				d.logger.Error().Err(err).Str("operation", "GetMetrics").Str("name", name).Int64("start", start).Int64("end", end).Msg("store operation failed")
+				return nil, err
+			}
+			for _, item := range page.Items {
+				points = append(points, dynamoMetricPoint(item))
+			}
+		}
+	}
+
+	d.logger.Debug().Str("operation", "GetMetrics").Str("name", name).Int64("start", start).Int64("end", end).Int("count", len(points)).Msg("store operation")
+	return points, nil
+}
+
+func dynamoMetricPoint(item map[string]types.AttributeValue) MetricPoint {
+	p := MetricPoint{Tags: make(map[string]string)}
+	p.Value, _ = dynamoNumber(item["value"])
+	ts, _ := dynamoNumber(item["timestamp"])
+	p.Timestamp = int64(ts)
+	if count, ok := dynamoNumber(item["count"]); ok {
+		p.Count = int64(count)
+	}
+	if resolution, ok := dynamoNumber(item["resolution"]); ok {
+		p.Resolution = int64(resolution)
+	}
+	if m, ok := item["tags"].(*types.AttributeValueMemberM); ok {
+		for k, v := range m.Value {
+			if s, ok := v.(*types.AttributeValueMemberS); ok {
+				p.Tags[k] = s.Value
+			}
+		}
+	}
+	return p
+}
+
+func dynamoNumber(attr types.AttributeValue) (float64, bool) {
+	n, ok := attr.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(n.Value, 64)
+	return v, err == nil
+}
+
+// ApplyRetention enables DynamoDB TTL on the history, metrics and cache tables. New history
+// items and metric points carry an expires_at attribute; DynamoDB deletes expired items in
+// the background. Metric points aren't rolled up on DynamoDB, so they are kept as long as
+// daily rollups would be.
+func (d *DynamoDBStore) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	d.historyRetention.Store(int64(policy.UsageHistory.Seconds()))
+	d.metricsRetention.Store(max(int64(policy.MetricsDaily.Seconds()), 0))
+	if policy.UsageHistory > 0 {
+		if err := d.enableTTL(ctx, d.tableHistory, "expires_at"); err != nil {
+			return err
+		}
+	}
+	if policy.MetricsDaily > 0 && (d.tableMetrics != d.tableHistory || policy.UsageHistory <= 0) {
+		if err := d.enableTTL(ctx, d.tableMetrics, "expires_at"); err != nil {
+			return err
+		}
+	}
+	return d.enableTTL(ctx, d.tableCache, "expiry")
+}
+
+func (d *DynamoDBStore) enableTTL(ctx context.Context, table, attribute string) error {
+	desc, err := d.client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		d.logger.Error().Err(err).Str("operation", "ApplyRetention").Str("table", table).Msg("store operation failed")
+		return err
+	}
+	if ttl := desc.TimeToLiveDescription; ttl != nil && aws.ToString(ttl.AttributeName) == attribute &&
+		(ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+
+	_, err = d.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Str("operation", "ApplyRetention").Str("table", table).Msg("store operation failed")
+		return err
+	}
+	return nil
+}
+
+// StorageStats reports item counts and sizes from DescribeTable (updated by DynamoDB about every six hours)
+func (d *DynamoDBStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	stats := &StorageStats{Backend: "dynamodb"}
+	tables := []string{d.tableUsage, d.tableHistory, d.tableCache}
+	if d.tableMetrics != d.tableHistory {
+		tables = append(tables, d.tableMetrics)
+	}
+	for _, table := range tables {
+		desc, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+		if err != nil {
+			d.logger.Error().Err(err).Str("operation", "StorageStats").Str("table", table).Msg("store operation failed")
+			return nil, err
+		}
+		t := TableStats{
+			Name:  table,
+			Rows:  aws.ToInt64(desc.Table.ItemCount),
+			Bytes: aws.ToInt64(desc.Table.TableSizeBytes),
+		}
+		stats.TotalBytes += t.Bytes
+		stats.Tables = append(stats.Tables, t)
+	}
+	return stats, nil
 }
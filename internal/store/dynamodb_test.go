@@ -0,0 +1,92 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/store"
+	"github.com/user/coo-llm/internal/store/storetest"
+)
+
+func TestDynamoDBStoreMetrics(t *testing.T) {
+	fake := storetest.NewFakeDynamoDB("usage", "cache", "history")
+	s := storetest.NewDynamoDBStore(t, fake, store.DynamoDBOptions{TableUsage: "usage", TableCache: "cache", TableHistory: "history"})
+
+	// Points on both sides of midnight land in different day partitions
+	midnight := time.Date(2025, 10, 18, 0, 0, 0, 0, time.UTC).Unix()
+	require.NoError(t, s.StoreMetric("latency", 100, map[string]string{"provider": "openai", "model": "gpt-4o"}, midnight-10))
+	require.NoError(t, s.StoreMetric("latency", 200, map[string]string{"provider": "gemini"}, midnight-10))
+	require.NoError(t, s.StoreMetric("latency", 300, map[string]string{"provider": "openai", "model": "gpt-4o-mini"}, midnight+10))
+	require.NoError(t, s.StoreMetric("tokens", 50, map[string]string{"provider": "openai"}, midnight+10))
+
+	points, err := s.GetMetrics("latency", nil, midnight-3600, midnight+3600)
+	require.NoError(t, err)
+	require.Len(t, points, 3)
+	assert.NotEmpty(t, fake.Items("history"), "metrics default to the history table")
+	assert.Equal(t, midnight-10, points[0].Timestamp)
+	assert.Equal(t, midnight+10, points[2].Timestamp)
+	assert.Equal(t, 300.0, points[2].Value)
+	assert.Equal(t, "gpt-4o-mini", points[2].Tags["model"])
+
+	// Tag filters are applied by DynamoDB
+	points, err = s.GetMetrics("latency", map[string]string{"provider": "openai"}, midnight-3600, midnight+3600)
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	points, err = s.GetMetrics("latency", map[string]string{"provider": "openai", "model": "gpt-4o"}, midnight-3600, midnight+3600)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 100.0, points[0].Value)
+
+	// Range bounds are inclusive to the second
+	points, err = s.GetMetrics("latency", nil, midnight, midnight+10)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	points, err = s.GetMetrics("latency", nil, midnight+11, midnight+3600)
+	require.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestDynamoDBStoreMetricsBatchAndPagination(t *testing.T) {
+	fake := storetest.NewFakeDynamoDB("usage", "cache", "history", "metrics")
+	s := storetest.NewDynamoDBStore(t, fake, store.DynamoDBOptions{TableUsage: "usage", TableCache: "cache", TableHistory: "history", TableMetrics: "metrics"})
+	s.SetQueryPageSize(4)
+
+	// 30 points in the same second: two BatchWriteItem chunks, one unprocessed item retried
+	now := time.Now().Unix()
+	writes := make([]store.MetricWrite, 30)
+	for i := range writes {
+		writes[i] = store.MetricWrite{Name: "cost", Value: float64(i), Tags: map[string]string{"provider": "openai"}, Timestamp: now}
+	}
+	fake.FailNextBatchItem()
+	require.NoError(t, s.StoreMetricBatch(writes))
+	assert.Len(t, fake.Items("metrics"), 30)
+	assert.Empty(t, fake.Items("history"))
+
+	queries := fake.Queries()
+	points, err := s.GetMetrics("cost", map[string]string{"provider": "openai"}, now-60, now)
+	require.NoError(t, err)
+	assert.Len(t, points, 30)
+	assert.Greater(t, fake.Queries()-queries, 1, "results should be paged")
+
+	// Points expire with the daily retention once TTL is applied
+	require.NoError(t, s.ApplyRetention(context.Background(), store.RetentionPolicy{UsageHistory: time.Hour, MetricsDaily: 24 * time.Hour}))
+	assert.Equal(t, "expires_at", fake.TTLAttribute("metrics"))
+	assert.Equal(t, "expires_at", fake.TTLAttribute("history"))
+	require.NoError(t, s.StoreMetric("cost", 1, nil, now))
+	expiring := 0
+	for _, item := range fake.Items("metrics") {
+		if expires, ok := item["expires_at"]; ok {
+			expiring++
+			assert.Equal(t, fmt.Sprint(now+86400), expires["N"])
+		}
+	}
+	assert.Equal(t, 1, expiring)
+
+	// Invalid numbers are rejected before reaching DynamoDB
+	assert.Error(t, s.StoreMetricBatch([]store.MetricWrite{{Name: "cost", Value: math.NaN(), Timestamp: now}}))
+}
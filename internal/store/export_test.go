@@ -0,0 +1,6 @@
+package store
+
+// SetQueryPageSize sets the DynamoDB Query page limit so tests can exercise pagination
+func (d *DynamoDBStore) SetQueryPageSize(n int32) {
+	d.queryPageSize = n
+}
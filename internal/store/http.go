@@ -2,178 +2,341 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/user/coo-llm/internal/config"
 )
 
+// Defaults for the HTTP store client
+const (
+	DefaultHTTPStoreTimeout    = 5 * time.Second
+	DefaultHTTPStoreMaxRetries = 2
+	httpStoreRetryBackoff      = 100 * time.Millisecond
+)
+
+// IdempotencyKeyHeader identifies retried writes so the server applies them once
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// HTTPStoreOptions tunes the HTTP store client
+type HTTPStoreOptions struct {
+	Timeout    time.Duration // Per attempt, default 5s
+	MaxRetries int           // Retries after the first attempt, default 2; negative disables retries
+}
+
+// HTTPStore is a RuntimeStore and ConfigStore backed by a remote server speaking the
+// store REST contract (see docs/content/Reference/Storage/HTTP.md and HTTPStoreServer)
 type HTTPStore struct {
-	endpoint string
-	apiKey   string
-	logger   zerolog.Logger
+	endpoint   string
+	apiKey     string
+	client     *http.Client
+	maxRetries int
+	logger     zerolog.Logger
 }
 
 func NewHTTPStore(endpoint, apiKey string, logger zerolog.Logger) *HTTPStore {
-	return &HTTPStore{endpoint: endpoint, apiKey: apiKey, logger: logger}
+	return NewHTTPStoreWithOptions(endpoint, apiKey, HTTPStoreOptions{}, logger)
 }
 
-func (h *HTTPStore) GetUsage(provider, keyID, metric string) (float64, error) {
-	url := fmt.Sprintf("%s/usage/%s/%s/%s", h.endpoint, provider, keyID, metric)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, err
+// NewHTTPStoreWithOptions creates an HTTP store whose requests share one pooled client
+func NewHTTPStoreWithOptions(endpoint, apiKey string, opts HTTPStoreOptions, logger zerolog.Logger) *HTTPStore {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHTTPStoreTimeout
 	}
-	req.Header.Set("Authorization", "Bearer "+h.apiKey)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, err
+	switch {
+	case opts.MaxRetries == 0:
+		opts.MaxRetries = DefaultHTTPStoreMaxRetries
+	case opts.MaxRetries < 0:
+		opts.MaxRetries = 0
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+	return &HTTPStore{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		apiKey:     apiKey,
+		client:     &http.Client{Timeout: opts.Timeout, Transport: transport},
+		maxRetries: opts.MaxRetries,
+		logger:     logger,
 	}
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
-	}
+// Wire types of the store REST contract
 
-	return strconv.ParseFloat(string(body), 64)
+type httpValue struct {
+	Value float64 `json:"value"`
 }
 
-func (h *HTTPStore) SetUsage(provider, keyID, metric string, value float64) error {
-	url := fmt.Sprintf("%s/usage/%s/%s/%s", h.endpoint, provider, keyID, metric)
-	data := map[string]float64{"value": value}
-	jsonData, _ := json.Marshal(data)
+type httpCacheEntry struct {
+	Value      string `json:"value"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
 
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
+type httpMetricPoint struct {
+	Name       string            `json:"name,omitempty"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Count      int64             `json:"count,omitempty"`
+	Resolution int64             `json:"resolution,omitempty"`
+}
+
+type httpMetricPoints struct {
+	Points []httpMetricPoint `json:"points"`
+}
+
+type httpUsageIncrements struct {
+	Items []UsageIncrement `json:"items"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// errHTTPNotFound is returned by do for 404 responses
+var errHTTPNotFound = errors.New("not found")
+
+// usagePath builds /usage/{provider}/{key_id}/{metric} with escaped segments
+func usagePath(provider, keyID, metric string) string {
+	return "/usage/" + url.PathEscape(provider) + "/" + url.PathEscape(keyID) + "/" + url.PathEscape(metric)
+}
+
+// do sends a request, retrying network errors, 429 and 5xx responses with backoff.
+// Writes that aren't idempotent carry an Idempotency-Key so retries are applied once.
+func (h *HTTPStore) do(method, path string, body, out any, idempotent bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	var idempotencyKey string
+	if !idempotent {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= h.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(httpStoreRetryBackoff << (attempt - 1))
+		}
+		retry, err := h.attempt(method, path, payload, idempotencyKey, out)
+		if err == nil || !retry {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (h *HTTPStore) attempt(method, path string, payload []byte, idempotencyKey string, out any) (bool, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, h.endpoint+path, reader)
 	if err != nil {
-		return err
+		return false, err
 	}
 	req.Header.Set("Authorization", "Bearer "+h.apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := h.client.Do(req)
 	if err != nil {
-		return err
+		var netErr net.Error
+		retry := errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+		return retry, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
 	}
-	return nil
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, errHTTPNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, httpStatusError(resp.StatusCode, respBody)
+	case resp.StatusCode >= 300:
+		return false, httpStatusError(resp.StatusCode, respBody)
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return false, nil
+	}
+	if v, ok := out.(*httpValue); ok {
+		// Older servers answer usage reads with a bare number
+		if f, err := strconv.ParseFloat(strings.TrimSpace(string(respBody)), 64); err == nil {
+			v.Value = f
+			return false, nil
+		}
+	}
+	return false, json.Unmarshal(respBody, out)
 }
 
-func (h *HTTPStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
-	url := fmt.Sprintf("%s/usage/%s/%s/%s/increment", h.endpoint, provider, keyID, metric)
-	data := map[string]float64{"delta": delta}
-	jsonData, _ := json.Marshal(data)
+func httpStatusError(status int, body []byte) error {
+	var e httpError
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return fmt.Errorf("HTTP %d: %s", status, e.Error)
+	}
+	return fmt.Errorf("HTTP %d", status)
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *HTTPStore) GetUsage(provider, keyID, metric string) (float64, error) {
+	var v httpValue
+	if err := h.do(http.MethodGet, usagePath(provider, keyID, metric), nil, &v, true); err != nil {
+		if errors.Is(err, errHTTPNotFound) {
+			return 0, nil
+		}
+		h.logger.Error().Err(err).Str("operation", "GetUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Msg("store operation failed")
+		return 0, err
 	}
-	req.Header.Set("Authorization", "Bearer "+h.apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	return v.Value, nil
+}
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
+func (h *HTTPStore) SetUsage(provider, keyID, metric string, value float64) error {
+	if err := h.do(http.MethodPut, usagePath(provider, keyID, metric), httpValue{Value: value}, nil, true); err != nil {
+		h.logger.Error().Err(err).Str("operation", "SetUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("value", value).Msg("store operation failed")
 		return err
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+func (h *HTTPStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
+	body := map[string]float64{"delta": delta}
+	if err := h.do(http.MethodPost, usagePath(provider, keyID, metric)+"/increment", body, nil, false); err != nil {
+		h.logger.Error().Err(err).Str("operation", "IncrementUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("delta", delta).Msg("store operation failed")
+		return err
 	}
 	return nil
 }
 
 func (h *HTTPStore) GetUsageInWindow(provider, keyID, metric string, windowSeconds int64) (float64, error) {
-	// TODO: implement HTTP window query
-	return h.GetUsage(provider, keyID, metric)
+	path := usagePath(provider, keyID, metric) + "/window?seconds=" + strconv.FormatInt(windowSeconds, 10)
+	var v httpValue
+	if err := h.do(http.MethodGet, path, nil, &v, true); err != nil {
+		if errors.Is(err, errHTTPNotFound) {
+			return 0, nil
+		}
+		h.logger.Error().Err(err).Str("operation", "GetUsageInWindow").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Int64("windowSeconds", windowSeconds).Msg("store operation failed")
+		return 0, err
+	}
+	return v.Value, nil
 }
 
 func (h *HTTPStore) SetCache(key, value string, ttlSeconds int64) error {
-	// TODO: implement HTTP cache
+	if err := h.do(http.MethodPut, "/cache/"+url.PathEscape(key), httpCacheEntry{Value: value, TTLSeconds: ttlSeconds}, nil, true); err != nil {
+		h.logger.Error().Err(err).Str("operation", "SetCache").Str("key", key).Int64("ttlSeconds", ttlSeconds).Msg("store operation failed")
+		return err
+	}
 	return nil
 }
 
 func (h *HTTPStore) GetCache(key string) (string, error) {
-	// TODO: implement HTTP cache get
-	return "", nil
+	var entry httpCacheEntry
+	if err := h.do(http.MethodGet, "/cache/"+url.PathEscape(key), nil, &entry, true); err != nil {
+		if errors.Is(err, errHTTPNotFound) {
+			return "", nil
+		}
+		h.logger.Error().Err(err).Str("operation", "GetCache").Str("key", key).Msg("store operation failed")
+		return "", err
+	}
+	return entry.Value, nil
 }
 
 func (h *HTTPStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
-	// TODO: implement HTTP metric storage
-	return nil
+	return h.StoreMetricBatch([]MetricWrite{{Name: name, Value: value, Tags: tags, Timestamp: timestamp}})
 }
 
 func (h *HTTPStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
-	// TODO: implement HTTP metric query
-	return []MetricPoint{}, nil
-}
-
-func (h *HTTPStore) LoadConfig() (*config.Config, error) {
-	url := fmt.Sprintf("%s/config", h.endpoint)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+	query := url.Values{}
+	query.Set("start", strconv.FormatInt(start, 10))
+	query.Set("end", strconv.FormatInt(end, 10))
+	for k, v := range tags {
+		query.Set("tag."+k, v)
 	}
-	req.Header.Set("Authorization", "Bearer "+h.apiKey)
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
+	var resp httpMetricPoints
+	if err := h.do(http.MethodGet, "/metrics/"+url.PathEscape(name)+"?"+query.Encode(), nil, &resp, true); err != nil {
+		h.logger.Error().Err(err).Str("operation", "GetMetrics").Str("name", name).Msg("store operation failed")
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	points := make([]MetricPoint, 0, len(resp.Points))
+	for _, p := range resp.Points {
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		points = append(points, MetricPoint{Value: p.Value, Timestamp: p.Timestamp, Tags: p.Tags, Count: p.Count, Resolution: p.Resolution})
 	}
+	return points, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// IncrementUsageBatch applies many increments in one request
+func (h *HTTPStore) IncrementUsageBatch(items []UsageIncrement) error {
+	if len(items) == 0 {
+		return nil
 	}
-
-	var cfg config.Config
-	err = json.Unmarshal(body, &cfg)
-	return &cfg, err
+	if err := h.do(http.MethodPost, "/batch/usage/increment", httpUsageIncrements{Items: items}, nil, false); err != nil {
+		h.logger.Error().Err(err).Str("operation", "IncrementUsageBatch").Int("items", len(items)).Msg("store operation failed")
+		return err
+	}
+	return nil
 }
 
-func (h *HTTPStore) SaveConfig(cfg *config.Config) error {
-	url := fmt.Sprintf("%s/config", h.endpoint)
-	jsonData, _ := json.Marshal(cfg)
-
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
-	if err != nil {
+// StoreMetricBatch stores many metric points in one request
+func (h *HTTPStore) StoreMetricBatch(points []MetricWrite) error {
+	if len(points) == 0 {
+		return nil
+	}
+	body := httpMetricPoints{Points: make([]httpMetricPoint, 0, len(points))}
+	for _, p := range points {
+		body.Points = append(body.Points, httpMetricPoint{Name: p.Name, Value: p.Value, Timestamp: p.Timestamp, Tags: p.Tags})
+	}
+	if err := h.do(http.MethodPost, "/batch/metrics", body, nil, false); err != nil {
+		h.logger.Error().Err(err).Str("operation", "StoreMetricBatch").Int("points", len(points)).Msg("store operation failed")
 		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+h.apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+func (h *HTTPStore) LoadConfig() (*config.Config, error) {
+	var cfg config.Config
+	if err := h.do(http.MethodGet, "/config", nil, &cfg, true); err != nil {
+		h.logger.Error().Err(err).Str("operation", "LoadConfig").Msg("store operation failed")
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return &cfg, nil
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+func (h *HTTPStore) SaveConfig(cfg *config.Config) error {
+	if err := h.do(http.MethodPut, "/config", cfg, nil, true); err != nil {
+		h.logger.Error().Err(err).Str("operation", "SaveConfig").Msg("store operation failed")
+		return err
 	}
 	return nil
 }
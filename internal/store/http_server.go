@@ -0,0 +1,379 @@
+package store
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/config"
+)
+
+// idempotencyTTL is how long the server remembers Idempotency-Key values
+const idempotencyTTL = 10 * time.Minute
+
+// HTTPStoreServer serves the store REST contract used by HTTPStore on top of a local runtime store
+type HTTPStoreServer struct {
+	backend RuntimeStore
+	configs ConfigStore
+	apiKey  string
+	logger  zerolog.Logger
+
+	mu      sync.Mutex
+	writes  map[string]*idempotentWrite // By Idempotency-Key, applied or in flight
+	applied []appliedKey                // Keys of applied writes, oldest first, for expiry
+}
+
+// idempotentWrite is a write made under an Idempotency-Key
+type idempotentWrite struct {
+	done chan struct{} // Closed once the write has finished
+	ok   bool          // Set before done is closed
+}
+
+// appliedKey records when the write under an Idempotency-Key was applied
+type appliedKey struct {
+	key string
+	at  time.Time
+}
+
+func NewHTTPStoreServer(backend RuntimeStore, configs ConfigStore, apiKey string, logger zerolog.Logger) *HTTPStoreServer {
+	return &HTTPStoreServer{backend: backend, configs: configs, apiKey: apiKey, logger: logger, writes: make(map[string]*idempotentWrite)}
+}
+
+// Handler returns the router serving the contract
+func (s *HTTPStoreServer) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeStoreJSON(w, map[string]string{"status": "ok"})
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+
+		r.Get("/usage/{provider}/{key_id}/{metric}", s.getUsage)
+		r.Put("/usage/{provider}/{key_id}/{metric}", s.setUsage)
+		r.Post("/usage/{provider}/{key_id}/{metric}/increment", s.idempotent(s.incrementUsage))
+		r.Get("/usage/{provider}/{key_id}/{metric}/window", s.getUsageInWindow)
+
+		r.Get("/cache/{key}", s.getCache)
+		r.Put("/cache/{key}", s.setCache)
+
+		r.Get("/metrics/{name}", s.getMetrics)
+
+		r.Post("/batch/usage/increment", s.idempotent(s.incrementUsageBatch))
+		r.Post("/batch/metrics", s.idempotent(s.storeMetricBatch))
+
+		r.Get("/config", s.loadConfig)
+		r.Put("/config", s.saveConfig)
+	})
+	return r
+}
+
+func (s *HTTPStoreServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.apiKey)) != 1 {
+			writeStoreError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// idempotent applies a write once per Idempotency-Key; repeated keys are acknowledged
+// without reapplying. A repeat that arrives while the first write is running waits for
+// it, and is applied itself if the first write failed.
+func (s *HTTPStoreServer) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		var write *idempotentWrite
+		for {
+			s.mu.Lock()
+			s.expireWrites(time.Now())
+			first, ok := s.writes[key]
+			if !ok {
+				write = &idempotentWrite{done: make(chan struct{})}
+				s.writes[key] = write
+			}
+			s.mu.Unlock()
+			if !ok {
+				break
+			}
+
+			select {
+			case <-first.done:
+			case <-r.Context().Done():
+				writeStoreError(w, http.StatusServiceUnavailable, "request cancelled")
+				return
+			}
+			if first.ok {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			// The first write failed and was forgotten; apply this one
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			s.mu.Lock()
+			if rec.status < 300 {
+				write.ok = true
+				s.applied = append(s.applied, appliedKey{key: key, at: time.Now()})
+			} else {
+				// Let the client retry failed writes
+				delete(s.writes, key)
+			}
+			s.mu.Unlock()
+			close(write.done)
+		}()
+		next(rec, r)
+	}
+}
+
+// expireWrites forgets the keys of writes applied more than idempotencyTTL ago. The
+// caller holds s.mu.
+func (s *HTTPStoreServer) expireWrites(now time.Time) {
+	n := 0
+	for n < len(s.applied) && now.Sub(s.applied[n].at) >= idempotencyTTL {
+		delete(s.writes, s.applied[n].key)
+		n++
+	}
+	s.applied = s.applied[n:]
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// pathParam returns a decoded URL parameter
+func pathParam(r *http.Request, name string) string {
+	value := chi.URLParam(r, name)
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func (s *HTTPStoreServer) usageParams(r *http.Request) (string, string, string) {
+	return pathParam(r, "provider"), pathParam(r, "key_id"), pathParam(r, "metric")
+}
+
+func (s *HTTPStoreServer) getUsage(w http.ResponseWriter, r *http.Request) {
+	provider, keyID, metric := s.usageParams(r)
+	value, err := s.backend.GetUsage(provider, keyID, metric)
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeStoreJSON(w, httpValue{Value: value})
+}
+
+func (s *HTTPStoreServer) setUsage(w http.ResponseWriter, r *http.Request) {
+	var body httpValue
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	provider, keyID, metric := s.usageParams(r)
+	if err := s.backend.SetUsage(provider, keyID, metric, body.Value); err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStoreServer) incrementUsage(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Delta float64 `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	provider, keyID, metric := s.usageParams(r)
+	if err := s.backend.IncrementUsage(provider, keyID, metric, body.Delta); err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStoreServer) getUsageInWindow(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseInt(r.URL.Query().Get("seconds"), 10, 64)
+	if err != nil || seconds <= 0 {
+		writeStoreError(w, http.StatusBadRequest, "seconds must be a positive integer")
+		return
+	}
+	provider, keyID, metric := s.usageParams(r)
+	value, err := s.backend.GetUsageInWindow(provider, keyID, metric, seconds)
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeStoreJSON(w, httpValue{Value: value})
+}
+
+func (s *HTTPStoreServer) getCache(w http.ResponseWriter, r *http.Request) {
+	value, err := s.backend.GetCache(pathParam(r, "key"))
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if value == "" {
+		writeStoreError(w, http.StatusNotFound, "cache miss")
+		return
+	}
+	writeStoreJSON(w, httpCacheEntry{Value: value})
+}
+
+func (s *HTTPStoreServer) setCache(w http.ResponseWriter, r *http.Request) {
+	var body httpCacheEntry
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if err := s.backend.SetCache(pathParam(r, "key"), body.Value, body.TTLSeconds); err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStoreServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start, _ := strconv.ParseInt(query.Get("start"), 10, 64)
+	end, err := strconv.ParseInt(query.Get("end"), 10, 64)
+	if err != nil {
+		end = time.Now().Unix()
+	}
+	tags := make(map[string]string)
+	for k, v := range query {
+		if tag, ok := strings.CutPrefix(k, "tag."); ok && len(v) > 0 {
+			tags[tag] = v[0]
+		}
+	}
+
+	points, err := s.backend.GetMetrics(pathParam(r, "name"), tags, start, end)
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := httpMetricPoints{Points: make([]httpMetricPoint, 0, len(points))}
+	for _, p := range points {
+		if !matchTags(p.Tags, tags) {
+			continue
+		}
+		resp.Points = append(resp.Points, httpMetricPoint{Value: p.Value, Timestamp: p.Timestamp, Tags: p.Tags, Count: p.Count, Resolution: p.Resolution})
+	}
+	writeStoreJSON(w, resp)
+}
+
+func (s *HTTPStoreServer) incrementUsageBatch(w http.ResponseWriter, r *http.Request) {
+	var body httpUsageIncrements
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	var err error
+	if batch, ok := s.backend.(BatchWriter); ok {
+		err = batch.IncrementUsageBatch(body.Items)
+	} else {
+		for _, item := range body.Items {
+			if err = s.backend.IncrementUsage(item.Provider, item.KeyID, item.Metric, item.Delta); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStoreServer) storeMetricBatch(w http.ResponseWriter, r *http.Request) {
+	var body httpMetricPoints
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	writes := make([]MetricWrite, 0, len(body.Points))
+	for _, p := range body.Points {
+		if p.Name == "" {
+			writeStoreError(w, http.StatusBadRequest, "metric name is required")
+			return
+		}
+		writes = append(writes, MetricWrite{Name: p.Name, Value: p.Value, Tags: p.Tags, Timestamp: p.Timestamp})
+	}
+
+	var err error
+	if batch, ok := s.backend.(BatchWriter); ok {
+		err = batch.StoreMetricBatch(writes)
+	} else {
+		for _, p := range writes {
+			if err = s.backend.StoreMetric(p.Name, p.Value, p.Tags, p.Timestamp); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStoreServer) loadConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, err := s.configs.LoadConfig()
+	if err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if cfg == nil {
+		writeStoreError(w, http.StatusNotFound, "no config stored")
+		return
+	}
+	writeStoreJSON(w, cfg)
+}
+
+func (s *HTTPStoreServer) saveConfig(w http.ResponseWriter, r *http.Request) {
+	var cfg config.Config
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeStoreError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if err := s.configs.SaveConfig(&cfg); err != nil {
+		writeStoreError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeStoreJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStoreError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(httpError{Error: msg})
+}
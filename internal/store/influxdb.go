@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -119,12 +120,22 @@ func (i *InfluxDBStore) GetCache(key string) (string, error) {
 	return "", nil
 }
 
+// influxFieldTags are metric tags written as fields: they are unique per request, and
+// as Influx tags every request would create a new series
+var influxFieldTags = map[string]bool{"request_id": true}
+
 func (i *InfluxDBStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
+	// Without request_id, points of the same series can share a second; the write
+	// time's nanoseconds keep them from overwriting each other
 	point := influxdb2.NewPointWithMeasurement(name).
-		SetTime(time.Unix(timestamp, 0))
+		SetTime(time.Unix(timestamp, int64(time.Now().Nanosecond())))
 
 	for k, v := range tags {
-		point = point.AddTag(k, v)
+		if influxFieldTags[k] {
+			point = point.AddField(k, v)
+		} else {
+			point = point.AddTag(k, v)
+		}
 	}
 
 	point = point.AddField("value", value)
@@ -133,15 +144,24 @@ func (i *InfluxDBStore) StoreMetric(name string, value float64, tags map[string]
 }
 
 func (i *InfluxDBStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
-	query := fmt.Sprintf(`from(bucket: "%s")
+	// Fields such as request_id are pivoted into columns so they read and filter like tags
+	query := fmt.Sprintf(`from(bucket: %s)
 		|> range(start: %d, stop: %d)
-		|> filter(fn: (r) => r._measurement == "%s"`, i.bucket, start, end, name)
-
-	for k, v := range tags {
-		query += fmt.Sprintf(` and r.%s == "%s"`, k, v)
+		|> filter(fn: (r) => r._measurement == %s)
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		fluxString(i.bucket), start, end+1, fluxString(name))
+
+	if len(tags) > 0 {
+		var conds []string
+		for _, k := range sortedTagKeys(tags) {
+			conds = append(conds, fmt.Sprintf(`r[%s] == %s`, fluxString(k), fluxString(tags[k])))
+		}
+		query += fmt.Sprintf(`
+		|> filter(fn: (r) => %s)`, strings.Join(conds, " and "))
 	}
-
-	query += `)`
+	query += `
+		|> group()
+		|> sort(columns: ["_time"])`
 
 	result, err := i.queryAPI.Query(context.Background(), query)
 	if err != nil {
@@ -151,21 +171,28 @@ func (i *InfluxDBStore) GetMetrics(name string, tags map[string]string, start, e
 	var points []MetricPoint
 	for result.Next() {
 		record := result.Record()
+		value, ok := record.ValueByKey("value").(float64)
+		if !ok {
+			continue
+		}
 		tags := make(map[string]string)
-		values := record.Values()
-		for k, v := range values {
-			if k != "_value" && k != "_time" && k != "_measurement" {
-				if str, ok := v.(string); ok {
-					tags[k] = str
-				}
+		for k, v := range record.Values() {
+			if strings.HasPrefix(k, "_") || k == "value" || k == "result" || k == "table" {
+				continue
+			}
+			if str, ok := v.(string); ok {
+				tags[k] = str
 			}
 		}
 		points = append(points, MetricPoint{
-			Value:     record.Value().(float64),
+			Value:     value,
 			Timestamp: record.Time().Unix(),
 			Tags:      tags,
 		})
 	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
 
 	return points, nil
 }
@@ -173,3 +200,66 @@ func (i *InfluxDBStore) GetMetrics(name string, tags map[string]string, start, e
 func (i *InfluxDBStore) Close() {
 	i.client.Close()
 }
+
+// fluxString quotes s as a Flux string literal
+func fluxString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// QueryTimeSeries aggregates metrics with Flux aggregateWindow on aligned time buckets
+func (i *InfluxDBStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	var fn string
+	switch q.Agg {
+	case AggSum:
+		fn = "sum"
+	case AggAvg:
+		fn = "mean"
+	case AggCount:
+		fn = "count"
+	case AggMin:
+		fn = "min"
+	case AggMax:
+		fn = "max"
+	default:
+		fn = fmt.Sprintf(`(column, tables=<-) => tables |> quantile(q: %g, column: column, method: "exact_selector")`, percentileOf(q.Agg))
+	}
+
+	filter := fmt.Sprintf(`r._measurement == %s and r._field == "value"`, fluxString(q.Name))
+	for _, k := range sortedTagKeys(q.Tags) {
+		filter += fmt.Sprintf(` and r[%s] == %s`, fluxString(k), fluxString(q.Tags[k]))
+	}
+
+	// Range stop is exclusive, End is inclusive; group() merges tag series before windowing
+	query := fmt.Sprintf(`from(bucket: %s)
+		|> range(start: %d, stop: %d)
+		|> filter(fn: (r) => %s)
+		|> group()
+		|> aggregateWindow(every: %ds, fn: %s, createEmpty: false, timeSrc: "_start")`,
+		fluxString(i.bucket), q.Start, q.End+1, filter, q.Interval, fn)
+
+	result, err := i.queryAPI.Query(context.Background(), query)
+	if err != nil {
+		i.logger.Error().Err(err).Str("operation", "QueryTimeSeries").Str("name", q.Name).Str("agg", q.Agg).Msg("store operation failed")
+		return nil, err
+	}
+
+	points := []TimeSeriesPoint{}
+	for result.Next() {
+		record := result.Record()
+		var value float64
+		switch v := record.Value().(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		case uint64:
+			value = float64(v)
+		}
+		points = append(points, TimeSeriesPoint{Timestamp: record.Time().Unix(), Value: value, Metric: q.Name})
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return points, nil
+}
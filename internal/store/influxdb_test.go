@@ -1,6 +1,10 @@
 package store
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/rs/zerolog"
@@ -27,3 +31,25 @@ func TestInfluxDBStore(t *testing.T) {
 	assert.Equal(t, 42.0, points[0].Value)
 	assert.Equal(t, int64(1234567890), points[0].Timestamp)
 }
+
+func TestInfluxDBStore_RequestIDIsAField(t *testing.T) {
+	var line string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		line = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := NewInfluxDBStore(server.URL, "token", "org", "bucket", zerolog.Nop())
+	defer store.Close()
+	err := store.StoreMetric("latency", 42, map[string]string{"provider": "openai", "request_id": "req-1"}, 1234567890)
+	require.NoError(t, err)
+
+	// A request ID tag would make every request a new series
+	series, fields, ok := strings.Cut(line, " ")
+	require.True(t, ok, line)
+	assert.Equal(t, "latency,provider=openai", series)
+	assert.Contains(t, fields, `request_id="req-1"`)
+	assert.Contains(t, fields, "value=42")
+}
@@ -3,15 +3,19 @@ package store
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/user/coo-llm/internal/config"
 )
 
 type MetricPoint struct {
-	Value     float64
-	Timestamp int64
-	Tags      map[string]string
+	Value      float64
+	Timestamp  int64
+	Tags       map[string]string
+	Count      int64 `json:",omitempty"` // Raw points covered by a rollup; the value is their sum
+	Resolution int64 `json:",omitempty"` // Rollup bucket width in seconds, 0 for raw points
 }
 
 type RuntimeStore interface {
@@ -25,11 +29,39 @@ type RuntimeStore interface {
 	GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error)
 }
 
+// UsageIncrement is one IncrementUsage call in a batch
+type UsageIncrement struct {
+	Provider string  `json:"provider"`
+	KeyID    string  `json:"key_id"`
+	Metric   string  `json:"metric"`
+	Delta    float64 `json:"delta"`
+}
+
+// MetricWrite is one StoreMetric call in a batch
+type MetricWrite struct {
+	Name      string
+	Value     float64
+	Tags      map[string]string
+	Timestamp int64
+}
+
+// BatchWriter is implemented by runtime stores that can apply many writes in one round trip
+type BatchWriter interface {
+	IncrementUsageBatch(items []UsageIncrement) error
+	StoreMetricBatch(points []MetricWrite) error
+}
+
 type ConfigStore interface {
 	LoadConfig() (*config.Config, error)
 	SaveConfig(cfg *config.Config) error
 }
 
+// ConfigVersioner is implemented by config stores that can report a cheap version
+// of the stored config, which changes on every save
+type ConfigVersioner interface {
+	ConfigVersion() (string, error)
+}
+
 type ClientStore interface {
 	CreateClient(clientID, apiKey, description string, allowedProviders []string) error
 	UpdateClient(clientID, description string, allowedProviders []string) error
@@ -62,45 +94,51 @@ type MetricsStore interface {
 }
 
 type ClientMetrics struct {
-	ClientID        string  `json:"client_id"`
-	TotalRequests   int64   `json:"total_requests"`
-	TotalTokens     int64   `json:"total_tokens"`
-	TotalCost       float64 `json:"total_cost"`
-	SuccessRate     float64 `json:"success_rate"`
-	AvgLatency      float64 `json:"avg_latency"`
-	LastRequestTime int64   `json:"last_request_time"`
+	ClientID        string           `json:"client_id"`
+	TotalRequests   int64            `json:"total_requests"`
+	TotalTokens     int64            `json:"total_tokens"`
+	TotalCost       float64          `json:"total_cost"`
+	SuccessRate     float64          `json:"success_rate"`
+	AvgLatency      float64          `json:"avg_latency"`
+	LastRequestTime int64            `json:"last_request_time"`
+	ErrorCount      int64            `json:"error_count"`
+	ErrorsByClass   map[string]int64 `json:"errors_by_class,omitempty"`
 }
 
 type ProviderMetrics struct {
-	ProviderID    string  `json:"provider_id"`
-	TotalRequests int64   `json:"total_requests"`
-	TotalTokens   int64   `json:"total_tokens"`
-	TotalCost     float64 `json:"total_cost"`
-	SuccessRate   float64 `json:"success_rate"`
-	AvgLatency    float64 `json:"avg_latency"`
-	ErrorCount    int64   `json:"error_count"`
+	ProviderID    string           `json:"provider_id"`
+	TotalRequests int64            `json:"total_requests"`
+	TotalTokens   int64            `json:"total_tokens"`
+	TotalCost     float64          `json:"total_cost"`
+	SuccessRate   float64          `json:"success_rate"`
+	AvgLatency    float64          `json:"avg_latency"`
+	ErrorCount    int64            `json:"error_count"`
+	ErrorsByClass map[string]int64 `json:"errors_by_class,omitempty"`
 }
 
 type KeyMetrics struct {
-	ProviderID    string  `json:"provider_id"`
-	KeyID         string  `json:"key_id"`
-	TotalRequests int64   `json:"total_requests"`
-	TotalTokens   int64   `json:"total_tokens"`
-	TotalCost     float64 `json:"total_cost"`
-	SuccessRate   float64 `json:"success_rate"`
-	AvgLatency    float64 `json:"avg_latency"`
-	ErrorCount    int64   `json:"error_count"`
-	LastUsed      int64   `json:"last_used"`
+	ProviderID    string           `json:"provider_id"`
+	KeyID         string           `json:"key_id"`
+	TotalRequests int64            `json:"total_requests"`
+	TotalTokens   int64            `json:"total_tokens"`
+	TotalCost     float64          `json:"total_cost"`
+	SuccessRate   float64          `json:"success_rate"`
+	AvgLatency    float64          `json:"avg_latency"`
+	ErrorCount    int64            `json:"error_count"`
+	LastUsed      int64            `json:"last_used"`
+	ErrorsByClass map[string]int64 `json:"errors_by_class,omitempty"`
 }
 
 type GlobalMetrics struct {
-	TotalClients       int     `json:"total_clients"`
-	TotalProviders     int     `json:"total_providers"`
-	TotalRequests      int64   `json:"total_requests"`
-	TotalTokens        int64   `json:"total_tokens"`
-	TotalCost          float64 `json:"total_cost"`
-	OverallSuccessRate float64 `json:"overall_success_rate"`
-	AvgLatency         float64 `json:"avg_latency"`
+	TotalClients       int              `json:"total_clients"`
+	TotalProviders     int              `json:"total_providers"`
+	TotalRequests      int64            `json:"total_requests"`
+	TotalTokens        int64            `json:"total_tokens"`
+	TotalCost          float64          `json:"total_cost"`
+	OverallSuccessRate float64          `json:"overall_success_rate"`
+	AvgLatency         float64          `json:"avg_latency"`
+	TotalErrors        int64            `json:"total_errors"`
+	ErrorsByClass      map[string]int64 `json:"errors_by_class,omitempty"`
 }
 
 type TimeSeriesPoint struct {
@@ -156,12 +194,21 @@ func (s *SimpleConfigStore) LoadConfig() (*config.Config, error) {
 	return &cfg, nil
 }
 
+// SaveConfig stores the config, then bumps its version so other instances reload it
 func (s *SimpleConfigStore) SaveConfig(cfg *config.Config) error {
 	data, err := json.Marshal(cfg)
 	if err != nil {
 		return err
 	}
-	return s.runtimeStore.SetCache("config", string(data), 0)
+	if err := s.runtimeStore.SetCache("config", string(data), 0); err != nil {
+		return err
+	}
+	return s.runtimeStore.SetCache(configVersionKey, strconv.FormatInt(time.Now().UnixNano(), 10), 0)
+}
+
+// ConfigVersion returns the version of the stored config, "" if none was saved
+func (s *SimpleConfigStore) ConfigVersion() (string, error) {
+	return s.runtimeStore.GetCache(configVersionKey)
 }
 
 // Default implementations for missing interfaces
@@ -239,140 +286,58 @@ type DefaultMetricsStore struct {
 
 func (d *DefaultMetricsStore) GetClientMetrics(clientID string, start, end int64) (*ClientMetrics, error) {
 	metrics := &ClientMetrics{ClientID: clientID}
+	filters := map[string]string{"client_key": clientID}
 
-	// Get latency metrics for request count and avg latency
-	latencyPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{"client_key": clientID}, start, end)
+	// Request counts and success rate from outcome metrics
+	outcomes, err := d.getOutcomes(filters, true, start, end)
 	if err == nil {
-		metrics.TotalRequests = int64(len(latencyPoints))
-		var totalLatency float64
-		var successCount int64
-		for _, p := range latencyPoints {
-			totalLatency += p.Value
-			if p.Value > 0 { // Assume positive latency means success
-				successCount++
-			}
-		}
-		if metrics.TotalRequests > 0 {
-			metrics.AvgLatency = totalLatency / float64(metrics.TotalRequests)
-			metrics.SuccessRate = float64(successCount) / float64(metrics.TotalRequests)
-		}
+		metrics.TotalRequests = outcomes.Requests
+		metrics.SuccessRate = outcomes.SuccessRate()
+		metrics.ErrorCount = outcomes.Errors
+		metrics.ErrorsByClass = outcomes.ErrorsByClass
+		metrics.LastRequestTime = outcomes.LastTimestamp
 	}
 
-	// Get token metrics
-	tokenPoints, err := d.runtimeStore.GetMetrics("tokens", map[string]string{"client_key": clientID}, start, end)
-	if err == nil {
-		for _, p := range tokenPoints {
-			metrics.TotalTokens += int64(p.Value)
-		}
-	}
-
-	// Get cost metrics
-	costPoints, err := d.runtimeStore.GetMetrics("cost", map[string]string{"client_key": clientID}, start, end)
-	if err == nil {
-		for _, p := range costPoints {
-			metrics.TotalCost += p.Value
-		}
-	}
-
-	// Get last request time
-	if len(latencyPoints) > 0 {
-		metrics.LastRequestTime = latencyPoints[len(latencyPoints)-1].Timestamp
-	}
+	metrics.AvgLatency = d.avgLatency(filters, start, end)
+	metrics.TotalTokens, metrics.TotalCost = d.usageTotals(filters, start, end)
 
 	return metrics, nil
 }
 
 func (d *DefaultMetricsStore) GetProviderMetrics(providerID string, start, end int64) (*ProviderMetrics, error) {
 	metrics := &ProviderMetrics{ProviderID: providerID}
+	filters := map[string]string{"provider": providerID}
 
-	// Get latency metrics for request count and avg latency
-	latencyPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{"provider": providerID}, start, end)
-	if err == nil {
-		metrics.TotalRequests = int64(len(latencyPoints))
-		var totalLatency float64
-		var successCount int64
-		for _, p := range latencyPoints {
-			totalLatency += p.Value
-			if p.Value > 0 { // Assume positive latency means success
-				successCount++
-			}
-		}
-		if metrics.TotalRequests > 0 {
-			metrics.AvgLatency = totalLatency / float64(metrics.TotalRequests)
-			metrics.SuccessRate = float64(successCount) / float64(metrics.TotalRequests)
-		}
-	}
-
-	// Get token metrics
-	tokenPoints, err := d.runtimeStore.GetMetrics("tokens", map[string]string{"provider": providerID}, start, end)
-	if err == nil {
-		for _, p := range tokenPoints {
-			metrics.TotalTokens += int64(p.Value)
-		}
-	}
-
-	// Get cost metrics
-	costPoints, err := d.runtimeStore.GetMetrics("cost", map[string]string{"provider": providerID}, start, end)
+	// Every attempt made on the provider counts, including ones a fallback recovered from
+	outcomes, err := d.getOutcomes(filters, false, start, end)
 	if err == nil {
-		for _, p := range costPoints {
-			metrics.TotalCost += p.Value
-		}
+		metrics.TotalRequests = outcomes.Requests
+		metrics.SuccessRate = outcomes.SuccessRate()
+		metrics.ErrorCount = outcomes.Errors
+		metrics.ErrorsByClass = outcomes.ErrorsByClass
 	}
 
-	// Get error count (negative latency could indicate errors)
-	errorPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{"provider": providerID, "error": "true"}, start, end)
-	if err == nil {
-		metrics.ErrorCount = int64(len(errorPoints))
-	}
+	metrics.AvgLatency = d.avgLatency(filters, start, end)
+	metrics.TotalTokens, metrics.TotalCost = d.usageTotals(filters, start, end)
 
 	return metrics, nil
 }
 
 func (d *DefaultMetricsStore) GetKeyMetrics(providerID, keyID string, start, end int64) (*KeyMetrics, error) {
 	metrics := &KeyMetrics{ProviderID: providerID, KeyID: keyID}
+	filters := map[string]string{"provider": providerID, "key": keyID}
 
-	// Get latency metrics for request count and avg latency
-	latencyPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{"provider": providerID, "key": keyID}, start, end)
-	if err == nil {
-		metrics.TotalRequests = int64(len(latencyPoints))
-		var totalLatency float64
-		var successCount int64
-		for _, p := range latencyPoints {
-			totalLatency += p.Value
-			if p.Value > 0 { // Assume positive latency means success
-				successCount++
-			}
-		}
-		if metrics.TotalRequests > 0 {
-			metrics.AvgLatency = totalLatency / float64(metrics.TotalRequests)
-			metrics.SuccessRate = float64(successCount) / float64(metrics.TotalRequests)
-		}
-		if len(latencyPoints) > 0 {
-			metrics.LastUsed = latencyPoints[len(latencyPoints)-1].Timestamp
-		}
-	}
-
-	// Get token metrics
-	tokenPoints, err := d.runtimeStore.GetMetrics("tokens", map[string]string{"provider": providerID, "key": keyID}, start, end)
+	outcomes, err := d.getOutcomes(filters, false, start, end)
 	if err == nil {
-		for _, p := range tokenPoints {
-			metrics.TotalTokens += int64(p.Value)
-		}
+		metrics.TotalRequests = outcomes.Requests
+		metrics.SuccessRate = outcomes.SuccessRate()
+		metrics.ErrorCount = outcomes.Errors
+		metrics.ErrorsByClass = outcomes.ErrorsByClass
+		metrics.LastUsed = outcomes.LastTimestamp
 	}
 
-	// Get cost metrics
-	costPoints, err := d.runtimeStore.GetMetrics("cost", map[string]string{"provider": providerID, "key": keyID}, start, end)
-	if err == nil {
-		for _, p := range costPoints {
-			metrics.TotalCost += p.Value
-		}
-	}
-
-	// Get error count
-	errorPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{"provider": providerID, "key": keyID, "error": "true"}, start, end)
-	if err == nil {
-		metrics.ErrorCount = int64(len(errorPoints))
-	}
+	metrics.AvgLatency = d.avgLatency(filters, start, end)
+	metrics.TotalTokens, metrics.TotalCost = d.usageTotals(filters, start, end)
 
 	return metrics, nil
 }
@@ -380,20 +345,16 @@ func (d *DefaultMetricsStore) GetKeyMetrics(providerID, keyID string, start, end
 func (d *DefaultMetricsStore) GetGlobalMetrics(start, end int64) (*GlobalMetrics, error) {
 	metrics := &GlobalMetrics{}
 
-	// Get all latency points to count total requests
-	latencyPoints, err := d.runtimeStore.GetMetrics("latency", map[string]string{}, start, end)
+	points, err := d.runtimeStore.GetMetrics(MetricRequest, map[string]string{TagFinal: "true"}, start, end)
 	if err == nil {
-		metrics.TotalRequests = int64(len(latencyPoints))
-		var totalLatency float64
-		var successCount int64
 		providerSet := make(map[string]bool)
 		clientSet := make(map[string]bool)
-
-		for _, p := range latencyPoints {
-			totalLatency += p.Value
-			if p.Value > 0 {
-				successCount++
+		var final []MetricPoint
+		for _, p := range points {
+			if p.Tags[TagFinal] != "true" {
+				continue
 			}
+			final = append(final, p)
 			if p.Tags["provider"] != "" {
 				providerSet[p.Tags["provider"]] = true
 			}
@@ -401,45 +362,51 @@ func (d *DefaultMetricsStore) GetGlobalMetrics(start, end int64) (*GlobalMetrics
 				clientSet[p.Tags["client_key"]] = true
 			}
 		}
-
-		if metrics.TotalRequests > 0 {
-			metrics.AvgLatency = totalLatency / float64(metrics.TotalRequests)
-			metrics.OverallSuccessRate = float64(successCount) / float64(metrics.TotalRequests)
-		}
-
+		outcomes := summarizeOutcomes(final)
+		metrics.TotalRequests = outcomes.Requests
+		metrics.OverallSuccessRate = outcomes.SuccessRate()
+		metrics.TotalErrors = outcomes.Errors
+		metrics.ErrorsByClass = outcomes.ErrorsByClass
 		metrics.TotalProviders = len(providerSet)
 		metrics.TotalClients = len(clientSet)
 	}
 
-	// Get all token points
-	tokenPoints, err := d.runtimeStore.GetMetrics("tokens", map[string]string{}, start, end)
-	if err == nil {
-		for _, p := range tokenPoints {
-			metrics.TotalTokens += int64(p.Value)
-		}
-	}
-
-	// Get all cost points
-	costPoints, err := d.runtimeStore.GetMetrics("cost", map[string]string{}, start, end)
-	if err == nil {
-		for _, p := range costPoints {
-			metrics.TotalCost += p.Value
-		}
-	}
+	metrics.AvgLatency = d.avgLatency(map[string]string{}, start, end)
+	metrics.TotalTokens, metrics.TotalCost = d.usageTotals(map[string]string{}, start, end)
 
 	return metrics, nil
 }
 
-func (d *DefaultMetricsStore) GetClientTimeSeries(clientID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
-	return []TimeSeriesPoint{}, nil
-}
-
-func (d *DefaultMetricsStore) GetProviderTimeSeries(providerID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
-	return []TimeSeriesPoint{}, nil
+// avgLatency averages the latency of successful requests
+func (d *DefaultMetricsStore) avgLatency(filters map[string]string, start, end int64) float64 {
+	points, err := d.runtimeStore.GetMetrics("latency", filters, start, end)
+	if err != nil || len(points) == 0 {
+		return 0
+	}
+	var total float64
+	var samples int64
+	for _, p := range points {
+		total += p.Value
+		samples += p.Samples()
+	}
+	return total / float64(samples)
 }
 
-func (d *DefaultMetricsStore) GetKeyTimeSeries(providerID, keyID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
-	return []TimeSeriesPoint{}, nil
+// usageTotals sums the token and cost metrics
+func (d *DefaultMetricsStore) usageTotals(filters map[string]string, start, end int64) (int64, float64) {
+	var tokens int64
+	var cost float64
+	if tokenPoints, err := d.runtimeStore.GetMetrics("tokens", filters, start, end); err == nil {
+		for _, p := range tokenPoints {
+			tokens += int64(p.Value)
+		}
+	}
+	if costPoints, err := d.runtimeStore.GetMetrics("cost", filters, start, end); err == nil {
+		for _, p := range costPoints {
+			cost += p.Value
+		}
+	}
+	return tokens, cost
 }
 
 type DefaultAlgorithmStore struct {
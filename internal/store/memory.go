@@ -0,0 +1,553 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultMemoryMaxMetricPoints bounds the points kept per metric name
+const DefaultMemoryMaxMetricPoints = 100000
+
+// memoryMetricDropDivisor sets how much of a full series is dropped at once: a 1/64th
+// share of the limit on top of the overflow, so a series at its limit isn't trimmed
+// on every write
+const memoryMetricDropDivisor = 64
+
+// memoryCacheSweepEvery is how many cache writes pass between sweeps of expired entries
+const memoryCacheSweepEvery = 1024
+
+// defaultMemoryHistoryTTL is how long window history is kept when no retention policy is applied
+const defaultMemoryHistoryTTL = time.Hour
+
+// memorySnapshotVersion is the format version of snapshot files
+const memorySnapshotVersion = 1
+
+// MemoryStoreOptions configures NewMemoryStore
+type MemoryStoreOptions struct {
+	SnapshotPath    string // Loaded on start and written by Close; empty disables snapshots
+	MaxMetricPoints int    // Points kept per metric name, oldest dropped first in batches; default 100000
+}
+
+// MemoryStore is a RuntimeStore kept in process memory, for single-node deployments and tests
+type MemoryStore struct {
+	mu      sync.RWMutex
+	usage   map[usageID]*memoryUsage
+	cache   map[string]memoryCacheEntry
+	metrics map[string]*memorySeries
+
+	cacheWrites int
+	historyTTL  time.Duration // Window history kept per usage counter
+	metricsTTL  time.Duration // Metric points older than this are dropped, 0 to keep them
+
+	maxMetricPoints int
+	snapshotPath    string
+	logger          zerolog.Logger
+}
+
+type usageID struct {
+	Provider string
+	KeyID    string
+	Metric   string
+}
+
+// memoryUsage is a usage counter and its per-second deltas, oldest first
+type memoryUsage struct {
+	total   float64
+	buckets []memoryBucket
+}
+
+type memoryBucket struct {
+	Second int64   `json:"t"`
+	Delta  float64 `json:"d"`
+}
+
+type memoryCacheEntry struct {
+	Value     string `json:"value"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix seconds, 0 for no expiry
+}
+
+// memorySeries holds a metric's points sorted by timestamp, plus one index per tag value
+type memorySeries struct {
+	points []*MetricPoint
+	index  map[string][]*MetricPoint // tag, NUL, value -> points sorted by timestamp
+}
+
+func NewMemoryStore(opts MemoryStoreOptions, logger zerolog.Logger) (*MemoryStore, error) {
+	if opts.MaxMetricPoints <= 0 {
+		opts.MaxMetricPoints = DefaultMemoryMaxMetricPoints
+	}
+	m := &MemoryStore{
+		usage:           make(map[usageID]*memoryUsage),
+		cache:           make(map[string]memoryCacheEntry),
+		metrics:         make(map[string]*memorySeries),
+		historyTTL:      defaultMemoryHistoryTTL,
+		maxMetricPoints: opts.MaxMetricPoints,
+		snapshotPath:    opts.SnapshotPath,
+		logger:          logger,
+	}
+	if opts.SnapshotPath != "" {
+		if err := m.loadSnapshot(); err != nil {
+			return nil, fmt.Errorf("failed to load memory store snapshot %s: %w", opts.SnapshotPath, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *MemoryStore) GetUsage(provider, keyID, metric string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if u, ok := m.usage[usageID{provider, keyID, metric}]; ok {
+		return u.total, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) SetUsage(provider, keyID, metric string, value float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usageFor(usageID{provider, keyID, metric}).total = value
+	return nil
+}
+
+func (m *MemoryStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.increment(usageID{provider, keyID, metric}, delta, time.Now().Unix())
+	return nil
+}
+
+// IncrementUsageBatch applies all increments under one lock
+func (m *MemoryStore) IncrementUsageBatch(items []UsageIncrement) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	for _, item := range items {
+		m.increment(usageID{item.Provider, item.KeyID, item.Metric}, item.Delta, now)
+	}
+	return nil
+}
+
+func (m *MemoryStore) usageFor(id usageID) *memoryUsage {
+	u, ok := m.usage[id]
+	if !ok {
+		u = &memoryUsage{}
+		m.usage[id] = u
+	}
+	return u
+}
+
+// increment adds delta to the total and the bucket of now, dropping buckets past the history TTL
+func (m *MemoryStore) increment(id usageID, delta float64, now int64) {
+	u := m.usageFor(id)
+	u.total += delta
+	if n := len(u.buckets); n > 0 && u.buckets[n-1].Second == now {
+		u.buckets[n-1].Delta += delta
+	} else {
+		u.buckets = append(u.buckets, memoryBucket{Second: now, Delta: delta})
+	}
+
+	oldest := now - int64(m.historyTTL/time.Second)
+	if expired := sort.Search(len(u.buckets), func(i int) bool { return u.buckets[i].Second >= oldest }); expired > 0 {
+		u.buckets = append(u.buckets[:0], u.buckets[expired:]...)
+	}
+}
+
+func (m *MemoryStore) GetUsageInWindow(provider, keyID, metric string, windowSeconds int64) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.usage[usageID{provider, keyID, metric}]
+	if !ok {
+		return 0, nil
+	}
+
+	now := time.Now().Unix()
+	start := sort.Search(len(u.buckets), func(i int) bool { return u.buckets[i].Second >= now-windowSeconds })
+	total := 0.0
+	for _, b := range u.buckets[start:] {
+		if b.Second <= now {
+			total += b.Delta
+		}
+	}
+	return total, nil
+}
+
+func (m *MemoryStore) SetCache(key, value string, ttlSeconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := memoryCacheEntry{Value: value}
+	// Entries without a TTL never expire
+	if ttlSeconds > 0 {
+		entry.ExpiresAt = time.Now().Unix() + ttlSeconds
+	}
+	m.cache[key] = entry
+
+	m.cacheWrites++
+	if m.cacheWrites%memoryCacheSweepEvery == 0 {
+		m.sweepCache(time.Now().Unix())
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetCache(key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.cache[key]
+	if !ok || entry.expired(time.Now().Unix()) {
+		return "", nil
+	}
+	return entry.Value, nil
+}
+
+func (e memoryCacheEntry) expired(now int64) bool {
+	return e.ExpiresAt > 0 && now >= e.ExpiresAt
+}
+
+func (m *MemoryStore) sweepCache(now int64) int64 {
+	var removed int64
+	for key, entry := range m.cache {
+		if entry.expired(now) {
+			delete(m.cache, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (m *MemoryStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addPoint(name, &MetricPoint{Value: value, Timestamp: timestamp, Tags: copyTags(tags)})
+	return nil
+}
+
+// StoreMetricBatch stores all points under one lock
+func (m *MemoryStore) StoreMetricBatch(points []MetricWrite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range points {
+		m.addPoint(p.Name, &MetricPoint{Value: p.Value, Timestamp: p.Timestamp, Tags: copyTags(p.Tags)})
+	}
+	return nil
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// insertByTimestamp inserts p after any points with the same timestamp
+func insertByTimestamp(points []*MetricPoint, p *MetricPoint) []*MetricPoint {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp > p.Timestamp })
+	points = append(points, nil)
+	copy(points[i+1:], points[i:])
+	points[i] = p
+	return points
+}
+
+// indexKeys returns the tag indexes a point belongs to. Per-request tags aren't indexed.
+func indexKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if !rollupExcludedTags[k] {
+			keys = append(keys, k+"\x00"+v)
+		}
+	}
+	return keys
+}
+
+// addPoint stores a point and drops the oldest ones past the age and count limits
+func (m *MemoryStore) addPoint(name string, p *MetricPoint) {
+	s, ok := m.metrics[name]
+	if !ok {
+		s = &memorySeries{index: make(map[string][]*MetricPoint)}
+		m.metrics[name] = s
+	}
+	s.points = insertByTimestamp(s.points, p)
+	for _, key := range indexKeys(p.Tags) {
+		s.index[key] = insertByTimestamp(s.index[key], p)
+	}
+
+	drop := 0
+	if over := len(s.points) - m.maxMetricPoints; over > 0 {
+		drop = over + m.maxMetricPoints/memoryMetricDropDivisor
+	}
+	if m.metricsTTL > 0 {
+		oldest := time.Now().Add(-m.metricsTTL).Unix()
+		drop = max(drop, sort.Search(len(s.points), func(i int) bool { return s.points[i].Timestamp >= oldest }))
+	}
+	if drop > 0 {
+		s.dropOldest(drop)
+	}
+}
+
+// dropOldest removes the n oldest points from the series and its indexes. Points are
+// inserted in the same order into both, so the dropped points lead every index they
+// are in and are sliced off its front.
+func (s *memorySeries) dropOldest(n int) {
+	dropped := make(map[string]int)
+	for _, p := range s.points[:n] {
+		for _, key := range indexKeys(p.Tags) {
+			dropped[key]++
+		}
+	}
+	for key, count := range dropped {
+		list := s.index[key]
+		if count >= len(list) {
+			delete(s.index, key)
+			continue
+		}
+		clear(list[:count])
+		s.index[key] = list[count:]
+	}
+	clear(s.points[:n])
+	s.points = s.points[n:]
+}
+
+// GetMetrics scans the smallest tag index that matches the filters
+func (m *MemoryStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []MetricPoint{}
+	s, ok := m.metrics[name]
+	if !ok {
+		return result, nil
+	}
+	candidates := s.points
+	for _, key := range indexKeys(tags) {
+		list, ok := s.index[key]
+		if !ok {
+			return result, nil
+		}
+		if len(list) < len(candidates) {
+			candidates = list
+		}
+	}
+
+	first := sort.Search(len(candidates), func(i int) bool { return candidates[i].Timestamp >= start })
+	for _, p := range candidates[first:] {
+		if p.Timestamp > end {
+			break
+		}
+		if matchTags(p.Tags, tags) {
+			point := *p
+			point.Tags = copyTags(p.Tags)
+			result = append(result, point)
+		}
+	}
+	return result, nil
+}
+
+// QueryTimeSeries buckets the matching points of a range
+func (m *MemoryStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	points, err := m.GetMetrics(q.Name, q.Tags, q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+	return AggregatePoints(points, q), nil
+}
+
+// ApplyRetention sets how long window history and metric points are kept. Memory is
+// always bounded, so history falls back to the default retention.
+func (m *MemoryStore) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.historyTTL = policy.UsageHistory
+	if m.historyTTL <= 0 {
+		m.historyTTL = DefaultUsageHistoryRetention
+	}
+	m.metricsTTL = max(policy.MetricsDaily, 0)
+	return nil
+}
+
+// Compact removes expired cache entries, history past its retention and metric points
+// older than the daily retention
+func (m *MemoryStore) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	started := time.Now()
+	result := &CompactionResult{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result.CacheDeleted = m.sweepCache(now.Unix())
+	if policy.UsageHistory > 0 {
+		oldest := now.Add(-policy.UsageHistory).Unix()
+		for _, u := range m.usage {
+			expired := sort.Search(len(u.buckets), func(i int) bool { return u.buckets[i].Second >= oldest })
+			u.buckets = append(u.buckets[:0], u.buckets[expired:]...)
+			result.UsageHistoryDeleted += int64(expired)
+		}
+	}
+	if policy.MetricsDaily > 0 {
+		cutoff := now.Add(-policy.MetricsDaily).Unix()
+		for _, s := range m.metrics {
+			expired := sort.Search(len(s.points), func(i int) bool { return s.points[i].Timestamp >= cutoff })
+			s.dropOldest(expired)
+			result.DailyDeleted += int64(expired)
+		}
+	}
+
+	result.DurationMS = time.Since(started).Milliseconds()
+	return result, nil
+}
+
+// StorageStats reports entry counts; memory use isn't measured
+func (m *MemoryStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var buckets int64
+	for _, u := range m.usage {
+		buckets += int64(len(u.buckets))
+	}
+	metrics := TableStats{Name: "metrics"}
+	for _, s := range m.metrics {
+		metrics.Rows += int64(len(s.points))
+		if len(s.points) > 0 && (metrics.OldestTimestamp == 0 || s.points[0].Timestamp < metrics.OldestTimestamp) {
+			metrics.OldestTimestamp = s.points[0].Timestamp
+		}
+	}
+
+	return &StorageStats{
+		Backend: "memory",
+		Tables: []TableStats{
+			{Name: "usage", Rows: int64(len(m.usage))},
+			{Name: "usage_history", Rows: buckets},
+			{Name: "cache", Rows: int64(len(m.cache))},
+			metrics,
+		},
+	}, nil
+}
+
+// memorySnapshot is the on-disk form of a MemoryStore
+type memorySnapshot struct {
+	Version int                         `json:"version"`
+	SavedAt int64                       `json:"saved_at"`
+	Usage   []memoryUsageSnapshot       `json:"usage"`
+	Cache   map[string]memoryCacheEntry `json:"cache"`
+	Metrics map[string][]MetricPoint    `json:"metrics"`
+}
+
+type memoryUsageSnapshot struct {
+	Provider string         `json:"provider"`
+	KeyID    string         `json:"key_id"`
+	Metric   string         `json:"metric"`
+	Total    float64        `json:"total"`
+	Buckets  []memoryBucket `json:"buckets,omitempty"`
+}
+
+// Snapshot writes the store to its snapshot path, replacing the previous file atomically
+func (m *MemoryStore) Snapshot() error {
+	if m.snapshotPath == "" {
+		return nil
+	}
+
+	m.mu.RLock()
+	now := time.Now().Unix()
+	snap := memorySnapshot{
+		Version: memorySnapshotVersion,
+		SavedAt: now,
+		Usage:   make([]memoryUsageSnapshot, 0, len(m.usage)),
+		Cache:   make(map[string]memoryCacheEntry, len(m.cache)),
+		Metrics: make(map[string][]MetricPoint, len(m.metrics)),
+	}
+	for id, u := range m.usage {
+		snap.Usage = append(snap.Usage, memoryUsageSnapshot{Provider: id.Provider, KeyID: id.KeyID, Metric: id.Metric, Total: u.total, Buckets: u.buckets})
+	}
+	for key, entry := range m.cache {
+		if !entry.expired(now) {
+			snap.Cache[key] = entry
+		}
+	}
+	for name, s := range m.metrics {
+		points := make([]MetricPoint, len(s.points))
+		for i, p := range s.points {
+			points[i] = *p
+		}
+		snap.Metrics[name] = points
+	}
+	data, err := json.Marshal(snap)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.snapshotPath), filepath.Base(m.snapshotPath)+".tmp-*")
+	if err != nil {
+		m.logger.Error().Err(err).Str("operation", "Snapshot").Str("path", m.snapshotPath).Msg("store operation failed")
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		m.logger.Error().Err(err).Str("operation", "Snapshot").Str("path", m.snapshotPath).Msg("store operation failed")
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.snapshotPath); err != nil {
+		m.logger.Error().Err(err).Str("operation", "Snapshot").Str("path", m.snapshotPath).Msg("store operation failed")
+		return err
+	}
+	m.logger.Info().Str("path", m.snapshotPath).Int("usage", len(snap.Usage)).Int("cache", len(snap.Cache)).Msg("memory store snapshot saved")
+	return nil
+}
+
+func (m *MemoryStore) loadSnapshot() error {
+	data, err := os.ReadFile(m.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Version > memorySnapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than supported version %d", snap.Version, memorySnapshotVersion)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range snap.Usage {
+		m.usage[usageID{u.Provider, u.KeyID, u.Metric}] = &memoryUsage{total: u.Total, buckets: u.Buckets}
+	}
+	now := time.Now().Unix()
+	for key, entry := range snap.Cache {
+		if !entry.expired(now) {
+			m.cache[key] = entry
+		}
+	}
+	for name, points := range snap.Metrics {
+		for i := range points {
+			p := points[i]
+			if p.Tags == nil {
+				p.Tags = make(map[string]string)
+			}
+			m.addPoint(name, &p)
+		}
+	}
+	return nil
+}
+
+// Close writes a snapshot when a snapshot path is configured
+func (m *MemoryStore) Close() error {
+	return m.Snapshot()
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreUsageAndCache(t *testing.T) {
+	m, err := NewMemoryStore(MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, m.IncrementUsage("openai", "key1", "req", 1))
+	require.NoError(t, m.IncrementUsageBatch([]UsageIncrement{
+		{Provider: "openai", KeyID: "key1", Metric: "req", Delta: 2},
+		{Provider: "openai", KeyID: "key1", Metric: "tokens", Delta: 100},
+	}))
+	total, err := m.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, total)
+
+	// Deltas older than the window don't count, and ones past the history TTL are dropped
+	now := time.Now().Unix()
+	u := m.usage[usageID{"openai", "key1", "req"}]
+	u.buckets = append([]memoryBucket{{Second: now - 7200, Delta: 50}, {Second: now - 120, Delta: 10}}, u.buckets...)
+	window, err := m.GetUsageInWindow("openai", "key1", "req", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, window)
+	window, err = m.GetUsageInWindow("openai", "key1", "req", 300)
+	require.NoError(t, err)
+	assert.Equal(t, 13.0, window)
+	require.NoError(t, m.IncrementUsage("openai", "key1", "req", 1))
+	assert.Equal(t, now-120, u.buckets[0].Second)
+
+	// Cache entries expire; a TTL of 0 never expires
+	require.NoError(t, m.SetCache("short", "v1", 60))
+	require.NoError(t, m.SetCache("forever", "v2", 0))
+	value, err := m.GetCache("short")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", value)
+	m.cache["short"] = memoryCacheEntry{Value: "v1", ExpiresAt: now - 1}
+	value, err = m.GetCache("short")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+	assert.Equal(t, int64(1), m.sweepCache(now))
+	value, err = m.GetCache("forever")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", value)
+}
+
+func TestMemoryStoreMetrics(t *testing.T) {
+	m, err := NewMemoryStore(MemoryStoreOptions{MaxMetricPoints: 3}, zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, m.StoreMetric("latency", 300, map[string]string{"provider": "gemini"}, 30))
+	require.NoError(t, m.StoreMetric("latency", 100, map[string]string{"provider": "openai", "model": "a", "request_id": "r1"}, 10))
+	require.NoError(t, m.StoreMetricBatch([]MetricWrite{
+		{Name: "latency", Value: 200, Tags: map[string]string{"provider": "openai", "model": "b"}, Timestamp: 20},
+	}))
+
+	points, err := m.GetMetrics("latency", nil, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, points, 3)
+	assert.Equal(t, []int64{10, 20, 30}, []int64{points[0].Timestamp, points[1].Timestamp, points[2].Timestamp})
+
+	points, err = m.GetMetrics("latency", map[string]string{"provider": "openai"}, 0, 100)
+	require.NoError(t, err)
+	assert.Len(t, points, 2)
+	points, err = m.GetMetrics("latency", map[string]string{"provider": "openai", "request_id": "r1"}, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 100.0, points[0].Value)
+	points, err = m.GetMetrics("latency", map[string]string{"provider": "openai"}, 15, 25)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 200.0, points[0].Value)
+
+	// Returned points don't alias stored ones
+	points[0].Tags["provider"] = "changed"
+	points, err = m.GetMetrics("latency", map[string]string{"provider": "openai"}, 15, 25)
+	require.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	// The oldest point is evicted from the series and its indexes
+	require.NoError(t, m.StoreMetric("latency", 400, map[string]string{"provider": "openai"}, 40))
+	points, err = m.GetMetrics("latency", nil, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, points, 3)
+	assert.Equal(t, int64(20), points[0].Timestamp)
+	assert.Len(t, m.metrics["latency"].index["model\x00a"], 0)
+	assert.NotContains(t, m.metrics["latency"].index, "model\x00a")
+
+	// Daily retention drops old points
+	_, err = m.Compact(context.Background(), RetentionPolicy{MetricsDaily: time.Hour}, time.Unix(3600+35, 0))
+	require.NoError(t, err)
+	points, err = m.GetMetrics("latency", nil, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 400.0, points[0].Value)
+}
+
+func TestMemoryStoreMetricsDropInBatches(t *testing.T) {
+	m, err := NewMemoryStore(MemoryStoreOptions{MaxMetricPoints: 640}, zerolog.Nop())
+	require.NoError(t, err)
+
+	providers := []string{"openai", "gemini", "claude"}
+	for i := range 641 {
+		require.NoError(t, m.StoreMetric("latency", float64(i), map[string]string{"provider": providers[i%3]}, int64(i)))
+	}
+
+	// The overflow and a 1/64th share of the limit go at once
+	s := m.metrics["latency"]
+	require.Len(t, s.points, 630)
+	assert.Equal(t, int64(11), s.points[0].Timestamp)
+	for _, provider := range providers {
+		points, err := m.GetMetrics("latency", map[string]string{"provider": provider}, 0, 1000)
+		require.NoError(t, err)
+		for _, p := range points {
+			assert.GreaterOrEqual(t, p.Timestamp, int64(11))
+			assert.Equal(t, provider, p.Tags["provider"])
+		}
+		assert.Len(t, s.index["provider\x00"+provider], len(points))
+	}
+	total := len(s.index["provider\x00openai"]) + len(s.index["provider\x00gemini"]) + len(s.index["provider\x00claude"])
+	assert.Equal(t, 630, total)
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.json")
+	m, err := NewMemoryStore(MemoryStoreOptions{SnapshotPath: path}, zerolog.Nop())
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	require.NoError(t, m.IncrementUsage("openai", "key1", "req", 2))
+	require.NoError(t, m.SetCache("key", "value", 300))
+	require.NoError(t, m.StoreMetric("cost", 0.5, map[string]string{"provider": "openai"}, now))
+	require.NoError(t, m.Close())
+
+	restored, err := NewMemoryStore(MemoryStoreOptions{SnapshotPath: path}, zerolog.Nop())
+	require.NoError(t, err)
+	total, err := restored.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, total)
+	window, err := restored.GetUsageInWindow("openai", "key1", "req", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, window)
+	value, err := restored.GetCache("key")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	points, err := restored.GetMetrics("cost", map[string]string{"provider": "openai"}, now-1, now)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 0.5, points[0].Value)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -258,15 +259,12 @@ func (m *MongoDBStore) SetCache(key, value string, ttlSeconds int64) error {
 	ctx := context.Background()
 	collection := m.database.Collection("cache")
 
-	expiry := time.Now().Add(time.Duration(ttlSeconds) * time.Second)
-	doc := CacheDocument{
-		Key:    key,
-		Value:  value,
-		Expiry: expiry,
-	}
-
 	filter := bson.M{"_id": key}
-	update := bson.M{"$set": doc}
+	update := bson.M{"$set": bson.M{"value": value, "expiry": time.Now().Add(time.Duration(ttlSeconds) * time.Second)}}
+	if ttlSeconds <= 0 {
+		// Entries without a TTL never expire
+		update = bson.M{"$set": bson.M{"value": value}, "$unset": bson.M{"expiry": ""}}
+	}
 	opts := options.Update().SetUpsert(true)
 
 	_, err := collection.UpdateOne(ctx, filter, update, opts)
@@ -332,19 +330,25 @@ func (m *MongoDBStore) GetMetrics(name string, tags map[string]string, start, en
 			"$lte": end,
 		},
 	}
+	for k, v := range tags {
+		filter["tags."+k] = v
+	}
 
-	cursor, err := collection.Find(ctx, filter)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
 	if err != nil {
+		m.logger.Error().Err(err).Str("operation", "GetMetrics").Str("name", name).Msg("store operation failed")
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var points []MetricPoint
+	points := []MetricPoint{}
 	for cursor.Next(ctx) {
 		var doc struct {
-			Value     float64           `bson:"value"`
-			Timestamp int64             `bson:"timestamp"`
-			Tags      map[string]string `bson:"tags"`
+			Value      float64           `bson:"value"`
+			Timestamp  int64             `bson:"timestamp"`
+			Tags       map[string]string `bson:"tags"`
+			Count      int64             `bson:"count"`
+			Resolution int64             `bson:"resolution"`
 		}
 		err := cursor.Decode(&doc)
 		if err != nil {
@@ -354,10 +358,298 @@ func (m *MongoDBStore) GetMetrics(name string, tags map[string]string, start, en
 			doc.Tags = make(map[string]string)
 		}
 		points = append(points, MetricPoint{
-			Value:     doc.Value,
-			Timestamp: doc.Timestamp,
-			Tags:      doc.Tags,
+			Value:      doc.Value,
+			Timestamp:  doc.Timestamp,
+			Tags:       doc.Tags,
+			Count:      doc.Count,
+			Resolution: doc.Resolution,
 		})
 	}
 	return points, nil
 }
+
+// QueryTimeSeries aggregates metrics with a $match/$group pipeline on aligned time buckets
+func (m *MongoDBStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	ctx := context.Background()
+	collection := m.database.Collection("metrics")
+
+	match := bson.M{
+		"name":      q.Name,
+		"timestamp": bson.M{"$gte": q.Start, "$lte": q.End},
+	}
+	for k, v := range q.Tags {
+		match["tags."+k] = v
+	}
+
+	// Rolled-up documents hold the sum of count raw values
+	samples := bson.M{"$ifNull": bson.A{"$count", 1}}
+	mean := bson.M{"$divide": bson.A{"$value", samples}}
+	var acc bson.M
+	switch q.Agg {
+	case AggSum, AggAvg:
+		acc = bson.M{"$sum": "$value"}
+	case AggCount:
+		acc = bson.M{"$sum": samples}
+	case AggMin:
+		acc = bson.M{"$min": mean}
+	case AggMax:
+		acc = bson.M{"$max": mean}
+	default:
+		// $percentile can't weigh rolled-up documents by count: collect them and rank in Go
+		acc = bson.M{"$push": bson.M{"value": "$value", "count": samples}}
+	}
+
+	bucket := bson.M{"$subtract": bson.A{"$timestamp", bson.M{"$mod": bson.A{"$timestamp", q.Interval}}}}
+	pipeline := mongo.Pipeline{
+		{primitive.E{Key: "$match", Value: match}},
+		{primitive.E{Key: "$group", Value: bson.M{"_id": bucket, "value": acc, "samples": bson.M{"$sum": samples}}}},
+		{primitive.E{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		m.logger.Error().Err(err).Str("operation", "QueryTimeSeries").Str("name", q.Name).Str("agg", q.Agg).Msg("store operation failed")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	points := []TimeSeriesPoint{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			Bucket  int64       `bson:"_id"`
+			Value   interface{} `bson:"value"`
+			Samples interface{} `bson:"samples"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if p := percentileOf(q.Agg); p > 0 {
+			var group struct {
+				Value []MetricPoint `bson:"value"`
+			}
+			if err := cursor.Decode(&group); err != nil {
+				return nil, err
+			}
+			sort.Slice(group.Value, func(i, j int) bool { return group.Value[i].Mean() < group.Value[j].Mean() })
+			value := weightedNearestRank(group.Value, int64(mongoNumber(doc.Samples)), p)
+			points = append(points, TimeSeriesPoint{Timestamp: doc.Bucket, Value: value, Metric: q.Name})
+			continue
+		}
+		value := mongoNumber(doc.Value)
+		if q.Agg == AggAvg {
+			if n := mongoNumber(doc.Samples); n > 0 {
+				value /= n
+			}
+		}
+		points = append(points, TimeSeriesPoint{Timestamp: doc.Bucket, Value: value, Metric: q.Name})
+	}
+	return points, cursor.Err()
+}
+
+// mongoNumber converts aggregation results to float64
+func mongoNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
+
+// ApplyRetention turns the usage history and cache expiry indexes into TTL indexes.
+// Converting an existing index requires MongoDB 5.1+.
+func (m *MongoDBStore) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	if policy.UsageHistory > 0 {
+		cmd := bson.D{
+			{Key: "collMod", Value: "usage_history"},
+			{Key: "index", Value: bson.M{"keyPattern": bson.M{"timestamp": 1}, "expireAfterSeconds": int64(policy.UsageHistory.Seconds())}},
+		}
+		if err := m.database.RunCommand(ctx, cmd).Err(); err != nil {
+			m.logger.Error().Err(err).Str("operation", "ApplyRetention").Str("collection", "usage_history").Msg("store operation failed")
+			return err
+		}
+	}
+	cmd := bson.D{
+		{Key: "collMod", Value: "cache"},
+		{Key: "index", Value: bson.M{"keyPattern": bson.M{"expiry": 1}, "expireAfterSeconds": 0}},
+	}
+	if err := m.database.RunCommand(ctx, cmd).Err(); err != nil {
+		m.logger.Error().Err(err).Str("operation", "ApplyRetention").Str("collection", "cache").Msg("store operation failed")
+		return err
+	}
+	return nil
+}
+
+// Compact rolls up and expires metrics, and deletes old usage history and expired
+// cache entries for deployments where TTL indexes are not available
+func (m *MongoDBStore) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	started := time.Now()
+	result := &CompactionResult{}
+
+	var err error
+	if cutoff := policy.rawCutoff(now); cutoff > 0 {
+		if result.RawRolledUp, err = m.rollupMetrics(ctx, ResolutionRaw, ResolutionHourly, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if cutoff := policy.hourlyCutoff(now); cutoff > 0 {
+		if result.HourlyRolledUp, err = m.rollupMetrics(ctx, ResolutionHourly, ResolutionDaily, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if cutoff := policy.dailyCutoff(now); cutoff > 0 {
+		res, err := m.database.Collection("metrics").DeleteMany(ctx, bson.M{"resolution": ResolutionDaily, "timestamp": bson.M{"$lt": cutoff}})
+		if err != nil {
+			m.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+			return nil, err
+		}
+		result.DailyDeleted = res.DeletedCount
+	}
+	if policy.UsageHistory > 0 {
+		res, err := m.database.Collection("usage_history").DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": now.Add(-policy.UsageHistory)}})
+		if err != nil {
+			m.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+			return nil, err
+		}
+		result.UsageHistoryDeleted = res.DeletedCount
+	}
+	res, err := m.database.Collection("cache").DeleteMany(ctx, bson.M{"expiry": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		m.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+		return nil, err
+	}
+	result.CacheDeleted = res.DeletedCount
+
+	result.DurationMS = time.Since(started).Milliseconds()
+	return result, nil
+}
+
+// rollupMetrics replaces documents of one resolution older than cutoff with rollups of the next, a day at a time
+func (m *MongoDBStore) rollupMetrics(ctx context.Context, from, to, cutoff int64) (int64, error) {
+	collection := m.database.Collection("metrics")
+	resolution := any(from)
+	if from == ResolutionRaw {
+		// Raw documents written before rollups existed have no resolution field
+		resolution = bson.M{"$in": bson.A{nil, ResolutionRaw}}
+	}
+
+	var oldest struct {
+		Timestamp int64 `bson:"timestamp"`
+	}
+	err := collection.FindOne(ctx, bson.M{"resolution": resolution, "timestamp": bson.M{"$lt": cutoff}},
+		options.FindOne().SetSort(bson.M{"timestamp": 1})).Decode(&oldest)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		m.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+		return 0, err
+	}
+
+	var total int64
+	for start := bucketStart(oldest.Timestamp, ResolutionDaily); start < cutoff; start += ResolutionDaily {
+		end := start + ResolutionDaily
+		if end > cutoff {
+			end = cutoff
+		}
+		filter := bson.M{"resolution": resolution, "timestamp": bson.M{"$gte": start, "$lt": end}}
+		n, err := m.rollupWindow(ctx, collection, filter, to)
+		if err != nil {
+			m.logger.Error().Err(err).Str("operation", "Compact").Int64("resolution", from).Int64("start", start).Msg("store operation failed")
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (m *MongoDBStore) rollupWindow(ctx context.Context, collection *mongo.Collection, filter bson.M, to int64) (int64, error) {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	byName := make(map[string][]MetricPoint)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Name      string            `bson:"name"`
+			Value     float64           `bson:"value"`
+			Timestamp int64             `bson:"timestamp"`
+			Tags      map[string]string `bson:"tags"`
+			Count     int64             `bson:"count"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			cursor.Close(ctx)
+			return 0, err
+		}
+		byName[doc.Name] = append(byName[doc.Name], MetricPoint{Value: doc.Value, Timestamp: doc.Timestamp, Tags: doc.Tags, Count: doc.Count})
+	}
+	cursor.Close(ctx)
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+	if len(byName) == 0 {
+		return 0, nil
+	}
+
+	var docs []interface{}
+	for name, points := range byName {
+		for _, p := range RollupPoints(points, to) {
+			docs = append(docs, bson.M{
+				"name":       name,
+				"value":      p.Value,
+				"tags":       p.Tags,
+				"timestamp":  p.Timestamp,
+				"count":      p.Count,
+				"resolution": p.Resolution,
+			})
+		}
+	}
+	if _, err := collection.InsertMany(ctx, docs); err != nil {
+		return 0, err
+	}
+	res, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// StorageStats reports document counts and sizes per collection
+func (m *MongoDBStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	stats := &StorageStats{Backend: "mongodb"}
+	var dbStats struct {
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	if err := m.database.RunCommand(ctx, bson.M{"dbStats": 1}).Decode(&dbStats); err != nil {
+		m.logger.Error().Err(err).Str("operation", "StorageStats").Msg("store operation failed")
+		return nil, err
+	}
+	stats.TotalBytes = int64(dbStats.StorageSize + dbStats.IndexSize)
+
+	for _, name := range []string{"usage_metrics", "usage_history", "cache", "metrics"} {
+		t := TableStats{Name: name}
+		var collStats struct {
+			Count          int64   `bson:"count"`
+			StorageSize    float64 `bson:"storageSize"`
+			TotalIndexSize float64 `bson:"totalIndexSize"`
+		}
+		if err := m.database.RunCommand(ctx, bson.M{"collStats": name}).Decode(&collStats); err != nil {
+			// collStats is unavailable on some managed deployments; fall back to counting
+			count, err := m.database.Collection(name).EstimatedDocumentCount(ctx)
+			if err != nil {
+				m.logger.Error().Err(err).Str("operation", "StorageStats").Str("collection", name).Msg("store operation failed")
+				return nil, err
+			}
+			t.Rows = count
+		} else {
+			t.Rows = collStats.Count
+			t.Bytes = int64(collStats.StorageSize + collStats.TotalIndexSize)
+		}
+		stats.Tables = append(stats.Tables, t)
+	}
+	return stats, nil
+}
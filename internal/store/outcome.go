@@ -0,0 +1,150 @@
+package store
+
+import (
+	"strconv"
+	"time"
+)
+
+// MetricRequest is the request outcome metric. One point is stored per upstream
+// attempt with the attempt latency in milliseconds as value; the attempt that
+// decided the response is tagged final=true. Requests rejected before reaching
+// a provider are stored as a single final point without provider tags.
+const MetricRequest = "request"
+
+// Outcome metric tags
+const (
+	TagOutcome    = "outcome"
+	TagStatus     = "status"
+	TagErrorClass = "error_class"
+	TagAttempt    = "attempt"
+	TagFallback   = "fallback"
+	TagFinal      = "final"
+	TagEndpoint   = "endpoint"
+)
+
+// Values of the outcome tag
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// RequestOutcome describes how a single attempt of a request ended
+type RequestOutcome struct {
+	Provider   string
+	KeyID      string
+	Model      string
+	ClientKey  string
+	RequestID  string
+	Endpoint   string // "chat", "chat_stream", "embeddings"
+	Status     int    // HTTP status returned, or that would have been returned, to the client
+	ErrorClass string // Empty on success
+	Attempt    int    // 1-based, 0 when no provider was tried
+	Fallback   bool
+	Final      bool
+	LatencyMS  int64
+}
+
+// Success reports whether the attempt succeeded
+func (o RequestOutcome) Success() bool {
+	return o.ErrorClass == "" && o.Status < 400
+}
+
+// Tags returns the metric tags for the outcome
+func (o RequestOutcome) Tags() map[string]string {
+	outcome := OutcomeSuccess
+	if !o.Success() {
+		outcome = OutcomeError
+	}
+	tags := map[string]string{
+		TagOutcome:  outcome,
+		TagStatus:   strconv.Itoa(o.Status),
+		TagAttempt:  strconv.Itoa(o.Attempt),
+		TagFallback: strconv.FormatBool(o.Fallback),
+		TagFinal:    strconv.FormatBool(o.Final),
+	}
+	if o.ErrorClass != "" {
+		tags[TagErrorClass] = o.ErrorClass
+	}
+	optional := map[string]string{
+		"provider":   o.Provider,
+		"key":        o.KeyID,
+		"model":      o.Model,
+		"client_key": o.ClientKey,
+		"request_id": o.RequestID,
+		TagEndpoint:  o.Endpoint,
+	}
+	for k, v := range optional {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// RecordOutcome stores the outcome metric for one attempt
+func RecordOutcome(s RuntimeStore, o RequestOutcome) error {
+	return s.StoreMetric(MetricRequest, float64(o.LatencyMS), o.Tags(), time.Now().Unix())
+}
+
+// outcomeSummary aggregates request outcome points
+type outcomeSummary struct {
+	Requests      int64
+	Successes     int64
+	Errors        int64
+	ErrorsByClass map[string]int64
+	LastTimestamp int64
+}
+
+func summarizeOutcomes(points []MetricPoint) outcomeSummary {
+	summary := outcomeSummary{ErrorsByClass: make(map[string]int64)}
+	for _, p := range points {
+		n := p.Samples()
+		summary.Requests += n
+		if p.Tags[TagOutcome] == OutcomeSuccess {
+			summary.Successes += n
+		} else {
+			summary.Errors += n
+			class := p.Tags[TagErrorClass]
+			if class == "" {
+				class = "other"
+			}
+			summary.ErrorsByClass[class] += n
+		}
+		if p.Timestamp > summary.LastTimestamp {
+			summary.LastTimestamp = p.Timestamp
+		}
+	}
+	return summary
+}
+
+// SuccessRate returns the fraction of successful outcomes, or 0 when there are none
+func (s outcomeSummary) SuccessRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Requests)
+}
+
+// getOutcomes loads outcome points for the filters. Client and global views count
+// requests (final attempts); provider and key views count every attempt made on them.
+func (d *DefaultMetricsStore) getOutcomes(filters map[string]string, finalOnly bool, start, end int64) (outcomeSummary, error) {
+	tags := make(map[string]string, len(filters)+1)
+	for k, v := range filters {
+		tags[k] = v
+	}
+	if finalOnly {
+		tags[TagFinal] = "true"
+	}
+	points, err := d.runtimeStore.GetMetrics(MetricRequest, tags, start, end)
+	if err != nil {
+		return outcomeSummary{}, err
+	}
+	// Stores that ignore tag filters return everything; filter again
+	filtered := points[:0]
+	for _, p := range points {
+		if matchTags(p.Tags, tags) {
+			filtered = append(filtered, p)
+		}
+	}
+	return summarizeOutcomes(filtered), nil
+}
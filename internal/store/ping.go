@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pingCacheKey is read by Ping for stores without a native connection check
+const pingCacheKey = "health:ping"
+
+// Pinger is implemented by runtime stores that can check their connection directly
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that a runtime store is reachable and returns how long the check took.
+// Stores that don't implement Pinger are checked with a cache lookup, which a miss satisfies.
+func Ping(ctx context.Context, s RuntimeStore) (time.Duration, error) {
+	start := time.Now()
+	if p, ok := s.(Pinger); ok {
+		err := p.Ping(ctx)
+		return time.Since(start), err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.GetCache(pingCacheKey)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (r *RedisStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (m *MongoDBStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
+// Ping calls the server's unauthenticated /health endpoint once, without retries
+func (h *HTTPStore) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.endpoint+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Ping checks the backend; pending writes don't need it to be reachable
+func (b *BufferedStore) Ping(ctx context.Context) error {
+	_, err := Ping(ctx, b.backend)
+	return err
+}
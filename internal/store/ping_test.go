@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPing(t *testing.T) {
+	memory, err := NewMemoryStore(MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	sqlStore, err := NewSQLStore(filepath.Join(t.TempDir(), "ping.db"), zerolog.Nop())
+	require.NoError(t, err)
+	server := httptest.NewServer(NewHTTPStoreServer(memory, NewSimpleConfigStore(memory), "test-key", zerolog.Nop()).Handler())
+	defer server.Close()
+
+	for name, s := range map[string]RuntimeStore{
+		"memory":   memory,
+		"sql":      sqlStore,
+		"http":     NewHTTPStore(server.URL, "test-key", zerolog.Nop()),
+		"buffered": NewBufferedStore(memory, BufferedStoreOptions{}, zerolog.Nop()),
+	} {
+		_, err := Ping(context.Background(), s)
+		assert.NoError(t, err, name)
+	}
+
+	// An unreachable HTTP store fails
+	unreachable := NewHTTPStore("http://127.0.0.1:1", "test-key", zerolog.Nop())
+	_, err = Ping(context.Background(), unreachable)
+	assert.Error(t, err)
+
+	// A closed SQL store fails
+	require.NoError(t, sqlStore.db.Close())
+	_, err = Ping(context.Background(), sqlStore)
+	assert.Error(t, err)
+}
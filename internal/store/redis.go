@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -13,6 +16,108 @@ import (
 type RedisStore struct {
 	client *redis.Client
 	logger zerolog.Logger
+
+	historyTTL atomic.Int64 // Expiry of usage history keys in nanoseconds, 0 for the default
+}
+
+// defaultRedisHistoryTTL is the expiry of usage history keys when no retention policy is applied
+const defaultRedisHistoryTTL = time.Hour
+
+// incrementUsageScript adds a delta to the total counter and to the current one-second
+// bucket of the sliding window, drops buckets older than the history TTL and refreshes
+// the window keys' expiry.
+// KEYS: total, buckets hash, bucket index; ARGV: bucket, delta, ttl seconds, oldest bucket kept
+var incrementUsageScript = redis.NewScript(`
+local total = redis.call('INCRBYFLOAT', KEYS[1], ARGV[2])
+redis.call('HINCRBYFLOAT', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[1], ARGV[1])
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[4], 'LIMIT', 0, 1000)
+if #expired > 0 then
+	redis.call('HDEL', KEYS[2], unpack(expired))
+	redis.call('ZREM', KEYS[3], unpack(expired))
+end
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+redis.call('EXPIRE', KEYS[3], ARGV[3])
+return total
+`)
+
+// windowSumScript sums the buckets of a sliding window.
+// KEYS: buckets hash, bucket index; ARGV: first bucket, last bucket
+var windowSumScript = redis.NewScript(`
+local buckets = redis.call('ZRANGEBYSCORE', KEYS[2], ARGV[1], ARGV[2])
+local total = 0
+for i = 1, #buckets, 500 do
+	local values = redis.call('HMGET', KEYS[1], unpack(buckets, i, math.min(i + 499, #buckets)))
+	for _, v in ipairs(values) do
+		if v then total = total + tonumber(v) end
+	end
+end
+return string.format('%.17g', total)
+`)
+
+// metricsRangeScript returns member, score pairs scored in a range that are in every given
+// set. It scans the set with the fewest members in range and checks the others with ZSCORE.
+// KEYS: metrics set or tag index sets; ARGV: start, end
+var metricsRangeScript = redis.NewScript(`
+local best, bestCount = nil, -1
+for _, key in ipairs(KEYS) do
+	local n = redis.call('ZCOUNT', key, ARGV[1], ARGV[2])
+	if best == nil or n < bestCount then
+		best, bestCount = key, n
+	end
+end
+if bestCount == 0 then
+	return {}
+end
+local members = redis.call('ZRANGEBYSCORE', best, ARGV[1], ARGV[2], 'WITHSCORES')
+if #KEYS == 1 then
+	return members
+end
+local result = {}
+for i = 1, #members, 2 do
+	local inAll = true
+	for _, key in ipairs(KEYS) do
+		if key ~= best and not redis.call('ZSCORE', key, members[i]) then
+			inAll = false
+			break
+		end
+	end
+	if inAll then
+		result[#result + 1] = members[i]
+		result[#result + 1] = members[i + 1]
+	end
+end
+return result
+`)
+
+func usageKey(provider, keyID, metric string) string {
+	return fmt.Sprintf("usage:%s:%s:%s", provider, keyID, metric)
+}
+
+// usageWindowKeys returns the hash of per-second deltas and the sorted set indexing its buckets
+func usageWindowKeys(provider, keyID, metric string) (string, string) {
+	base := usageKey(provider, keyID, metric)
+	return base + ":buckets", base + ":bucket_index"
+}
+
+func metricsKey(name string) string {
+	return fmt.Sprintf("metrics:%s", name)
+}
+
+// metricTagKey is the sorted set indexing the points of a metric with one tag value
+func metricTagKey(name, tag, value string) string {
+	return fmt.Sprintf("metrictag:%s:%s:%s", name, tag, value)
+}
+
+// metricTagKeys returns the tag indexes a point belongs to. Per-request tags aren't indexed.
+func metricTagKeys(name string, tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for _, k := range sortedTagKeys(tags) {
+		if !rollupExcludedTags[k] {
+			keys = append(keys, metricTagKey(name, k, tags[k]))
+		}
+	}
+	return keys
 }
 
 func NewRedisStore(addr, password string, logger zerolog.Logger) *RedisStore {
@@ -25,7 +130,7 @@ func NewRedisStore(addr, password string, logger zerolog.Logger) *RedisStore {
 }
 
 func (r *RedisStore) GetUsage(provider, keyID, metric string) (float64, error) {
-	key := fmt.Sprintf("usage:%s:%s:%s", provider, keyID, metric)
+	key := usageKey(provider, keyID, metric)
 	val, err := r.client.Get(context.Background(), key).Float64()
 	if err == redis.Nil {
 		r.logger.Debug().Str("operation", "GetUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("value", 0).Msg("store operation - key not found")
@@ -40,7 +145,7 @@ func (r *RedisStore) GetUsage(provider, keyID, metric string) (float64, error) {
 }
 
 func (r *RedisStore) SetUsage(provider, keyID, metric string, value float64) error {
-	key := fmt.Sprintf("usage:%s:%s:%s", provider, keyID, metric)
+	key := usageKey(provider, keyID, metric)
 	err := r.client.Set(context.Background(), key, value, time.Minute).Err()
 	if err != nil {
 		r.logger.Error().Err(err).Str("operation", "SetUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("value", value).Msg("store operation failed")
@@ -50,52 +155,38 @@ func (r *RedisStore) SetUsage(provider, keyID, metric string, value float64) err
 	return nil
 }
 
+// IncrementUsage updates the total and the sliding window atomically in one script
 func (r *RedisStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
-	// Store with timestamp for sliding window
-	timestampKey := fmt.Sprintf("usage:%s:%s:%s:%d", provider, keyID, metric, time.Now().Unix())
-	err := r.client.Set(context.Background(), timestampKey, delta, time.Hour).Err()
-	if err != nil {
-		r.logger.Error().Err(err).Str("operation", "IncrementUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("delta", delta).Msg("store operation failed - timestamp key")
-		return err
+	ttl := time.Duration(r.historyTTL.Load())
+	if ttl == 0 {
+		ttl = defaultRedisHistoryTTL
 	}
+	ttlSeconds := int64(ttl / time.Second)
+	now := time.Now().Unix()
+	buckets, index := usageWindowKeys(provider, keyID, metric)
 
-	// Also maintain total counter
-	totalKey := fmt.Sprintf("usage:%s:%s:%s", provider, keyID, metric)
-	err = r.client.IncrByFloat(context.Background(), totalKey, delta).Err()
+	err := incrementUsageScript.Run(context.Background(), r.client,
+		[]string{usageKey(provider, keyID, metric), buckets, index},
+		now, delta, ttlSeconds, now-ttlSeconds,
+	).Err()
 	if err != nil {
-		r.logger.Error().Err(err).Str("operation", "IncrementUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("delta", delta).Msg("store operation failed - total counter")
+		r.logger.Error().Err(err).Str("operation", "IncrementUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("delta", delta).Msg("store operation failed")
 		return err
 	}
 	r.logger.Debug().Str("operation", "IncrementUsage").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Float64("delta", delta).Msg("store operation")
 	return nil
 }
 
+// GetUsageInWindow sums the one-second buckets of the window inside Redis
 func (r *RedisStore) GetUsageInWindow(provider, keyID, metric string, windowSeconds int64) (float64, error) {
-	ctx := context.Background()
 	now := time.Now().Unix()
-	start := now - windowSeconds
+	buckets, index := usageWindowKeys(provider, keyID, metric)
 
-	// Find all timestamp keys in window
-	pattern := fmt.Sprintf("usage:%s:%s:%s:*", provider, keyID, metric)
-	keys, err := r.client.Keys(ctx, pattern).Result()
+	total, err := windowSumScript.Run(context.Background(), r.client, []string{buckets, index}, now-windowSeconds, now).Float64()
 	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "GetUsageInWindow").Str("provider", provider).Str("keyID", keyID).Str("metric", metric).Int64("windowSeconds", windowSeconds).Msg("store operation failed")
 		return 0, err
 	}
-
-	total := 0.0
-	for _, key := range keys {
-		// Extract timestamp from key
-		var timestamp int64
-		fmt.Sscanf(key, fmt.Sprintf("usage:%s:%s:%s:%%d", provider, keyID, metric), &timestamp)
-
-		if timestamp >= start && timestamp <= now {
-			val, err := r.client.Get(ctx, key).Float64()
-			if err == nil {
-				total += val
-			}
-		}
-	}
-
 	return total, nil
 }
 
@@ -113,9 +204,9 @@ func (r *RedisStore) GetCache(key string) (string, error) {
 	return val, err
 }
 
+// StoreMetric adds the point to the metric's sorted set and to one index set per tag value
 func (r *RedisStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
 	ctx := context.Background()
-	key := fmt.Sprintf("metrics:%s", name)
 
 	// Store metric point with tags as JSON
 	point := MetricPoint{
@@ -130,49 +221,190 @@ func (r *RedisStore) StoreMetric(name string, value float64, tags map[string]str
 	}
 
 	// Store as sorted set with timestamp as score, JSON as member
-	return r.client.ZAdd(ctx, key, &redis.Z{
-		Score:  float64(timestamp),
-		Member: string(pointJSON),
-	}).Err()
+	member := &redis.Z{Score: float64(timestamp), Member: string(pointJSON)}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, metricsKey(name), member)
+		for _, key := range metricTagKeys(name, tags) {
+			pipe.ZAdd(ctx, key, member)
+		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "StoreMetric").Str("name", name).Msg("store operation failed")
+		return err
+	}
+	return nil
 }
 
+// GetMetrics intersects the tag indexes inside Redis, so only matching points are returned
 func (r *RedisStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
-	ctx := context.Background()
-	key := fmt.Sprintf("metrics:%s", name)
-	results, err := r.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
-		Min: fmt.Sprintf("%d", start),
-		Max: fmt.Sprintf("%d", end),
-	}).Result()
+	keys := metricTagKeys(name, tags)
+	if len(keys) == 0 {
+		keys = []string{metricsKey(name)}
+	}
+	pairs, err := metricsRangeScript.Run(context.Background(), r.client, keys, start, end).StringSlice()
 	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "GetMetrics").Str("name", name).Msg("store operation failed")
 		return nil, err
 	}
 
-	var points []MetricPoint
-	for _, z := range results {
+	points := make([]MetricPoint, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		member := pairs[i]
 		var point MetricPoint
-		if err := json.Unmarshal([]byte(z.Member.(string)), &point); err != nil {
+		if err := json.Unmarshal([]byte(member), &point); err != nil {
 			// Fallback for old format (just value)
 			var value float64
-			fmt.Sscanf(z.Member.(string), "%f", &value)
-			point = MetricPoint{
-				Value:     value,
-				Timestamp: int64(z.Score),
-				Tags:      make(map[string]string),
+			fmt.Sscanf(member, "%f", &value)
+			score, _ := strconv.ParseFloat(pairs[i+1], 64)
+			point = MetricPoint{Value: value, Timestamp: int64(score)}
+		}
+		if point.Tags == nil {
+			point.Tags = make(map[string]string)
+		}
+
+		// Tags that aren't indexed, such as request_id, are checked here
+		if matchTags(point.Tags, tags) {
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// QueryTimeSeries range-scans the metric's sorted set and buckets the points
+func (r *RedisStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	points, err := r.GetMetrics(q.Name, q.Tags, q.Start, q.End)
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "QueryTimeSeries").Str("name", q.Name).Str("agg", q.Agg).Msg("store operation failed")
+		return nil, err
+	}
+	return AggregatePoints(points, q), nil
+}
+
+// ApplyRetention sets the expiry of new usage history keys; cache keys already expire natively
+func (r *RedisStore) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	// Redis keeps everything in memory, so history always expires
+	ttl := policy.UsageHistory
+	if ttl <= 0 {
+		ttl = DefaultUsageHistoryRetention
+	}
+	r.historyTTL.Store(int64(ttl))
+	return nil
+}
+
+// Compact rolls up the members of each metrics sorted set that passed their retention,
+// keeping the tag indexes in step
+func (r *RedisStore) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	started := time.Now()
+	result := &CompactionResult{}
+
+	iter := r.client.Scan(ctx, 0, "metrics:*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		var err error
+		var n int64
+		if cutoff := policy.rawCutoff(now); cutoff > 0 {
+			if n, err = r.rollupKey(ctx, key, ResolutionRaw, ResolutionHourly, cutoff); err != nil {
+				return nil, err
 			}
+			result.RawRolledUp += n
+		}
+		if cutoff := policy.hourlyCutoff(now); cutoff > 0 {
+			if n, err = r.rollupKey(ctx, key, ResolutionHourly, ResolutionDaily, cutoff); err != nil {
+				return nil, err
+			}
+			result.HourlyRolledUp += n
+		}
+		if cutoff := policy.dailyCutoff(now); cutoff > 0 {
+			if n, err = r.rollupKey(ctx, key, ResolutionDaily, 0, cutoff); err != nil {
+				return nil, err
+			}
+			result.DailyDeleted += n
+		}
+	}
+	if err := iter.Err(); err != nil {
+		r.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+		return nil, err
+	}
+
+	result.DurationMS = time.Since(started).Milliseconds()
+	return result, nil
+}
+
+// rollupKey replaces members of one resolution scored before cutoff with rollups of the
+// next resolution, or just removes them when to is 0
+func (r *RedisStore) rollupKey(ctx context.Context, key string, from, to, cutoff int64) (int64, error) {
+	members, err := r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("(%d", cutoff),
+	}).Result()
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "Compact").Str("key", key).Msg("store operation failed")
+		return 0, err
+	}
+
+	var expired []interface{}
+	var points []MetricPoint
+	for _, member := range members {
+		var point MetricPoint
+		if err := json.Unmarshal([]byte(member), &point); err != nil || point.Resolution != from {
+			continue
 		}
+		expired = append(expired, member)
+		points = append(points, point)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
 
-		// Filter by tags if specified
-		match := true
-		for k, v := range tags {
-			if point.Tags[k] != v {
-				match = false
-				break
+	name := strings.TrimPrefix(key, "metrics:")
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if to > 0 {
+			for _, rollup := range RollupPoints(points, to) {
+				rollupJSON, err := json.Marshal(rollup)
+				if err != nil {
+					return err
+				}
+				member := &redis.Z{Score: float64(rollup.Timestamp), Member: string(rollupJSON)}
+				pipe.ZAdd(ctx, key, member)
+				for _, indexKey := range metricTagKeys(name, rollup.Tags) {
+					pipe.ZAdd(ctx, indexKey, member)
+				}
+			}
+		}
+		pipe.ZRem(ctx, key, expired...)
+		for i, point := range points {
+			for _, indexKey := range metricTagKeys(name, point.Tags) {
+				pipe.ZRem(ctx, indexKey, expired[i])
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "Compact").Str("key", key).Msg("store operation failed")
+		return 0, err
+	}
+	return int64(len(expired)), nil
+}
 
-		if match {
-			points = append(points, point)
+// StorageStats reports the number of keys and the memory used by the Redis database
+func (r *RedisStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	keys, err := r.client.DBSize(ctx).Result()
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "StorageStats").Msg("store operation failed")
+		return nil, err
+	}
+	stats := &StorageStats{Backend: "redis", Tables: []TableStats{{Name: "keys", Rows: keys}}}
+
+	info, err := r.client.Info(ctx, "memory").Result()
+	if err != nil {
+		r.logger.Error().Err(err).Str("operation", "StorageStats").Msg("store operation failed")
+		return nil, err
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "used_memory:"); ok {
+			stats.TotalBytes, _ = strconv.ParseInt(v, 10, 64)
 		}
 	}
-	return points, nil
+	return stats, nil
 }
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/config"
+)
+
+// Resolutions of stored metric points
+const (
+	ResolutionRaw    int64 = 0
+	ResolutionHourly int64 = 3600
+	ResolutionDaily  int64 = 86400
+)
+
+// ResolutionName returns the name used for a resolution in storage stats
+func ResolutionName(resolution int64) string {
+	switch resolution {
+	case ResolutionRaw:
+		return "raw"
+	case ResolutionHourly:
+		return "hourly"
+	case ResolutionDaily:
+		return "daily"
+	}
+	return strconv.FormatInt(resolution, 10) + "s"
+}
+
+// ErrNotSupported is returned by optional store operations the backend doesn't implement
+var ErrNotSupported = errors.New("operation not supported by this store")
+
+// RetentionPolicy controls how long each kind of data is kept. Zero keeps data forever.
+type RetentionPolicy struct {
+	UsageHistory  time.Duration // Raw usage_history rows used for sliding windows
+	MetricsRaw    time.Duration // Raw metric points before they are rolled up hourly
+	MetricsHourly time.Duration // Hourly rollups before they are rolled up daily
+	MetricsDaily  time.Duration // Daily rollups before they are deleted
+}
+
+// Default retention periods
+const (
+	DefaultUsageHistoryRetention  = 7 * 24 * time.Hour
+	DefaultMetricsRawRetention    = 2 * 24 * time.Hour
+	DefaultMetricsHourlyRetention = 30 * 24 * time.Hour
+	DefaultMetricsDailyRetention  = 365 * 24 * time.Hour
+	DefaultCompactionInterval     = time.Hour
+)
+
+// NewRetentionPolicy builds a policy from config, filling unset periods with defaults
+func NewRetentionPolicy(cfg config.RetentionConfig) RetentionPolicy {
+	pick := func(v, def time.Duration) time.Duration {
+		if v < 0 {
+			return 0 // Negative disables expiry
+		}
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	return RetentionPolicy{
+		UsageHistory:  pick(cfg.UsageHistory, DefaultUsageHistoryRetention),
+		MetricsRaw:    pick(cfg.MetricsRaw, DefaultMetricsRawRetention),
+		MetricsHourly: pick(cfg.MetricsHourly, DefaultMetricsHourlyRetention),
+		MetricsDaily:  pick(cfg.MetricsDaily, DefaultMetricsDailyRetention),
+	}
+}
+
+// rawCutoff returns the hour-aligned time before which raw points are rolled up, or 0 when kept forever
+func (p RetentionPolicy) rawCutoff(now time.Time) int64 {
+	if p.MetricsRaw <= 0 {
+		return 0
+	}
+	return bucketStart(now.Add(-p.MetricsRaw).Unix(), ResolutionHourly)
+}
+
+// hourlyCutoff returns the day-aligned time before which hourly rollups are rolled up daily
+func (p RetentionPolicy) hourlyCutoff(now time.Time) int64 {
+	if p.MetricsHourly <= 0 {
+		return 0
+	}
+	return bucketStart(now.Add(-p.MetricsHourly).Unix(), ResolutionDaily)
+}
+
+// dailyCutoff returns the time before which daily rollups are deleted
+func (p RetentionPolicy) dailyCutoff(now time.Time) int64 {
+	if p.MetricsDaily <= 0 {
+		return 0
+	}
+	return bucketStart(now.Add(-p.MetricsDaily).Unix(), ResolutionDaily)
+}
+
+// CompactionResult summarizes one compaction run
+type CompactionResult struct {
+	UsageHistoryDeleted int64 `json:"usage_history_deleted"`
+	RawRolledUp         int64 `json:"raw_rolled_up"`
+	HourlyRolledUp      int64 `json:"hourly_rolled_up"`
+	DailyDeleted        int64 `json:"daily_deleted"`
+	CacheDeleted        int64 `json:"cache_deleted"`
+	DurationMS          int64 `json:"duration_ms"`
+}
+
+// Compactor is implemented by runtime stores that can roll up and expire old data
+type Compactor interface {
+	Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error)
+}
+
+// RetentionApplier is implemented by stores that enforce retention natively (TTL indexes, key expiry)
+type RetentionApplier interface {
+	ApplyRetention(ctx context.Context, policy RetentionPolicy) error
+}
+
+// TableStats describes the size of one table or collection
+type TableStats struct {
+	Name            string `json:"name"`
+	Rows            int64  `json:"rows"`
+	Bytes           int64  `json:"bytes,omitempty"`
+	OldestTimestamp int64  `json:"oldest_timestamp,omitempty"`
+	// Rows per metric resolution ("raw", "hourly", "daily")
+	Partitions map[string]int64 `json:"partitions,omitempty"`
+}
+
+// StorageStats describes the storage used by a runtime store
+type StorageStats struct {
+	Backend    string       `json:"backend"`
+	TotalBytes int64        `json:"total_bytes,omitempty"`
+	Tables     []TableStats `json:"tables"`
+}
+
+// StorageStatsProvider is implemented by runtime stores that can report their size
+type StorageStatsProvider interface {
+	StorageStats(ctx context.Context) (*StorageStats, error)
+}
+
+// Samples returns the number of raw points a metric point represents
+func (p MetricPoint) Samples() int64 {
+	if p.Count > 1 {
+		return p.Count
+	}
+	return 1
+}
+
+// Mean returns the average raw value represented by the point
+func (p MetricPoint) Mean() float64 {
+	return p.Value / float64(p.Samples())
+}
+
+// rollupExcludedTags are per-request tags dropped when points are rolled up
+var rollupExcludedTags = map[string]bool{"request_id": true}
+
+// rollupTags copies tags without per-request values
+func rollupTags(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if !rollupExcludedTags[k] {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// RollupPoints buckets points into rollups of the given resolution. The value of a
+// rollup is the sum of the values it covers and Count the number of raw points.
+func RollupPoints(points []MetricPoint, resolution int64) []MetricPoint {
+	groups := make(map[string]*MetricPoint)
+	var order []string
+	for _, p := range points {
+		tags := rollupTags(p.Tags)
+		b := bucketStart(p.Timestamp, resolution)
+		key := rollupKey(b, tags)
+		g, ok := groups[key]
+		if !ok {
+			g = &MetricPoint{Timestamp: b, Tags: tags, Resolution: resolution}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.Value += p.Value
+		g.Count += p.Samples()
+	}
+
+	result := make([]MetricPoint, 0, len(order))
+	for _, key := range order {
+		result = append(result, *groups[key])
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result
+}
+
+func rollupKey(bucket int64, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(strconv.FormatInt(bucket, 10))
+	for _, k := range sortedTagKeys(tags) {
+		b.WriteString("\x00")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// StartCompactor applies native retention and runs compaction every interval until ctx is done
+func StartCompactor(ctx context.Context, s RuntimeStore, policy RetentionPolicy, interval time.Duration, logger zerolog.Logger) {
+	if applier, ok := s.(RetentionApplier); ok {
+		if err := applier.ApplyRetention(ctx, policy); err != nil {
+			logger.Warn().Err(err).Msg("failed to apply native retention")
+		}
+	}
+	compactor, ok := s.(Compactor)
+	if !ok {
+		logger.Debug().Msg("runtime store does not support compaction")
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultCompactionInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			result, err := compactor.Compact(ctx, policy, time.Now())
+			if err != nil {
+				logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+			} else {
+				logger.Info().
+					Int64("usage_history_deleted", result.UsageHistoryDeleted).
+					Int64("raw_rolled_up", result.RawRolledUp).
+					Int64("hourly_rolled_up", result.HourlyRolledUp).
+					Int64("daily_deleted", result.DailyDeleted).
+					Int64("cache_deleted", result.CacheDeleted).
+					Int64("duration_ms", result.DurationMS).
+					Msg("storage compaction finished")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Compact delegates to the runtime store when it supports compaction
+func (w *StoreProviderWrapper) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	if c, ok := w.RuntimeStore.(Compactor); ok {
+		return c.Compact(ctx, policy, now)
+	}
+	return nil, ErrNotSupported
+}
+
+// ApplyRetention delegates to the runtime store when it enforces retention natively
+func (w *StoreProviderWrapper) ApplyRetention(ctx context.Context, policy RetentionPolicy) error {
+	if a, ok := w.RuntimeStore.(RetentionApplier); ok {
+		return a.ApplyRetention(ctx, policy)
+	}
+	return ErrNotSupported
+}
+
+// StorageStats delegates to the runtime store when it can report its size
+func (w *StoreProviderWrapper) StorageStats(ctx context.Context) (*StorageStats, error) {
+	if p, ok := w.RuntimeStore.(StorageStatsProvider); ok {
+		return p.StorageStats(ctx)
+	}
+	return nil, ErrNotSupported
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -14,126 +15,41 @@ import (
 )
 
 type SQLStore struct {
-	db     *sql.DB
-	logger zerolog.Logger
-	dbType string // "postgres" or "sqlite"
+	db      *sql.DB
+	logger  zerolog.Logger
+	dialect sqlDialect
 }
 
+// NewSQLStore connects to PostgreSQL or SQLite (detected from the connection string)
+// and applies pending schema migrations. It refuses to start against a schema newer
+// than this binary supports.
 func NewSQLStore(connStr string, logger zerolog.Logger) (*SQLStore, error) {
-	var db *sql.DB
-	var dbType string
-	var err error
-
-	// Detect database type from connection string
-	if strings.Contains(connStr, "sqlite") || strings.HasSuffix(connStr, ".db") || strings.HasSuffix(connStr, ".sqlite") || strings.HasPrefix(connStr, "./") || strings.HasPrefix(connStr, "/") {
-		db, err = sql.Open("sqlite3", connStr)
-		dbType = "sqlite"
-	} else {
-		db, err = sql.Open("postgres", connStr)
-		dbType = "postgres"
-	}
-
+	migrator, err := NewSQLMigrator(connStr)
 	if err != nil {
 		return nil, err
 	}
 
-	// Test connection
-	if err := db.Ping(); err != nil {
+	applied, err := migrator.Migrate(context.Background(), 0)
+	if err != nil {
+		migrator.Close()
 		return nil, err
 	}
-
-	// Create tables if not exist
-	if err := createTables(db, dbType); err != nil {
-		return nil, err
+	for _, m := range applied {
+		logger.Info().Int("version", m.Version).Str("description", m.Description).Msg("applied schema migration")
 	}
 
-	return &SQLStore{db: db, logger: logger, dbType: dbType}, nil
+	return &SQLStore{db: migrator.db, logger: logger, dialect: migrator.dialect}, nil
 }
 
 // placeholder returns the appropriate placeholder for the database type
 func (s *SQLStore) placeholder(n int) string {
-	if s.dbType == "sqlite" {
-		return "?"
-	}
-	return fmt.Sprintf("$%d", n)
-}
-
-func createTables(db *sql.DB, dbType string) error {
-
-	var queries []string
-	if dbType == "sqlite" {
-		queries = []string{
-			`CREATE TABLE IF NOT EXISTS usage_metrics (
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
-				provider TEXT NOT NULL,
-				key_id TEXT NOT NULL,
-				metric TEXT NOT NULL,
-				value REAL NOT NULL,
-				timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-				UNIQUE(provider, key_id, metric)
-			)`,
-			`CREATE TABLE IF NOT EXISTS usage_history (
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
-				provider TEXT NOT NULL,
-				key_id TEXT NOT NULL,
-				metric TEXT NOT NULL,
-				delta REAL NOT NULL,
-				timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-			)`,
-			`CREATE TABLE IF NOT EXISTS cache (
-				key TEXT PRIMARY KEY,
-				value TEXT NOT NULL,
-				expiry DATETIME
-			)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_metrics_provider_key_metric ON usage_metrics(provider, key_id, metric)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_history_timestamp ON usage_history(timestamp)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_history_provider_key_metric ON usage_history(provider, key_id, metric)`,
-			`CREATE INDEX IF NOT EXISTS idx_cache_expiry ON cache(expiry)`,
-		}
-	} else {
-		// PostgreSQL queries
-		queries = []string{
-			`CREATE TABLE IF NOT EXISTS usage_metrics (
-				id SERIAL PRIMARY KEY,
-				provider VARCHAR(50) NOT NULL,
-				key_id VARCHAR(100) NOT NULL,
-				metric VARCHAR(50) NOT NULL,
-				value DOUBLE PRECISION NOT NULL,
-				timestamp TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-				UNIQUE(provider, key_id, metric)
-			)`,
-			`CREATE TABLE IF NOT EXISTS usage_history (
-				id SERIAL PRIMARY KEY,
-				provider VARCHAR(50) NOT NULL,
-				key_id VARCHAR(100) NOT NULL,
-				metric VARCHAR(50) NOT NULL,
-				delta DOUBLE PRECISION NOT NULL,
-				timestamp TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-			)`,
-			`CREATE TABLE IF NOT EXISTS cache (
-				key VARCHAR(255) PRIMARY KEY,
-				value TEXT NOT NULL,
-				expiry TIMESTAMP WITH TIME ZONE
-			)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_metrics_provider_key_metric ON usage_metrics(provider, key_id, metric)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_history_timestamp ON usage_history(timestamp)`,
-			`CREATE INDEX IF NOT EXISTS idx_usage_history_provider_key_metric ON usage_history(provider, key_id, metric)`,
-			`CREATE INDEX IF NOT EXISTS idx_cache_expiry ON cache(expiry)`,
-		}
-	}
-
-	for _, query := range queries {
-		if _, err := db.Exec(query); err != nil {
-			return err
-		}
-	}
-	return nil
+	return s.dialect.placeholder(n)
 }
 
 func (s *SQLStore) GetUsage(provider, keyID, metric string) (float64, error) {
 	var value float64
 	var query string
-	if s.dbType == "sqlite" {
+	if s.dialect == dialectSQLite {
 		query = "SELECT value FROM usage_metrics WHERE provider = ? AND key_id = ? AND metric = ?"
 	} else {
 		query = "SELECT value FROM usage_metrics WHERE provider = $1 AND key_id = $2 AND metric = $3"
@@ -205,11 +121,63 @@ func (s *SQLStore) IncrementUsage(provider, keyID, metric string, delta float64)
 	return nil
 }
 
+// IncrementUsageBatch applies every increment in one transaction
+func (s *SQLStore) IncrementUsageBatch(items []UsageIncrement) error {
+	if len(items) == 0 {
+		return nil
+	}
+	err := s.inTx(func(tx *sql.Tx) error {
+		history, err := tx.Prepare("INSERT INTO usage_history (provider, key_id, metric, delta) VALUES ($1, $2, $3, $4)")
+		if err != nil {
+			return err
+		}
+		defer history.Close()
+		totals, err := tx.Prepare(
+			`INSERT INTO usage_metrics (provider, key_id, metric, value) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (provider, key_id, metric) DO UPDATE SET value = usage_metrics.value + EXCLUDED.value`,
+		)
+		if err != nil {
+			return err
+		}
+		defer totals.Close()
+
+		for _, item := range items {
+			if _, err := history.Exec(item.Provider, item.KeyID, item.Metric, item.Delta); err != nil {
+				return err
+			}
+			if _, err := totals.Exec(item.Provider, item.KeyID, item.Metric, item.Delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "IncrementUsageBatch").Int("items", len(items)).Msg("store operation failed")
+		return err
+	}
+	s.logger.Debug().Str("operation", "IncrementUsageBatch").Int("items", len(items)).Msg("store operation")
+	return nil
+}
+
+// inTx runs fn in a transaction and commits it when fn succeeds
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *SQLStore) GetUsageInWindow(provider, keyID, metric string, windowSeconds int64) (float64, error) {
 	var total float64
+	since := time.Now().Add(-time.Duration(windowSeconds) * time.Second)
 	err := s.db.QueryRow(
-		"SELECT COALESCE(SUM(delta), 0) FROM usage_history WHERE provider = $1 AND key_id = $2 AND metric = $3 AND timestamp > NOW() - INTERVAL '1 second' * $4",
-		provider, keyID, metric, windowSeconds,
+		"SELECT COALESCE(SUM(delta), 0) FROM usage_history WHERE provider = $1 AND key_id = $2 AND metric = $3 AND timestamp > $4",
+		provider, keyID, metric, s.dialect.timestamp(since),
 	).Scan(&total)
 
 	if err != nil {
@@ -222,7 +190,11 @@ func (s *SQLStore) GetUsageInWindow(provider, keyID, metric string, windowSecond
 }
 
 func (s *SQLStore) SetCache(key, value string, ttlSeconds int64) error {
-	expiry := time.Now().Add(time.Duration(ttlSeconds) * time.Second)
+	// Entries without a TTL never expire
+	var expiry any
+	if ttlSeconds > 0 {
+		expiry = s.dialect.timestamp(time.Now().Add(time.Duration(ttlSeconds) * time.Second))
+	}
 	_, err := s.db.Exec(
 		`INSERT INTO cache (key, value, expiry) VALUES ($1, $2, $3)
 		 ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expiry = EXCLUDED.expiry`,
@@ -238,11 +210,10 @@ func (s *SQLStore) SetCache(key, value string, ttlSeconds int64) error {
 
 func (s *SQLStore) GetCache(key string) (string, error) {
 	var value string
-	var expiry pq.NullTime
 	err := s.db.QueryRow(
-		"SELECT value, expiry FROM cache WHERE key = $1 AND (expiry IS NULL OR expiry > NOW())",
-		key,
-	).Scan(&value, &expiry)
+		"SELECT value FROM cache WHERE key = $1 AND (expiry IS NULL OR expiry > $2)",
+		key, s.dialect.timestamp(time.Now()),
+	).Scan(&value)
 
 	if err == sql.ErrNoRows {
 		s.logger.Debug().Str("operation", "GetCache").Str("key", key).Msg("store operation - cache miss")
@@ -258,20 +229,71 @@ func (s *SQLStore) GetCache(key string) (string, error) {
 }
 
 func (s *SQLStore) StoreMetric(name string, value float64, tags map[string]string, timestamp int64) error {
+	if tags == nil {
+		tags = map[string]string{}
+	}
 	tagsJSON, _ := json.Marshal(tags)
 	_, err := s.db.Exec(
-		"INSERT INTO metrics (name, value, tags, timestamp) VALUES ($1, $2, $3, $4)",
+		"INSERT INTO metrics (name, value, tags, timestamp, provider, key_id, model, client_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
 		name, value, string(tagsJSON), timestamp,
+		nullableTag(tags, "provider"), nullableTag(tags, "key"), nullableTag(tags, "model"), nullableTag(tags, "client_key"),
 	)
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "StoreMetric").Str("name", name).Msg("store operation failed")
+	}
 	return err
 }
 
+// StoreMetricBatch inserts every point in one transaction
+func (s *SQLStore) StoreMetricBatch(points []MetricWrite) error {
+	if len(points) == 0 {
+		return nil
+	}
+	err := s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT INTO metrics (name, value, tags, timestamp, provider, key_id, model, client_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, p := range points {
+			tags := p.Tags
+			if tags == nil {
+				tags = map[string]string{}
+			}
+			tagsJSON, _ := json.Marshal(tags)
+			if _, err := stmt.Exec(
+				p.Name, p.Value, string(tagsJSON), p.Timestamp,
+				nullableTag(tags, "provider"), nullableTag(tags, "key"), nullableTag(tags, "model"), nullableTag(tags, "client_key"),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "StoreMetricBatch").Int("points", len(points)).Msg("store operation failed")
+	}
+	return err
+}
+
+// nullableTag returns the tag value, or nil so missing tags are stored as NULL
+func nullableTag(tags map[string]string, key string) any {
+	if v, ok := tags[key]; ok {
+		return v
+	}
+	return nil
+}
+
 func (s *SQLStore) GetMetrics(name string, tags map[string]string, start, end int64) ([]MetricPoint, error) {
-	rows, err := s.db.Query(
-		"SELECT value, timestamp FROM metrics WHERE name = $1 AND timestamp >= $2 AND timestamp <= $3",
-		name, start, end,
-	)
+	where := fmt.Sprintf("name = %s AND timestamp >= %s AND timestamp <= %s", s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	args := []any{name, start, end}
+	tagSQL, tagArgs := s.tagFilterSQL(tags, 4)
+	args = append(args, tagArgs...)
+
+	rows, err := s.db.Query("SELECT value, timestamp, tags, sample_count, resolution FROM metrics WHERE "+where+tagSQL+" ORDER BY timestamp", args...)
 	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "GetMetrics").Str("name", name).Msg("store operation failed")
 		return nil, err
 	}
 	defer rows.Close()
@@ -279,12 +301,337 @@ func (s *SQLStore) GetMetrics(name string, tags map[string]string, start, end in
 	var points []MetricPoint
 	for rows.Next() {
 		var point MetricPoint
-		err := rows.Scan(&point.Value, &point.Timestamp)
+		var tagsJSON sql.NullString
+		var count int64
+		err := rows.Scan(&point.Value, &point.Timestamp, &tagsJSON, &count, &point.Resolution)
 		if err != nil {
 			return nil, err
 		}
+		if point.Resolution > 0 {
+			point.Count = count
+		}
 		point.Tags = make(map[string]string)
+		if tagsJSON.Valid && tagsJSON.String != "" {
+			if err := json.Unmarshal([]byte(tagsJSON.String), &point.Tags); err != nil {
+				s.logger.Warn().Err(err).Str("operation", "GetMetrics").Str("name", name).Msg("invalid metric tags")
+			}
+		}
 		points = append(points, point)
 	}
-	return points, nil
+	return points, rows.Err()
+}
+
+// tagFilterSQL builds WHERE conditions for tag filters. Well-known tags use their
+// indexed columns; other tags are matched in the JSON tags column (JSON1 on SQLite,
+// JSONB containment on PostgreSQL).
+func (s *SQLStore) tagFilterSQL(tags map[string]string, argIndex int) (string, []any) {
+	var conds []string
+	var args []any
+	jsonTags := make(map[string]string)
+	for _, k := range sortedTagKeys(tags) {
+		if column, ok := indexedTagColumns[k]; ok {
+			conds = append(conds, fmt.Sprintf("%s = %s", column, s.placeholder(argIndex)))
+			args = append(args, tags[k])
+			argIndex++
+			continue
+		}
+		if s.dialect == dialectSQLite {
+			conds = append(conds, fmt.Sprintf("json_extract(tags, %s) = %s", s.placeholder(argIndex), s.placeholder(argIndex+1)))
+			args = append(args, jsonPathForTag(k), tags[k])
+			argIndex += 2
+		} else {
+			jsonTags[k] = tags[k]
+		}
+	}
+	if len(jsonTags) > 0 {
+		data, _ := json.Marshal(jsonTags)
+		conds = append(conds, fmt.Sprintf("tags @> %s::jsonb", s.placeholder(argIndex)))
+		args = append(args, string(data))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+// QueryTimeSeries aggregates metrics with GROUP BY on aligned time buckets
+func (s *SQLStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	bucket := fmt.Sprintf("((timestamp / %d) * %d)", q.Interval, q.Interval)
+	where := fmt.Sprintf("name = %s AND timestamp >= %s AND timestamp <= %s", s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	args := []any{q.Name, q.Start, q.End}
+	tagSQL, tagArgs := s.tagFilterSQL(q.Tags, 4)
+	where += tagSQL
+	args = append(args, tagArgs...)
+
+	if p := percentileOf(q.Agg); p > 0 {
+		// SQLite has no percentile aggregate and Postgres' percentile_disc can't weigh
+		// rolled-up rows by sample_count: filter and order in SQL, rank in Go
+		return s.queryPercentileSeries(q, bucket, where, args, p)
+	}
+
+	// Rolled-up rows hold the sum of sample_count raw values
+	var aggExpr string
+	switch q.Agg {
+	case AggSum:
+		aggExpr = "SUM(value)"
+	case AggAvg:
+		aggExpr = "SUM(value) / SUM(sample_count)"
+	case AggCount:
+		aggExpr = "SUM(sample_count)"
+	case AggMin:
+		aggExpr = "MIN(value / sample_count)"
+	case AggMax:
+		aggExpr = "MAX(value / sample_count)"
+	default:
+		return nil, fmt.Errorf("unsupported aggregation: %s", q.Agg)
+	}
+
+	query := fmt.Sprintf("SELECT %s AS bucket, %s FROM metrics WHERE %s GROUP BY bucket ORDER BY bucket", bucket, aggExpr, where)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "QueryTimeSeries").Str("name", q.Name).Str("agg", q.Agg).Msg("store operation failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []TimeSeriesPoint{}
+	for rows.Next() {
+		point := TimeSeriesPoint{Metric: q.Name}
+		if err := rows.Scan(&point.Timestamp, &point.Value); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+func (s *SQLStore) queryPercentileSeries(q TimeSeriesQuery, bucket, where string, args []any, p float64) ([]TimeSeriesPoint, error) {
+	query := fmt.Sprintf("SELECT %s AS bucket, value, sample_count FROM metrics WHERE %s ORDER BY bucket, value / sample_count", bucket, where)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "QueryTimeSeries").Str("name", q.Name).Str("agg", q.Agg).Msg("store operation failed")
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []TimeSeriesPoint{}
+	var values []MetricPoint
+	var samples int64
+	current := int64(0)
+	flush := func() {
+		if len(values) > 0 {
+			points = append(points, TimeSeriesPoint{Timestamp: current, Value: weightedNearestRank(values, samples, p), Metric: q.Name})
+		}
+		values = values[:0]
+		samples = 0
+	}
+	for rows.Next() {
+		var b int64
+		var point MetricPoint
+		if err := rows.Scan(&b, &point.Value, &point.Count); err != nil {
+			return nil, err
+		}
+		if b != current {
+			flush()
+			current = b
+		}
+		values = append(values, point)
+		samples += point.Samples()
+	}
+	flush()
+	return points, rows.Err()
+}
+
+// rollupTagsSQL returns the expression for tags with per-request values removed
+func (s *SQLStore) rollupTagsSQL() string {
+	if s.dialect == dialectSQLite {
+		return "CASE WHEN json_valid(tags) THEN json_remove(tags, '$.request_id') ELSE tags END"
+	}
+	return "tags - 'request_id'"
+}
+
+// Compact rolls raw metrics up hourly and hourly rollups up daily once they pass their
+// retention, deletes expired daily rollups, usage history and cache entries
+func (s *SQLStore) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) (*CompactionResult, error) {
+	started := time.Now()
+	result := &CompactionResult{}
+
+	var err error
+	if cutoff := policy.rawCutoff(now); cutoff > 0 {
+		if result.RawRolledUp, err = s.rollupMetrics(ctx, ResolutionRaw, ResolutionHourly, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if cutoff := policy.hourlyCutoff(now); cutoff > 0 {
+		if result.HourlyRolledUp, err = s.rollupMetrics(ctx, ResolutionHourly, ResolutionDaily, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if cutoff := policy.dailyCutoff(now); cutoff > 0 {
+		if result.DailyDeleted, err = s.execCount(ctx, "DELETE FROM metrics WHERE resolution = $1 AND timestamp < $2", ResolutionDaily, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if policy.UsageHistory > 0 {
+		cutoff := s.dialect.timestamp(now.Add(-policy.UsageHistory))
+		if result.UsageHistoryDeleted, err = s.execCount(ctx, "DELETE FROM usage_history WHERE timestamp < $1", cutoff); err != nil {
+			return nil, err
+		}
+	}
+	if result.CacheDeleted, err = s.execCount(ctx, "DELETE FROM cache WHERE expiry IS NOT NULL AND expiry < $1", s.dialect.timestamp(time.Now())); err != nil {
+		return nil, err
+	}
+
+	result.DurationMS = time.Since(started).Milliseconds()
+	s.logger.Debug().Str("operation", "Compact").Int64("raw_rolled_up", result.RawRolledUp).Int64("hourly_rolled_up", result.HourlyRolledUp).Msg("store operation")
+	return result, nil
+}
+
+// rollupMetrics replaces points of one resolution older than cutoff with rollups of the
+// next, one day at a time so that each transaction stays short
+func (s *SQLStore) rollupMetrics(ctx context.Context, from, to, cutoff int64) (int64, error) {
+	var oldest sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM metrics WHERE resolution = $1 AND timestamp < $2", from, cutoff).Scan(&oldest); err != nil {
+		s.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+		return 0, err
+	}
+	if !oldest.Valid {
+		return 0, nil
+	}
+
+	tags := s.rollupTagsSQL()
+	bucket := fmt.Sprintf("(timestamp / %d) * %d", to, to)
+	insert := fmt.Sprintf(`INSERT INTO metrics (name, value, tags, timestamp, provider, key_id, model, client_key, sample_count, resolution)
+		SELECT name, SUM(value), %[1]s, %[2]s, provider, key_id, model, client_key, SUM(sample_count), %[3]d
+		FROM metrics WHERE resolution = $1 AND timestamp >= $2 AND timestamp < $3
+		GROUP BY name, %[1]s, %[2]s, provider, key_id, model, client_key`, tags, bucket, to)
+
+	var total int64
+	for start := bucketStart(oldest.Int64, ResolutionDaily); start < cutoff; start += ResolutionDaily {
+		end := start + ResolutionDaily
+		if end > cutoff {
+			end = cutoff
+		}
+		n, err := s.rollupWindow(ctx, insert, from, start, end)
+		if err != nil {
+			s.logger.Error().Err(err).Str("operation", "Compact").Int64("resolution", from).Int64("start", start).Msg("store operation failed")
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *SQLStore) rollupWindow(ctx context.Context, insert string, resolution, start, end int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, insert, resolution, start, end); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM metrics WHERE resolution = $1 AND timestamp >= $2 AND timestamp < $3", resolution, start, end)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (s *SQLStore) execCount(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Str("operation", "Compact").Msg("store operation failed")
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StorageStats reports row counts, sizes and the oldest data per table
+func (s *SQLStore) StorageStats(ctx context.Context) (*StorageStats, error) {
+	stats := &StorageStats{Backend: string(s.dialect)}
+	if s.dialect == dialectSQLite {
+		if err := s.db.QueryRowContext(ctx, "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&stats.TotalBytes); err != nil {
+			s.logger.Error().Err(err).Str("operation", "StorageStats").Msg("store operation failed")
+			return nil, err
+		}
+	} else {
+		if err := s.db.QueryRowContext(ctx, "SELECT pg_database_size(current_database())").Scan(&stats.TotalBytes); err != nil {
+			s.logger.Error().Err(err).Str("operation", "StorageStats").Msg("store operation failed")
+			return nil, err
+		}
+	}
+
+	for _, table := range []string{"usage_metrics", "usage_history", "cache", "metrics"} {
+		t := TableStats{Name: table}
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&t.Rows); err != nil {
+			s.logger.Error().Err(err).Str("operation", "StorageStats").Str("table", table).Msg("store operation failed")
+			return nil, err
+		}
+		if s.dialect == dialectPostgres {
+			if err := s.db.QueryRowContext(ctx, "SELECT pg_total_relation_size($1)", table).Scan(&t.Bytes); err != nil {
+				s.logger.Error().Err(err).Str("operation", "StorageStats").Str("table", table).Msg("store operation failed")
+				return nil, err
+			}
+		}
+		switch table {
+		case "metrics":
+			var oldest sql.NullInt64
+			if err := s.db.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM metrics").Scan(&oldest); err != nil {
+				return nil, err
+			}
+			t.OldestTimestamp = oldest.Int64
+			partitions, err := s.metricsByResolution(ctx)
+			if err != nil {
+				return nil, err
+			}
+			t.Partitions = partitions
+		case "usage_history":
+			oldest, err := s.oldestHistory(ctx)
+			if err != nil {
+				return nil, err
+			}
+			t.OldestTimestamp = oldest
+		}
+		stats.Tables = append(stats.Tables, t)
+	}
+	return stats, nil
+}
+
+func (s *SQLStore) metricsByResolution(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT resolution, COUNT(*) FROM metrics GROUP BY resolution")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	partitions := make(map[string]int64)
+	for rows.Next() {
+		var resolution, count int64
+		if err := rows.Scan(&resolution, &count); err != nil {
+			return nil, err
+		}
+		partitions[ResolutionName(resolution)] = count
+	}
+	return partitions, rows.Err()
+}
+
+func (s *SQLStore) oldestHistory(ctx context.Context) (int64, error) {
+	if s.dialect == dialectSQLite {
+		var oldest sql.NullInt64
+		err := s.db.QueryRowContext(ctx, "SELECT CAST(strftime('%s', MIN(timestamp)) AS INTEGER) FROM usage_history").Scan(&oldest)
+		return oldest.Int64, err
+	}
+	var oldest pq.NullTime
+	if err := s.db.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM usage_history").Scan(&oldest); err != nil {
+		return 0, err
+	}
+	if !oldest.Valid {
+		return 0, nil
+	}
+	return oldest.Time.Unix(), nil
 }
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlDialect captures the differences between the SQL databases SQLStore supports
+type sqlDialect string
+
+const (
+	dialectSQLite   sqlDialect = "sqlite"
+	dialectPostgres sqlDialect = "postgres"
+)
+
+// sqliteTimeFormat matches the format of CURRENT_TIMESTAMP so DATETIME columns compare as text
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// detectDialect picks the dialect from a connection string: file paths and sqlite DSNs are SQLite
+func detectDialect(connStr string) sqlDialect {
+	if strings.Contains(connStr, "sqlite") || strings.HasSuffix(connStr, ".db") || strings.HasSuffix(connStr, ".sqlite") || strings.HasPrefix(connStr, "./") || strings.HasPrefix(connStr, "/") {
+		return dialectSQLite
+	}
+	return dialectPostgres
+}
+
+// driver returns the database/sql driver name
+func (d sqlDialect) driver() string {
+	if d == dialectSQLite {
+		return "sqlite3"
+	}
+	return "postgres"
+}
+
+// placeholder returns the bind parameter for the nth (1-based) argument
+func (d sqlDialect) placeholder(n int) string {
+	if d == dialectSQLite {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// rebind rewrites ? placeholders for the dialect
+func (d sqlDialect) rebind(query string) string {
+	if d == dialectSQLite {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// timestamp converts a time into a parameter comparable with DATETIME/TIMESTAMPTZ columns.
+// SQLite stores UTC text in the CURRENT_TIMESTAMP format, so NOW()-style arithmetic is done in Go.
+func (d sqlDialect) timestamp(t time.Time) any {
+	if d == dialectSQLite {
+		return t.UTC().Format(sqliteTimeFormat)
+	}
+	return t
+}
@@ -0,0 +1,382 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version of coo-llm
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating, so that
+// instances starting together don't apply the same migration twice
+const migrationLockID = 7243001
+
+// sqlMigration is one ordered schema change. Migrations run in a transaction
+// together with their schema_version row.
+type sqlMigration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, tx *sql.Tx, d sqlDialect) error
+}
+
+// SQLMigrationInfo describes a schema migration
+type SQLMigrationInfo struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// sqlMigrations must only ever be appended to. Migrations 1-3 are idempotent so
+// that databases created before versioning was introduced upgrade cleanly.
+var sqlMigrations = []sqlMigration{
+	{Version: 1, Description: "create usage, history, cache and metrics tables", Up: migrateBaseTables},
+	{Version: 2, Description: "promote metric tags to indexed columns", Up: migrateMetricsTags},
+	{Version: 3, Description: "add metric rollup columns", Up: migrateMetricsRollups},
+	{Version: 4, Description: "store SQLite timestamps as UTC text", Up: migrateSQLiteTimestamps},
+}
+
+// LatestSchemaVersion returns the schema version this binary migrates to
+func LatestSchemaVersion() int {
+	return sqlMigrations[len(sqlMigrations)-1].Version
+}
+
+// SQLMigrator applies versioned schema migrations to a SQL runtime store
+type SQLMigrator struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// NewSQLMigrator opens the database behind a SQL runtime store connection string
+func NewSQLMigrator(connStr string) (*SQLMigrator, error) {
+	dialect := detectDialect(connStr)
+	db, err := sql.Open(dialect.driver(), connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLMigrator{db: db, dialect: dialect}, nil
+}
+
+// Close closes the database
+func (m *SQLMigrator) Close() error {
+	return m.db.Close()
+}
+
+// Version returns the current schema version, 0 for an unversioned database
+func (m *SQLMigrator) Version(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, m.db)
+}
+
+// Pending returns the migrations not yet applied
+func (m *SQLMigrator) Pending(ctx context.Context) ([]SQLMigrationInfo, error) {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+	var pending []SQLMigrationInfo
+	for _, migration := range sqlMigrations {
+		if migration.Version > current {
+			pending = append(pending, SQLMigrationInfo{Version: migration.Version, Description: migration.Description})
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies pending migrations up to target (0 for the latest) and returns those applied
+func (m *SQLMigrator) Migrate(ctx context.Context, target int) ([]SQLMigrationInfo, error) {
+	if target <= 0 {
+		target = LatestSchemaVersion()
+	}
+	if target > LatestSchemaVersion() {
+		return nil, fmt.Errorf("unknown schema version %d, latest is %d", target, LatestSchemaVersion())
+	}
+
+	// Pin one connection so the advisory lock and migrations share a session
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if m.dialect == dialectPostgres {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return nil, fmt.Errorf("acquire migration lock: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	createVersionTable := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := conn.ExecContext(ctx, createVersionTable); err != nil {
+		return nil, fmt.Errorf("create schema_version: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	var applied []SQLMigrationInfo
+	for _, migration := range sqlMigrations {
+		if migration.Version <= current || migration.Version > target {
+			continue
+		}
+		if err := m.apply(ctx, conn, migration); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		applied = append(applied, SQLMigrationInfo{Version: migration.Version, Description: migration.Description})
+	}
+	return applied, nil
+}
+
+func (m *SQLMigrator) apply(ctx context.Context, conn *sql.Conn, migration sqlMigration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := migration.Up(ctx, tx, m.dialect); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.dialect.rebind("INSERT INTO schema_version (version, description) VALUES (?, ?)"), migration.Version, migration.Description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion reads the highest applied version; a missing table means version 0
+func schemaVersion(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		if isMissingTable(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// isMissingTable reports whether err is a "no such table" error from either driver
+func isMissingTable(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "no such table") || strings.Contains(msg, "does not exist")
+}
+
+// migrateBaseTables creates the original tables. Columns added later live in their own migrations.
+func migrateBaseTables(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+	var queries []string
+	if d == dialectSQLite {
+		queries = []string{
+			`CREATE TABLE IF NOT EXISTS usage_metrics (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				provider TEXT NOT NULL,
+				key_id TEXT NOT NULL,
+				metric TEXT NOT NULL,
+				value REAL NOT NULL,
+				timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE(provider, key_id, metric)
+			)`,
+			`CREATE TABLE IF NOT EXISTS usage_history (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				provider TEXT NOT NULL,
+				key_id TEXT NOT NULL,
+				metric TEXT NOT NULL,
+				delta REAL NOT NULL,
+				timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS cache (
+				key TEXT PRIMARY KEY,
+				value TEXT NOT NULL,
+				expiry DATETIME
+			)`,
+			`CREATE TABLE IF NOT EXISTS metrics (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				value REAL NOT NULL,
+				tags TEXT,
+				timestamp INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_metrics_provider_key_metric ON usage_metrics(provider, key_id, metric)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_history_timestamp ON usage_history(timestamp)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_history_provider_key_metric ON usage_history(provider, key_id, metric)`,
+			`CREATE INDEX IF NOT EXISTS idx_cache_expiry ON cache(expiry)`,
+			`CREATE INDEX IF NOT EXISTS idx_metrics_name_timestamp ON metrics(name, timestamp)`,
+		}
+	} else {
+		// PostgreSQL queries
+		queries = []string{
+			`CREATE TABLE IF NOT EXISTS usage_metrics (
+				id SERIAL PRIMARY KEY,
+				provider VARCHAR(50) NOT NULL,
+				key_id VARCHAR(100) NOT NULL,
+				metric VARCHAR(50) NOT NULL,
+				value DOUBLE PRECISION NOT NULL,
+				timestamp TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+				UNIQUE(provider, key_id, metric)
+			)`,
+			`CREATE TABLE IF NOT EXISTS usage_history (
+				id SERIAL PRIMARY KEY,
+				provider VARCHAR(50) NOT NULL,
+				key_id VARCHAR(100) NOT NULL,
+				metric VARCHAR(50) NOT NULL,
+				delta DOUBLE PRECISION NOT NULL,
+				timestamp TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+			)`,
+			`CREATE TABLE IF NOT EXISTS cache (
+				key VARCHAR(255) PRIMARY KEY,
+				value TEXT NOT NULL,
+				expiry TIMESTAMP WITH TIME ZONE
+			)`,
+			`CREATE TABLE IF NOT EXISTS metrics (
+				id BIGSERIAL PRIMARY KEY,
+				name VARCHAR(100) NOT NULL,
+				value DOUBLE PRECISION NOT NULL,
+				tags JSONB,
+				timestamp BIGINT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_metrics_provider_key_metric ON usage_metrics(provider, key_id, metric)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_history_timestamp ON usage_history(timestamp)`,
+			`CREATE INDEX IF NOT EXISTS idx_usage_history_provider_key_metric ON usage_history(provider, key_id, metric)`,
+			`CREATE INDEX IF NOT EXISTS idx_cache_expiry ON cache(expiry)`,
+			`CREATE INDEX IF NOT EXISTS idx_metrics_name_timestamp ON metrics(name, timestamp)`,
+		}
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedTagColumns maps well-known metric tags to dedicated indexed columns
+var indexedTagColumns = map[string]string{
+	"provider":   "provider",
+	"key":        "key_id",
+	"model":      "model",
+	"client_key": "client_key",
+}
+
+// sqliteColumns returns the column names of a SQLite table
+func sqliteColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info('"+table+"')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	return existing, rows.Err()
+}
+
+// migrateMetricsTags upgrades metrics tables created before tags were indexed:
+// it adds the tag columns, backfills them from the JSON tags and creates the indexes
+func migrateMetricsTags(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+	existing := make(map[string]bool)
+	if d == dialectSQLite {
+		var err error
+		if existing, err = sqliteColumns(ctx, tx, "metrics"); err != nil {
+			return err
+		}
+	}
+
+	var queries []string
+	for _, tag := range sortedTagKeys(indexedTagColumns) {
+		column := indexedTagColumns[tag]
+		if d == dialectSQLite {
+			if !existing[column] {
+				queries = append(queries, fmt.Sprintf("ALTER TABLE metrics ADD COLUMN %s TEXT", column))
+			}
+			queries = append(queries, fmt.Sprintf("UPDATE metrics SET %s = json_extract(tags, '%s') WHERE %s IS NULL AND json_valid(tags)", column, jsonPathForTag(tag), column))
+		} else {
+			queries = append(queries,
+				fmt.Sprintf("ALTER TABLE metrics ADD COLUMN IF NOT EXISTS %s VARCHAR(255)", column),
+				fmt.Sprintf("UPDATE metrics SET %s = tags ->> '%s' WHERE %s IS NULL AND tags IS NOT NULL", column, tag, column),
+			)
+		}
+		queries = append(queries, fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_metrics_%s ON metrics(name, %s, timestamp)", column, column))
+	}
+	if d != dialectSQLite {
+		// Tables created with a TEXT tags column are converted to JSONB for containment queries
+		queries = append([]string{
+			`DO $$ BEGIN
+				IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'metrics' AND column_name = 'tags') = 'text' THEN
+					ALTER TABLE metrics ALTER COLUMN tags TYPE JSONB USING tags::jsonb;
+				END IF;
+			END $$`,
+		}, queries...)
+		queries = append(queries, "CREATE INDEX IF NOT EXISTS idx_metrics_tags ON metrics USING GIN (tags)")
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("migrate metrics tags: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateMetricsRollups adds the columns that let rolled-up points share the metrics table
+func migrateMetricsRollups(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+	var queries []string
+	if d == dialectSQLite {
+		existing, err := sqliteColumns(ctx, tx, "metrics")
+		if err != nil {
+			return err
+		}
+		if !existing["sample_count"] {
+			queries = append(queries, "ALTER TABLE metrics ADD COLUMN sample_count INTEGER NOT NULL DEFAULT 1")
+		}
+		if !existing["resolution"] {
+			queries = append(queries, "ALTER TABLE metrics ADD COLUMN resolution INTEGER NOT NULL DEFAULT 0")
+		}
+	} else {
+		queries = append(queries,
+			"ALTER TABLE metrics ADD COLUMN IF NOT EXISTS sample_count BIGINT NOT NULL DEFAULT 1",
+			"ALTER TABLE metrics ADD COLUMN IF NOT EXISTS resolution INTEGER NOT NULL DEFAULT 0",
+		)
+	}
+	queries = append(queries, "CREATE INDEX IF NOT EXISTS idx_metrics_resolution_timestamp ON metrics(resolution, timestamp)")
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("migrate metrics rollups: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateSQLiteTimestamps rewrites cache expiries the driver wrote with the local UTC
+// offset and fractional seconds as UTC text comparable with CURRENT_TIMESTAMP
+func migrateSQLiteTimestamps(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+	if d != dialectSQLite {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE cache SET expiry = datetime(expiry) WHERE expiry IS NOT NULL AND datetime(expiry) IS NOT NULL")
+	return err
+}
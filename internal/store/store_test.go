@@ -1,14 +1,23 @@
 package store
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/config"
 )
 
 func TestFileStore(t *testing.T) {
@@ -57,6 +66,73 @@ func TestRedisStore(t *testing.T) {
 	assert.NotNil(t, store)
 }
 
+// TestRedisStoreWindowsAndTagIndexes runs the Lua scripts against a real Redis server
+// when REDIS_ADDR is set
+func TestRedisStoreWindowsAndTagIndexes(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	s := NewRedisStore(addr, "", zerolog.Nop())
+	ctx := context.Background()
+	require.NoError(t, s.client.Ping(ctx).Err())
+
+	prefix := "test" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer func() {
+		iter := s.client.Scan(ctx, 0, "*"+prefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			s.client.Del(ctx, iter.Val())
+		}
+	}()
+
+	// Sliding windows
+	require.NoError(t, s.IncrementUsage(prefix, "key1", "req", 1))
+	require.NoError(t, s.IncrementUsage(prefix, "key1", "req", 2.5))
+	total, err := s.GetUsage(prefix, "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 3.5, total)
+	window, err := s.GetUsageInWindow(prefix, "key1", "req", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 3.5, window)
+
+	// Buckets older than the history TTL are dropped on the next increment
+	buckets, index := usageWindowKeys(prefix, "key1", "req")
+	old := time.Now().Unix() - 7200
+	require.NoError(t, s.client.HSet(ctx, buckets, strconv.FormatInt(old, 10), 10).Err())
+	require.NoError(t, s.client.ZAdd(ctx, index, &redis.Z{Score: float64(old), Member: strconv.FormatInt(old, 10)}).Err())
+	require.NoError(t, s.IncrementUsage(prefix, "key1", "req", 1))
+	window, err = s.GetUsageInWindow(prefix, "key1", "req", 3*3600)
+	require.NoError(t, err)
+	assert.Equal(t, 4.5, window)
+	assert.Positive(t, s.client.TTL(ctx, buckets).Val())
+
+	// Tag indexes
+	name := prefix + "_latency"
+	now := time.Now().Unix()
+	require.NoError(t, s.StoreMetric(name, 100, map[string]string{"provider": "openai", "model": "a", "request_id": "r1"}, now-20))
+	require.NoError(t, s.StoreMetric(name, 200, map[string]string{"provider": "openai", "model": "b", "request_id": "r2"}, now-10))
+	require.NoError(t, s.StoreMetric(name, 300, map[string]string{"provider": "gemini", "model": "a"}, now))
+	assert.Equal(t, int64(0), s.client.Exists(ctx, metricTagKey(name, "request_id", "r1")).Val())
+
+	points, err := s.GetMetrics(name, nil, now-60, now)
+	require.NoError(t, err)
+	assert.Len(t, points, 3)
+	points, err = s.GetMetrics(name, map[string]string{"provider": "openai"}, now-60, now)
+	require.NoError(t, err)
+	assert.Len(t, points, 2)
+	points, err = s.GetMetrics(name, map[string]string{"provider": "openai", "model": "a"}, now-60, now)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 100.0, points[0].Value)
+	points, err = s.GetMetrics(name, map[string]string{"request_id": "r2"}, now-60, now)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 200.0, points[0].Value)
+	points, err = s.GetMetrics(name, map[string]string{"provider": "anthropic"}, now-60, now)
+	require.NoError(t, err)
+	assert.Empty(t, points)
+}
+
 func TestHTTPStore(t *testing.T) {
 	// Mock HTTP server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -101,3 +177,523 @@ func TestHTTPStore(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "1.0", cfg.Version)
 }
+
+func TestHTTPStoreServerRoundTrip(t *testing.T) {
+	backend, err := NewSQLStore(t.TempDir()+"/backend.db", zerolog.Nop())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewHTTPStoreServer(backend, NewSimpleConfigStore(backend), "test-key", zerolog.Nop()).Handler())
+	defer server.Close()
+	s := NewHTTPStore(server.URL, "test-key", zerolog.Nop())
+
+	// Usage, including segments that need escaping
+	require.NoError(t, s.SetUsage("openai", "key/1", "req", 2))
+	require.NoError(t, s.IncrementUsage("openai", "key/1", "req", 3))
+	val, err := s.GetUsage("openai", "key/1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, val)
+	val, err = s.GetUsageInWindow("openai", "key/1", "req", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, val)
+
+	require.NoError(t, s.IncrementUsageBatch([]UsageIncrement{
+		{Provider: "openai", KeyID: "key/1", Metric: "req", Delta: 1},
+		{Provider: "openai", KeyID: "key2", Metric: "tokens", Delta: 100},
+	}))
+	val, err = s.GetUsage("openai", "key/1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 6.0, val)
+	val, err = s.GetUsage("openai", "key2", "tokens")
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, val)
+
+	// Cache hits and misses
+	require.NoError(t, s.SetCache("a b", "cached", 60))
+	cached, err := s.GetCache("a b")
+	require.NoError(t, err)
+	assert.Equal(t, "cached", cached)
+	cached, err = s.GetCache("missing")
+	require.NoError(t, err)
+	assert.Empty(t, cached)
+
+	// Metrics with tag filters
+	now := time.Now().Unix()
+	require.NoError(t, s.StoreMetric("latency", 100, map[string]string{"provider": "openai"}, now-10))
+	require.NoError(t, s.StoreMetricBatch([]MetricWrite{
+		{Name: "latency", Value: 200, Tags: map[string]string{"provider": "gemini"}, Timestamp: now - 5},
+		{Name: "latency", Value: 300, Tags: map[string]string{"provider": "openai"}, Timestamp: now - 1},
+	}))
+	points, err := s.GetMetrics("latency", map[string]string{"provider": "openai"}, now-60, now)
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	for _, p := range points {
+		assert.Equal(t, "openai", p.Tags["provider"])
+	}
+
+	// Config
+	require.NoError(t, s.SaveConfig(&config.Config{Version: "2.0"}))
+	cfg, err := s.LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "2.0", cfg.Version)
+
+	// Wrong API key
+	_, err = NewHTTPStore(server.URL, "wrong", zerolog.Nop()).GetUsage("openai", "key2", "tokens")
+	assert.Error(t, err)
+}
+
+func TestHTTPStoreRetriesAreIdempotent(t *testing.T) {
+	backend, err := NewSQLStore(t.TempDir()+"/backend.db", zerolog.Nop())
+	require.NoError(t, err)
+	handler := NewHTTPStoreServer(backend, NewSimpleConfigStore(backend), "test-key", zerolog.Nop()).Handler()
+
+	// The first increment is applied but its response is lost as a 503,
+	// so the client retries with the same Idempotency-Key
+	var attempts int
+	var keys []string
+	failNext := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			attempts++
+			keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+			if failNext {
+				failNext = false
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	s := NewHTTPStore(server.URL, "test-key", zerolog.Nop())
+	require.NoError(t, s.IncrementUsage("openai", "key1", "req", 1))
+	assert.Equal(t, 2, attempts)
+	require.Len(t, keys, 2)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+
+	val, err := s.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, val)
+
+	// Client errors are not retried
+	attempts = 0
+	noRetry := NewHTTPStoreWithOptions(server.URL, "wrong", HTTPStoreOptions{MaxRetries: 3}, zerolog.Nop())
+	assert.Error(t, noRetry.IncrementUsage("openai", "key1", "req", 1))
+	assert.Equal(t, 1, attempts)
+}
+
+// blockingStore holds increments until released and fails the first one
+type blockingStore struct {
+	RuntimeStore
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (b *blockingStore) IncrementUsage(provider, keyID, metric string, delta float64) error {
+	if b.calls.Add(1) == 1 {
+		close(b.started)
+		<-b.release
+		return errors.New("backend unavailable")
+	}
+	return b.RuntimeStore.IncrementUsage(provider, keyID, metric, delta)
+}
+
+func TestHTTPStoreServer_ConcurrentDuplicates(t *testing.T) {
+	backend, err := NewMemoryStore(MemoryStoreOptions{}, zerolog.Nop())
+	require.NoError(t, err)
+	blocking := &blockingStore{RuntimeStore: backend, started: make(chan struct{}), release: make(chan struct{})}
+	handler := NewHTTPStoreServer(blocking, NewSimpleConfigStore(backend), "test-key", zerolog.Nop()).Handler()
+
+	increment := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/usage/openai/key1/req/increment", strings.NewReader(`{"delta": 1}`))
+		req.Header.Set("Authorization", "Bearer test-key")
+		req.Header.Set(IdempotencyKeyHeader, "write-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A retry that arrives while the first write runs waits for it, and is applied
+	// itself when the first write fails
+	first := make(chan int)
+	go func() { first <- increment() }()
+	<-blocking.started
+	retry := make(chan int)
+	go func() { retry <- increment() }()
+	time.Sleep(50 * time.Millisecond) // Let the retry arrive while the first write runs
+	close(blocking.release)
+	assert.Equal(t, http.StatusInternalServerError, <-first)
+	assert.Equal(t, http.StatusOK, <-retry)
+
+	val, err := backend.GetUsage("openai", "key1", "req")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, val)
+
+	// Once applied, the key is acknowledged without applying it again
+	assert.Equal(t, http.StatusOK, increment())
+	assert.Equal(t, int32(2), blocking.calls.Load())
+}
+
+func TestParseInterval(t *testing.T) {
+	cases := map[string]int64{"30s": 30, "1m": 60, "5m": 300, "1h": 3600, "1d": 86400}
+	for in, want := range cases {
+		got, err := ParseInterval(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"", "h", "0m", "-1h", "1w", "abc"} {
+		_, err := ParseInterval(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestAggregatePoints(t *testing.T) {
+	points := []MetricPoint{
+		{Value: 10, Timestamp: 3600, Tags: map[string]string{"provider": "openai"}},
+		{Value: 20, Timestamp: 3601, Tags: map[string]string{"provider": "openai"}},
+		{Value: 30, Timestamp: 3602, Tags: map[string]string{"provider": "openai"}},
+		{Value: 40, Timestamp: 3603, Tags: map[string]string{"provider": "openai"}},
+		{Value: 99, Timestamp: 3604, Tags: map[string]string{"provider": "gemini"}},
+		{Value: 5, Timestamp: 7300, Tags: map[string]string{"provider": "openai"}},
+	}
+	q := TimeSeriesQuery{Name: "latency", Tags: map[string]string{"provider": "openai"}, Start: 0, End: 10000, Interval: 3600}
+
+	q.Agg = AggSum
+	got := AggregatePoints(points, q)
+	require.Len(t, got, 2)
+	assert.Equal(t, TimeSeriesPoint{Timestamp: 3600, Value: 100, Metric: "latency"}, got[0])
+	assert.Equal(t, TimeSeriesPoint{Timestamp: 7200, Value: 5, Metric: "latency"}, got[1])
+
+	expected := map[string]float64{AggAvg: 25, AggCount: 4, AggMin: 10, AggMax: 40, AggP50: 20, AggP95: 40, AggP99: 40}
+	for agg, want := range expected {
+		q.Agg = agg
+		got := AggregatePoints(points, q)
+		require.Len(t, got, 2, agg)
+		assert.Equal(t, want, got[0].Value, agg)
+	}
+}
+
+func TestSQLStoreTimeSeries(t *testing.T) {
+	logger := zerolog.Nop()
+	s, err := NewSQLStore(t.TempDir()+"/metrics.db", logger)
+	require.NoError(t, err)
+
+	for i, v := range []float64{100, 200, 300, 400} {
+		require.NoError(t, s.StoreMetric("latency", v, map[string]string{"provider": "openai", "key": "k1"}, int64(60+i)))
+	}
+	require.NoError(t, s.StoreMetric("latency", 1000, map[string]string{"provider": "gemini", "key": "k2"}, 61))
+	require.NoError(t, s.StoreMetric(MetricRequest, 1000, RequestOutcome{Provider: "gemini", KeyID: "k2", Status: 200, Attempt: 1, Final: true}.Tags(), 61))
+	require.NoError(t, s.StoreMetric(MetricRequest, 10, RequestOutcome{Provider: "gemini", KeyID: "k2", Status: 429, ErrorClass: "rate_limit", Attempt: 1}.Tags(), 62))
+	require.NoError(t, s.StoreMetric("latency", 50, map[string]string{"provider": "openai", "key": "k1"}, 130))
+
+	metrics := &DefaultMetricsStore{runtimeStore: s}
+	q := TimeSeriesQuery{Name: "latency", Tags: map[string]string{"provider": "openai"}, Start: 0, End: 200, Interval: 60}
+
+	expected := map[string][]float64{
+		AggSum:   {1000, 50},
+		AggAvg:   {250, 50},
+		AggCount: {4, 1},
+		AggP50:   {200, 50},
+		AggP99:   {400, 50},
+	}
+	for agg, want := range expected {
+		q.Agg = agg
+		got, err := metrics.QueryTimeSeries(q)
+		require.NoError(t, err, agg)
+		require.Len(t, got, 2, agg)
+		assert.Equal(t, int64(60), got[0].Timestamp, agg)
+		assert.Equal(t, int64(120), got[1].Timestamp, agg)
+		assert.Equal(t, want[0], got[0].Value, agg)
+		assert.Equal(t, want[1], got[1].Value, agg)
+	}
+
+	series, err := metrics.GetProviderTimeSeries("gemini", 0, 200, "1m")
+	require.NoError(t, err)
+	bySeries := map[string]float64{}
+	for _, p := range series {
+		bySeries[p.Metric] = p.Value
+	}
+	assert.Equal(t, 2.0, bySeries["requests"])
+	assert.Equal(t, 1.0, bySeries["errors"])
+	assert.Equal(t, 1000.0, bySeries["latency_avg"])
+
+	_, err = metrics.GetProviderTimeSeries("gemini", 0, 200, "bogus")
+	assert.Error(t, err)
+}
+
+func TestSQLStoreGetMetricsTags(t *testing.T) {
+	logger := zerolog.Nop()
+	s, err := NewSQLStore(t.TempDir()+"/metrics.db", logger)
+	require.NoError(t, err)
+
+	require.NoError(t, s.StoreMetric("latency", 100, map[string]string{"provider": "openai", "key": "k1", "model": "gpt-4o"}, 10))
+	require.NoError(t, s.StoreMetric("latency", 200, map[string]string{"provider": "openai", "key": "k2", "error": "true"}, 20))
+	require.NoError(t, s.StoreMetric("latency", 300, map[string]string{"provider": "gemini", "key": "k3"}, 30))
+	require.NoError(t, s.StoreMetric("latency", 400, nil, 40))
+
+	all, err := s.GetMetrics("latency", nil, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, all, 4)
+	assert.Equal(t, map[string]string{"provider": "openai", "key": "k1", "model": "gpt-4o"}, all[0].Tags)
+	assert.Empty(t, all[3].Tags)
+
+	// Indexed column filter
+	openai, err := s.GetMetrics("latency", map[string]string{"provider": "openai"}, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, openai, 2)
+	assert.Equal(t, int64(10), openai[0].Timestamp)
+	assert.Equal(t, int64(20), openai[1].Timestamp)
+
+	// Mixed indexed and JSON tag filters
+	errs, err := s.GetMetrics("latency", map[string]string{"provider": "openai", "error": "true"}, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 200.0, errs[0].Value)
+
+	none, err := s.GetMetrics("latency", map[string]string{"provider": "openai", "key": "k3"}, 0, 100)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestSQLStoreMigratesMetricsTags(t *testing.T) {
+	path := t.TempDir() + "/legacy.db"
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE metrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		tags TEXT,
+		timestamp INTEGER NOT NULL
+	)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO metrics (name, value, tags, timestamp) VALUES ('latency', 5, '{"provider":"openai","key":"k1"}', 10)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := NewSQLStore(path, zerolog.Nop())
+	require.NoError(t, err)
+
+	points, err := s.GetMetrics("latency", map[string]string{"provider": "openai", "key": "k1"}, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 5.0, points[0].Value)
+
+	// Opening again is a no-op
+	_, err = NewSQLStore(path, zerolog.Nop())
+	require.NoError(t, err)
+}
+
+func TestDefaultMetricsStoreOutcomes(t *testing.T) {
+	s, err := NewSQLStore(t.TempDir()+"/outcomes.db", zerolog.Nop())
+	require.NoError(t, err)
+	metrics := &DefaultMetricsStore{runtimeStore: s}
+
+	record := func(o RequestOutcome, ts int64) {
+		require.NoError(t, s.StoreMetric(MetricRequest, float64(o.LatencyMS), o.Tags(), ts))
+	}
+	// Request 1: rate limited on openai, served by the gemini fallback
+	record(RequestOutcome{Provider: "openai", KeyID: "k1", ClientKey: "c1", Status: 429, ErrorClass: "rate_limit", Attempt: 1, LatencyMS: 20}, 100)
+	record(RequestOutcome{Provider: "gemini", KeyID: "k2", ClientKey: "c1", Status: 200, Attempt: 2, Fallback: true, Final: true, LatencyMS: 80}, 101)
+	// Request 2: timed out on openai
+	record(RequestOutcome{Provider: "openai", KeyID: "k1", ClientKey: "c1", Status: 504, ErrorClass: "timeout", Attempt: 1, Final: true, LatencyMS: 30000}, 110)
+	// Request 3: rejected before reaching a provider
+	record(RequestOutcome{ClientKey: "c2", Status: 400, ErrorClass: "invalid_request", Final: true}, 120)
+	require.NoError(t, s.StoreMetric("latency", 80, map[string]string{"provider": "gemini", "key": "k2", "client_key": "c1"}, 101))
+
+	client, err := metrics.GetClientMetrics("c1", 0, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), client.TotalRequests)
+	assert.Equal(t, 0.5, client.SuccessRate)
+	assert.Equal(t, int64(1), client.ErrorCount)
+	assert.Equal(t, map[string]int64{"timeout": 1}, client.ErrorsByClass)
+	assert.Equal(t, 80.0, client.AvgLatency)
+	assert.Equal(t, int64(110), client.LastRequestTime)
+
+	openaiMetrics, err := metrics.GetProviderMetrics("openai", 0, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), openaiMetrics.TotalRequests)
+	assert.Equal(t, 0.0, openaiMetrics.SuccessRate)
+	assert.Equal(t, int64(2), openaiMetrics.ErrorCount)
+	assert.Equal(t, map[string]int64{"rate_limit": 1, "timeout": 1}, openaiMetrics.ErrorsByClass)
+
+	key, err := metrics.GetKeyMetrics("gemini", "k2", 0, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), key.TotalRequests)
+	assert.Equal(t, 1.0, key.SuccessRate)
+	assert.Equal(t, int64(101), key.LastUsed)
+
+	global, err := metrics.GetGlobalMetrics(0, 200)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), global.TotalRequests)
+	assert.InDelta(t, 1.0/3, global.OverallSuccessRate, 1e-9)
+	assert.Equal(t, int64(2), global.TotalErrors)
+	assert.Equal(t, 2, global.TotalClients)
+	assert.Equal(t, 2, global.TotalProviders)
+}
+
+func TestNewRetentionPolicy(t *testing.T) {
+	policy := NewRetentionPolicy(config.RetentionConfig{MetricsRaw: 6 * time.Hour, MetricsDaily: -1})
+	assert.Equal(t, DefaultUsageHistoryRetention, policy.UsageHistory)
+	assert.Equal(t, 6*time.Hour, policy.MetricsRaw)
+	assert.Equal(t, DefaultMetricsHourlyRetention, policy.MetricsHourly)
+	assert.Equal(t, time.Duration(0), policy.MetricsDaily)
+
+	now := time.Unix(10*86400+5*3600+120, 0)
+	assert.Equal(t, int64(10*86400-3600), policy.rawCutoff(now))
+	assert.Equal(t, int64(0), policy.dailyCutoff(now))
+}
+
+func TestRollupPoints(t *testing.T) {
+	points := []MetricPoint{
+		{Value: 100, Timestamp: 3600, Tags: map[string]string{"provider": "openai", "request_id": "a"}},
+		{Value: 300, Timestamp: 5000, Tags: map[string]string{"provider": "openai", "request_id": "b"}},
+		{Value: 50, Timestamp: 7300, Tags: map[string]string{"provider": "openai", "request_id": "c"}},
+		{Value: 600, Timestamp: 10, Tags: map[string]string{"provider": "gemini"}, Count: 3, Resolution: ResolutionHourly},
+	}
+
+	rollups := RollupPoints(points, ResolutionHourly)
+	require.Len(t, rollups, 3)
+	assert.Equal(t, MetricPoint{Value: 600, Timestamp: 0, Tags: map[string]string{"provider": "gemini"}, Count: 3, Resolution: ResolutionHourly}, rollups[0])
+	assert.Equal(t, MetricPoint{Value: 400, Timestamp: 3600, Tags: map[string]string{"provider": "openai"}, Count: 2, Resolution: ResolutionHourly}, rollups[1])
+	assert.Equal(t, int64(7200), rollups[2].Timestamp)
+	assert.Equal(t, 200.0, rollups[1].Mean())
+}
+
+func TestSQLStoreCompact(t *testing.T) {
+	logger := zerolog.Nop()
+	s, err := NewSQLStore(t.TempDir()+"/compact.db", logger)
+	require.NoError(t, err)
+
+	now := time.Unix(1000*86400+12*3600, 0)
+	old := now.Add(-72 * time.Hour).Unix() // rolled up hourly
+	for i, v := range []float64{100, 200, 300, 400} {
+		tags := map[string]string{"provider": "openai", "key": "k1", "request_id": strconv.Itoa(i)}
+		require.NoError(t, s.StoreMetric("latency", v, tags, old+int64(i)))
+	}
+	require.NoError(t, s.StoreMetric("latency", 50, map[string]string{"provider": "openai", "key": "k1"}, now.Unix()-60))
+	require.NoError(t, s.StoreMetric("latency", 7, map[string]string{"provider": "openai"}, now.Add(-400*24*time.Hour).Unix()))
+
+	require.NoError(t, s.SetCache("forever", "v", 0))
+	_, err = s.db.Exec("INSERT INTO cache (key, value, expiry) VALUES (?, ?, ?)", "expired", "v", s.dialect.timestamp(time.Now().Add(-time.Minute)))
+	require.NoError(t, err)
+
+	policy := RetentionPolicy{MetricsRaw: 48 * time.Hour, MetricsHourly: 720 * time.Hour, MetricsDaily: 365 * 24 * time.Hour}
+	result, err := s.Compact(context.Background(), policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), result.RawRolledUp)
+	assert.Equal(t, int64(1), result.HourlyRolledUp)
+	assert.Equal(t, int64(1), result.DailyDeleted)
+	assert.Equal(t, int64(1), result.CacheDeleted)
+
+	points, err := s.GetMetrics("latency", map[string]string{"key": "k1"}, 0, now.Unix())
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, bucketStart(old, ResolutionHourly), points[0].Timestamp)
+	assert.Equal(t, 1000.0, points[0].Value)
+	assert.Equal(t, int64(4), points[0].Count)
+	assert.Equal(t, ResolutionHourly, points[0].Resolution)
+	assert.NotContains(t, points[0].Tags, "request_id")
+
+	// Weighted aggregates over the rolled-up range match the raw data
+	metrics := &DefaultMetricsStore{runtimeStore: s}
+	q := TimeSeriesQuery{Name: "latency", Tags: map[string]string{"key": "k1"}, Start: old - 86400, End: old + 86400, Interval: 86400}
+	for agg, want := range map[string]float64{AggSum: 1000, AggAvg: 250, AggCount: 4, AggMax: 250} {
+		q.Agg = agg
+		got, err := metrics.QueryTimeSeries(q)
+		require.NoError(t, err, agg)
+		require.Len(t, got, 1, agg)
+		assert.Equal(t, want, got[0].Value, agg)
+	}
+
+	var cached int
+	require.NoError(t, s.db.QueryRow("SELECT COUNT(*) FROM cache WHERE key = 'forever' AND expiry IS NULL").Scan(&cached))
+	assert.Equal(t, 1, cached)
+
+	stats, err := s.StorageStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "sqlite", stats.Backend)
+	assert.Positive(t, stats.TotalBytes)
+	for _, table := range stats.Tables {
+		if table.Name == "metrics" {
+			assert.Equal(t, int64(2), table.Rows)
+			assert.Equal(t, map[string]int64{"raw": 1, "hourly": 1}, table.Partitions)
+		}
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir() + "/migrate.db"
+
+	migrator, err := NewSQLMigrator(path)
+	require.NoError(t, err)
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, LatestSchemaVersion())
+
+	applied, err := migrator.Migrate(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []SQLMigrationInfo{
+		{Version: 1, Description: sqlMigrations[0].Description},
+		{Version: 2, Description: sqlMigrations[1].Description},
+	}, applied)
+
+	applied, err = migrator.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, LatestSchemaVersion()-2)
+	version, err := migrator.Version(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion(), version)
+
+	// Re-running is a no-op
+	applied, err = migrator.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// A schema written by a newer binary is refused
+	_, err = migrator.db.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", LatestSchemaVersion()+1, "from the future")
+	require.NoError(t, err)
+	require.NoError(t, migrator.Close())
+
+	_, err = NewSQLStore(path, zerolog.Nop())
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestSQLStoreSQLiteWindowsAndCache(t *testing.T) {
+	s, err := NewSQLStore(t.TempDir()+"/window.db", zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, s.IncrementUsage("openai", "k1", "req", 1))
+	require.NoError(t, s.IncrementUsage("openai", "k1", "req", 2))
+	_, err = s.db.Exec("INSERT INTO usage_history (provider, key_id, metric, delta, timestamp) VALUES (?, ?, ?, ?, ?)",
+		"openai", "k1", "req", 100, s.dialect.timestamp(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+
+	total, err := s.GetUsageInWindow("openai", "k1", "req", 60)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, total)
+
+	require.NoError(t, s.SetCache("live", "v1", 60))
+	require.NoError(t, s.SetCache("forever", "v2", 0))
+	_, err = s.db.Exec("INSERT INTO cache (key, value, expiry) VALUES (?, ?, ?)", "stale", "v3", s.dialect.timestamp(time.Now().Add(-time.Minute)))
+	require.NoError(t, err)
+
+	for key, want := range map[string]string{"live": "v1", "forever": "v2", "stale": ""} {
+		value, err := s.GetCache(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, value, key)
+	}
+}
+
+func TestSQLDialectRebind(t *testing.T) {
+	query := "SELECT * FROM metrics WHERE name = ? AND timestamp > ?"
+	assert.Equal(t, query, dialectSQLite.rebind(query))
+	assert.Equal(t, "SELECT * FROM metrics WHERE name = $1 AND timestamp > $2", dialectPostgres.rebind(query))
+	assert.Equal(t, dialectSQLite, detectDialect("./data/coo-llm.db"))
+	assert.Equal(t, dialectPostgres, detectDialect("postgres://user@localhost/coo"))
+}
@@ -0,0 +1,320 @@
+package storetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// fakeAttr is an attribute value in DynamoDB JSON form, e.g. {"S": "x"} or {"N": "1"}
+type fakeAttr map[string]any
+
+// FakeDynamoDB is an in-process stand-in for the DynamoDB JSON API. It covers the
+// operations and expressions DynamoDBStore uses, including Query pagination.
+type FakeDynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]map[string]fakeAttr // table -> primary key -> item
+	ttl    map[string]string                         // table -> TTL attribute
+
+	queries         int  // Query requests served
+	unprocessedOnce bool // Return the next BatchWriteItem's last item as unprocessed
+}
+
+// Queries returns the number of Query requests served
+func (f *FakeDynamoDB) Queries() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries
+}
+
+// TTLAttribute returns the attribute TTL is enabled on for a table, or ""
+func (f *FakeDynamoDB) TTLAttribute(table string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ttl[table]
+}
+
+// Items returns the items of a table in DynamoDB JSON form
+func (f *FakeDynamoDB) Items(table string) []map[string]map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := make([]map[string]map[string]any, 0, len(f.tables[table]))
+	for _, item := range f.tables[table] {
+		copied := make(map[string]map[string]any, len(item))
+		for k, v := range item {
+			copied[k] = v
+		}
+		items = append(items, copied)
+	}
+	return items
+}
+
+// FailNextBatchItem makes the next BatchWriteItem return its last item as unprocessed
+func (f *FakeDynamoDB) FailNextBatchItem() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unprocessedOnce = true
+}
+
+func NewFakeDynamoDB(tables ...string) *FakeDynamoDB {
+	f := &FakeDynamoDB{tables: make(map[string]map[string]map[string]fakeAttr), ttl: make(map[string]string)}
+	for _, table := range tables {
+		f.tables[table] = make(map[string]map[string]fakeAttr)
+	}
+	return f
+}
+
+func (f *FakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TableName    string
+		Item         map[string]fakeAttr
+		Key          map[string]fakeAttr
+		RequestItems map[string][]struct {
+			PutRequest struct{ Item map[string]fakeAttr }
+		}
+		KeyConditionExpression    string
+		FilterExpression          string
+		UpdateExpression          string
+		ExpressionAttributeNames  map[string]string
+		ExpressionAttributeValues map[string]fakeAttr
+		ExclusiveStartKey         map[string]fakeAttr
+		Limit                     int
+		TimeToLiveSpecification   struct{ AttributeName string }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fakeDynamoError(w, "SerializationException", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tableNames := []string{req.TableName}
+	if req.RequestItems != nil {
+		tableNames = tableNames[:0]
+		for table := range req.RequestItems {
+			tableNames = append(tableNames, table)
+		}
+	}
+	for _, table := range tableNames {
+		if _, ok := f.tables[table]; !ok {
+			fakeDynamoError(w, "ResourceNotFoundException", "Requested resource not found: "+table)
+			return
+		}
+	}
+	table := f.tables[req.TableName]
+
+	var resp any
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); op {
+	case "DescribeTable":
+		resp = map[string]any{"Table": map[string]any{"TableName": req.TableName, "TableStatus": "ACTIVE", "ItemCount": len(table), "TableSizeBytes": 0}}
+	case "DescribeTimeToLive":
+		status := map[string]any{"TimeToLiveStatus": "DISABLED"}
+		if attr, ok := f.ttl[req.TableName]; ok {
+			status = map[string]any{"TimeToLiveStatus": "ENABLED", "AttributeName": attr}
+		}
+		resp = map[string]any{"TimeToLiveDescription": status}
+	case "UpdateTimeToLive":
+		f.ttl[req.TableName] = req.TimeToLiveSpecification.AttributeName
+		resp = map[string]any{"TimeToLiveSpecification": map[string]any{"AttributeName": req.TimeToLiveSpecification.AttributeName, "Enabled": true}}
+	case "PutItem":
+		table[fakePrimaryKey(req.Item)] = req.Item
+		resp = map[string]any{}
+	case "GetItem":
+		resp = map[string]any{}
+		if item, ok := table[fakePrimaryKey(req.Key)]; ok {
+			resp = map[string]any{"Item": item}
+		}
+	case "UpdateItem":
+		// Only "ADD <path> <value>" on numbers
+		parts := strings.Fields(req.UpdateExpression)
+		if len(parts) != 3 || parts[0] != "ADD" {
+			fakeDynamoError(w, "ValidationException", "unsupported update expression "+req.UpdateExpression)
+			return
+		}
+		item, ok := table[fakePrimaryKey(req.Key)]
+		if !ok {
+			item = map[string]fakeAttr{"pk": req.Key["pk"], "sk": req.Key["sk"]}
+			table[fakePrimaryKey(req.Key)] = item
+		}
+		attrName := fakeAttrName(parts[1], req.ExpressionAttributeNames)
+		sum := fakeNumber(req.ExpressionAttributeValues[parts[2]])
+		if current, ok := item[attrName]; ok {
+			sum.Add(sum, fakeNumber(current))
+		}
+		item[attrName] = fakeAttr{"N": sum.Text('f', -1)}
+		resp = map[string]any{}
+	case "BatchWriteItem":
+		unprocessed := map[string][]any{}
+		for name, requests := range req.RequestItems {
+			for i, request := range requests {
+				if f.unprocessedOnce && i == len(requests)-1 {
+					f.unprocessedOnce = false
+					unprocessed[name] = append(unprocessed[name], map[string]any{"PutRequest": map[string]any{"Item": request.PutRequest.Item}})
+					continue
+				}
+				f.tables[name][fakePrimaryKey(request.PutRequest.Item)] = request.PutRequest.Item
+			}
+		}
+		resp = map[string]any{"UnprocessedItems": unprocessed}
+	case "Query":
+		f.queries++
+		var matched []map[string]fakeAttr
+		for _, item := range table {
+			if fakeEval(req.KeyConditionExpression, item, req.ExpressionAttributeNames, req.ExpressionAttributeValues) {
+				matched = append(matched, item)
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool { return fakeCompare(matched[i]["sk"], matched[j]["sk"]) < 0 })
+		if req.ExclusiveStartKey != nil {
+			for len(matched) > 0 && fakeCompare(matched[0]["sk"], req.ExclusiveStartKey["sk"]) <= 0 {
+				matched = matched[1:]
+			}
+		}
+
+		// Limit caps the items evaluated, before the filter is applied
+		result := map[string]any{}
+		if req.Limit > 0 && len(matched) > req.Limit {
+			matched = matched[:req.Limit]
+			last := matched[len(matched)-1]
+			result["LastEvaluatedKey"] = map[string]fakeAttr{"pk": last["pk"], "sk": last["sk"]}
+		}
+		items := []map[string]fakeAttr{}
+		for _, item := range matched {
+			if req.FilterExpression == "" || fakeEval(req.FilterExpression, item, req.ExpressionAttributeNames, req.ExpressionAttributeValues) {
+				items = append(items, item)
+			}
+		}
+		result["Items"] = items
+		result["Count"] = len(items)
+		result["ScannedCount"] = len(matched)
+		resp = result
+	default:
+		fakeDynamoError(w, "UnknownOperationException", "unsupported operation "+op)
+		return
+	}
+
+	body, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("X-Amz-Crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10))
+	w.Write(body)
+}
+
+func fakeDynamoError(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#" + code, "message": msg})
+}
+
+func fakePrimaryKey(item map[string]fakeAttr) string {
+	return fmt.Sprint(item["pk"]) + "\x00" + fmt.Sprint(item["sk"])
+}
+
+func fakeAttrName(token string, names map[string]string) string {
+	if name, ok := names[token]; ok {
+		return name
+	}
+	return token
+}
+
+func fakeNumber(attr fakeAttr) *big.Float {
+	n, _ := new(big.Float).SetPrec(256).SetString(fmt.Sprint(attr["N"]))
+	if n == nil {
+		return new(big.Float).SetPrec(256)
+	}
+	return n
+}
+
+// fakeCompare orders two numbers or two strings; mismatched types never compare equal
+func fakeCompare(a, b fakeAttr) int {
+	if _, ok := a["N"]; ok {
+		if _, ok := b["N"]; ok {
+			return fakeNumber(a).Cmp(fakeNumber(b))
+		}
+	}
+	as, aok := a["S"].(string)
+	bs, bok := b["S"].(string)
+	if aok && bok {
+		return strings.Compare(as, bs)
+	}
+	return 2
+}
+
+// fakeEval evaluates conditions of the form "path = :v" and "path BETWEEN :a AND :b" joined by AND
+func fakeEval(expr string, item map[string]fakeAttr, names map[string]string, values map[string]fakeAttr) bool {
+	tokens := strings.Fields(expr)
+	for i := 0; i < len(tokens); {
+		left := fakeResolve(item, tokens[i], names)
+		switch tokens[i+1] {
+		case "=":
+			if left == nil || fakeCompare(left, values[tokens[i+2]]) != 0 {
+				return false
+			}
+			i += 3
+		case "BETWEEN":
+			if left == nil {
+				return false
+			}
+			lo, hi := fakeCompare(left, values[tokens[i+2]]), fakeCompare(left, values[tokens[i+4]])
+			if lo == 2 || hi == 2 || lo < 0 || hi > 0 {
+				return false
+			}
+			i += 5
+		default:
+			panic("unsupported condition " + expr)
+		}
+		if i < len(tokens) && tokens[i] == "AND" {
+			i++
+		}
+	}
+	return true
+}
+
+// fakeResolve follows a dotted document path such as #tags.#t0
+func fakeResolve(item map[string]fakeAttr, path string, names map[string]string) fakeAttr {
+	parts := strings.Split(path, ".")
+	current, ok := item[fakeAttrName(parts[0], names)]
+	if !ok {
+		return nil
+	}
+	for _, part := range parts[1:] {
+		m, ok := current["M"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		next, ok := m[fakeAttrName(part, names)].(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+// NewDynamoDBStore serves fake over HTTP and connects a DynamoDBStore to it
+func NewDynamoDBStore(t *testing.T, fake *FakeDynamoDB, opts store.DynamoDBOptions) *store.DynamoDBStore {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	opts.Endpoint = server.URL
+	s, err := store.NewDynamoDBStoreWithOptions("us-east-1", opts, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("failed to connect to fake DynamoDB: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,350 @@
+// Package storetest provides a conformance suite for store.RuntimeStore and
+// store.ConfigStore implementations, and local stand-ins for backends that
+// otherwise need a running service.
+//
+// A backend's test runs the suite with a factory for a fresh store:
+//
+//	func TestMyStoreConformance(t *testing.T) {
+//		storetest.RunRuntimeStore(t, func(t *testing.T) store.RuntimeStore {
+//			return newMyStore(t)
+//		})
+//	}
+//
+// Keys, metric names and providers are unique per run, so the suite is safe to
+// run against a shared database.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/user/coo-llm/internal/config"
+	"github.com/user/coo-llm/internal/store"
+)
+
+// RuntimeStoreFactory returns a ready-to-use store. It is called once per subtest;
+// cleanup should be registered with t.Cleanup.
+type RuntimeStoreFactory func(t *testing.T) store.RuntimeStore
+
+// ConfigStoreFactory returns a ready-to-use config store
+type ConfigStoreFactory func(t *testing.T) store.ConfigStore
+
+// RunRuntimeStore checks the RuntimeStore contract every backend must follow:
+//   - usage totals start at 0, SetUsage overwrites and IncrementUsage adds
+//   - GetUsageInWindow sums the increments of the last windowSeconds only, and
+//     SetUsage doesn't count as an increment
+//   - a cache miss or an expired entry returns "" and no error, and a TTL of 0
+//     never expires
+//   - GetMetrics returns the points of one name within [start, end], oldest
+//     first, with every requested tag matching, and never nil tags
+//   - concurrent increments are not lost
+//   - time-series percentiles weigh rolled-up rows by the raw points they hold,
+//     for stores that implement store.Compactor and store.TimeSeriesStore
+//
+// Stores that implement store.BatchWriter are checked for equivalence with the
+// single-write methods. Subtests that wait for expiry are skipped with -short.
+func RunRuntimeStore(t *testing.T, newStore RuntimeStoreFactory) {
+	run := fmt.Sprintf("%d", time.Now().UnixNano())
+	id := func(t *testing.T, name string) string {
+		return fmt.Sprintf("conformance-%s-%s-%s", run, t.Name(), name)
+	}
+
+	t.Run("UsageCounters", func(t *testing.T) {
+		s := newStore(t)
+		provider := id(t, "provider")
+
+		total, err := s.GetUsage(provider, "key", "req")
+		require.NoError(t, err)
+		assert.Zero(t, total, "unknown usage is 0")
+
+		require.NoError(t, s.SetUsage(provider, "key", "req", 10))
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 2.5))
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 1))
+		total, err = s.GetUsage(provider, "key", "req")
+		require.NoError(t, err)
+		assert.InDelta(t, 13.5, total, 1e-9)
+
+		require.NoError(t, s.SetUsage(provider, "key", "req", 4))
+		total, err = s.GetUsage(provider, "key", "req")
+		require.NoError(t, err)
+		assert.InDelta(t, 4, total, 1e-9, "SetUsage overwrites the total")
+
+		// Counters are independent per provider, key and metric
+		for _, other := range [][3]string{{provider, "key", "tokens"}, {provider, "other", "req"}, {provider + "-other", "key", "req"}} {
+			total, err = s.GetUsage(other[0], other[1], other[2])
+			require.NoError(t, err)
+			assert.Zero(t, total, "usage of %v", other)
+		}
+	})
+
+	t.Run("UsageWindow", func(t *testing.T) {
+		s := newStore(t)
+		provider := id(t, "provider")
+
+		window, err := s.GetUsageInWindow(provider, "key", "req", 60)
+		require.NoError(t, err)
+		assert.Zero(t, window, "unknown usage is 0")
+
+		require.NoError(t, s.SetUsage(provider, "key", "req", 100))
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 1))
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 2))
+		require.NoError(t, s.IncrementUsage(provider, "key", "tokens", 50))
+
+		window, err = s.GetUsageInWindow(provider, "key", "req", 60)
+		require.NoError(t, err)
+		assert.InDelta(t, 3, window, 1e-9, "the window counts increments, not the SetUsage total")
+		window, err = s.GetUsageInWindow(provider, "key", "tokens", 3600)
+		require.NoError(t, err)
+		assert.InDelta(t, 50, window, 1e-9)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("waits for usage and cache entries to expire")
+		}
+		s := newStore(t)
+		provider := id(t, "provider")
+		key := id(t, "cache")
+
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 5))
+		require.NoError(t, s.SetCache(key, "short-lived", 1))
+		require.NoError(t, s.SetCache(key+"-forever", "kept", 0))
+		value, err := s.GetCache(key)
+		require.NoError(t, err)
+		assert.Equal(t, "short-lived", value)
+
+		time.Sleep(2100 * time.Millisecond)
+		require.NoError(t, s.IncrementUsage(provider, "key", "req", 1))
+
+		window, err := s.GetUsageInWindow(provider, "key", "req", 1)
+		require.NoError(t, err)
+		assert.InDelta(t, 1, window, 1e-9, "increments older than the window are excluded")
+		window, err = s.GetUsageInWindow(provider, "key", "req", 60)
+		require.NoError(t, err)
+		assert.InDelta(t, 6, window, 1e-9)
+
+		value, err = s.GetCache(key)
+		require.NoError(t, err, "an expired entry is a miss, not an error")
+		assert.Empty(t, value)
+		value, err = s.GetCache(key + "-forever")
+		require.NoError(t, err)
+		assert.Equal(t, "kept", value, "a TTL of 0 never expires")
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		s := newStore(t)
+		key := id(t, "cache")
+
+		value, err := s.GetCache(key)
+		require.NoError(t, err, "a miss is not an error")
+		assert.Empty(t, value)
+
+		require.NoError(t, s.SetCache(key, "v1", 300))
+		value, err = s.GetCache(key)
+		require.NoError(t, err)
+		assert.Equal(t, "v1", value)
+
+		require.NoError(t, s.SetCache(key, "v2", 0))
+		value, err = s.GetCache(key)
+		require.NoError(t, err)
+		assert.Equal(t, "v2", value, "SetCache overwrites")
+
+		// Values are stored verbatim
+		payload := `{"choices":[{"message":{"content":"héllo\n\"world\""}}]}`
+		require.NoError(t, s.SetCache(key+"/json", payload, 300))
+		value, err = s.GetCache(key + "/json")
+		require.NoError(t, err)
+		assert.Equal(t, payload, value)
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		s := newStore(t)
+		name := id(t, "latency")
+		base := time.Now().Unix() - 600
+
+		require.NoError(t, s.StoreMetric(name, 300, map[string]string{"provider": "gemini", "model": "flash"}, base+30))
+		require.NoError(t, s.StoreMetric(name, 100, map[string]string{"provider": "openai", "model": "gpt-4o"}, base+10))
+		require.NoError(t, s.StoreMetric(name, 200, map[string]string{"provider": "openai", "model": "gpt-4o-mini", "client_key": "c1"}, base+20))
+		require.NoError(t, s.StoreMetric(name, 400, nil, base+40))
+		require.NoError(t, s.StoreMetric(name+"-other", 999, map[string]string{"provider": "openai"}, base+20))
+
+		points, err := s.GetMetrics(name, nil, base, base+100)
+		require.NoError(t, err)
+		require.Len(t, points, 4, "only points of the requested name")
+		assert.Equal(t, []float64{100, 200, 300, 400}, values(points), "oldest first")
+		assert.Equal(t, base+10, points[0].Timestamp)
+		assert.Equal(t, "gpt-4o", points[0].Tags["model"])
+		for _, p := range points {
+			assert.NotNil(t, p.Tags, "tags are never nil")
+		}
+
+		points, err = s.GetMetrics(name, nil, base+10, base+30)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{100, 200, 300}, values(points), "bounds are inclusive")
+		points, err = s.GetMetrics(name, nil, base+41, base+100)
+		require.NoError(t, err)
+		assert.Empty(t, points)
+
+		points, err = s.GetMetrics(name, map[string]string{"provider": "openai"}, base, base+100)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{100, 200}, values(points))
+		points, err = s.GetMetrics(name, map[string]string{"provider": "openai", "model": "gpt-4o-mini"}, base, base+100)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{200}, values(points), "every tag must match")
+		points, err = s.GetMetrics(name, map[string]string{"client_key": "c1"}, base, base+100)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{200}, values(points))
+		points, err = s.GetMetrics(name, map[string]string{"provider": "anthropic"}, base, base+100)
+		require.NoError(t, err)
+		assert.Empty(t, points)
+	})
+
+	t.Run("ConcurrentIncrements", func(t *testing.T) {
+		s := newStore(t)
+		provider := id(t, "provider")
+		const workers, perWorker = 8, 10
+
+		var wg sync.WaitGroup
+		errs := make(chan error, workers*perWorker)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perWorker; i++ {
+					errs <- s.IncrementUsage(provider, "key", "req", 1)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		total, err := s.GetUsage(provider, "key", "req")
+		require.NoError(t, err)
+		assert.InDelta(t, workers*perWorker, total, 1e-9, "no increment is lost")
+		window, err := s.GetUsageInWindow(provider, "key", "req", 60)
+		require.NoError(t, err)
+		assert.InDelta(t, workers*perWorker, window, 1e-9)
+	})
+
+	t.Run("BatchWriter", func(t *testing.T) {
+		s := newStore(t)
+		batch, ok := s.(store.BatchWriter)
+		if !ok {
+			t.Skip("store does not implement store.BatchWriter")
+		}
+		provider := id(t, "provider")
+		name := id(t, "cost")
+		now := time.Now().Unix()
+
+		require.NoError(t, batch.IncrementUsageBatch([]store.UsageIncrement{
+			{Provider: provider, KeyID: "key", Metric: "req", Delta: 1},
+			{Provider: provider, KeyID: "key", Metric: "req", Delta: 2},
+			{Provider: provider, KeyID: "key", Metric: "tokens", Delta: 100},
+		}))
+		require.NoError(t, batch.IncrementUsageBatch(nil))
+		total, err := s.GetUsage(provider, "key", "req")
+		require.NoError(t, err)
+		assert.InDelta(t, 3, total, 1e-9)
+		window, err := s.GetUsageInWindow(provider, "key", "tokens", 60)
+		require.NoError(t, err)
+		assert.InDelta(t, 100, window, 1e-9)
+
+		require.NoError(t, batch.StoreMetricBatch([]store.MetricWrite{
+			{Name: name, Value: 0.5, Tags: map[string]string{"provider": "openai"}, Timestamp: now - 2},
+			{Name: name, Value: 1.5, Tags: map[string]string{"provider": "gemini"}, Timestamp: now - 1},
+		}))
+		require.NoError(t, batch.StoreMetricBatch(nil))
+		points, err := s.GetMetrics(name, nil, now-60, now)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{0.5, 1.5}, values(points))
+		points, err = s.GetMetrics(name, map[string]string{"provider": "gemini"}, now-60, now)
+		require.NoError(t, err)
+		assert.Equal(t, []float64{1.5}, values(points))
+	})
+
+	t.Run("RolledUpPercentiles", func(t *testing.T) {
+		s := newStore(t)
+		compactor, ok := s.(store.Compactor)
+		series, native := s.(store.TimeSeriesStore)
+		if !ok || !native {
+			t.Skip("store does not implement store.Compactor and store.TimeSeriesStore")
+		}
+		name := id(t, "latency")
+		// A day long past, so compacting up to it leaves current data alone
+		base := time.Now().Add(-30*24*time.Hour).Unix() / 86400 * 86400
+
+		// One fast request and four slow ones that roll up into a single row
+		require.NoError(t, s.StoreMetric(name, 100, map[string]string{"provider": "fast"}, base+10))
+		for i := 0; i < 4; i++ {
+			require.NoError(t, s.StoreMetric(name, 1000, map[string]string{"provider": "slow", "request_id": fmt.Sprint(i)}, base+20+int64(i)))
+		}
+
+		query := func(agg string) float64 {
+			t.Helper()
+			got, err := series.QueryTimeSeries(store.TimeSeriesQuery{Name: name, Start: base, End: base + 3599, Interval: 3600, Agg: agg})
+			require.NoError(t, err)
+			require.Len(t, got, 1, agg)
+			return got[0].Value
+		}
+		want := map[string]float64{store.AggP50: 1000, store.AggP95: 1000, store.AggAvg: 820, store.AggCount: 5}
+		for agg, v := range want {
+			assert.InDelta(t, v, query(agg), 1e-9, "raw %s", agg)
+		}
+
+		_, err := compactor.Compact(context.Background(), store.RetentionPolicy{MetricsRaw: time.Hour}, time.Unix(base+3*3600, 0))
+		require.NoError(t, err)
+		points, err := s.GetMetrics(name, nil, base, base+3599)
+		require.NoError(t, err)
+		if len(points) == 5 {
+			t.Skip("store keeps raw points until they expire")
+		}
+		require.Len(t, points, 2, "the slow requests are rolled up")
+		for agg, v := range want {
+			assert.InDelta(t, v, query(agg), 1e-9, "rolled-up %s weighs each row by its samples", agg)
+		}
+	})
+}
+
+// RunConfigStore checks that a saved config loads back with the same content
+// and that a later save replaces the earlier one
+func RunConfigStore(t *testing.T, newStore ConfigStoreFactory) {
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		s := newStore(t)
+
+		cfg := &config.Config{Version: "1.0"}
+		cfg.Server.Listen = ":2906"
+		cfg.LLMProviders = []config.LLMProvider{{ID: "openai", Type: "openai", Model: "gpt-4o"}}
+		require.NoError(t, s.SaveConfig(cfg))
+
+		loaded, err := s.LoadConfig()
+		require.NoError(t, err)
+		require.NotNil(t, loaded)
+		assert.Equal(t, ":2906", loaded.Server.Listen)
+		require.Len(t, loaded.LLMProviders, 1)
+		assert.Equal(t, "gpt-4o", loaded.LLMProviders[0].Model)
+
+		cfg.Server.Listen = ":8080"
+		cfg.LLMProviders = nil
+		require.NoError(t, s.SaveConfig(cfg))
+		loaded, err = s.LoadConfig()
+		require.NoError(t, err)
+		assert.Equal(t, ":8080", loaded.Server.Listen)
+		assert.Empty(t, loaded.LLMProviders)
+	})
+}
+
+func values(points []store.MetricPoint) []float64 {
+	out := make([]float64, len(points))
+	for i, p := range points {
+		out[i] = p.Value
+	}
+	return out
+}
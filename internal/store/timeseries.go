@@ -0,0 +1,293 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregation functions supported by time-series queries
+const (
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggCount = "count"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggP50   = "p50"
+	AggP95   = "p95"
+	AggP99   = "p99"
+)
+
+// TimeSeriesQuery describes a bucketed aggregation over stored metric points.
+// Buckets are aligned to multiples of Interval since the Unix epoch.
+type TimeSeriesQuery struct {
+	Name     string            // Metric name, e.g. "latency"
+	Tags     map[string]string // Tag filters, all must match
+	Start    int64             // Inclusive, unix seconds
+	End      int64             // Inclusive, unix seconds
+	Interval int64             // Bucket width in seconds
+	Agg      string            // One of the Agg* constants
+}
+
+// TimeSeriesStore is implemented by runtime stores that can aggregate metrics natively.
+// Stores that don't implement it are aggregated in memory from GetMetrics.
+type TimeSeriesStore interface {
+	QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error)
+}
+
+// ParseInterval parses bucket intervals like "30s", "1m", "1h" or "1d" into seconds
+func ParseInterval(interval string) (int64, error) {
+	if interval == "" {
+		return 0, fmt.Errorf("interval is required")
+	}
+	unit := interval[len(interval)-1]
+	num, err := strconv.ParseInt(interval[:len(interval)-1], 10, 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("invalid interval: %s", interval)
+	}
+	switch unit {
+	case 's':
+		return num, nil
+	case 'm':
+		return num * 60, nil
+	case 'h':
+		return num * 3600, nil
+	case 'd':
+		return num * 86400, nil
+	default:
+		return 0, fmt.Errorf("invalid interval unit: %s", interval)
+	}
+}
+
+// ValidAggregation reports whether agg is a supported aggregation function
+func ValidAggregation(agg string) bool {
+	switch agg {
+	case AggSum, AggAvg, AggCount, AggMin, AggMax, AggP50, AggP95, AggP99:
+		return true
+	}
+	return false
+}
+
+// percentileOf returns the fraction for percentile aggregations, or 0 for other aggregations
+func percentileOf(agg string) float64 {
+	switch agg {
+	case AggP50:
+		return 0.50
+	case AggP95:
+		return 0.95
+	case AggP99:
+		return 0.99
+	}
+	return 0
+}
+
+// bucketStart aligns a timestamp to the start of its bucket
+func bucketStart(ts, interval int64) int64 {
+	return ts - ((ts%interval)+interval)%interval
+}
+
+// nearestRank returns the p-th percentile of sorted values using the nearest-rank method
+func nearestRank(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// aggregatePoints applies agg to the points of a single bucket. Rolled-up points are
+// weighted by their sample count; min, max and percentiles use their mean value.
+func aggregatePoints(points []MetricPoint, agg string) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+	var sum float64
+	var samples int64
+	for _, p := range points {
+		sum += p.Value
+		samples += p.Samples()
+	}
+	switch agg {
+	case AggCount:
+		return float64(samples)
+	case AggSum:
+		return sum
+	case AggAvg:
+		return sum / float64(samples)
+	case AggMin, AggMax:
+		result := points[0].Mean()
+		for _, p := range points[1:] {
+			v := p.Mean()
+			if (agg == AggMin && v < result) || (agg == AggMax && v > result) {
+				result = v
+			}
+		}
+		return result
+	default:
+		sorted := append([]MetricPoint(nil), points...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Mean() < sorted[j].Mean() })
+		return weightedNearestRank(sorted, samples, percentileOf(agg))
+	}
+}
+
+// weightedNearestRank is nearestRank over points sorted by mean, each counted Samples() times
+func weightedNearestRank(sorted []MetricPoint, samples int64, p float64) float64 {
+	rank := int64(math.Ceil(p * float64(samples)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, point := range sorted {
+		seen += point.Samples()
+		if seen >= rank {
+			return point.Mean()
+		}
+	}
+	return sorted[len(sorted)-1].Mean()
+}
+
+// AggregatePoints buckets points in memory; used by stores without native aggregation
+func AggregatePoints(points []MetricPoint, q TimeSeriesQuery) []TimeSeriesPoint {
+	buckets := make(map[int64][]MetricPoint)
+	for _, p := range points {
+		if p.Timestamp < q.Start || p.Timestamp > q.End || !matchTags(p.Tags, q.Tags) {
+			continue
+		}
+		b := bucketStart(p.Timestamp, q.Interval)
+		buckets[b] = append(buckets[b], p)
+	}
+
+	result := make([]TimeSeriesPoint, 0, len(buckets))
+	for b, bucketPoints := range buckets {
+		result = append(result, TimeSeriesPoint{
+			Timestamp: b,
+			Value:     aggregatePoints(bucketPoints, q.Agg),
+			Metric:    q.Name,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result
+}
+
+// matchTags reports whether every filter tag is present with the same value
+func matchTags(tags, filters map[string]string) bool {
+	for k, v := range filters {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedTagKeys returns the filter keys in a stable order for query building
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timeSeriesSpec maps a dashboard series to the stored metric it is computed from
+type timeSeriesSpec struct {
+	Series string
+	Source string
+	Agg    string
+	Tags   map[string]string
+}
+
+// dashboardSeries lists the series returned by the Get*TimeSeries methods
+var dashboardSeries = []timeSeriesSpec{
+	{Series: "requests", Source: MetricRequest, Agg: AggCount},
+	{Series: "latency_avg", Source: "latency", Agg: AggAvg},
+	{Series: "latency_p50", Source: "latency", Agg: AggP50},
+	{Series: "latency_p95", Source: "latency", Agg: AggP95},
+	{Series: "latency_p99", Source: "latency", Agg: AggP99},
+	{Series: "tokens", Source: "tokens", Agg: AggSum},
+	{Series: "cost", Source: "cost", Agg: AggSum},
+	{Series: "errors", Source: MetricRequest, Agg: AggCount, Tags: map[string]string{TagOutcome: OutcomeError}},
+}
+
+// QueryTimeSeries aggregates through the runtime store, pushing down when supported
+func (d *DefaultMetricsStore) QueryTimeSeries(q TimeSeriesQuery) ([]TimeSeriesPoint, error) {
+	if q.Interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	if !ValidAggregation(q.Agg) {
+		return nil, fmt.Errorf("unsupported aggregation: %s", q.Agg)
+	}
+	if native, ok := d.runtimeStore.(TimeSeriesStore); ok {
+		return native.QueryTimeSeries(q)
+	}
+	points, err := d.runtimeStore.GetMetrics(q.Name, q.Tags, q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+	return AggregatePoints(points, q), nil
+}
+
+// dashboardTimeSeries computes every dashboard series for the given tag filters.
+// With finalOnly, outcome series count requests rather than individual attempts.
+func (d *DefaultMetricsStore) dashboardTimeSeries(filters map[string]string, finalOnly bool, start, end int64, interval string) ([]TimeSeriesPoint, error) {
+	seconds, err := ParseInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []TimeSeriesPoint{}
+	for _, spec := range dashboardSeries {
+		tags := make(map[string]string, len(filters)+len(spec.Tags))
+		for k, v := range filters {
+			tags[k] = v
+		}
+		for k, v := range spec.Tags {
+			tags[k] = v
+		}
+		if finalOnly && spec.Source == MetricRequest {
+			tags[TagFinal] = "true"
+		}
+
+		points, err := d.QueryTimeSeries(TimeSeriesQuery{
+			Name:     spec.Source,
+			Tags:     tags,
+			Start:    start,
+			End:      end,
+			Interval: seconds,
+			Agg:      spec.Agg,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s series: %w", spec.Series, err)
+		}
+		for _, p := range points {
+			p.Metric = spec.Series
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func (d *DefaultMetricsStore) GetClientTimeSeries(clientID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
+	return d.dashboardTimeSeries(map[string]string{"client_key": clientID}, true, start, end, interval)
+}
+
+func (d *DefaultMetricsStore) GetProviderTimeSeries(providerID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
+	return d.dashboardTimeSeries(map[string]string{"provider": providerID}, false, start, end, interval)
+}
+
+func (d *DefaultMetricsStore) GetKeyTimeSeries(providerID, keyID string, start, end int64, interval string) ([]TimeSeriesPoint, error) {
+	return d.dashboardTimeSeries(map[string]string{"provider": providerID, "key": keyID}, false, start, end, interval)
+}
+
+// jsonPathForTag builds a JSON path selecting a top-level tag key, quoted so any key is safe
+func jsonPathForTag(key string) string {
+	return `$."` + strings.ReplaceAll(strings.ReplaceAll(key, `\`, `\\`), `"`, `\"`) + `"`
+}
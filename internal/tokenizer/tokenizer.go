@@ -0,0 +1,198 @@
+// Package tokenizer estimates how many tokens a prompt takes before it is sent
+// upstream. OpenAI models are counted with their tiktoken BPE encoding; other
+// vendors don't publish a tokenizer, so their counts come from a character heuristic.
+package tokenizer
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Counting methods
+const (
+	MethodTiktoken  = "tiktoken"
+	MethodHeuristic = "heuristic"
+	MethodVendor    = "vendor" // Counted by the vendor's API
+)
+
+// OpenAI chat formatting overhead, per the OpenAI cookbook
+const (
+	tokensPerMessage = 3 // <|start|>{role}\n ... <|end|>
+	tokensPerName    = 1
+	tokensForReply   = 3 // Every reply is primed with <|start|>assistant<|message|>
+)
+
+// imageTokens is the smallest token charge of an image input. The real charge
+// depends on its size and detail, which aren't known without fetching it.
+const imageTokens = 85
+
+func init() {
+	// The encodings ship with the binary instead of being downloaded on first use
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Count is a token count and how it was made
+type Count struct {
+	Tokens   int    `json:"tokens"`
+	Method   string `json:"method"`
+	Encoding string `json:"encoding,omitempty"` // tiktoken encoding, e.g. "o200k_base"
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   = map[string]*tiktoken.Tiktoken{}
+)
+
+// encoder returns the tiktoken encoder for an encoding, building it on first use
+func encoder(encoding string) (*tiktoken.Tiktoken, error) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if enc, ok := encoders[encoding]; ok {
+		return enc, nil
+	}
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	encoders[encoding] = enc
+	return enc, nil
+}
+
+// Encoding returns the tiktoken encoding of a model, or "" if it isn't an OpenAI
+// model. Models routed through aggregators may carry an "openai/" prefix.
+func Encoding(providerType, model string) string {
+	model = strings.TrimPrefix(model, "openai/")
+	if encoding, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return encoding
+	}
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return encoding
+		}
+	}
+	// Reasoning and newer models use o200k_base
+	for _, prefix := range []string{"o1", "o3", "o4", "gpt-5", "chatgpt-4o"} {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	if providerType == "openai" {
+		return tiktoken.MODEL_CL100K_BASE
+	}
+	return ""
+}
+
+// charsPerToken is the average characters per token of non-CJK text for vendors
+// without a published tokenizer
+func charsPerToken(providerType string) float64 {
+	switch providerType {
+	case "claude":
+		return 3.5
+	default:
+		return 4
+	}
+}
+
+// heuristicTokens counts CJK characters as one token each and the rest of the
+// text at the vendor's characters per token
+func heuristicTokens(providerType, text string) int {
+	if text == "" {
+		return 0
+	}
+	cjk, other := 0, 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + int(math.Ceil(float64(other)/charsPerToken(providerType)))
+}
+
+// counter counts text with one model's tokenizer
+type counter struct {
+	providerType string
+	encoding     string
+	enc          *tiktoken.Tiktoken
+}
+
+func newCounter(providerType, model string) counter {
+	c := counter{providerType: providerType, encoding: Encoding(providerType, model)}
+	if c.encoding != "" {
+		if enc, err := encoder(c.encoding); err == nil {
+			c.enc = enc
+		} else {
+			c.encoding = ""
+		}
+	}
+	return c
+}
+
+func (c counter) tokens(text string) int {
+	if c.enc != nil {
+		return len(c.enc.EncodeOrdinary(text))
+	}
+	return heuristicTokens(c.providerType, text)
+}
+
+func (c counter) count(tokens int) Count {
+	if c.enc != nil {
+		return Count{Tokens: tokens, Method: MethodTiktoken, Encoding: c.encoding}
+	}
+	return Count{Tokens: tokens, Method: MethodHeuristic}
+}
+
+// CountText counts the tokens of plain text for a model
+func CountText(providerType, model, text string) Count {
+	c := newCounter(providerType, model)
+	return c.count(c.tokens(text))
+}
+
+// CountMessages estimates the prompt tokens of a chat request: each message's role,
+// name and content with the chat format overhead, plus the tool definitions. Images
+// are counted at their smallest charge.
+func CountMessages(providerType, model string, messages []map[string]any, tools []any) Count {
+	c := newCounter(providerType, model)
+	total := tokensForReply
+	for _, msg := range messages {
+		total += tokensPerMessage
+		if role, ok := msg["role"].(string); ok {
+			total += c.tokens(role)
+		}
+		if name, ok := msg["name"].(string); ok && name != "" {
+			total += c.tokens(name) + tokensPerName
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			total += c.tokens(content)
+		case []any:
+			for _, part := range content {
+				p, _ := part.(map[string]any)
+				switch p["type"] {
+				case "text":
+					text, _ := p["text"].(string)
+					total += c.tokens(text)
+				case "image_url", "image":
+					total += imageTokens
+				}
+			}
+		}
+		// Tool calls made by the assistant are part of the prompt on the next turn
+		if calls, ok := msg["tool_calls"].([]any); ok && len(calls) > 0 {
+			data, _ := json.Marshal(calls)
+			total += c.tokens(string(data))
+		}
+	}
+	if len(tools) > 0 {
+		data, _ := json.Marshal(tools)
+		total += c.tokens(string(data))
+	}
+	return c.count(total)
+}
@@ -0,0 +1,46 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountText(t *testing.T) {
+	assert.Equal(t, Count{Tokens: 2, Method: MethodTiktoken, Encoding: "o200k_base"}, CountText("openai", "gpt-4o", "hello world"))
+	assert.Equal(t, Count{Tokens: 2, Method: MethodTiktoken, Encoding: "cl100k_base"}, CountText("openai", "gpt-4", "hello world"))
+	assert.Equal(t, "o200k_base", CountText("openrouter", "openai/gpt-4o-mini", "hi").Encoding)
+
+	// Other vendors are estimated from the characters
+	assert.Equal(t, Count{Tokens: 3, Method: MethodHeuristic}, CountText("gemini", "gemini-1.5-pro", "hello world"))
+	assert.Equal(t, Count{Tokens: 4, Method: MethodHeuristic}, CountText("claude", "claude-3-opus", "hello world"))
+	assert.Equal(t, 4, CountText("gemini", "gemini-1.5-pro", "你好世界").Tokens)
+	assert.Equal(t, 0, CountText("gemini", "gemini-1.5-pro", "").Tokens)
+}
+
+func TestCountMessages(t *testing.T) {
+	// The example from the OpenAI cookbook, which the API reports as 129 prompt tokens
+	messages := []map[string]any{
+		{"role": "system", "content": "You are a helpful, pattern-following assistant that translates corporate jargon into plain English."},
+		{"role": "system", "name": "example_user", "content": "New synergies will help drive top-line growth."},
+		{"role": "system", "name": "example_assistant", "content": "Things working well together will increase revenue."},
+		{"role": "system", "name": "example_user", "content": "Let's circle back when we have more bandwidth to touch base on opportunities for increased leverage."},
+		{"role": "system", "name": "example_assistant", "content": "Let's talk later when we're less busy about how to do better."},
+		{"role": "user", "content": "This late pivot means we don't have time to boil the ocean for the client deliverable."},
+	}
+	assert.Equal(t, 129, CountMessages("openai", "gpt-4", messages, nil).Tokens)
+
+	// Text parts are counted and images add their smallest charge
+	parts := []map[string]any{{"role": "user", "content": []any{
+		map[string]any{"type": "text", "text": "hello world"},
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/cat.png"}},
+	}}}
+	plain := []map[string]any{{"role": "user", "content": "hello world"}}
+	assert.Equal(t, CountMessages("openai", "gpt-4o", plain, nil).Tokens+imageTokens, CountMessages("openai", "gpt-4o", parts, nil).Tokens)
+
+	// Tool definitions are part of the prompt
+	tools := []any{map[string]any{"type": "function", "function": map[string]any{"name": "get_weather", "parameters": map[string]any{"type": "object"}}}}
+	withTools := CountMessages("claude", "claude-3-opus", plain, tools)
+	assert.Equal(t, MethodHeuristic, withTools.Method)
+	assert.Greater(t, withTools.Tokens, CountMessages("claude", "claude-3-opus", plain, nil).Tokens)
+}
@@ -219,7 +219,7 @@ func TestE2E_ChatCompletionsFlow(t *testing.T) {
 
 	// Setup router
 	r := chi.NewRouter()
-	api.SetupRoutes(r, selector, logger, reg, cfg, runtimeStore)
+	api.SetupRoutes(r, selector, logger, reg, runtimeStore)
 
 	// Create test server
 	ts := httptest.NewServer(r)